@@ -0,0 +1,134 @@
+// Package access decides what a user may do with workspaces and the pages in them.
+// Handlers go through it instead of filtering on pages.created_by, which only records the author.
+//
+// Access to a page comes from the user's role in its workspace and from page_permissions grants
+// on the page or any of its ancestors, whichever is higher.
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Role string
+
+const (
+	// RoleOwner can do everything, including managing other owners
+	RoleOwner Role = "owner"
+	// RoleAdmin can manage members but not owners
+	RoleAdmin Role = "admin"
+	// RoleMember can create and edit pages
+	RoleMember Role = "member"
+	// RoleGuest can only view pages, unless a page is shared with them at a higher level
+	RoleGuest Role = "guest"
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleOwner, RoleAdmin, RoleMember, RoleGuest:
+		return true
+	}
+	return false
+}
+
+type Action int
+
+const (
+	ActionView Action = iota
+	ActionComment
+	ActionEdit
+	// ActionManage covers moving, duplicating, deleting and sharing pages
+	ActionManage
+	ActionManageMembers
+)
+
+func (r Role) Can(action Action) bool {
+	if action == ActionManageMembers {
+		return r == RoleOwner || r == RoleAdmin
+	}
+	return r.PageLevel().Allows(action)
+}
+
+// PageLevel is the access the role gives to every page in the workspace
+func (r Role) PageLevel() Level {
+	switch r {
+	case RoleOwner, RoleAdmin, RoleMember:
+		return LevelFullAccess
+	case RoleGuest:
+		return LevelViewer
+	}
+	return LevelNone
+}
+
+var (
+	// ErrNotFound is returned when the resource doesn't exist or the user isn't a member of its workspace.
+	// The two aren't distinguished so ids can't be probed.
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when the user can see the resource but their role doesn't allow the action
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Querier is satisfied by *pgxpool.Pool, *pgx.Conn and pgx.Tx so checks can run inside the caller's transaction
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// WorkspaceRole returns the user's role in the workspace, or ErrNotFound when they aren't a member
+func WorkspaceRole(ctx context.Context, q Querier, workspaceID, userID int64) (Role, error) {
+	var role Role
+	err := q.QueryRow(ctx, `
+		SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2
+	`, workspaceID, userID).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get workspace role: %w", err)
+	}
+	return role, nil
+}
+
+// AuthorizeWorkspace checks that the user's role in the workspace allows the action and returns the role
+func AuthorizeWorkspace(ctx context.Context, q Querier, workspaceID, userID int64, action Action) (Role, error) {
+	role, err := WorkspaceRole(ctx, q, workspaceID, userID)
+	if err != nil {
+		return "", err
+	}
+	if !role.Can(action) {
+		return role, ErrForbidden
+	}
+	return role, nil
+}
+
+// PersonalWorkspaceID returns the workspace pages go to when the client doesn't name one
+func PersonalWorkspaceID(ctx context.Context, q Querier, userID int64) (int64, error) {
+	var workspaceID int64
+	err := q.QueryRow(ctx, `
+		SELECT id FROM workspaces WHERE created_by = $1 AND is_personal
+	`, userID).Scan(&workspaceID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get personal workspace: %w", err)
+	}
+	return workspaceID, nil
+}
+
+// CreatePersonalWorkspace creates the workspace every user starts with and makes them its owner
+func CreatePersonalWorkspace(ctx context.Context, q Querier, userID int64, username string) (int64, error) {
+	var workspaceID int64
+	err := q.QueryRow(ctx, `
+		WITH workspace AS (
+			INSERT INTO workspaces (name, created_by, is_personal) VALUES ($2, $1::integer, true) RETURNING id
+		), owner AS (
+			INSERT INTO workspace_members (workspace_id, user_id, role) SELECT id, $1::integer, $3::varchar FROM workspace
+		)
+		SELECT id FROM workspace
+	`, userID, username+"'s workspace", RoleOwner).Scan(&workspaceID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create personal workspace: %w", err)
+	}
+	return workspaceID, nil
+}
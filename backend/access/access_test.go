@@ -0,0 +1,57 @@
+package access_test
+
+import (
+	"go_notion/backend/access"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role          access.Role
+		view          bool
+		edit          bool
+		manageMembers bool
+	}{
+		{role: access.RoleOwner, view: true, edit: true, manageMembers: true},
+		{role: access.RoleAdmin, view: true, edit: true, manageMembers: true},
+		{role: access.RoleMember, view: true, edit: true, manageMembers: false},
+		{role: access.RoleGuest, view: true, edit: false, manageMembers: false},
+		{role: access.Role("unknown"), view: false, edit: false, manageMembers: false},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.role), func(t *testing.T) {
+			assert.Equal(t, test.view, test.role.Can(access.ActionView))
+			assert.Equal(t, test.edit, test.role.Can(access.ActionEdit))
+			assert.Equal(t, test.manageMembers, test.role.Can(access.ActionManageMembers))
+		})
+	}
+}
+
+func TestLevelAllows(t *testing.T) {
+	viewer, err := access.ParseLevel("viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commenter, err := access.ParseLevel("commenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor, err := access.ParseLevel("editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = access.ParseLevel("full_access")
+	assert.Error(t, err, "full access can't be granted by sharing")
+
+	assert.True(t, viewer.Allows(access.ActionView))
+	assert.False(t, viewer.Allows(access.ActionComment))
+	assert.True(t, commenter.Allows(access.ActionComment))
+	assert.False(t, commenter.Allows(access.ActionEdit))
+	assert.True(t, editor.Allows(access.ActionEdit))
+	assert.False(t, editor.Allows(access.ActionManage))
+	assert.True(t, access.LevelFullAccess.Allows(access.ActionManage))
+	assert.Equal(t, "editor", editor.String())
+}
@@ -0,0 +1,113 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Level is how much a user can do with a page, higher levels include the lower ones
+type Level int
+
+const (
+	LevelNone Level = iota
+	LevelViewer
+	LevelCommenter
+	LevelEditor
+	// LevelFullAccess can't be granted through sharing, it comes from being a member of the workspace
+	LevelFullAccess
+)
+
+var levelNames = map[Level]string{
+	LevelViewer:    "viewer",
+	LevelCommenter: "commenter",
+	LevelEditor:    "editor",
+}
+
+// ParseLevel parses a level that can be granted by sharing a page
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return LevelNone, fmt.Errorf("invalid permission level %q", name)
+}
+
+func (l Level) String() string {
+	if l == LevelFullAccess {
+		return "full_access"
+	}
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "none"
+}
+
+func (l Level) Allows(action Action) bool {
+	switch action {
+	case ActionView:
+		return l >= LevelViewer
+	case ActionComment:
+		return l >= LevelCommenter
+	case ActionEdit:
+		return l >= LevelEditor
+	case ActionManage:
+		return l >= LevelFullAccess
+	}
+	return false
+}
+
+// PageLevel resolves the user's level on the page from their workspace role and the grants
+// on the page and its ancestors. The page's workspace id is returned along with it.
+func PageLevel(ctx context.Context, q Querier, pageID uuid.UUID, userID int64) (int64, Level, error) {
+	var workspaceID int64
+	var role *Role
+	var grants []string
+	err := q.QueryRow(ctx, `
+		SELECT pages.workspace_id, workspace_members.role, ARRAY(
+			SELECT page_permissions.level FROM page_permissions
+			WHERE page_permissions.user_id = $2 AND (
+				page_permissions.page_id = $1
+				OR page_permissions.page_id IN (SELECT ancestor_id FROM pages_closures WHERE descendant_id = $1)
+			)
+		)
+		FROM pages
+		LEFT JOIN workspace_members ON workspace_members.workspace_id = pages.workspace_id AND workspace_members.user_id = $2
+		WHERE pages.id = $1
+	`, pageID, userID).Scan(&workspaceID, &role, &grants)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, LevelNone, ErrNotFound
+	} else if err != nil {
+		return 0, LevelNone, fmt.Errorf("failed to get page access: %w", err)
+	}
+
+	level := LevelNone
+	if role != nil {
+		level = role.PageLevel()
+	}
+	for _, grant := range grants {
+		if granted, err := ParseLevel(grant); err == nil && granted > level {
+			level = granted
+		}
+	}
+	return workspaceID, level, nil
+}
+
+// AuthorizePage checks that the user's level on the page allows the action and returns the page's workspace id
+func AuthorizePage(ctx context.Context, q Querier, pageID uuid.UUID, userID int64, action Action) (int64, error) {
+	workspaceID, level, err := PageLevel(ctx, q, pageID, userID)
+	if err != nil {
+		return 0, err
+	}
+	if level == LevelNone {
+		return 0, ErrNotFound
+	}
+	if !level.Allows(action) {
+		return workspaceID, ErrForbidden
+	}
+	return workspaceID, nil
+}
@@ -35,11 +35,36 @@ func NewUnauthorizedError(message string, err error) *ApiError {
 	return newApiError(message, http.StatusUnauthorized, err)
 }
 
+// NewForbiddenError creates a new API error with StatusForbidden
+func NewForbiddenError(message string, err error) *ApiError {
+	return newApiError(message, http.StatusForbidden, err)
+}
+
 // NewNotFoundError creates a new API error with StatusNotFound
 func NewNotFoundError(message string, err error) *ApiError {
 	return newApiError(message, http.StatusNotFound, err)
 }
 
+// NewConflictError creates a new API error with StatusConflict
+func NewConflictError(message string, err error) *ApiError {
+	return newApiError(message, http.StatusConflict, err)
+}
+
+// NewTooManyRequestsError creates a new API error with StatusTooManyRequests
+func NewTooManyRequestsError(message string, err error) *ApiError {
+	return newApiError(message, http.StatusTooManyRequests, err)
+}
+
+// NewPayloadTooLargeError creates a new API error with StatusRequestEntityTooLarge
+func NewPayloadTooLargeError(message string, err error) *ApiError {
+	return newApiError(message, http.StatusRequestEntityTooLarge, err)
+}
+
+// NewUnsupportedMediaTypeError creates a new API error with StatusUnsupportedMediaType
+func NewUnsupportedMediaTypeError(message string, err error) *ApiError {
+	return newApiError(message, http.StatusUnsupportedMediaType, err)
+}
+
 func newApiError(message string, code int, err error) *ApiError {
 	return &ApiError{Message: message, Code: code, Err: err}
 }
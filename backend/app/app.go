@@ -7,8 +7,11 @@ import (
 	"go_notion/backend/auth"
 	"go_notion/backend/db"
 	"go_notion/backend/handlers"
+	"go_notion/backend/mailer"
 	"go_notion/backend/page"
+	"go_notion/backend/realtime"
 	"go_notion/backend/router"
+	"go_notion/backend/storage"
 	"log"
 	"net/http"
 	"os"
@@ -28,6 +31,12 @@ type App struct {
 	server      *http.Server
 	tokenConfig *auth.TokenConfig
 	pageConfig  *page.PageConfig
+	mailer      mailer.Mailer
+	hub         *realtime.Hub
+	blobs       storage.BlobStore
+	// stopListening stops the hub from listening to the events published by every instance,
+	// and the announcer of document edits
+	stopListening context.CancelFunc
 }
 
 func New(port string) (*App, error) {
@@ -41,6 +50,11 @@ func New(port string) (*App, error) {
 	}
 	app := &App{}
 	app.pool = pool
+	app.hub = realtime.NewHub()
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	app.stopListening = stopListening
+	go app.hub.Listen(listenCtx, pool)
+	go handlers.RunDocumentAnnouncer(listenCtx, pool)
 
 	appRouter := router.NewRouter()
 	appRouter.Use(router.IPRateLimiter(router.RateLimitConfig{Requests: 60, Period: time.Minute, Burst: 5}))
@@ -59,6 +73,13 @@ func New(port string) (*App, error) {
 	}
 	app.tokenConfig = tokenConfig
 	app.pageConfig = page.NewPageConfig(1000)
+	app.mailer, err = mailer.NewMailerFromEnv()
+	if err != nil {
+		if shutdownErr := app.Shutdown(context.Background()); shutdownErr != nil {
+			return nil, fmt.Errorf("multiple errors: %w", errors.Join(err, shutdownErr))
+		}
+		return nil, fmt.Errorf("error creating mailer: %w", err)
+	}
 	err = app.registerHandlers(appRouter)
 	if err != nil {
 		if shutdownErr := app.Shutdown(context.Background()); shutdownErr != nil {
@@ -72,7 +93,21 @@ func New(port string) (*App, error) {
 }
 
 func (app *App) registerHandlers(appRouter *gin.Engine) error {
-	signin, err := handlers.NewSignInHandler(app.pool, app.tokenConfig)
+	blobs, err := storage.NewBlobStoreFromEnv()
+	if err != nil {
+		return fmt.Errorf("error creating blob store: %w", err)
+	}
+	app.blobs = blobs
+	storageLimits, err := storage.LimitsFromEnv()
+	if err != nil {
+		return fmt.Errorf("error loading storage limits: %w", err)
+	}
+	urlSigner, err := storage.URLSignerFromEnv()
+	if err != nil {
+		return fmt.Errorf("error creating url signer: %w", err)
+	}
+
+	signin, err := handlers.NewSignInHandler(app.pool, app.tokenConfig, app.tokenConfig, app.mailer)
 	if err != nil {
 		return fmt.Errorf("error creating signin handler: %w", err)
 	}
@@ -81,12 +116,44 @@ func (app *App) registerHandlers(appRouter *gin.Engine) error {
 		return fmt.Errorf("error creating signup handler: %w", err)
 	}
 
+	oidcConfigs, err := auth.LoadOIDCProviderConfigs()
+	if err != nil {
+		return fmt.Errorf("error loading oidc providers: %w", err)
+	}
+	oidcProviders := make([]*auth.OIDCProvider, 0, len(oidcConfigs))
+	for _, config := range oidcConfigs {
+		oidcProviders = append(oidcProviders, auth.NewOIDCProvider(config, nil))
+	}
+	oidc, err := handlers.NewOIDCHandler(app.pool, app.tokenConfig, app.tokenConfig, oidcProviders)
+	if err != nil {
+		return fmt.Errorf("error creating oidc handler: %w", err)
+	}
+
+	jwks, err := handlers.NewJWKSHandler(app.tokenConfig)
+	if err != nil {
+		return fmt.Errorf("error creating jwks handler: %w", err)
+	}
+	// the jwks lives at the well-known location at the root, not under the versioned api
+	jwks.RegisterRoutes(appRouter.Group(""))
+
 	// public routes
 	apiv1 := appRouter.Group("/api/v1")
-	for _, r := range []Handler{signup, signin} {
+	for _, r := range []Handler{signup, signin, oidc} {
 		r.RegisterRoutes(apiv1)
 	}
 
+	publicLinks, err := handlers.NewPublicLinksHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating public links handler: %w", err)
+	}
+	publicLinks.RegisterPublicRoutes(apiv1)
+
+	attachments, err := handlers.NewAttachmentsHandler(app.pool, app.blobs, storageLimits, urlSigner)
+	if err != nil {
+		return fmt.Errorf("error creating attachments handler: %w", err)
+	}
+	attachments.RegisterPublicRoutes(apiv1)
+
 	newPage, err := handlers.NewCreatePageHandler(app.pool, app.pageConfig)
 	if err != nil {
 		return fmt.Errorf("error creating page handler: %w", err)
@@ -107,7 +174,7 @@ func (app *App) registerHandlers(appRouter *gin.Engine) error {
 		return fmt.Errorf("error creating update page handler: %w", err)
 	}
 
-	deletePage, err := handlers.NewDeletePageHandler(app.pool)
+	deletePage, err := handlers.NewDeletePageHandler(app.pool, app.blobs)
 	if err != nil {
 		return fmt.Errorf("error creating delete page handler: %w", err)
 	}
@@ -122,9 +189,84 @@ func (app *App) registerHandlers(appRouter *gin.Engine) error {
 		return fmt.Errorf("error creating reorder page handler: %w", err)
 	}
 
+	twoFactor, err := handlers.NewTwoFactorHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating two factor handler: %w", err)
+	}
+
+	sessions, err := handlers.NewSessionsHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating sessions handler: %w", err)
+	}
+
+	workspaces, err := handlers.NewWorkspacesHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating workspaces handler: %w", err)
+	}
+
+	shares, err := handlers.NewSharesHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating shares handler: %w", err)
+	}
+
+	invites, err := handlers.NewInvitesHandler(app.pool, app.mailer)
+	if err != nil {
+		return fmt.Errorf("error creating invites handler: %w", err)
+	}
+
+	comments, err := handlers.NewCommentsHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating comments handler: %w", err)
+	}
+
+	links, err := handlers.NewLinksHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating links handler: %w", err)
+	}
+
+	notifications, err := handlers.NewNotificationsHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating notifications handler: %w", err)
+	}
+
+	realtimeHandler, err := handlers.NewRealtimeHandler(app.pool, app.hub)
+	if err != nil {
+		return fmt.Errorf("error creating realtime handler: %w", err)
+	}
+
+	events, err := handlers.NewEventsHandler(app.pool, app.hub)
+	if err != nil {
+		return fmt.Errorf("error creating events handler: %w", err)
+	}
+
+	syncHandler, err := handlers.NewSyncHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating sync handler: %w", err)
+	}
+
+	batch, err := handlers.NewBatchHandler(app.pool, app.pageConfig, app.blobs)
+	if err != nil {
+		return fmt.Errorf("error creating batch handler: %w", err)
+	}
+
+	templates, err := handlers.NewTemplatesHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating templates handler: %w", err)
+	}
+
+	databases, err := handlers.NewDatabasesHandler(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating databases handler: %w", err)
+	}
+
+	sessionStore, err := auth.NewSessionStore(app.pool)
+	if err != nil {
+		return fmt.Errorf("error creating session store: %w", err)
+	}
+
 	// protected routes
-	protectedRoutes := []Handler{newPage, getPage, getPages, updatePage, deletePage, duplicatePage, reorderPage}
-	protectedApiGroup := apiv1.Group("", app.tokenConfig.AuthMiddleware())
+	protectedRoutes := []Handler{newPage, getPage, getPages, updatePage, deletePage, duplicatePage, reorderPage, twoFactor, sessions, workspaces, shares, publicLinks, invites, comments, links, notifications, realtimeHandler, events, syncHandler, batch, templates, attachments, databases}
+	protectedApiGroup := apiv1.Group("", app.tokenConfig.AuthMiddleware(sessionStore))
 	for _, r := range protectedRoutes {
 		r.RegisterRoutes(protectedApiGroup)
 	}
@@ -141,6 +283,8 @@ func (app *App) Run() error {
 
 func (app *App) Shutdown(ctx context.Context) error {
 	log.Println("shutting down app")
+	app.stopListening()
+	app.hub.Close()
 	app.pool.Close()
 	return app.server.Shutdown(ctx)
 }
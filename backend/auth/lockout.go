@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// LockoutPolicy decides how long an account is locked after repeated failed sign in attempts
+type LockoutPolicy struct {
+	// FreeAttempts is the number of failed attempts allowed before the account gets locked
+	FreeAttempts int
+	// BaseDelay is how long the account is locked once FreeAttempts is reached.
+	// Each further failure doubles the delay.
+	BaseDelay time.Duration
+	// MaxDelay caps the lock duration so a forgotten password never locks a user out for days
+	MaxDelay time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{FreeAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Hour}
+
+// LockDuration returns how long the account should be locked after the given number of consecutive failures.
+// A zero duration means the account should not be locked.
+func (p LockoutPolicy) LockDuration(failedAttempts int) time.Duration {
+	if failedAttempts < p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < failedAttempts; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// DummyComparePassword burns the same amount of time as ComparePassword does for a real user.
+// It is used when the email does not exist so response times don't reveal which emails have an account.
+func DummyComparePassword(password string) {
+	dummyHashOnce.Do(func() {
+		// the hash is generated with the same cost as real passwords, otherwise the timing would still differ
+		hash, err := HashPassword("dummy-password-for-timing")
+		if err == nil {
+			dummyHash = hash
+		}
+	})
+	ComparePassword(password, dummyHash)
+}
@@ -0,0 +1,30 @@
+package auth_test
+
+import (
+	"go_notion/backend/auth"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockDuration(t *testing.T) {
+	policy := auth.LockoutPolicy{FreeAttempts: 3, BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+
+	tests := []struct {
+		failedAttempts int
+		expected       time.Duration
+	}{
+		{failedAttempts: 0, expected: 0},
+		{failedAttempts: 2, expected: 0},
+		{failedAttempts: 3, expected: time.Minute},
+		{failedAttempts: 4, expected: 2 * time.Minute},
+		{failedAttempts: 6, expected: 8 * time.Minute},
+		{failedAttempts: 7, expected: 10 * time.Minute},
+		{failedAttempts: 100, expected: 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, policy.LockDuration(test.failedAttempts), "failed attempts: %d", test.failedAttempts)
+	}
+}
@@ -0,0 +1,102 @@
+package auth_test
+
+import (
+	"context"
+	"go_notion/backend/auth"
+	"go_notion/backend/mocks"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOIDCProvider(t *testing.T) (*auth.OIDCProvider, *mocks.OIDCIssuer) {
+	issuer, err := mocks.NewOIDCIssuer("client-id", "client secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+
+	provider := auth.NewOIDCProvider(auth.OIDCProviderConfig{
+		Name:         "mock",
+		Issuer:       issuer.URL(),
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  "http://localhost:8080/api/v1/auth/oidc/mock/callback",
+	}, nil)
+	return provider, issuer
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	provider, issuer := newTestOIDCProvider(t)
+	ctx := context.Background()
+
+	verifier, err := auth.NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", auth.PKCEChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, issuer.URL()+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	assert.Equal(t, "S256", parsed.Query().Get("code_challenge_method"))
+
+	code, state, err := issuer.Authorize(authURL, mocks.OIDCIdentity{Subject: "subject-1", Email: "Test@Test.com", EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "state", state)
+
+	claims, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "subject-1", claims.Subject)
+	assert.Equal(t, "test@test.com", claims.Email)
+	assert.True(t, claims.EmailVerified)
+	assert.Equal(t, "nonce", claims.Nonce)
+
+	// codes can only be redeemed once
+	_, err = provider.Exchange(ctx, code, verifier)
+	assert.Error(t, err)
+}
+
+func TestOIDCProviderRejectsWrongVerifier(t *testing.T) {
+	provider, issuer := newTestOIDCProvider(t)
+	ctx := context.Background()
+
+	verifier, err := auth.NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", auth.PKCEChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := issuer.Authorize(authURL, mocks.OIDCIdentity{Subject: "subject-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = provider.Exchange(ctx, code, "not-the-verifier")
+	assert.Error(t, err)
+}
+
+func TestOIDCProviderRejectsIssuerMismatch(t *testing.T) {
+	issuer, err := mocks.NewOIDCIssuer("client-id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer issuer.Close()
+
+	// the discovery document says the issuer is issuer.URL() without the trailing slash
+	provider := auth.NewOIDCProvider(auth.OIDCProviderConfig{Name: "mock", Issuer: issuer.URL() + "/", ClientID: "client-id", RedirectURL: "http://localhost"}, nil)
+	_, err = provider.AuthCodeURL(context.Background(), "state", "nonce", "challenge")
+	assert.ErrorContains(t, err, "issuer mismatch")
+}
@@ -1,9 +1,14 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
 	"os"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -12,6 +17,10 @@ const (
 	BcryptDevCost = 10
 	// BcryptProdCost is the recommended cost for production environments
 	BcryptProdCost = 12
+	// bcryptMaxPasswordLength is a limit of the bcrypt algorithm, anything past it is silently ignored
+	bcryptMaxPasswordLength = 72
+	// MaxPasswordLength keeps hashing cheap enough that huge passwords can't be used to tie up the server
+	MaxPasswordLength = 1024
 )
 
 type HashError struct {
@@ -30,6 +39,34 @@ func (e *HashError) IsPasswordValidationError() bool {
 	return e.passwordValidationError != nil
 }
 
+// PasswordHasher is a password hashing algorithm. Hashes are self describing, they carry the algorithm
+// and its parameters, so a hasher can tell whether it produced a hash and whether it's outdated.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of an already validated password
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash
+	Verify(password, encoded string) bool
+	// Recognizes reports whether the encoded hash was produced by this algorithm
+	Recognizes(encoded string) bool
+	// NeedsRehash reports whether a hash this hasher recognizes was made with different parameters
+	NeedsRehash(encoded string) bool
+	// MaxPasswordLength is the longest password the algorithm can hash without truncating it
+	MaxPasswordLength() int
+}
+
+// DefaultHasher is used for new hashes. Hashes from any of the other known hashers are still
+// accepted and get upgraded on the user's next successful sign in.
+var DefaultHasher PasswordHasher = NewArgon2idHasher(defaultArgon2idParams())
+
+var knownHashers = []PasswordHasher{NewBcryptHasher(defaultBcryptCost())}
+
+func defaultBcryptCost() int {
+	if os.Getenv("GO_ENV") == "production" {
+		return BcryptProdCost
+	}
+	return BcryptDevCost
+}
+
 func HashPassword(password string) (string, *HashError) {
 
 	if password == "" {
@@ -38,25 +75,212 @@ func HashPassword(password string) (string, *HashError) {
 		}
 	}
 
-	if len(password) > 72 {
+	if maxLength := DefaultHasher.MaxPasswordLength(); len(password) > maxLength {
 		return "", &HashError{
-			passwordValidationError: fmt.Errorf("password exceeds maximum length of 72 characters"),
+			passwordValidationError: fmt.Errorf("password exceeds maximum length of %d characters", maxLength),
 		}
 	}
 
-	cost := BcryptDevCost
-	if os.Getenv("GO_ENV") == "production" {
-		cost = BcryptProdCost
-	}
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	hashedPassword, err := DefaultHasher.Hash(password)
 	if err != nil {
 		return "", &HashError{
 			hashError: err,
 		}
 	}
-	return string(hashedPassword), nil
+	return hashedPassword, nil
 }
 
 func ComparePassword(password, hashedPassword string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+	hasher := hasherFor(hashedPassword)
+	if hasher == nil {
+		return false
+	}
+	return hasher.Verify(password, hashedPassword)
+}
+
+// PasswordNeedsRehash reports whether the hash should be replaced by a fresh one from DefaultHasher,
+// either because it uses another algorithm or because the default parameters have changed since.
+func PasswordNeedsRehash(hashedPassword string) bool {
+	if !DefaultHasher.Recognizes(hashedPassword) {
+		return true
+	}
+	return DefaultHasher.NeedsRehash(hashedPassword)
+}
+
+func hasherFor(hashedPassword string) PasswordHasher {
+	if DefaultHasher.Recognizes(hashedPassword) {
+		return DefaultHasher
+	}
+	for _, hasher := range knownHashers {
+		if hasher.Recognizes(hashedPassword) {
+			return hasher
+		}
+	}
+	return nil
+}
+
+type BcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{cost: cost}
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+func (h *BcryptHasher) Verify(password, encoded string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+func (h *BcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+func (h *BcryptHasher) MaxPasswordLength() int {
+	return bcryptMaxPasswordLength
+}
+
+// Argon2idParams are the tuning parameters of argon2id, see RFC 9106 section 4
+type Argon2idParams struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func defaultArgon2idParams() Argon2idParams {
+	if os.Getenv("GO_ENV") == "production" {
+		return Argon2idParams{Memory: 64 * 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+	}
+	// the minimum recommended by OWASP, which keeps tests and local sign ins fast
+	return Argon2idParams{Memory: 19 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+}
+
+// Argon2idHasher produces PHC formatted hashes, eg: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type Argon2idHasher struct {
+	params Argon2idParams
+}
+
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(password, encoded string) bool {
+	params, salt, key, err := decodeArgon2idHash(encoded)
+	if err != nil {
+		return false
+	}
+	// the parameters stored in the hash are used, not the current ones, so old hashes keep working
+	computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+func (h *Argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2idHash(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.params.Memory ||
+		params.Iterations != h.params.Iterations ||
+		params.Parallelism != h.params.Parallelism ||
+		uint32(len(salt)) != h.params.SaltLength ||
+		uint32(len(key)) != h.params.KeyLength
+}
+
+func (h *Argon2idHasher) MaxPasswordLength() int {
+	return MaxPasswordLength
+}
+
+func decodeArgon2idHash(encoded string) (Argon2idParams, []byte, []byte, error) {
+	var params Argon2idParams
+	// "$argon2id$v=19$m=65536,t=3,p=2$salt$hash" splits into 6 parts, the first being empty
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// MaxLinkPasswordLength is the longest password a public link can have
+const MaxLinkPasswordLength = 256
+
+// linkPasswordHasher hashes the passwords of public links. A link password guards a single page rather than an
+// account and wrong guesses lock the link for a while, so the lighter OWASP minimum parameters are used everywhere.
+var linkPasswordHasher = NewArgon2idHasher(Argon2idParams{Memory: 19 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+
+// HashLinkPassword hashes the password of a public link. Only the length is checked,
+// the account password policy doesn't apply to a password shared along with a link.
+func HashLinkPassword(password string) (string, *HashError) {
+	if password == "" {
+		return "", &HashError{passwordValidationError: fmt.Errorf("password cannot be empty")}
+	}
+	if len(password) > MaxLinkPasswordLength {
+		return "", &HashError{passwordValidationError: fmt.Errorf("password exceeds maximum length of %d characters", MaxLinkPasswordLength)}
+	}
+	hash, err := linkPasswordHasher.Hash(password)
+	if err != nil {
+		return "", &HashError{hashError: err}
+	}
+	return hash, nil
+}
+
+// CompareLinkPassword reports whether the password matches the hash of a public link.
+// Links created before HashLinkPassword were hashed like account passwords, they still match since hashes carry their parameters.
+func CompareLinkPassword(password, hashedPassword string) bool {
+	if password == "" || len(password) > MaxLinkPasswordLength {
+		return false
+	}
+	return ComparePassword(password, hashedPassword)
 }
@@ -0,0 +1,93 @@
+package auth_test
+
+import (
+	"go_notion/backend/auth"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPasswordUsesArgon2id(t *testing.T) {
+	hash, hashErr := auth.HashPassword("password")
+	if hashErr != nil {
+		t.Fatal(hashErr)
+	}
+
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m="), "hash should be PHC formatted: %s", hash)
+	assert.True(t, auth.ComparePassword("password", hash))
+	assert.False(t, auth.ComparePassword("wrong password", hash))
+	assert.False(t, auth.PasswordNeedsRehash(hash))
+}
+
+func TestHashPasswordLength(t *testing.T) {
+	// bcrypt would have rejected this, argon2id has no such limit
+	long := strings.Repeat("a", 100)
+	hash, hashErr := auth.HashPassword(long)
+	if hashErr != nil {
+		t.Fatal(hashErr)
+	}
+	assert.True(t, auth.ComparePassword(long, hash))
+	assert.False(t, auth.ComparePassword(long[:72], hash))
+
+	_, hashErr = auth.HashPassword(strings.Repeat("a", auth.MaxPasswordLength+1))
+	if assert.NotNil(t, hashErr) {
+		assert.True(t, hashErr.IsPasswordValidationError())
+	}
+
+	_, hashErr = auth.HashPassword("")
+	if assert.NotNil(t, hashErr) {
+		assert.True(t, hashErr.IsPasswordValidationError())
+	}
+}
+
+func TestBcryptHashesAreVerifiedAndUpgraded(t *testing.T) {
+	bcryptHash, err := auth.NewBcryptHasher(auth.BcryptDevCost).Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, auth.ComparePassword("password", bcryptHash))
+	assert.False(t, auth.ComparePassword("wrong password", bcryptHash))
+	assert.True(t, auth.PasswordNeedsRehash(bcryptHash))
+}
+
+func TestArgon2idHashesWithOutdatedParamsAreUpgraded(t *testing.T) {
+	weakHash, err := auth.NewArgon2idHasher(auth.Argon2idParams{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}).Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hashes are verified with the parameters they were created with
+	assert.True(t, auth.ComparePassword("password", weakHash))
+	assert.True(t, auth.PasswordNeedsRehash(weakHash))
+}
+
+func TestComparePasswordRejectsUnknownFormats(t *testing.T) {
+	assert.False(t, auth.ComparePassword("password", "password"))
+	assert.False(t, auth.ComparePassword("password", "$argon2id$v=19$m=abc$salt$hash"))
+	assert.True(t, auth.PasswordNeedsRehash("password"))
+}
+
+func TestLinkPasswords(t *testing.T) {
+	hash, hashErr := auth.HashLinkPassword("pw")
+	if hashErr != nil {
+		t.Fatal(hashErr)
+	}
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"), "link passwords use their own parameters: %s", hash)
+	assert.True(t, auth.CompareLinkPassword("pw", hash))
+	assert.False(t, auth.CompareLinkPassword("wrong", hash))
+
+	// links created with account password hashes keep working
+	accountHash, hashErr := auth.HashPassword("password")
+	if hashErr != nil {
+		t.Fatal(hashErr)
+	}
+	assert.True(t, auth.CompareLinkPassword("password", accountHash))
+
+	_, hashErr = auth.HashLinkPassword(strings.Repeat("a", auth.MaxLinkPasswordLength+1))
+	if assert.NotNil(t, hashErr) {
+		assert.True(t, hashErr.IsPasswordValidationError())
+	}
+	assert.False(t, auth.CompareLinkPassword(strings.Repeat("a", auth.MaxLinkPasswordLength+1), hash))
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// sessionTouchInterval limits how often last_seen_at is written, so busy clients don't cause a write per request
+const sessionTouchInterval = time.Minute
+
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// SessionValidator is used by AuthMiddleware to reject tokens whose session has been revoked
+type SessionValidator interface {
+	ValidateSession(ctx context.Context, sessionID uuid.UUID, userID int64) error
+}
+
+// CreateSession records a new signed in device. The returned id goes into the token's sid claim.
+func CreateSession(ctx context.Context, db *pgxpool.Pool, userID int64, userAgent, ipAddress string) (uuid.UUID, error) {
+	var sessionID uuid.UUID
+	err := db.QueryRow(ctx, `
+		INSERT INTO sessions (user_id, user_agent, ip_address) VALUES ($1, $2, $3) RETURNING id
+	`, userID, userAgent, ipAddress).Scan(&sessionID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	return sessionID, nil
+}
+
+type SessionStore struct {
+	db *pgxpool.Pool
+}
+
+func NewSessionStore(db *pgxpool.Pool) (*SessionStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &SessionStore{db}, nil
+}
+
+// ValidateSession checks that the session exists, belongs to the user and hasn't been revoked.
+// It also keeps last_seen_at roughly up to date for the session list.
+func (s *SessionStore) ValidateSession(ctx context.Context, sessionID uuid.UUID, userID int64) error {
+	var revokedAt *time.Time
+	var lastSeenAt time.Time
+	err := s.db.QueryRow(ctx, `
+		SELECT revoked_at, last_seen_at FROM sessions WHERE id = $1 AND user_id = $2
+	`, sessionID, userID).Scan(&revokedAt, &lastSeenAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// a deleted session is treated the same as a revoked one
+		return ErrSessionRevoked
+	} else if err != nil {
+		return fmt.Errorf("failed to validate session: %w", err)
+	}
+
+	if revokedAt != nil {
+		return ErrSessionRevoked
+	}
+
+	if time.Since(lastSeenAt) > sessionTouchInterval {
+		_, err = s.db.Exec(ctx, `UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP WHERE id = $1`, sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to update session last seen time: %w", err)
+		}
+	}
+	return nil
+}
@@ -5,11 +5,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -17,22 +19,52 @@ const (
 	TokenSecretEnvVar    = "TOKEN_SECRET"
 	TokenLifeSpanEnvVar  = "TOKEN_HOUR_LIFESPAN"
 	DefaultTokenLifeSpan = "24"
+	// TokenSigningKeyFileEnvVar points to a PEM encoded RSA or Ed25519 private key.
+	// When set, tokens are signed with RS256 or EdDSA instead of HS256 with TOKEN_SECRET.
+	TokenSigningKeyFileEnvVar = "TOKEN_SIGNING_KEY_FILE"
+	// TokenVerificationKeyFilesEnvVar is a comma separated list of PEM files with keys that tokens are still accepted from.
+	// This is where the previous signing key goes during a rotation until the tokens it signed have expired.
+	TokenVerificationKeyFilesEnvVar = "TOKEN_VERIFICATION_KEY_FILES"
 )
 
+// ChallengeTokenLifeSpan is how long a user has to submit their 2FA code after entering valid credentials
+const ChallengeTokenLifeSpan = 5 * time.Minute
+
+// challengePurpose is set in the "purpose" claim of challenge tokens so they can't be used as session tokens
+const challengePurpose = "2fa_challenge"
+
 type TokenGenerator interface {
-	Generate(userID int64) (string, error)
+	// Generate issues a token for the user bound to the session, revoking the session invalidates the token
+	Generate(userID int64, sessionID uuid.UUID) (string, error)
+}
+
+// ChallengeIssuer issues and verifies the short-lived tokens handed out between the password and 2FA steps of sign in
+type ChallengeIssuer interface {
+	GenerateChallenge(userID int64) (string, error)
+	VerifyChallenge(token string) (int64, error)
+}
+
+// KeySetProvider exposes the public keys tokens can be verified with
+type KeySetProvider interface {
+	JWKS() JWKSet
 }
 
 type TokenConfig struct {
+	// tokenSecret is used for HS256 tokens. It is optional once a signing key is configured,
+	// but keeping it set means tokens issued before switching to asymmetric keys stay valid.
 	tokenSecret   string
 	tokenLifeSpan int
+	signingKey    *signingKey
+	// verificationKeys are indexed by kid and include the signing key
+	verificationKeys map[string]*verificationKey
 }
 
 func NewTokenConfig() (*TokenConfig, error) {
 	// loading of env variables is done at app startup
-	tokenSecret, ok := os.LookupEnv(TokenSecretEnvVar)
-	if !ok {
-		return nil, fmt.Errorf("authentication configuration error: %s environment variable is not set", TokenSecretEnvVar)
+	tokenSecret, hasTokenSecret := os.LookupEnv(TokenSecretEnvVar)
+	signingKeyFile, hasSigningKey := os.LookupEnv(TokenSigningKeyFileEnvVar)
+	if !hasTokenSecret && !hasSigningKey {
+		return nil, fmt.Errorf("authentication configuration error: either %s or %s environment variable must be set", TokenSecretEnvVar, TokenSigningKeyFileEnvVar)
 	}
 	tokenLifeSpan, ok := os.LookupEnv(TokenLifeSpanEnvVar)
 	if !ok {
@@ -43,26 +75,114 @@ func NewTokenConfig() (*TokenConfig, error) {
 	if err != nil || tokenLifeSpanInt <= 0 {
 		return nil, fmt.Errorf("invalid token lifespan: %s. Full error: %w", tokenLifeSpan, err)
 	}
-	return &TokenConfig{tokenSecret: tokenSecret, tokenLifeSpan: tokenLifeSpanInt}, nil
-}
 
-func (tc *TokenConfig) Generate(userID int64) (string, error) {
+	tc := &TokenConfig{tokenSecret: tokenSecret, tokenLifeSpan: tokenLifeSpanInt, verificationKeys: make(map[string]*verificationKey)}
+
+	if hasSigningKey {
+		key, err := loadSigningKey(signingKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("authentication configuration error: %w", err)
+		}
+		tc.signingKey = key
+		tc.verificationKeys[key.kid] = &verificationKey{kid: key.kid, method: key.method, public: key.private.Public()}
+	}
+
+	if files := os.Getenv(TokenVerificationKeyFilesEnvVar); files != "" {
+		for _, file := range strings.Split(files, ",") {
+			file = strings.TrimSpace(file)
+			if file == "" {
+				continue
+			}
+			key, err := loadVerificationKey(file)
+			if err != nil {
+				return nil, fmt.Errorf("authentication configuration error: %w", err)
+			}
+			// the signing key may be listed too, both have the same kid so it's the same entry
+			tc.verificationKeys[key.kid] = key
+		}
+	}
+
+	return tc, nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+func (tc *TokenConfig) Generate(userID int64, sessionID uuid.UUID) (string, error) {
+	tokenString, err := tc.sign(jwt.MapClaims{
 		"user_id": userID,
+		"sid":     sessionID.String(),
 		"exp":     time.Now().Add(time.Hour * time.Duration(tc.tokenLifeSpan)).Unix(),
 	})
-
-	tokenString, err := token.SignedString([]byte(tc.tokenSecret))
 	if err != nil {
 		return "", fmt.Errorf("failed to generate token: %w", err)
 	}
 	return tokenString, nil
 }
 
-func (tc *TokenConfig) AuthMiddleware() gin.HandlerFunc {
+// sign uses the asymmetric signing key when one is configured and falls back to HS256 with the token secret
+func (tc *TokenConfig) sign(claims jwt.MapClaims) (string, error) {
+	if tc.signingKey != nil {
+		token := jwt.NewWithClaims(tc.signingKey.method, claims)
+		token.Header["kid"] = tc.signingKey.kid
+		return token.SignedString(tc.signingKey.private)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(tc.tokenSecret))
+}
+
+// JWKS returns the public keys tokens can currently be verified with so other services don't need the token secret
+func (tc *TokenConfig) JWKS() JWKSet {
+	set := JWKSet{Keys: make([]JWK, 0, len(tc.verificationKeys))}
+	for _, key := range tc.verificationKeys {
+		jwk, err := NewJWK(key.kid, key.method.Alg(), key.public)
+		if err != nil {
+			// keys are validated when they're loaded so this can't happen
+			log.Printf("failed to encode verification key %s: %v", key.kid, err)
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	// map iteration order is random, a stable order keeps the response cacheable
+	slices.SortFunc(set.Keys, func(a, b JWK) int { return strings.Compare(a.Kid, b.Kid) })
+	return set
+}
+
+// GenerateChallenge creates a token proving the user passed the password step of sign in.
+// It can only be exchanged for a real token through VerifyChallenge and is rejected by AuthMiddleware.
+func (tc *TokenConfig) GenerateChallenge(userID int64) (string, error) {
+	tokenString, err := tc.sign(jwt.MapClaims{
+		"user_id": userID,
+		"purpose": challengePurpose,
+		"exp":     time.Now().Add(ChallengeTokenLifeSpan).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate challenge token: %w", err)
+	}
+	return tokenString, nil
+}
+
+func (tc *TokenConfig) VerifyChallenge(token string) (int64, error) {
+	claims, err := tc.parseToken(token)
+	if err != nil {
+		return 0, err
+	}
+	if purpose, _ := claims["purpose"].(string); purpose != challengePurpose {
+		return 0, fmt.Errorf("invalid token. not a challenge token")
+	}
+	return userIDFromClaims(claims)
+}
+
+func (tc *TokenConfig) AuthMiddleware(sessions SessionValidator) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID, err := tc.extractUserID(c)
+		claims, err := tc.extractClaims(c)
+		if err != nil {
+			log.Printf("userId extraction error: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid token",
+			})
+			c.Abort()
+			return
+		}
+
+		userID, err := userIDFromClaims(claims)
 		if err != nil {
 			log.Printf("userId extraction error: %v", err)
 			c.JSON(http.StatusUnauthorized, gin.H{
@@ -71,39 +191,98 @@ func (tc *TokenConfig) AuthMiddleware() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
+
+		// tokens issued before sessions were introduced have no sid, they are accepted until they expire
+		if sid, ok := claims["sid"].(string); ok {
+			sessionID, err := uuid.FromString(sid)
+			if err == nil {
+				err = sessions.ValidateSession(c.Request.Context(), sessionID, userID)
+			}
+			if err != nil {
+				log.Printf("session validation error: %v", err)
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": "Invalid token",
+				})
+				c.Abort()
+				return
+			}
+			c.Set("session_id", sessionID)
+		}
 		c.Set("user_id", userID)
 
 		c.Next()
 	}
 }
 
-func (tc *TokenConfig) extractUserID(c *gin.Context) (int64, error) {
+func (tc *TokenConfig) extractClaims(c *gin.Context) (jwt.MapClaims, error) {
 	token := c.GetHeader("Authorization")
+	// browsers can't set headers when opening a websocket or an event stream, so the token may come in the query instead
+	if token == "" && acceptsQueryToken(c.Request) {
+		if queryToken := c.Query(QueryTokenParam); queryToken != "" {
+			token = "Bearer " + queryToken
+		}
+	}
 	if token == "" {
-		return 0, fmt.Errorf("no token provided")
+		return nil, fmt.Errorf("no token provided")
 	}
 	const prefix = "Bearer "
 	if !strings.HasPrefix(token, prefix) {
-		return 0, fmt.Errorf("invalid token format")
+		return nil, fmt.Errorf("invalid token format")
 	}
 	token = token[len(prefix):]
 
+	claims, err := tc.parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// challenge tokens are only good for completing sign in, not for accessing the api
+	if _, ok := claims["purpose"]; ok {
+		return nil, fmt.Errorf("invalid token. purpose-bound tokens cannot be used for authentication")
+	}
+	return claims, nil
+}
+
+// QueryTokenParam carries the token of websocket and event stream requests, it is ignored on any other request
+const QueryTokenParam = "access_token"
+
+func acceptsQueryToken(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func (tc *TokenConfig) parseToken(token string) (jwt.MapClaims, error) {
 	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			if tc.tokenSecret == "" {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return []byte(tc.tokenSecret), nil
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := tc.verificationKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key: %q", kid)
+		}
+		// the algorithm comes from the token so it must be checked against the key, otherwise an attacker could pick it
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
 		}
-		return []byte(tc.tokenSecret), nil
+		return key.public, nil
 	})
 
 	if err != nil {
-		return 0, fmt.Errorf("error parsing token: %w", err)
+		return nil, fmt.Errorf("error parsing token: %w", err)
 	}
 
 	if !parsedToken.Valid {
-		return 0, fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
 
-	claims := parsedToken.Claims.(jwt.MapClaims)
+	return parsedToken.Claims.(jwt.MapClaims), nil
+}
+
+func userIDFromClaims(claims jwt.MapClaims) (int64, error) {
 	// When parsing JSON numbers, the default type for numbers in Go's map[string]interface{} is float64, not int64
 	userID, ok := claims["user_id"].(float64)
 	if !ok {
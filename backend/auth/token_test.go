@@ -0,0 +1,257 @@
+package auth_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"go_notion/backend/auth"
+	"go_notion/backend/mocks"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyFile(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newRSAKeyFile(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeKeyFile(t, key)
+}
+
+func newEd25519KeyFile(t *testing.T) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeKeyFile(t, key)
+}
+
+// authStatus runs the token through AuthMiddleware and returns the status code
+func authStatus(tc *auth.TokenConfig, token string) int {
+	return authStatusWithSessions(tc, &mocks.SessionValidatorMock{}, token)
+}
+
+func authStatusWithSessions(tc *auth.TokenConfig, sessions auth.SessionValidator, token string) int {
+	r := gin.New()
+	r.GET("/", tc.AuthMiddleware(sessions), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func setTokenEnv(t *testing.T, secret, signingKeyFile string, verificationKeyFiles ...string) {
+	vars := map[string]string{
+		auth.TokenSecretEnvVar:               secret,
+		auth.TokenSigningKeyFileEnvVar:       signingKeyFile,
+		auth.TokenVerificationKeyFilesEnvVar: strings.Join(verificationKeyFiles, ","),
+	}
+	for name, value := range vars {
+		t.Setenv(name, value)
+		if value == "" {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestTokenConfigWithSecret(t *testing.T) {
+	setTokenEnv(t, "secret", "")
+	tc, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := tc.Generate(1, uuid.Must(uuid.NewV4()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, authStatus(tc, token))
+	assert.Empty(t, tc.JWKS().Keys, "hmac secrets must never be published")
+
+	challenge, err := tc.GenerateChallenge(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, authStatus(tc, challenge), "challenge tokens must not authenticate requests")
+}
+
+func TestTokenConfigRequiresSecretOrKey(t *testing.T) {
+	setTokenEnv(t, "", "")
+	_, err := auth.NewTokenConfig()
+	assert.Error(t, err)
+}
+
+func TestTokenConfigWithSigningKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyFile string
+		alg     string
+	}{
+		{name: "rsa", keyFile: newRSAKeyFile(t), alg: "RS256"},
+		{name: "ed25519", keyFile: newEd25519KeyFile(t), alg: "EdDSA"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTokenEnv(t, "", test.keyFile)
+			tc, err := auth.NewTokenConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := tc.Generate(1, uuid.Must(uuid.NewV4()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, http.StatusOK, authStatus(tc, token))
+
+			keys := tc.JWKS().Keys
+			if assert.Len(t, keys, 1) {
+				assert.Equal(t, test.alg, keys[0].Alg)
+				assert.NotEmpty(t, keys[0].Kid)
+			}
+
+			challenge, err := tc.GenerateChallenge(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			userID, err := tc.VerifyChallenge(challenge)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), userID)
+		})
+	}
+}
+
+func TestTokenConfigKeyRotation(t *testing.T) {
+	oldKeyFile := newRSAKeyFile(t)
+	newKeyFile := newEd25519KeyFile(t)
+
+	setTokenEnv(t, "secret", oldKeyFile)
+	oldConfig, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := oldConfig.Generate(1, uuid.Must(uuid.NewV4()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setTokenEnv(t, "secret", "")
+	legacyConfig, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyToken, err := legacyConfig.Generate(1, uuid.Must(uuid.NewV4()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new key signs while the old key and the secret are still accepted
+	setTokenEnv(t, "secret", newKeyFile, oldKeyFile)
+	rotatedConfig, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := rotatedConfig.Generate(1, uuid.Must(uuid.NewV4()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, authStatus(rotatedConfig, oldToken))
+	assert.Equal(t, http.StatusOK, authStatus(rotatedConfig, legacyToken))
+	assert.Equal(t, http.StatusOK, authStatus(rotatedConfig, newToken))
+	assert.Len(t, rotatedConfig.JWKS().Keys, 2)
+
+	// listing the signing key among the verification keys doesn't add a second entry for it
+	setTokenEnv(t, "secret", newKeyFile, oldKeyFile, newKeyFile)
+	listedConfig, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, listedConfig.JWKS().Keys, 2)
+
+	// once the old key and the secret are dropped, their tokens are rejected
+	setTokenEnv(t, "", newKeyFile)
+	finalConfig, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, authStatus(finalConfig, oldToken))
+	assert.Equal(t, http.StatusUnauthorized, authStatus(finalConfig, legacyToken))
+	assert.Equal(t, http.StatusOK, authStatus(finalConfig, newToken))
+}
+
+func TestRevokedSessionIsRejected(t *testing.T) {
+	setTokenEnv(t, "secret", "")
+	tc, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionID := uuid.Must(uuid.NewV4())
+	token, err := tc.Generate(1, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := &mocks.SessionValidatorMock{Revoked: map[uuid.UUID]bool{}}
+	assert.Equal(t, http.StatusOK, authStatusWithSessions(tc, sessions, token))
+
+	sessions.Revoked[sessionID] = true
+	assert.Equal(t, http.StatusUnauthorized, authStatusWithSessions(tc, sessions, token))
+}
+
+func TestQueryTokenOnlyForStreams(t *testing.T) {
+	setTokenEnv(t, "secret", "")
+	tc, err := auth.NewTokenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tc.Generate(1, uuid.Must(uuid.NewV4()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(headers map[string]string) int {
+		r := gin.New()
+		r.GET("/", tc.AuthMiddleware(&mocks.SessionValidatorMock{}), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/?"+auth.QueryTokenParam+"="+token, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, status(nil))
+	assert.Equal(t, http.StatusOK, status(map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}))
+	assert.Equal(t, http.StatusOK, status(map[string]string{"Accept": "text/event-stream"}))
+}
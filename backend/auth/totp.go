@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTPIssuer is the issuer shown by authenticator apps next to the account name
+	TOTPIssuer = "go_notion"
+	// TOTPDigits is the number of digits in a generated code
+	TOTPDigits = 6
+	// TOTPPeriod is the time step used to derive codes, as recommended by RFC 6238
+	TOTPPeriod = 30 * time.Second
+	// TOTPSkew is the number of time steps before and after the current one that are still accepted.
+	// It absorbs small clock differences between the server and the user's device.
+	TOTPSkew = 1
+	// RecoveryCodeCount is the number of recovery codes generated when 2FA is confirmed
+	RecoveryCodeCount = 10
+)
+
+// base32 without padding is what authenticator apps expect in the otpauth URI
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 encoded secret.
+// 20 bytes matches the output size of HMAC-SHA1 as recommended by RFC 4226.
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI builds the otpauth:// URI that authenticator apps consume, usually through a QR code
+func TOTPURI(accountName, secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + accountName)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTPDigits))
+	params.Set("period", fmt.Sprint(int(TOTPPeriod.Seconds())))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// GenerateTOTP returns the code for the secret at the given time
+func GenerateTOTP(secret string, at time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %w", err)
+	}
+	return hotp(key, uint64(at.Unix()/int64(TOTPPeriod.Seconds())), TOTPDigits), nil
+}
+
+// ValidateTOTP checks the code against the secret at the given time, allowing for TOTPSkew steps of drift
+func ValidateTOTP(secret, code string, at time.Time) bool {
+	_, valid := MatchTOTP(secret, code, at, -1)
+	return valid
+}
+
+// MatchTOTP checks the code like ValidateTOTP and returns the time step it matched.
+// Steps at or below lastStep were already used, rejecting them stops a code from being replayed within its window.
+func MatchTOTP(secret, code string, at time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	counter := at.Unix() / int64(TOTPPeriod.Seconds())
+	var matched int64
+	valid := false
+	for offset := int64(-TOTPSkew); offset <= TOTPSkew; offset++ {
+		step := counter + offset
+		expected := hotp(key, uint64(step), TOTPDigits)
+		// we don't break early so the comparison takes the same time regardless of which step matched
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 && step > lastStep {
+			matched, valid = step, true
+		}
+	}
+	return matched, valid
+}
+
+// hotp implements the HMAC-based one-time password algorithm from RFC 4226
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation: the low nibble of the last byte decides where the 31 bit code is read from
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// GenerateRecoveryCodes returns n random single-use codes formatted as xxxxx-xxxxx
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		code := hex.EncodeToString(raw)
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode returns the value stored in the database for a recovery code.
+// The code is normalized first so users can type it with or without the dash and in any case.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
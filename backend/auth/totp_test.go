@@ -0,0 +1,87 @@
+package auth_test
+
+import (
+	"go_notion/backend/auth"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// base32 of the ASCII secret "12345678901234567890" used by the RFC 6238 test vectors
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTPMatchesRFCVectors(t *testing.T) {
+	// the RFC vectors are 8 digits long, we use the last 6 digits since we generate 6 digit codes
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			assert.True(t, auth.ValidateTOTP(rfcSecret, test.code, time.Unix(test.unix, 0)))
+		})
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	at := time.Unix(59, 0)
+
+	assert.True(t, auth.ValidateTOTP(rfcSecret, "287082", at.Add(auth.TOTPPeriod)), "previous step should be accepted")
+	assert.False(t, auth.ValidateTOTP(rfcSecret, "287082", at.Add(3*auth.TOTPPeriod)), "codes older than the skew should be rejected")
+	assert.False(t, auth.ValidateTOTP(rfcSecret, "000000", at))
+	assert.False(t, auth.ValidateTOTP(rfcSecret, "28708", at))
+	assert.False(t, auth.ValidateTOTP("not base32!", "287082", at))
+}
+
+func TestMatchTOTPRejectsUsedSteps(t *testing.T) {
+	at := time.Unix(59, 0)
+
+	step, valid := auth.MatchTOTP(rfcSecret, "287082", at, -1)
+	assert.True(t, valid)
+	assert.Equal(t, int64(1), step)
+
+	_, valid = auth.MatchTOTP(rfcSecret, "287082", at, step)
+	assert.False(t, valid, "a code must not be accepted twice")
+	_, valid = auth.MatchTOTP(rfcSecret, "287082", at.Add(auth.TOTPPeriod), step)
+	assert.False(t, valid, "a code must not be accepted again in the next step")
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri, err := url.Parse(auth.TOTPURI("test@test.com", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/"+auth.TOTPIssuer+":test@test.com", uri.Path)
+	assert.Equal(t, secret, uri.Query().Get("secret"))
+	assert.Equal(t, auth.TOTPIssuer, uri.Query().Get("issuer"))
+}
+
+func TestHashRecoveryCodeIsNormalized(t *testing.T) {
+	codes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, codes, auth.RecoveryCodeCount)
+
+	code := codes[0]
+	assert.Equal(t, auth.HashRecoveryCode(code), auth.HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(code, "-", ""))))
+	assert.NotEqual(t, auth.HashRecoveryCode(code), auth.HashRecoveryCode(codes[1]))
+}
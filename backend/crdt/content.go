@@ -0,0 +1,51 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ServerClientID is the client id of the writes made by the server itself
+const ServerClientID = "server"
+
+// FromContent builds a document from editor content that was saved without one. The top-level nodes become
+// the blocks, keeping their attrs.id when they have one. The writes are at counter 0 so any client write wins.
+func FromContent(content json.RawMessage) (*Document, error) {
+	doc := NewDocument()
+
+	var root struct {
+		Content []json.RawMessage `json:"content"`
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &root); err != nil {
+			// content that isn't a doc node can't be split into blocks, the document starts empty
+			return doc, nil
+		}
+	}
+
+	at := Timestamp{Counter: 0, ClientID: ServerClientID}
+	update := Update{Blocks: make(map[string]Block, len(root.Content))}
+	for i, node := range root.Content {
+		var block struct {
+			Attrs struct {
+				ID any `json:"id"`
+			} `json:"attrs"`
+		}
+		json.Unmarshal(node, &block)
+		id, ok := block.Attrs.ID.(string)
+		if !ok || id == "" {
+			id = fmt.Sprintf("block-%d", i)
+		}
+		if _, exists := update.Blocks[id]; exists {
+			id = fmt.Sprintf("%s-%d", id, i)
+		}
+		update.Blocks[id] = Block{
+			Data:     &Register[json.RawMessage]{Value: node, At: at},
+			Position: &Register[string]{Value: fmt.Sprintf("%08d", (i+1)*1000), At: at},
+		}
+	}
+	if _, err := doc.Apply(update); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,372 @@
+// Package crdt merges concurrent edits of a page's content.
+//
+// The document is a set of top-level blocks, each block's data, position and deletion are
+// last-writer-wins registers ordered by Lamport timestamps. Merging is commutative, associative
+// and idempotent, so replicas that applied the same updates in any order end up with the same
+// document. Concurrent edits to different blocks, or to the position and the data of the same block,
+// all survive.
+//
+// The text of a block is merged character by character. A block with characters renders its data with
+// the text of its characters as content, so the data only carries the node's type and attrs, and two
+// people typing in the same paragraph both keep what they typed. Characters are ordered like blocks,
+// by a fractional position and then by their key, they are never changed once inserted, only deleted.
+// Blocks without characters, like the ones built from saved content, are merged as a whole until an
+// editor moves their text into characters.
+//
+// Deleted blocks and characters are kept as tombstones so late writes to them still lose, and are
+// dropped by Compact once every editor has seen the deletion.
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Timestamp orders writes, ties between clients are broken by the client id
+type Timestamp struct {
+	Counter  uint64 `json:"counter"`
+	ClientID string `json:"client_id"`
+}
+
+func (t Timestamp) After(other Timestamp) bool {
+	if t.Counter != other.Counter {
+		return t.Counter > other.Counter
+	}
+	return t.ClientID > other.ClientID
+}
+
+type Register[T any] struct {
+	Value T         `json:"value"`
+	At    Timestamp `json:"at"`
+}
+
+// Block is a top-level node of the content. Position is a fractional index, blocks are
+// sorted by it and by id, so clients pick a key between the neighbours of the new block.
+type Block struct {
+	Data     *Register[json.RawMessage] `json:"data,omitempty"`
+	Position *Register[string]          `json:"position,omitempty"`
+	Deleted  *Register[bool]            `json:"deleted,omitempty"`
+	// Text holds the characters of the block by key, editors make keys unique with their client id
+	Text map[string]Char `json:"text,omitempty"`
+}
+
+// Char is a character of a block's text, inserted at a fractional position between its neighbours.
+// The same key always comes with the same value and position, only Deleted is ever written again,
+// so a deletion is sent as the whole character.
+type Char struct {
+	Value    string     `json:"value"`
+	Position string     `json:"position"`
+	At       Timestamp  `json:"at"`
+	Deleted  *Timestamp `json:"deleted,omitempty"`
+}
+
+// Update is a set of writes to blocks. The state of a document is an update as well,
+// the one that brings an empty document to it.
+type Update struct {
+	Blocks map[string]Block `json:"blocks"`
+}
+
+// MaxClockJump is how far above the document's clock the counter of a write can be. Clients continue
+// from the clock, so honest writes stay close to it, and a write at a huge counter would win every
+// later conflict and bring the clock close to overflowing.
+const MaxClockJump = 1 << 20
+
+type Document struct {
+	blocks map[string]*Block
+	clock  uint64
+}
+
+func NewDocument() *Document {
+	return &Document{blocks: make(map[string]*Block)}
+}
+
+// Clock is the highest counter the document has seen, clients continue from it
+func (d *Document) Clock() uint64 {
+	return d.clock
+}
+
+// Apply merges the update and returns the writes that won, which are the ones worth relaying to other replicas.
+// Updates with a write more than MaxClockJump above the clock are rejected whole.
+func (d *Document) Apply(update Update) (Update, error) {
+	limit := d.clock + MaxClockJump
+	for id, incoming := range update.Blocks {
+		if (incoming.Data != nil && incoming.Data.At.Counter > limit) ||
+			(incoming.Position != nil && incoming.Position.At.Counter > limit) ||
+			(incoming.Deleted != nil && incoming.Deleted.At.Counter > limit) {
+			return Update{}, fmt.Errorf("block %q is too far ahead of the document clock %d", id, d.clock)
+		}
+		for key, char := range incoming.Text {
+			if char.At.Counter > limit || (char.Deleted != nil && char.Deleted.Counter > limit) {
+				return Update{}, fmt.Errorf("character %q of block %q is too far ahead of the document clock %d", key, id, d.clock)
+			}
+		}
+	}
+	return d.apply(update)
+}
+
+// apply merges the update without checking its counters, for states that were already accepted
+func (d *Document) apply(update Update) (Update, error) {
+	applied := Update{Blocks: make(map[string]Block)}
+	for id, incoming := range update.Blocks {
+		if id == "" {
+			return Update{}, fmt.Errorf("block id cannot be empty")
+		}
+		if incoming.Data != nil && !json.Valid(incoming.Data.Value) {
+			return Update{}, fmt.Errorf("block %q has invalid data", id)
+		}
+		for key, char := range incoming.Text {
+			if key == "" || char.Value == "" {
+				return Update{}, fmt.Errorf("characters of block %q need a key and a value", id)
+			}
+			if block, ok := d.blocks[id]; ok {
+				if current, ok := block.Text[key]; ok && (current.Value != char.Value || current.Position != char.Position || current.At != char.At) {
+					return Update{}, fmt.Errorf("character %q of block %q was inserted with another value", key, id)
+				}
+			}
+		}
+	}
+
+	for id, incoming := range update.Blocks {
+		block, ok := d.blocks[id]
+		if !ok {
+			block = &Block{}
+			d.blocks[id] = block
+		}
+
+		var won Block
+		if mergeRegister(&block.Data, incoming.Data) {
+			won.Data = block.Data
+			d.observe(incoming.Data.At)
+		}
+		if mergeRegister(&block.Position, incoming.Position) {
+			won.Position = block.Position
+			d.observe(incoming.Position.At)
+		}
+		if mergeRegister(&block.Deleted, incoming.Deleted) {
+			won.Deleted = block.Deleted
+			d.observe(incoming.Deleted.At)
+		}
+		for key, char := range incoming.Text {
+			if !mergeChar(block, key, char) {
+				continue
+			}
+			if won.Text == nil {
+				won.Text = make(map[string]Char)
+			}
+			won.Text[key] = block.Text[key]
+			d.observe(char.At)
+			if char.Deleted != nil {
+				d.observe(*char.Deleted)
+			}
+		}
+		if won.Data != nil || won.Position != nil || won.Deleted != nil || won.Text != nil {
+			applied.Blocks[id] = won
+		}
+	}
+	return applied, nil
+}
+
+func mergeRegister[T any](current **Register[T], incoming *Register[T]) bool {
+	if incoming == nil {
+		return false
+	}
+	if *current != nil && !incoming.At.After((*current).At) {
+		return false
+	}
+	value := *incoming
+	*current = &value
+	return true
+}
+
+// mergeChar inserts the character, or marks it deleted. A character deleted twice keeps the earliest
+// deletion so replicas agree whatever the order.
+func mergeChar(block *Block, key string, incoming Char) bool {
+	current, ok := block.Text[key]
+	if !ok {
+		if block.Text == nil {
+			block.Text = make(map[string]Char)
+		}
+		block.Text[key] = incoming
+		return true
+	}
+	if incoming.Deleted == nil || (current.Deleted != nil && !current.Deleted.After(*incoming.Deleted)) {
+		return false
+	}
+	deletedAt := *incoming.Deleted
+	current.Deleted = &deletedAt
+	block.Text[key] = current
+	return true
+}
+
+func (d *Document) observe(at Timestamp) {
+	if at.Counter > d.clock {
+		d.clock = at.Counter
+	}
+}
+
+// State is the whole document as an update. Deleted blocks and characters are kept as tombstones so a late
+// write to them still loses.
+func (d *Document) State() Update {
+	state := Update{Blocks: make(map[string]Block, len(d.blocks))}
+	for id, block := range d.blocks {
+		copied := *block
+		if block.Text != nil {
+			copied.Text = make(map[string]Char, len(block.Text))
+			for key, char := range block.Text {
+				copied.Text[key] = char
+			}
+		}
+		state.Blocks[id] = copied
+	}
+	return state
+}
+
+// Compact drops the tombstones of blocks and characters deleted at or below the horizon, the lowest clock
+// every editor has seen. Past it no editor can still send a write the tombstone would have to win against.
+// It returns how many tombstones were dropped.
+func (d *Document) Compact(horizon uint64) int {
+	dropped := 0
+	for id, block := range d.blocks {
+		if block.Deleted != nil && block.Deleted.Value && block.Deleted.At.Counter <= horizon {
+			delete(d.blocks, id)
+			dropped++
+			continue
+		}
+		for key, char := range block.Text {
+			if char.Deleted != nil && char.Deleted.Counter <= horizon {
+				delete(block.Text, key)
+				dropped++
+			}
+		}
+	}
+	return dropped
+}
+
+// MarshalJSON encodes the state of the document
+func (d *Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.State())
+}
+
+func (d *Document) UnmarshalJSON(data []byte) error {
+	var state Update
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*d = *NewDocument()
+	_, err := d.apply(state)
+	return err
+}
+
+type visibleBlock struct {
+	id       string
+	position string
+	data     json.RawMessage
+}
+
+func (d *Document) visibleBlocks() []visibleBlock {
+	blocks := make([]visibleBlock, 0, len(d.blocks))
+	for id, block := range d.blocks {
+		if block.Data == nil || (block.Deleted != nil && block.Deleted.Value) {
+			continue
+		}
+		var position string
+		if block.Position != nil {
+			position = block.Position.Value
+		}
+		blocks = append(blocks, visibleBlock{id: id, position: position, data: block.render()})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].position != blocks[j].position {
+			return blocks[i].position < blocks[j].position
+		}
+		return blocks[i].id < blocks[j].id
+	})
+	return blocks
+}
+
+type visibleChar struct {
+	key      string
+	position string
+	value    string
+}
+
+// render returns the data of the block, with the text of its characters as content when it has any
+func (b *Block) render() json.RawMessage {
+	if len(b.Text) == 0 {
+		return b.Data.Value
+	}
+	chars := make([]visibleChar, 0, len(b.Text))
+	for key, char := range b.Text {
+		if char.Deleted == nil {
+			chars = append(chars, visibleChar{key: key, position: char.Position, value: char.Value})
+		}
+	}
+	sort.Slice(chars, func(i, j int) bool {
+		if chars[i].position != chars[j].position {
+			return chars[i].position < chars[j].position
+		}
+		return chars[i].key < chars[j].key
+	})
+	var text strings.Builder
+	for _, char := range chars {
+		text.WriteString(char.value)
+	}
+
+	var node map[string]any
+	if err := json.Unmarshal(b.Data.Value, &node); err != nil || node == nil {
+		return b.Data.Value
+	}
+	content := []any{}
+	if text.Len() > 0 {
+		content = append(content, map[string]any{"type": "text", "text": text.String()})
+	}
+	node["content"] = content
+	rendered, err := json.Marshal(node)
+	if err != nil {
+		return b.Data.Value
+	}
+	return rendered
+}
+
+// Content renders the document in the editor's format, the blocks in order under a doc node
+func (d *Document) Content() json.RawMessage {
+	blocks := d.visibleBlocks()
+	nodes := make([]json.RawMessage, 0, len(blocks))
+	for _, block := range blocks {
+		nodes = append(nodes, block.data)
+	}
+	content, _ := json.Marshal(map[string]any{"type": "doc", "content": nodes})
+	return content
+}
+
+// Text renders the text of the document, one line per block
+func (d *Document) Text() string {
+	blocks := d.visibleBlocks()
+	lines := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		var node any
+		if err := json.Unmarshal(block.data, &node); err != nil {
+			continue
+		}
+		var sb strings.Builder
+		collectText(node, &sb)
+		lines = append(lines, sb.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func collectText(node any, sb *strings.Builder) {
+	switch n := node.(type) {
+	case []any:
+		for _, child := range n {
+			collectText(child, sb)
+		}
+	case map[string]any:
+		if text, ok := n["text"].(string); ok {
+			sb.WriteString(text)
+		}
+		collectText(n["content"], sb)
+	}
+}
@@ -0,0 +1,221 @@
+package crdt_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/crdt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func at(counter uint64, client string) crdt.Timestamp {
+	return crdt.Timestamp{Counter: counter, ClientID: client}
+}
+
+func data(counter uint64, client, node string) *crdt.Register[json.RawMessage] {
+	return &crdt.Register[json.RawMessage]{Value: json.RawMessage(node), At: at(counter, client)}
+}
+
+func position(counter uint64, client, key string) *crdt.Register[string] {
+	return &crdt.Register[string]{Value: key, At: at(counter, client)}
+}
+
+func deleted(counter uint64, client string) *crdt.Register[bool] {
+	return &crdt.Register[bool]{Value: true, At: at(counter, client)}
+}
+
+func paragraph(text string) string {
+	return `{"type":"paragraph","content":[{"type":"text","text":"` + text + `"}]}`
+}
+
+func TestConcurrentUpdatesConverge(t *testing.T) {
+	updates := []crdt.Update{
+		{Blocks: map[string]crdt.Block{"a": {Data: data(1, "alice", paragraph("first")), Position: position(1, "alice", "1")}}},
+		{Blocks: map[string]crdt.Block{"b": {Data: data(1, "bob", paragraph("second")), Position: position(1, "bob", "2")}}},
+		// concurrent edits of the same block, bob's wins the tie on the client id
+		{Blocks: map[string]crdt.Block{"a": {Data: data(2, "alice", paragraph("alice edit"))}}},
+		{Blocks: map[string]crdt.Block{"a": {Data: data(2, "bob", paragraph("bob edit"))}}},
+		// a move and an edit of the same block both survive
+		{Blocks: map[string]crdt.Block{"b": {Position: position(3, "alice", "0")}}},
+		{Blocks: map[string]crdt.Block{"b": {Data: data(3, "bob", paragraph("second edit"))}}},
+	}
+
+	orders := [][]int{
+		{0, 1, 2, 3, 4, 5},
+		{5, 4, 3, 2, 1, 0},
+		{3, 0, 5, 1, 2, 4},
+		// applying an update twice changes nothing
+		{0, 0, 1, 2, 2, 3, 4, 5, 5},
+	}
+
+	var expected string
+	for _, order := range orders {
+		doc := crdt.NewDocument()
+		for _, i := range order {
+			_, err := doc.Apply(updates[i])
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, "second edit\nbob edit", doc.Text())
+		assert.Equal(t, uint64(3), doc.Clock())
+		if expected == "" {
+			expected = string(doc.Content())
+		}
+		assert.JSONEq(t, expected, string(doc.Content()))
+	}
+}
+
+func TestDeletedBlocksStayDeleted(t *testing.T) {
+	doc := crdt.NewDocument()
+	doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Data: data(1, "alice", paragraph("hello")), Position: position(1, "alice", "1")}}})
+	doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Deleted: deleted(2, "bob")}}})
+
+	// an older edit that arrives late is recorded but the block stays deleted
+	applied, err := doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Data: data(1, "carol", paragraph("late"))}}})
+	assert.NoError(t, err)
+	assert.NotNil(t, applied.Blocks["a"].Data)
+	assert.Equal(t, "", doc.Text())
+
+	// the tombstone survives a round trip through the stored state
+	state, err := json.Marshal(doc)
+	assert.NoError(t, err)
+	restored := crdt.NewDocument()
+	assert.NoError(t, json.Unmarshal(state, restored))
+	assert.Equal(t, "", restored.Text())
+	applied, err = restored.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Deleted: deleted(1, "alice")}}})
+	assert.NoError(t, err)
+	assert.Empty(t, applied.Blocks)
+}
+
+func TestApplyReturnsOnlyWinningWrites(t *testing.T) {
+	doc := crdt.NewDocument()
+	doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Data: data(5, "alice", paragraph("new"))}}})
+
+	applied, err := doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{
+		"a": {Data: data(4, "bob", paragraph("old")), Position: position(4, "bob", "1")},
+	}})
+	assert.NoError(t, err)
+	assert.Nil(t, applied.Blocks["a"].Data)
+	assert.NotNil(t, applied.Blocks["a"].Position)
+}
+
+func TestInvalidUpdatesAreRejectedWhole(t *testing.T) {
+	doc := crdt.NewDocument()
+	_, err := doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{
+		"a": {Data: data(1, "alice", paragraph("valid"))},
+		"b": {Data: data(1, "alice", `{"broken"`)},
+	}})
+	assert.Error(t, err)
+	assert.Empty(t, doc.State().Blocks)
+
+	_, err = doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"": {Data: data(1, "alice", paragraph("x"))}}})
+	assert.Error(t, err)
+}
+
+func TestCountersFarAheadOfTheClockAreRejected(t *testing.T) {
+	doc := crdt.NewDocument()
+	_, err := doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{
+		"a": {Data: data(1, "alice", paragraph("valid"))},
+		"b": {Position: position(math.MaxUint64, "mallory", "1")},
+	}})
+	assert.Error(t, err)
+	assert.Empty(t, doc.State().Blocks)
+	assert.Equal(t, uint64(0), doc.Clock())
+
+	_, err = doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Data: data(crdt.MaxClockJump, "alice", paragraph("valid"))}}})
+	assert.NoError(t, err)
+	_, err = doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Deleted: deleted(2*crdt.MaxClockJump+1, "bob")}}})
+	assert.Error(t, err)
+	_, err = doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"a": {Deleted: deleted(2*crdt.MaxClockJump, "bob")}}})
+	assert.NoError(t, err)
+
+	// stored states are loaded whatever their clock
+	state, err := json.Marshal(doc)
+	assert.NoError(t, err)
+	loaded := crdt.NewDocument()
+	assert.NoError(t, json.Unmarshal(state, loaded))
+	assert.Equal(t, doc.Clock(), loaded.Clock())
+}
+
+func TestFromContent(t *testing.T) {
+	content := `{"type":"doc","content":[
+		{"type":"paragraph","attrs":{"id":"intro"},"content":[{"type":"text","text":"one"}]},
+		{"type":"paragraph","content":[{"type":"text","text":"two"}]}
+	]}`
+	doc, err := crdt.FromContent(json.RawMessage(content))
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo", doc.Text())
+	assert.Contains(t, doc.State().Blocks, "intro")
+
+	// any client write wins over the imported content
+	doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{"intro": {Data: data(1, "alice", paragraph("edited"))}}})
+	assert.Equal(t, "edited\ntwo", doc.Text())
+
+	doc, err = crdt.FromContent(json.RawMessage(`{"data": "test"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "", doc.Text())
+}
+
+func char(counter uint64, client, position, value string) crdt.Char {
+	return crdt.Char{Value: value, Position: position, At: at(counter, client)}
+}
+
+func TestConcurrentTypingInTheSameBlockKeepsBothEdits(t *testing.T) {
+	typed := func(chars map[string]crdt.Char) crdt.Update {
+		return crdt.Update{Blocks: map[string]crdt.Block{"a": {Text: chars}}}
+	}
+	removed := at(4, "bob")
+	updates := []crdt.Update{
+		{Blocks: map[string]crdt.Block{"a": {Data: data(1, "alice", `{"type":"paragraph"}`), Position: position(1, "alice", "1"), Text: map[string]crdt.Char{
+			"alice-1": char(1, "alice", "1", "h"),
+			"alice-2": char(1, "alice", "2", "i"),
+		}}}},
+		// both type after "hi" at the same time, and pick the same position
+		typed(map[string]crdt.Char{"alice-3": char(2, "alice", "3", "!")}),
+		typed(map[string]crdt.Char{"bob-1": char(2, "bob", "3", "?")}),
+		// bob deletes the "i" while alice sets the block's attrs
+		typed(map[string]crdt.Char{"alice-2": {Value: "i", Position: "2", At: at(1, "alice"), Deleted: &removed}}),
+		{Blocks: map[string]crdt.Block{"a": {Data: data(3, "alice", `{"type":"heading","attrs":{"level":1}}`)}}},
+	}
+
+	orders := [][]int{{0, 1, 2, 3, 4}, {0, 4, 3, 2, 1}, {0, 2, 2, 1, 4, 3, 3}}
+	for _, order := range orders {
+		doc := crdt.NewDocument()
+		for _, i := range order {
+			_, err := doc.Apply(updates[i])
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, "h!?", doc.Text())
+		assert.JSONEq(t, `{"type":"doc","content":[{"type":"heading","attrs":{"level":1},"content":[{"type":"text","text":"h!?"}]}]}`, string(doc.Content()))
+	}
+
+	doc := crdt.NewDocument()
+	doc.Apply(updates[0])
+	_, err := doc.Apply(typed(map[string]crdt.Char{"alice-1": char(1, "alice", "1", "x")}))
+	assert.Error(t, err, "a character can't be inserted again with another value")
+}
+
+func TestCompactDropsTombstonesEveryoneHasSeen(t *testing.T) {
+	removed := at(3, "bob")
+	doc := crdt.NewDocument()
+	doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{
+		"a": {Data: data(1, "alice", `{"type":"paragraph"}`), Position: position(1, "alice", "1"), Text: map[string]crdt.Char{
+			"alice-1": char(1, "alice", "1", "h"),
+			"alice-2": char(1, "alice", "2", "i"),
+		}},
+		"b": {Data: data(1, "alice", paragraph("gone")), Position: position(1, "alice", "2")},
+	}})
+	doc.Apply(crdt.Update{Blocks: map[string]crdt.Block{
+		"a": {Text: map[string]crdt.Char{"alice-2": {Value: "i", Position: "2", At: at(1, "alice"), Deleted: &removed}}},
+		"b": {Deleted: deleted(4, "bob")},
+	}})
+
+	assert.Equal(t, 0, doc.Compact(2), "an editor may not have seen the deletions yet")
+	assert.Equal(t, 1, doc.Compact(3))
+	assert.NotContains(t, doc.State().Blocks["a"].Text, "alice-2")
+	assert.Contains(t, doc.State().Blocks, "b")
+	assert.Equal(t, 1, doc.Compact(4))
+	assert.NotContains(t, doc.State().Blocks, "b")
+	assert.Equal(t, "h", doc.Text())
+	assert.Equal(t, uint64(4), doc.Clock())
+}
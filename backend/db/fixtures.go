@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/auth"
 
 	"github.com/gofrs/uuid/v5"
@@ -21,9 +22,76 @@ func InsertTestUserWithData(email, username, password string) Fixture {
 		if hashErr != nil {
 			return fmt.Errorf("error hashing password: %w", hashErr)
 		}
+		return insertUserFixture(conn, email, username, hashedPassword)
+	}
+}
+
+// InsertTestUserWithPasswordHash inserts a user whose password was hashed elsewhere, eg: with an older algorithm
+func InsertTestUserWithPasswordHash(email, username, passwordHash string) Fixture {
+	return func(conn *pgx.Conn) error {
+		return insertUserFixture(conn, email, username, passwordHash)
+	}
+}
+
+// insertUserFixture inserts the user along with the personal workspace sign up creates
+func insertUserFixture(conn *pgx.Conn, email, username, passwordHash string) error {
+	var userID int64
+	err := conn.QueryRow(context.Background(), `
+		INSERT INTO users (email, username, password) VALUES ($1, $2, $3) RETURNING id
+	`, email, username, passwordHash).Scan(&userID)
+	if err != nil {
+		return err
+	}
+	_, err = access.CreatePersonalWorkspace(context.Background(), conn, userID, username)
+	return err
+}
+
+// InsertTestWorkspaceMemberFixture adds the user to another user's personal workspace with the given role
+func InsertTestWorkspaceMemberFixture(owner_id int64, user_id int64, role access.Role) Fixture {
+	return func(conn *pgx.Conn) error {
+		_, err := conn.Exec(context.Background(), `
+		INSERT INTO workspace_members (workspace_id, user_id, role)
+		SELECT id, $2::integer, $3::varchar FROM workspaces WHERE created_by = $1 AND is_personal
+	`, owner_id, user_id, role)
+		return err
+	}
+}
+
+// VerifyTestUserEmail marks the user's email as verified, as if they had used a link mailed to it
+func VerifyTestUserEmail(userID int64) Fixture {
+	return func(conn *pgx.Conn) error {
+		_, err := conn.Exec(context.Background(), `UPDATE users SET email_verified_at = CURRENT_TIMESTAMP WHERE id = $1`, userID)
+		return err
+	}
+}
+
+// EnableTestUserTwoFactor turns on 2FA for the user with the given TOTP secret and recovery codes
+func EnableTestUserTwoFactor(userID int64, totpSecret string, recoveryCodes ...string) Fixture {
+	return func(conn *pgx.Conn) error {
+		_, err := conn.Exec(context.Background(), `
+		UPDATE users SET totp_secret = $1, totp_enabled = true WHERE id = $2
+	`, totpSecret, userID)
+		if err != nil {
+			return err
+		}
+		for _, code := range recoveryCodes {
+			_, err = conn.Exec(context.Background(), `
+			INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, auth.HashRecoveryCode(code))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// InsertTestSessionFixture records a signed in device for the user
+func InsertTestSessionFixture(session_id uuid.UUID, user_id int64) Fixture {
+	return func(conn *pgx.Conn) error {
 		_, err := conn.Exec(context.Background(), `
-		INSERT INTO users (email, username, password) VALUES ($1, $2, $3)
-	`, email, username, hashedPassword)
+		INSERT INTO sessions (id, user_id, user_agent, ip_address) VALUES ($1, $2, 'test-agent', '127.0.0.1')
+	`, session_id, user_id)
 		return err
 	}
 }
@@ -62,7 +130,8 @@ func InsertTestPageFixtureWithPosition(page_id uuid.UUID, user_id int64, positio
 
 func insertPageFixture(conn *pgx.Conn, page_id uuid.UUID, user_id int64, position int, is_top_level bool) error {
 	_, err := conn.Exec(context.Background(), `
-	INSERT INTO pages (id, created_by, position, text_title, text_content, title, content, is_top_level) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	INSERT INTO pages (id, created_by, workspace_id, position, text_title, text_content, title, content, is_top_level)
+	SELECT $1::uuid, $2::integer, id, $3::float8, $4::text, $5::text, $6::jsonb, $7::jsonb, $8::boolean FROM workspaces WHERE created_by = $2 AND is_personal
 `, page_id, user_id, position, "test", "test", json.RawMessage(`{"data": "test"}`), json.RawMessage(`{"data": "test"}`), is_top_level)
 	return err
 }
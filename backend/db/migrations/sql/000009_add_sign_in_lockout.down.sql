@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS account_unlock_tokens;
+
+ALTER TABLE users DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE users DROP COLUMN IF EXISTS failed_sign_in_attempts;
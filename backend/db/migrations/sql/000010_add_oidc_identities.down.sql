@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS oidc_login_states;
+DROP TABLE IF EXISTS user_identities;
+
+-- this fails if users without a password were created, they have to be removed or given a password first
+ALTER TABLE users ALTER COLUMN password SET NOT NULL;
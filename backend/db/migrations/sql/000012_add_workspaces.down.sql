@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_pages_workspace_id_position;
+CREATE UNIQUE INDEX IF NOT EXISTS pages_created_by_position_idx ON pages (created_by, position);
+
+DROP INDEX IF EXISTS idx_pages_workspace_id;
+ALTER TABLE pages DROP COLUMN IF EXISTS workspace_id;
+
+DROP TABLE IF EXISTS workspace_members;
+DROP TABLE IF EXISTS workspaces;
@@ -0,0 +1,44 @@
+CREATE TABLE IF NOT EXISTS workspaces (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    is_personal BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON COLUMN workspaces.is_personal IS 'Every user gets a personal workspace on sign up, it is where their pages go when no workspace is given.';
+
+-- a user has at most one personal workspace
+CREATE UNIQUE INDEX IF NOT EXISTS idx_workspaces_personal ON workspaces (created_by) WHERE is_personal;
+
+CREATE TABLE IF NOT EXISTS workspace_members (
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (workspace_id, user_id),
+    CONSTRAINT workspace_members_role_check CHECK (role IN ('owner', 'admin', 'member', 'guest'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_workspace_members_user_id ON workspace_members (user_id);
+
+-- existing users get a personal workspace holding the pages they created
+INSERT INTO workspaces (name, created_by, is_personal)
+SELECT username || '''s workspace', id, true FROM users;
+
+INSERT INTO workspace_members (workspace_id, user_id, role)
+SELECT id, created_by, 'owner' FROM workspaces WHERE is_personal;
+
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE;
+
+UPDATE pages SET workspace_id = workspaces.id
+FROM workspaces
+WHERE workspaces.created_by = pages.created_by AND workspaces.is_personal;
+
+ALTER TABLE pages ALTER COLUMN workspace_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_pages_workspace_id ON pages (workspace_id);
+
+-- pages are ordered within their workspace now, created_by only records the author
+DROP INDEX IF EXISTS pages_created_by_position_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_pages_workspace_id_position ON pages (workspace_id, position);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS page_permissions (
+    page_id UUID NOT NULL REFERENCES pages(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    level VARCHAR(16) NOT NULL,
+    granted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (page_id, user_id),
+    CONSTRAINT page_permissions_level_check CHECK (level IN ('viewer', 'commenter', 'editor'))
+);
+
+COMMENT ON TABLE page_permissions IS 'Grants on a single page. A grant applies to the page and all of its descendants through pages_closures.';
+
+CREATE INDEX IF NOT EXISTS idx_page_permissions_user_id ON page_permissions (user_id);
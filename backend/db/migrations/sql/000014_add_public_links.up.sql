@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS public_links (
+    id SERIAL PRIMARY KEY,
+    page_id UUID NOT NULL REFERENCES pages(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    password_hash VARCHAR(255),
+    include_sub_pages BOOLEAN NOT NULL DEFAULT true,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON COLUMN public_links.token_hash IS 'Hex encoded sha256 of the token in the link, the token itself is only shown once when the link is created.';
+
+CREATE INDEX IF NOT EXISTS idx_public_links_page_id ON public_links (page_id);
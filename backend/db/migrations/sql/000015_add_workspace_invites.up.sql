@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS workspace_invites (
+    id SERIAL PRIMARY KEY,
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    accepted_at TIMESTAMP WITH TIME ZONE,
+    accepted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT workspace_invites_role_check CHECK (role IN ('owner', 'admin', 'member', 'guest'))
+);
+
+-- inviting the same email again replaces the pending invite
+CREATE UNIQUE INDEX IF NOT EXISTS idx_workspace_invites_pending ON workspace_invites (workspace_id, lower(email)) WHERE accepted_at IS NULL;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS page_links (
+    source_page_id UUID NOT NULL REFERENCES pages(id) ON DELETE CASCADE,
+    target_page_id UUID NOT NULL,
+    broken_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (source_page_id, target_page_id)
+);
+
+COMMENT ON TABLE page_links IS 'Links from the content of a page to other pages, kept in sync on every page update.';
+COMMENT ON COLUMN page_links.target_page_id IS 'Not a foreign key on purpose, a link outlives its target and is marked with broken_at instead.';
+
+CREATE INDEX IF NOT EXISTS idx_page_links_target_page_id ON page_links (target_page_id);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS page_events (
+    id BIGSERIAL PRIMARY KEY,
+    type VARCHAR(32) NOT NULL,
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    page_ids UUID[] NOT NULL DEFAULT '{}',
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE page_events IS 'Log of page lifecycle events. Ids are assigned in commit order so clients can resume from the last id they saw.';
+
+CREATE INDEX IF NOT EXISTS idx_page_events_workspace_id_id ON page_events (workspace_id, id);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS page_documents (
+    page_id UUID PRIMARY KEY REFERENCES pages(id) ON DELETE CASCADE,
+    state JSONB NOT NULL,
+    clock BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE page_documents IS 'Merged collaborative editing state of a page. pages.content and pages.text_content are rendered from it on every update.';
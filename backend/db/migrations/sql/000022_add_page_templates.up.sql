@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS page_templates (
+    page_id UUID PRIMARY KEY REFERENCES pages(id) ON DELETE CASCADE,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE page_templates IS 'Pages that are templates, new pages can be created from the page and its sub pages.';
@@ -0,0 +1,4 @@
+ALTER TABLE pages DROP COLUMN IF EXISTS last_edited_by;
+ALTER TABLE pages DROP COLUMN IF EXISTS properties;
+ALTER TABLE pages DROP COLUMN IF EXISTS cover;
+ALTER TABLE pages DROP COLUMN IF EXISTS icon;
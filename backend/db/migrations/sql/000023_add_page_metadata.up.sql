@@ -0,0 +1,10 @@
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS icon VARCHAR(255);
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS cover TEXT;
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS properties JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS last_edited_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+COMMENT ON COLUMN pages.icon IS 'An emoji or the url of an image shown next to the title.';
+COMMENT ON COLUMN pages.cover IS 'The url of the image shown above the page.';
+COMMENT ON COLUMN pages.properties IS 'Free-form metadata set by clients, always a JSON object.';
+
+UPDATE pages SET last_edited_by = created_by;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    page_id UUID NOT NULL REFERENCES pages(id) ON DELETE CASCADE,
+    uploaded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    storage_key TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_page_id ON attachments (page_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_uploaded_by ON attachments (uploaded_by);
+
+COMMENT ON TABLE attachments IS 'Files uploaded to pages, the content is in the blob store under storage_key.';
+COMMENT ON COLUMN attachments.size IS 'The size in bytes, counted against the uploader''s storage quota.';
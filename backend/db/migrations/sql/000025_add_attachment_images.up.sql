@@ -0,0 +1,6 @@
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS width INTEGER;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS height INTEGER;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnail_key TEXT UNIQUE;
+
+COMMENT ON COLUMN attachments.width IS 'The width in pixels of images, NULL for other files.';
+COMMENT ON COLUMN attachments.thumbnail_key IS 'Where the thumbnail of the image is in the blob store, NULL when it has none.';
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS page_databases (
+    page_id UUID PRIMARY KEY REFERENCES pages(id) ON DELETE CASCADE,
+    schema JSONB NOT NULL DEFAULT '[]',
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE page_databases IS 'Pages that are databases, their sub pages are the rows.';
+COMMENT ON COLUMN page_databases.schema IS 'The typed properties of the rows, whose values are in the properties of the sub pages.';
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN users.totp_last_step IS 'Time step of the last accepted TOTP code. Codes of this step or earlier ones are rejected so they cannot be replayed.';
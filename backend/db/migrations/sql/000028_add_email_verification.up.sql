@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE;
+
+COMMENT ON COLUMN users.email_verified_at IS 'When the user proved they receive mail at their email, by an identity provider, an unlock link or an invite. Null until then.';
+
+-- identity providers only link verified emails
+UPDATE users SET email_verified_at = CURRENT_TIMESTAMP WHERE id IN (SELECT user_id FROM user_identities);
@@ -0,0 +1,4 @@
+ALTER TABLE public_links ADD COLUMN IF NOT EXISTS failed_password_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE public_links ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE;
+
+COMMENT ON COLUMN public_links.locked_until IS 'Password attempts are refused until then, after repeated wrong passwords for the link.';
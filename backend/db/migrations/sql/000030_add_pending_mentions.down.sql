@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_page_mentions_pending;
+
+ALTER TABLE page_mentions
+    DROP COLUMN IF EXISTS notified_at,
+    DROP COLUMN IF EXISTS actor_id;
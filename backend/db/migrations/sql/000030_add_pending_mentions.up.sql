@@ -0,0 +1,20 @@
+ALTER TABLE page_mentions
+    ADD COLUMN IF NOT EXISTS actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS notified_at TIMESTAMP WITH TIME ZONE;
+
+-- mentions that already got a notification are delivered, the others wait until the user can view the page
+UPDATE page_mentions SET actor_id = notifications.actor_id, notified_at = notifications.created_at
+FROM notifications
+WHERE notifications.page_id = page_mentions.page_id
+AND notifications.user_id = page_mentions.user_id
+AND notifications.kind = 'mention';
+
+-- the others are credited to the author of the page, who is never notified of their own mentions
+UPDATE page_mentions SET actor_id = pages.created_by,
+    notified_at = CASE WHEN page_mentions.user_id = pages.created_by THEN page_mentions.created_at END
+FROM pages
+WHERE pages.id = page_mentions.page_id AND page_mentions.notified_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_page_mentions_pending ON page_mentions (user_id) WHERE notified_at IS NULL;
+
+COMMENT ON COLUMN page_mentions.notified_at IS 'When the mentioned user was notified, NULL while they cannot view the page yet.';
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS page_events_publish ON page_events;
+DROP FUNCTION IF EXISTS publish_page_event();
+ALTER TABLE page_events ALTER COLUMN id SET DEFAULT nextval('page_events_id_seq');
+DROP SEQUENCE IF EXISTS page_events_pending_id_seq;
+
+COMMENT ON TABLE page_events IS 'Log of page lifecycle events. Ids are assigned in commit order so clients can resume from the last id they saw.';
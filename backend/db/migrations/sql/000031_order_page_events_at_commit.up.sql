@@ -0,0 +1,37 @@
+-- events are inserted with a negative placeholder id and numbered as their transaction commits
+CREATE SEQUENCE IF NOT EXISTS page_events_pending_id_seq;
+ALTER TABLE page_events ALTER COLUMN id SET DEFAULT -nextval('page_events_pending_id_seq');
+
+-- numbers the event and sends it to every server instance. The lock is only taken at commit, once the
+-- transaction holds every other lock it needs, and is released when the commit is done, so ids follow
+-- commit order without serializing whole transactions. Events with many pages are split over several
+-- notifications sharing the id, notifications are limited to 8000 bytes.
+CREATE OR REPLACE FUNCTION publish_page_event() RETURNS trigger AS $$
+DECLARE
+    event_id BIGINT;
+    page_count INTEGER := cardinality(NEW.page_ids);
+    chunk_start INTEGER := 1;
+BEGIN
+    PERFORM pg_advisory_xact_lock(4242001);
+    event_id := nextval('page_events_id_seq');
+    UPDATE page_events SET id = event_id WHERE id = NEW.id;
+    LOOP
+        PERFORM pg_notify('page_events', jsonb_strip_nulls(jsonb_build_object(
+            'id', event_id,
+            'type', NEW.type,
+            'workspace_id', NEW.workspace_id,
+            'page_ids', CASE WHEN page_count > 0 THEN to_jsonb(NEW.page_ids[chunk_start:chunk_start + 99]) END,
+            'actor_id', NEW.actor_id
+        ))::text);
+        chunk_start := chunk_start + 100;
+        EXIT WHEN chunk_start > page_count;
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER page_events_publish AFTER INSERT ON page_events
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION publish_page_event();
+
+COMMENT ON TABLE page_events IS 'Log of page lifecycle events. Ids are assigned as transactions commit so clients can resume from the last id they saw.';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_page_documents_announce_pending;
+
+ALTER TABLE page_documents
+    DROP COLUMN IF EXISTS announce_pending,
+    DROP COLUMN IF EXISTS announced_at;
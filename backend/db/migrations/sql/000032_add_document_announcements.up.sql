@@ -0,0 +1,8 @@
+ALTER TABLE page_documents
+    ADD COLUMN IF NOT EXISTS announced_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS announce_pending BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_page_documents_announce_pending ON page_documents (announced_at) WHERE announce_pending;
+
+COMMENT ON COLUMN page_documents.announced_at IS 'When a page.updated event was last published for edits of the document, they are published at most once per interval.';
+COMMENT ON COLUMN page_documents.announce_pending IS 'Edits were made since announced_at without publishing an event, a background job publishes it once the interval is over.';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS access_changes;
+DROP TABLE IF EXISTS sync_sequences;
@@ -0,0 +1,20 @@
+-- the last sequence number given to a change of the user's access, the row is locked until the change
+-- commits so the changes of a user are numbered in commit order
+CREATE TABLE IF NOT EXISTS sync_sequences (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS access_changes (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE,
+    page_ids UUID[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, seq),
+    CONSTRAINT access_changes_type_check CHECK (type IN ('workspace.joined', 'workspace.left', 'page.shared', 'page.unshared'))
+);
+
+COMMENT ON TABLE access_changes IS 'Per user log of the workspaces joined and left and the pages shared and unshared, so sync can send or tombstone the pages that became visible or hidden.';
+COMMENT ON COLUMN access_changes.page_ids IS 'The shared page, or every page of the unshared subtree as it was when it was unshared.';
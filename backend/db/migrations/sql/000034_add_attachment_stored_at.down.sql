@@ -0,0 +1,2 @@
+DELETE FROM attachments WHERE stored_at IS NULL;
+ALTER TABLE attachments DROP COLUMN IF EXISTS stored_at;
@@ -0,0 +1,4 @@
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS stored_at TIMESTAMP WITH TIME ZONE;
+UPDATE attachments SET stored_at = created_at WHERE stored_at IS NULL;
+
+COMMENT ON COLUMN attachments.stored_at IS 'When the upload to the blob store finished. Until then the row only reserves the size in the uploader''s quota.';
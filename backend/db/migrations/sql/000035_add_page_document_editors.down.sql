@@ -0,0 +1 @@
+DROP TABLE IF EXISTS page_document_editors;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS page_document_editors (
+    page_id UUID NOT NULL REFERENCES pages(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL,
+    clock BIGINT NOT NULL,
+    seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (page_id, client_id)
+);
+
+COMMENT ON TABLE page_document_editors IS 'The clock each editor session based its last update of a document on, tombstones are compacted below the lowest clock of the recent editors.';
@@ -0,0 +1,624 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/media"
+	"go_notion/backend/storage"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AttachmentContentTypes are the types of files that can be uploaded.
+// Types browsers run, such as html and svg, are left out since attachments are served from the api's origin.
+var AttachmentContentTypes = map[string]bool{
+	"image/png":        true,
+	"image/jpeg":       true,
+	"image/gif":        true,
+	"image/webp":       true,
+	"application/pdf":  true,
+	"application/json": true,
+	"text/plain":       true,
+	"text/csv":         true,
+	"text/markdown":    true,
+}
+
+const (
+	AttachmentSizeOriginal = "original"
+	AttachmentSizeThumb    = "thumb"
+)
+
+// multipartOverhead is the room left in the request body for the multipart headers and boundaries
+const multipartOverhead = 1 << 20
+
+type AttachmentsHandler struct {
+	db     *pgxpool.Pool
+	blobs  storage.BlobStore
+	limits storage.Limits
+	signer *storage.URLSigner
+	// publicBasePath is the path of the group the public routes are registered on, download urls start with it
+	publicBasePath string
+}
+
+func NewAttachmentsHandler(db *pgxpool.Pool, blobs storage.BlobStore, limits storage.Limits, signer *storage.URLSigner) (*AttachmentsHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	if blobs == nil {
+		return nil, fmt.Errorf("blob store cannot be nil")
+	}
+	if limits.MaxFileSize <= 0 || limits.UserQuota <= 0 {
+		return nil, fmt.Errorf("storage limits must be positive")
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("url signer cannot be nil")
+	}
+	return &AttachmentsHandler{db: db, blobs: blobs, limits: limits, signer: signer}, nil
+}
+
+type Attachment struct {
+	ID          uuid.UUID `json:"id"`
+	PageID      uuid.UUID `json:"page_id"`
+	UploadedBy  *int64    `json:"uploaded_by"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	// Width and Height are the dimensions of images in pixels
+	Width     *int      `json:"width"`
+	Height    *int      `json:"height"`
+	CreatedAt time.Time `json:"created_at"`
+	// DownloadURL serves the file without an authorization header until it expires
+	DownloadURL string `json:"download_url"`
+	// ThumbnailURL serves the thumbnail the same way, only png, jpeg and gif images that aren't too large have one
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+
+	storageKey   string
+	thumbnailKey *string
+}
+
+// blobKeys are where the attachment's files are in the blob store
+func (a *Attachment) blobKeys() []string {
+	if a.thumbnailKey == nil {
+		return []string{a.storageKey}
+	}
+	return []string{a.storageKey, *a.thumbnailKey}
+}
+
+type AttachmentsResponse struct {
+	Attachments []Attachment `json:"attachments"`
+}
+
+type GetAttachmentParams struct {
+	// Size is the original file or the thumbnail of images, it defaults to the original
+	Size string `form:"size" binding:"omitempty,oneof=original thumb"`
+}
+
+type DownloadAttachmentParams struct {
+	Size      string `form:"size" binding:"omitempty,oneof=original thumb"`
+	Expires   int64  `form:"expires" binding:"required"`
+	Signature string `form:"signature" binding:"required"`
+}
+
+const attachmentColumns = `id, page_id, uploaded_by, file_name, content_type, size, width, height, created_at, storage_key, thumbnail_key`
+
+func scanAttachment(row pgx.Row, attachment *Attachment) error {
+	return row.Scan(&attachment.ID, &attachment.PageID, &attachment.UploadedBy, &attachment.FileName, &attachment.ContentType, &attachment.Size,
+		&attachment.Width, &attachment.Height, &attachment.CreatedAt, &attachment.storageKey, &attachment.thumbnailKey)
+}
+
+// UploadAttachment stores the multipart "file" field as an attachment of the page.
+// Its type is sniffed from its content, the location metadata of photos is stripped and images get a thumbnail.
+func (h *AttachmentsHandler) UploadAttachment(c *gin.Context) {
+	// the blob store gets the whole file within the request, which takes longer than a query
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to upload attachment")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.limits.MaxFileSize+multipartOverhead)
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.Error(api_error.NewPayloadTooLargeError(fmt.Sprintf("file must be at most %d bytes", h.limits.MaxFileSize), err))
+			return
+		}
+		c.Error(api_error.NewBadRequestError("file is required", err))
+		return
+	}
+	if fileHeader.Size > h.limits.MaxFileSize {
+		c.Error(api_error.NewPayloadTooLargeError(fmt.Sprintf("file must be at most %d bytes", h.limits.MaxFileSize), nil))
+		return
+	}
+
+	fileName := filepath.Base(strings.ReplaceAll(fileHeader.Filename, "\\", "/"))
+	if fileName == "." || fileName == "/" || len(fileName) > 255 {
+		c.Error(api_error.NewBadRequestError("invalid file name", nil))
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to upload attachment", err))
+		return
+	}
+	defer file.Close()
+	// the limit guards against a part larger than the header said, only images are read whole
+	limited := io.LimitReader(file, h.limits.MaxFileSize+1)
+	head := make([]byte, 512)
+	n, err := io.ReadFull(limited, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		c.Error(api_error.NewInternalServerError("failed to upload attachment", err))
+		return
+	}
+	head = head[:n]
+
+	contentType, apiErr := attachmentContentType(head, fileHeader.Header.Get("Content-Type"), fileName)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+	body := io.MultiReader(bytes.NewReader(head), limited)
+	size := fileHeader.Size
+
+	// images are stripped of their metadata and thumbnailed, which needs all of their content
+	var image *media.Image
+	if strings.HasPrefix(contentType, "image/") {
+		content, err := io.ReadAll(body)
+		if err != nil {
+			c.Error(api_error.NewInternalServerError("failed to upload attachment", err))
+			return
+		}
+		if int64(len(content)) > h.limits.MaxFileSize {
+			c.Error(api_error.NewPayloadTooLargeError(fmt.Sprintf("file must be at most %d bytes", h.limits.MaxFileSize), nil))
+			return
+		}
+		content, err = media.StripMetadata(contentType, content)
+		if err != nil {
+			c.Error(api_error.NewBadRequestError("file is not a valid image", err))
+			return
+		}
+		image, err = media.ProcessImage(contentType, content)
+		if errors.Is(err, media.ErrInvalidImage) {
+			c.Error(api_error.NewBadRequestError("file is not a valid image", err))
+			return
+		} else if err != nil {
+			c.Error(api_error.NewInternalServerError("failed to upload attachment", err))
+			return
+		}
+		body = bytes.NewReader(content)
+		size = int64(len(content))
+	}
+
+	attachmentID, err := uuid.NewV4()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to upload attachment", err))
+		return
+	}
+	var width, height *int
+	var thumbnailKey *string
+	if image != nil {
+		width, height = &image.Width, &image.Height
+		if image.Thumbnail != nil {
+			key := attachmentBlobKey(attachmentID, AttachmentSizeThumb)
+			thumbnailKey = &key
+		}
+	}
+	storageKey := attachmentBlobKey(attachmentID, AttachmentSizeOriginal)
+	blobKeys := []string{storageKey}
+	if thumbnailKey != nil {
+		blobKeys = append(blobKeys, *thumbnailKey)
+	}
+
+	// the size is reserved in the quota before the upload, which can take a while and is done outside of any transaction
+	if apiErr := h.reserveAttachment(ctx, attachmentID, pageID, userIdInt, fileName, contentType, size, width, height, storageKey, thumbnailKey); apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if err := h.blobs.Put(ctx, storageKey, body, size, contentType); err != nil {
+		h.discardAttachment(attachmentID, blobKeys[:1])
+		c.Error(api_error.NewInternalServerError("failed to store attachment", err))
+		return
+	}
+	if thumbnailKey != nil {
+		err := h.blobs.Put(ctx, *thumbnailKey, bytes.NewReader(image.Thumbnail), int64(len(image.Thumbnail)), media.ThumbnailContentType(contentType))
+		if err != nil {
+			h.discardAttachment(attachmentID, blobKeys)
+			c.Error(api_error.NewInternalServerError("failed to store attachment", err))
+			return
+		}
+	}
+
+	var attachment Attachment
+	err = scanAttachment(h.db.QueryRow(ctx, `
+		UPDATE attachments SET stored_at = CURRENT_TIMESTAMP WHERE id = $1 RETURNING `+attachmentColumns,
+		attachmentID), &attachment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// the page was deleted during the upload and the reservation with it
+		removeBlobs(h.blobs, blobKeys)
+		c.Error(api_error.NewNotFoundError("page not found", nil))
+		return
+	} else if err != nil {
+		h.discardAttachment(attachmentID, blobKeys)
+		c.Error(api_error.NewInternalServerError("failed to upload attachment", err))
+		return
+	}
+
+	h.signURLs(&attachment)
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// attachmentReservationTimeout is how long an upload can take, past it a reservation no longer counts
+// against the quota and is removed by the next upload of the user
+const attachmentReservationTimeout = time.Hour
+
+// reserveAttachment inserts the row of an attachment that is about to be uploaded, its size counts against the
+// uploader's quota from then on. The user row is only locked for this short transaction, so concurrent uploads
+// can't both fit in what is left of the quota without holding up other writes to the user during the upload.
+func (h *AttachmentsHandler) reserveAttachment(ctx context.Context, attachmentID, pageID uuid.UUID, userID int64, fileName, contentType string, size int64, width, height *int, storageKey string, thumbnailKey *string) *api_error.ApiError {
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return api_error.NewInternalServerError("failed to upload attachment", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := access.AuthorizePage(ctx, tx, pageID, userID, access.ActionEdit); err != nil {
+		return accessError(err, "page not found")
+	}
+
+	var used int64
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE((
+			SELECT SUM(size) FROM attachments
+			WHERE uploaded_by = users.id AND (stored_at IS NOT NULL OR created_at > CURRENT_TIMESTAMP - $2::interval)
+		), 0)
+		FROM users WHERE id = $1 FOR UPDATE
+	`, userID, attachmentReservationTimeout).Scan(&used)
+	if err != nil {
+		return api_error.NewInternalServerError("failed to upload attachment", err)
+	}
+	if used+size > h.limits.UserQuota {
+		return api_error.NewPayloadTooLargeError(fmt.Sprintf("storage quota of %d bytes exceeded", h.limits.UserQuota), nil)
+	}
+
+	// uploads that never finished, their blobs may have been partly stored
+	rows, err := tx.Query(ctx, `
+		DELETE FROM attachments
+		WHERE uploaded_by = $1 AND stored_at IS NULL AND created_at <= CURRENT_TIMESTAMP - $2::interval
+		RETURNING storage_key, thumbnail_key
+	`, userID, attachmentReservationTimeout)
+	if err != nil {
+		return api_error.NewInternalServerError("failed to upload attachment", err)
+	}
+	var abandonedKeys []string
+	var abandonedKey string
+	var abandonedThumbnailKey *string
+	_, err = pgx.ForEachRow(rows, []any{&abandonedKey, &abandonedThumbnailKey}, func() error {
+		abandonedKeys = append(abandonedKeys, abandonedKey)
+		if abandonedThumbnailKey != nil {
+			abandonedKeys = append(abandonedKeys, *abandonedThumbnailKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return api_error.NewInternalServerError("failed to upload attachment", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO attachments (id, page_id, uploaded_by, file_name, content_type, size, width, height, storage_key, thumbnail_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, attachmentID, pageID, userID, fileName, contentType, size, width, height, storageKey, thumbnailKey)
+	if err != nil {
+		return api_error.NewInternalServerError("failed to upload attachment", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return api_error.NewInternalServerError("failed to upload attachment", err)
+	}
+	removeBlobs(h.blobs, abandonedKeys)
+	return nil
+}
+
+// discardAttachment releases the reservation of an upload that failed and removes what was stored of it
+func (h *AttachmentsHandler) discardAttachment(attachmentID uuid.UUID, storageKeys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := h.db.Exec(ctx, `DELETE FROM attachments WHERE id = $1 AND stored_at IS NULL`, attachmentID); err != nil {
+		log.Printf("failed to discard attachment %s: %v", attachmentID, err)
+	}
+	removeBlobs(h.blobs, storageKeys)
+}
+
+// GetAttachments lists the attachments of the page
+func (h *AttachmentsHandler) GetAttachments(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get attachments")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT `+attachmentColumns+` FROM attachments WHERE page_id = $1 AND stored_at IS NOT NULL ORDER BY created_at, id
+	`, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get attachments", err))
+		return
+	}
+	attachments, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Attachment, error) {
+		var attachment Attachment
+		err := scanAttachment(row, &attachment)
+		h.signURLs(&attachment)
+		return attachment, err
+	})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get attachments", err))
+		return
+	}
+	if attachments == nil {
+		attachments = []Attachment{}
+	}
+
+	c.JSON(http.StatusOK, AttachmentsResponse{Attachments: attachments})
+}
+
+// GetAttachment serves the file, or the thumbnail of images, to users who can view its page
+func (h *AttachmentsHandler) GetAttachment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get attachment")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	attachmentID, apiErr := uuidFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var params GetAttachmentParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	attachment, apiErr := h.getAttachment(ctx, attachmentID)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+	if _, err := access.AuthorizePage(ctx, h.db, attachment.PageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "attachment not found"))
+		return
+	}
+
+	h.serveBlob(c, attachment, params.Size)
+}
+
+// DownloadAttachment serves the file to anyone with a download url that hasn't expired
+func (h *AttachmentsHandler) DownloadAttachment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	attachmentID, apiErr := uuidFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var params DownloadAttachmentParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	if !h.signer.Verify(attachmentResource(attachmentID), params.Expires, params.Signature, time.Now()) {
+		c.Error(api_error.NewForbiddenError("download url is invalid or expired", nil))
+		return
+	}
+
+	attachment, apiErr := h.getAttachment(ctx, attachmentID)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	h.serveBlob(c, attachment, params.Size)
+}
+
+// DeleteAttachment lets the uploader, or users who can manage the page, delete an attachment
+func (h *AttachmentsHandler) DeleteAttachment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to delete attachment")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	attachmentID, apiErr := uuidFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	attachment, apiErr := h.getAttachment(ctx, attachmentID)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	action := access.ActionManage
+	if attachment.UploadedBy != nil && *attachment.UploadedBy == userIdInt {
+		action = access.ActionEdit
+	}
+	if _, err := access.AuthorizePage(ctx, h.db, attachment.PageID, userIdInt, action); err != nil {
+		c.Error(accessError(err, "attachment not found"))
+		return
+	}
+
+	cmd, err := h.db.Exec(ctx, `DELETE FROM attachments WHERE id = $1`, attachmentID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete attachment", err))
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewNotFoundError("attachment not found", nil))
+		return
+	}
+	removeBlobs(h.blobs, attachment.blobKeys())
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *AttachmentsHandler) getAttachment(ctx context.Context, attachmentID uuid.UUID) (*Attachment, *api_error.ApiError) {
+	var attachment Attachment
+	err := scanAttachment(h.db.QueryRow(ctx, `
+		SELECT `+attachmentColumns+` FROM attachments WHERE id = $1 AND stored_at IS NOT NULL
+	`, attachmentID), &attachment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, api_error.NewNotFoundError("attachment not found", nil)
+	} else if err != nil {
+		return nil, api_error.NewInternalServerError("failed to get attachment", err)
+	}
+	return &attachment, nil
+}
+
+func (h *AttachmentsHandler) serveBlob(c *gin.Context, attachment *Attachment, size string) {
+	key, contentType, length := attachment.storageKey, attachment.ContentType, attachment.Size
+	if size == AttachmentSizeThumb {
+		if attachment.thumbnailKey == nil {
+			c.Error(api_error.NewNotFoundError("attachment has no thumbnail", nil))
+			return
+		}
+		// the thumbnail's length isn't stored, it is sent without a content length
+		key, contentType, length = *attachment.thumbnailKey, media.ThumbnailContentType(attachment.ContentType), -1
+	}
+
+	// the blob is streamed with the request's context, the query timeout would cut off large files
+	blob, err := h.blobs.Get(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.Error(api_error.NewNotFoundError("attachment not found", err))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get attachment", err))
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") || attachment.ContentType == "application/pdf" {
+		disposition = "inline"
+	}
+	c.DataFromReader(http.StatusOK, length, contentType, blob, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=3600",
+	})
+}
+
+// signURLs sets the download urls of the attachment, the signature covers the original and the thumbnail
+func (h *AttachmentsHandler) signURLs(attachment *Attachment) {
+	expires, signature := h.signer.Sign(attachmentResource(attachment.ID), time.Now())
+	query := url.Values{"expires": {strconv.FormatInt(expires, 10)}, "signature": {signature}}
+	attachment.DownloadURL = h.publicBasePath + "/attachments/" + attachment.ID.String() + "/download?" + query.Encode()
+	if attachment.thumbnailKey != nil {
+		query.Set("size", AttachmentSizeThumb)
+		attachment.ThumbnailURL = h.publicBasePath + "/attachments/" + attachment.ID.String() + "/download?" + query.Encode()
+	}
+}
+
+// attachmentContentType sniffs the type of the file from its content. The type the client sent,
+// or the one of the file's extension, only tells text formats apart.
+func attachmentContentType(content []byte, declared, fileName string) (string, *api_error.ApiError) {
+	if declared == "" || declared == "application/octet-stream" {
+		declared = mime.TypeByExtension(filepath.Ext(fileName))
+	}
+	contentType := media.SniffContentType(content, declared)
+	if !AttachmentContentTypes[contentType] {
+		return "", api_error.NewUnsupportedMediaTypeError("file type is not allowed", nil)
+	}
+	return contentType, nil
+}
+
+// attachmentBlobKey is where the original file or the thumbnail of the attachment is stored
+func attachmentBlobKey(attachmentID uuid.UUID, size string) string {
+	return "attachments/" + attachmentID.String() + "/" + size
+}
+
+// attachmentResource is what download urls are signed for
+func attachmentResource(attachmentID uuid.UUID) string {
+	return "attachments/" + attachmentID.String()
+}
+
+// removeBlobs deletes the blobs of attachments whose rows are gone. It runs after the commit so a rollback
+// can't leave rows without blobs, a failure only leaves an orphaned blob behind so it is logged rather than returned.
+func removeBlobs(blobs storage.BlobStore, storageKeys []string) {
+	if len(storageKeys) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range storageKeys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			log.Printf("failed to remove blob %s: %v", key, err)
+		}
+	}
+}
+
+// RegisterRoutes registers the routes for uploading and managing attachments, they require authentication
+func (h *AttachmentsHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/pages/:id/attachments", h.UploadAttachment)
+	router.GET("/pages/:id/attachments", h.GetAttachments)
+	router.GET("/attachments/:id", h.GetAttachment)
+	router.DELETE("/attachments/:id", h.DeleteAttachment)
+}
+
+// RegisterPublicRoutes registers the route that serves download urls, it must be outside the authenticated group
+func (h *AttachmentsHandler) RegisterPublicRoutes(router *gin.RouterGroup) {
+	h.publicBasePath = strings.TrimSuffix(router.BasePath(), "/")
+	router.GET("/attachments/:id/download", h.DownloadAttachment)
+}
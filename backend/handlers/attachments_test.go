@@ -0,0 +1,288 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"go_notion/backend/storage"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachments(t *testing.T) {
+	pageId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("stranger@example.com", "stranger", "password"),
+		db.InsertTestPageFixtureWithParent(childId, pageId, 1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	blobs := mocks.NewBlobStoreMock()
+	signer, err := storage.NewURLSigner([]byte(strings.Repeat("s", 32)), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachments, err := handlers.NewAttachmentsHandler(pool, blobs, storage.Limits{MaxFileSize: 1 << 20, UserQuota: 1 << 21}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// limited shares the attachments, the user has less than 16 bytes left with it once a file is uploaded
+	limited, err := handlers.NewAttachmentsHandler(pool, blobs, storage.Limits{MaxFileSize: 16, UserQuota: 20}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletePage, err := handlers.NewDeletePageHandler(pool, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveWith := func(attachments *handlers.AttachmentsHandler, userID int64, method, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return serveRequest(req, userID, attachments, deletePage)
+	}
+	serve := func(userID int64, method, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		return serveWith(attachments, userID, method, path, body, contentType)
+	}
+	uploadWith := func(attachments *handlers.AttachmentsHandler, userID int64, pageID uuid.UUID, fileName, fileType, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+fileName+`"`)
+		if fileType != "" {
+			header.Set("Content-Type", fileType)
+		}
+		part, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+		form.Close()
+		return serveWith(attachments, userID, "POST", "/api/pages/"+pageID.String()+"/attachments", &body, form.FormDataContentType())
+	}
+	upload := func(userID int64, pageID uuid.UUID, fileName, fileType, content string) *httptest.ResponseRecorder {
+		return uploadWith(attachments, userID, pageID, fileName, fileType, content)
+	}
+	decode := func(w *httptest.ResponseRecorder) handlers.Attachment {
+		var attachment handlers.Attachment
+		if err := json.Unmarshal(w.Body.Bytes(), &attachment); err != nil {
+			t.Fatal(err)
+		}
+		return attachment
+	}
+
+	var attachment handlers.Attachment
+	t.Run("uploads a file", func(t *testing.T) {
+		w := upload(1, pageId, "notes.txt", "text/plain; charset=utf-8", "hello")
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		attachment = decode(w)
+		assert.Equal(t, pageId, attachment.PageID)
+		assert.Equal(t, "notes.txt", attachment.FileName)
+		assert.Equal(t, "text/plain", attachment.ContentType)
+		assert.Equal(t, int64(5), attachment.Size)
+		assert.Nil(t, attachment.Width)
+		assert.Empty(t, attachment.ThumbnailURL)
+		assert.True(t, strings.HasPrefix(attachment.DownloadURL, "/api/attachments/"+attachment.ID.String()+"/download?"))
+		assert.True(t, blobs.Has("attachments/"+attachment.ID.String()+"/original"))
+	})
+
+	t.Run("lists and serves attachments to viewers", func(t *testing.T) {
+		w := serve(1, "GET", "/api/pages/"+pageId.String()+"/attachments", nil, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response handlers.AttachmentsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, response.Attachments, 1) {
+			assert.Equal(t, attachment.ID, response.Attachments[0].ID)
+		}
+
+		w = serve(1, "GET", "/api/attachments/"+attachment.ID.String(), nil, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello", w.Body.String())
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "notes.txt")
+
+		w = serve(2, "GET", "/api/attachments/"+attachment.ID.String(), nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = serve(2, "GET", "/api/pages/"+pageId.String()+"/attachments", nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("serves download urls until they expire", func(t *testing.T) {
+		w := serve(2, "GET", attachment.DownloadURL, nil, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello", w.Body.String())
+
+		tampered := strings.Replace(attachment.DownloadURL, "signature=", "signature=0", 1)
+		w = serve(2, "GET", tampered, nil, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		expires, signature := signer.Sign("attachments/"+attachment.ID.String(), time.Now().Add(-2*time.Hour))
+		w = serve(2, "GET", "/api/attachments/"+attachment.ID.String()+"/download?expires="+strconv.FormatInt(expires, 10)+"&signature="+signature, nil, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("enforces limits", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			userID   int64
+			fileName string
+			fileType string
+			content  string
+			code     int
+		}{
+			{"file too large", 1, "big.txt", "text/plain", strings.Repeat("a", 17), http.StatusRequestEntityTooLarge},
+			{"type not allowed", 1, "page.html", "text/html", "<p></p>", http.StatusUnsupportedMediaType},
+			{"type from extension not allowed", 1, "run.exe", "", "MZ", http.StatusUnsupportedMediaType},
+			{"not an editor", 2, "notes.txt", "text/plain", "hello", http.StatusNotFound},
+			{"quota exceeded", 1, "notes.txt", "text/plain", strings.Repeat("a", 16), http.StatusRequestEntityTooLarge},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := uploadWith(limited, tt.userID, pageId, tt.fileName, tt.fileType, tt.content)
+				assert.Equal(t, tt.code, w.Code, w.Body.String())
+			})
+		}
+
+		w := serve(1, "POST", "/api/pages/"+pageId.String()+"/attachments", strings.NewReader("{}"), "application/json")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = upload(1, pageId, "photo.jpg", "image/jpeg", "\xFF\xD8\xFF\xE0 not a jpeg")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("counts uploads in progress against the quota", func(t *testing.T) {
+		pendingId := uuid.Must(uuid.NewV4())
+		_, err := pool.Exec(context.Background(), `
+			INSERT INTO attachments (id, page_id, uploaded_by, file_name, content_type, size, storage_key)
+			VALUES ($1, $2, 1, 'pending.txt', 'text/plain', $3, $4)
+		`, pendingId, pageId, 1<<21, "attachments/"+pendingId.String()+"/original")
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs.Put(context.Background(), "attachments/"+pendingId.String()+"/original", strings.NewReader("partial"), 7, "text/plain")
+
+		w := upload(1, pageId, "notes.txt", "text/plain", "hello")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+		w = serve(1, "GET", "/api/attachments/"+pendingId.String(), nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		// an upload that never finished stops counting and is cleaned up
+		_, err = pool.Exec(context.Background(), `UPDATE attachments SET created_at = created_at - INTERVAL '2 hours' WHERE id = $1`, pendingId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = upload(1, pageId, "notes.txt", "text/plain", "hello")
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var exists bool
+		if err := pool.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM attachments WHERE id = $1)`, pendingId).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, exists)
+		assert.False(t, blobs.Has("attachments/"+pendingId.String()+"/original"))
+	})
+
+	t.Run("sniffs images and makes thumbnails", func(t *testing.T) {
+		var content bytes.Buffer
+		if err := png.Encode(&content, image.NewNRGBA(image.Rect(0, 0, 600, 300))); err != nil {
+			t.Fatal(err)
+		}
+		// the type and the name the client sent are ignored for images
+		w := upload(1, pageId, "photo.txt", "text/plain", content.String())
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		photo := decode(w)
+		assert.Equal(t, "image/png", photo.ContentType)
+		if assert.NotNil(t, photo.Width) && assert.NotNil(t, photo.Height) {
+			assert.Equal(t, 600, *photo.Width)
+			assert.Equal(t, 300, *photo.Height)
+		}
+		assert.True(t, blobs.Has("attachments/"+photo.ID.String()+"/thumb"))
+
+		w = serve(1, "GET", "/api/attachments/"+photo.ID.String()+"?size=thumb", nil, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+		thumbnail, err := png.DecodeConfig(w.Body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 256, thumbnail.Width)
+			assert.Equal(t, 128, thumbnail.Height)
+		}
+
+		w = serve(2, "GET", photo.ThumbnailURL, nil, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = serve(1, "GET", "/api/attachments/"+attachment.ID.String()+"?size=thumb", nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = serve(1, "GET", "/api/attachments/"+attachment.ID.String()+"?size=huge", nil, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("strips exif from photos", func(t *testing.T) {
+		var content bytes.Buffer
+		if err := jpeg.Encode(&content, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+			t.Fatal(err)
+		}
+		withExif := "\xFF\xD8\xFF\xE1\x00\x0EExif\x00\x00GPS!!!" + content.String()[2:]
+
+		w := upload(1, pageId, "photo.jpg", "image/jpeg", withExif)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		photo := decode(w)
+		assert.Equal(t, int64(content.Len()), photo.Size)
+
+		w = serve(1, "GET", "/api/attachments/"+photo.ID.String(), nil, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "GPS")
+	})
+
+	t.Run("deletes attachments", func(t *testing.T) {
+		w := serve(2, "DELETE", "/api/attachments/"+attachment.ID.String(), nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = serve(1, "DELETE", "/api/attachments/"+attachment.ID.String(), nil, "")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.False(t, blobs.Has("attachments/"+attachment.ID.String()+"/original"))
+
+		w = serve(1, "GET", "/api/attachments/"+attachment.ID.String(), nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("removes the blobs of deleted pages", func(t *testing.T) {
+		w := upload(1, childId, "child.csv", "text/csv", "a,b")
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		childAttachment := decode(w)
+
+		w = serve(1, "DELETE", "/api/pages/"+pageId.String(), nil, "")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.False(t, blobs.Has("attachments/"+childAttachment.ID.String()+"/original"))
+
+		var remaining int
+		if err := pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM attachments`).Scan(&remaining); err != nil {
+			t.Fatal(err)
+		}
+		assert.Zero(t, remaining)
+	})
+}
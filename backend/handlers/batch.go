@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go_notion/backend/api_error"
+	"go_notion/backend/page"
+	"go_notion/backend/storage"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	BatchOpCreate    = "create"
+	BatchOpUpdate    = "update"
+	BatchOpMove      = "move"
+	BatchOpDelete    = "delete"
+	BatchOpDuplicate = "duplicate"
+)
+
+// BatchHandler runs several page operations in one transaction, reusing the single page handlers
+type BatchHandler struct {
+	db        *pgxpool.Pool
+	create    *CreatePageHandler
+	update    *UpdatePageHandler
+	reorder   *ReorderPageHandler
+	delete    *DeletePageHandler
+	duplicate *DuplicatePageHandler
+}
+
+func NewBatchHandler(db *pgxpool.Pool, pageConfig *page.PageConfig, blobs storage.BlobStore) (*BatchHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	if pageConfig == nil {
+		return nil, fmt.Errorf("page config cannot be nil")
+	}
+	if blobs == nil {
+		return nil, fmt.Errorf("blob store cannot be nil")
+	}
+	return &BatchHandler{
+		db:        db,
+		create:    &CreatePageHandler{db, pageConfig},
+		update:    &UpdatePageHandler{db: db},
+		reorder:   &ReorderPageHandler{db: db},
+		delete:    &DeletePageHandler{db, blobs},
+		duplicate: &DuplicatePageHandler{db, pageConfig},
+	}, nil
+}
+
+type BatchOperation struct {
+	Op string `json:"op" binding:"required,oneof=create update move delete duplicate"`
+	// PageID is the page the operation applies to, every operation except create needs it
+	PageID *uuid.UUID `json:"page_id"`
+	// Input is the body the single page endpoint for the operation takes
+	Input json.RawMessage `json:"input"`
+}
+
+type BatchInput struct {
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,max=100,dive"`
+}
+
+type BatchResult struct {
+	Op string `json:"op"`
+	// PageID is the page the operation applied to, or the new page for create and duplicate
+	PageID uuid.UUID `json:"page_id"`
+}
+
+// Batch applies the operations in order, the first failing operation rolls back all of them
+func (h *BatchHandler) Batch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	userID, apiErr := contextUserID(c, "not authorized to update pages")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input BatchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to run batch", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	results := make([]BatchResult, 0, len(input.Operations))
+	// the blobs of deleted attachments can't be rolled back, they are removed after the commit
+	var storageKeys []string
+	for i, op := range input.Operations {
+		pageID, keys, apiErr := h.apply(ctx, tx, userID, op)
+		if apiErr != nil {
+			c.Error(&api_error.ApiError{Message: fmt.Sprintf("operation %d failed: %s", i, apiErr.Message), Code: apiErr.Code, Err: apiErr.Err})
+			return
+		}
+		results = append(results, BatchResult{Op: op.Op, PageID: pageID})
+		storageKeys = append(storageKeys, keys...)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to run batch", err))
+		return
+	}
+	removeBlobs(h.delete.blobs, storageKeys)
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// apply runs the operation and returns the page it applied to, along with the storage keys of the attachments it deleted
+func (h *BatchHandler) apply(ctx context.Context, tx pgx.Tx, userID int64, op BatchOperation) (uuid.UUID, []string, *api_error.ApiError) {
+	if op.Op == BatchOpCreate {
+		var input CreatePageInput
+		if apiErr := bindBatchInput(op.Input, &input); apiErr != nil {
+			return uuid.Nil, nil, apiErr
+		}
+		// creates with a client id share the idempotency keys of the create endpoint, a retried batch gets the
+		// page it created the first time instead of a conflict on the id
+		if input.ID != nil {
+			response, apiErr := claimIdempotencyKey(ctx, tx, userID, idempotencyScopeCreatePage, input.ID.String(), input, 0)
+			if apiErr != nil {
+				return uuid.Nil, nil, apiErr
+			}
+			if response != nil {
+				var created struct {
+					PageID uuid.UUID `json:"page_id"`
+				}
+				if err := json.Unmarshal(response, &created); err != nil {
+					return uuid.Nil, nil, api_error.NewInternalServerError("failed to create page", err)
+				}
+				return created.PageID, nil, nil
+			}
+		}
+		pageID, apiErr := h.create.createPageInTx(ctx, tx, userID, input)
+		if apiErr != nil {
+			return uuid.Nil, nil, apiErr
+		}
+		if input.ID != nil {
+			if err := storeIdempotentResponse(ctx, tx, userID, idempotencyScopeCreatePage, input.ID.String(), gin.H{"page_id": pageID}); err != nil {
+				return uuid.Nil, nil, api_error.NewInternalServerError("failed to create page", err)
+			}
+		}
+		return pageID, nil, nil
+	}
+
+	if op.PageID == nil {
+		return uuid.Nil, nil, api_error.NewBadRequestError("page_id is required", nil)
+	}
+	pageID := *op.PageID
+
+	switch op.Op {
+	case BatchOpUpdate:
+		var input UpdatePageInput
+		if apiErr := bindBatchInput(op.Input, &input); apiErr != nil {
+			return uuid.Nil, nil, apiErr
+		}
+		return pageID, nil, h.update.updatePageInTx(ctx, tx, userID, pageID, input)
+	case BatchOpMove:
+		var input ReorderPageInput
+		if apiErr := bindBatchInput(op.Input, &input); apiErr != nil {
+			return uuid.Nil, nil, apiErr
+		}
+		return pageID, nil, h.reorder.reorderPageInTx(ctx, tx, userID, pageID, input)
+	case BatchOpDelete:
+		storageKeys, apiErr := h.delete.deletePageInTx(ctx, tx, userID, pageID)
+		return pageID, storageKeys, apiErr
+	case BatchOpDuplicate:
+		var input DuplicatePageInput
+		if apiErr := bindBatchInput(op.Input, &input); apiErr != nil {
+			return uuid.Nil, nil, apiErr
+		}
+		duplicated, apiErr := h.duplicate.duplicatePageInTx(ctx, tx, userID, pageID, input)
+		if apiErr != nil {
+			return uuid.Nil, nil, apiErr
+		}
+		return duplicated.ID, nil, nil
+	default:
+		return uuid.Nil, nil, api_error.NewBadRequestError(fmt.Sprintf("unknown operation %q", op.Op), nil)
+	}
+}
+
+// bindBatchInput decodes and validates an operation's input the way gin binds a request body
+func bindBatchInput(raw json.RawMessage, obj any) *api_error.ApiError {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return api_error.NewBadRequestError(err.Error(), err)
+	}
+	if err := binding.Validator.ValidateStruct(obj); err != nil {
+		return api_error.NewBadRequestError(err.Error(), err)
+	}
+	return nil
+}
+
+func (h *BatchHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/pages/batch", h.Batch)
+}
@@ -0,0 +1,148 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"go_notion/backend/page"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	otherId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("stranger@example.com", "stranger", "password"),
+		db.InsertTestPageFixtureWithParent(childId, parentId, 1),
+		db.InsertTestPageFixtureWithPosition(otherId, 1, 3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	batch, err := handlers.NewBatchHandler(pool, page.NewPageConfig(10), mocks.NewBlobStoreMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveAs := newServe(batch)
+	serve := func(userID int64, body string) *httptest.ResponseRecorder {
+		return serveAs(userID, "POST", "/api/pages/batch", body)
+	}
+	pageExists := func(id uuid.UUID) bool {
+		var exists bool
+		err := pool.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM pages WHERE id = $1)`, id).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	t.Run("applies all operations in order", func(t *testing.T) {
+		newId := uuid.Must(uuid.NewV4())
+		w := serve(1, `{"operations": [
+			{"op": "create", "input": {"id": "`+newId.String()+`", "parent_id": "`+parentId.String()+`"}},
+			{"op": "update", "page_id": "`+newId.String()+`", "input": {"title_text": "batched", "content_text": "", "raw_title": {}, "raw_content": {}}},
+			{"op": "move", "page_id": "`+childId.String()+`", "input": {"new_parent_id": "`+otherId.String()+`"}},
+			{"op": "duplicate", "page_id": "`+otherId.String()+`"}
+		]}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response struct {
+			Results []handlers.BatchResult `json:"results"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, response.Results, 4) {
+			assert.Equal(t, newId, response.Results[0].PageID)
+			assert.Equal(t, newId, response.Results[1].PageID)
+			assert.Equal(t, childId, response.Results[2].PageID)
+			assert.NotEqual(t, otherId, response.Results[3].PageID)
+			assert.True(t, pageExists(response.Results[3].PageID))
+		}
+
+		var title string
+		err := pool.QueryRow(context.Background(), `SELECT text_title FROM pages WHERE id = $1`, newId).Scan(&title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "batched", title)
+
+		var parent uuid.UUID
+		err = pool.QueryRow(context.Background(), `SELECT ancestor_id FROM pages_closures WHERE descendant_id = $1 AND is_parent`, childId).Scan(&parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, otherId, parent)
+	})
+
+	t.Run("a retried batch gets the pages it already created", func(t *testing.T) {
+		newId := uuid.Must(uuid.NewV4())
+		body := `{"operations": [
+			{"op": "create", "input": {"id": "` + newId.String() + `"}},
+			{"op": "update", "page_id": "` + newId.String() + `", "input": {"title_text": "retried", "content_text": "", "raw_title": {}, "raw_content": {}}}
+		]}`
+		first := serve(1, body)
+		assert.Equal(t, http.StatusOK, first.Code, first.Body.String())
+		retry := serve(1, body)
+		assert.Equal(t, http.StatusOK, retry.Code, retry.Body.String())
+		assert.JSONEq(t, first.Body.String(), retry.Body.String())
+
+		var count int
+		err := pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM pages WHERE id = $1`, newId).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, count)
+
+		// the id is still taken for another request
+		w := serve(1, `{"operations": [{"op": "create", "input": {"id": "`+newId.String()+`", "title_text": "other"}}]}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("rolls back everything when an operation fails", func(t *testing.T) {
+		newId := uuid.Must(uuid.NewV4())
+		w := serve(1, `{"operations": [
+			{"op": "create", "input": {"id": "`+newId.String()+`"}},
+			{"op": "delete", "page_id": "`+uuid.Must(uuid.NewV4()).String()+`"}
+		]}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "operation 1 failed")
+		assert.False(t, pageExists(newId))
+	})
+
+	t.Run("rolls back when the user may not change a page", func(t *testing.T) {
+		w := serve(2, `{"operations": [{"op": "delete", "page_id": "`+otherId.String()+`"}]}`)
+		assert.NotEqual(t, http.StatusOK, w.Code)
+		assert.True(t, pageExists(otherId))
+	})
+
+	t.Run("rejects invalid operations", func(t *testing.T) {
+		tests := []struct {
+			name string
+			body string
+		}{
+			{"no operations", `{"operations": []}`},
+			{"unknown operation", `{"operations": [{"op": "archive", "page_id": "` + otherId.String() + `"}]}`},
+			{"missing page id", `{"operations": [{"op": "delete"}]}`},
+			{"invalid input", `{"operations": [{"op": "move", "page_id": "` + childId.String() + `", "input": {}}]}`},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := serve(1, tt.body)
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+			})
+		}
+	})
+}
@@ -0,0 +1,501 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type CommentsHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewCommentsHandler(db *pgxpool.Pool) (*CommentsHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &CommentsHandler{db}, nil
+}
+
+type Comment struct {
+	ID             uuid.UUID  `json:"id"`
+	ThreadID       uuid.UUID  `json:"thread_id"`
+	AuthorID       *int64     `json:"author_id"`
+	AuthorUsername *string    `json:"author_username"`
+	Body           string     `json:"body"`
+	CreatedAt      time.Time  `json:"created_at"`
+	EditedAt       *time.Time `json:"edited_at"`
+}
+
+type CommentThread struct {
+	ID         uuid.UUID  `json:"id"`
+	PageID     uuid.UUID  `json:"page_id"`
+	BlockID    *string    `json:"block_id"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	ResolvedBy *int64     `json:"resolved_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Comments   []Comment  `json:"comments"`
+}
+
+type CommentThreadsResponse struct {
+	Threads []CommentThread `json:"threads"`
+}
+
+type GetCommentsQuery struct {
+	IncludeResolved bool `form:"include_resolved"`
+}
+
+func (h *CommentsHandler) GetComments(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get comments")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var query GetCommentsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	threads, err := h.getThreads(ctx, pageID, query.IncludeResolved)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get comments", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, CommentThreadsResponse{Threads: threads})
+}
+
+func (h *CommentsHandler) getThreads(ctx context.Context, pageID uuid.UUID, includeResolved bool) ([]CommentThread, error) {
+	rows, err := h.db.Query(ctx, `
+		SELECT id, page_id, block_id, resolved_at, resolved_by, created_at FROM comment_threads
+		WHERE page_id = $1 AND ($2 OR resolved_at IS NULL)
+		ORDER BY created_at
+	`, pageID, includeResolved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get comment threads: %w", err)
+	}
+	defer rows.Close()
+
+	threads := []CommentThread{}
+	threadIndex := make(map[uuid.UUID]int)
+	threadIDs := []uuid.UUID{}
+	for rows.Next() {
+		thread := CommentThread{Comments: []Comment{}}
+		if err := rows.Scan(&thread.ID, &thread.PageID, &thread.BlockID, &thread.ResolvedAt, &thread.ResolvedBy, &thread.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan comment thread: %w", err)
+		}
+		threadIndex[thread.ID] = len(threads)
+		threadIDs = append(threadIDs, thread.ID)
+		threads = append(threads, thread)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get comment threads: %w", err)
+	}
+	if len(threads) == 0 {
+		return threads, nil
+	}
+
+	commentRows, err := h.db.Query(ctx, `
+		SELECT comments.id, comments.thread_id, comments.author_id, users.username, comments.body, comments.created_at, comments.edited_at
+		FROM comments
+		LEFT JOIN users ON users.id = comments.author_id
+		WHERE comments.thread_id = ANY($1)
+		ORDER BY comments.created_at
+	`, threadIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get comments: %w", err)
+	}
+	defer commentRows.Close()
+
+	for commentRows.Next() {
+		var comment Comment
+		if err := commentRows.Scan(&comment.ID, &comment.ThreadID, &comment.AuthorID, &comment.AuthorUsername, &comment.Body, &comment.CreatedAt, &comment.EditedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan comment: %w", err)
+		}
+		i := threadIndex[comment.ThreadID]
+		threads[i].Comments = append(threads[i].Comments, comment)
+	}
+	if err := commentRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get comments: %w", err)
+	}
+
+	return threads, nil
+}
+
+type CreateThreadInput struct {
+	Body string `json:"body" binding:"required,max=10000"`
+	// BlockID anchors the thread to a block in the page content, leave it out to comment on the whole page
+	BlockID *string `json:"block_id" binding:"omitempty,max=255"`
+}
+
+// CreateThread starts a discussion on the page, the body is the first comment of the thread
+func (h *CommentsHandler) CreateThread(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to comment")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input CreateThreadInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	body := strings.TrimSpace(input.Body)
+	if body == "" {
+		c.Error(api_error.NewBadRequestError("comment cannot be empty", nil))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create comment", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := access.AuthorizePage(ctx, tx, pageID, userIdInt, access.ActionComment); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	if input.BlockID != nil {
+		var blockExists bool
+		// block ids can be nested anywhere in the editor's document, so every "id" in the content is searched
+		err = tx.QueryRow(ctx, `
+			SELECT COALESCE(jsonb_path_exists(content, '$.**.id ? (@ == $block)', jsonb_build_object('block', $2::text)), false)
+			FROM pages WHERE id = $1
+		`, pageID, *input.BlockID).Scan(&blockExists)
+		if err != nil {
+			c.Error(api_error.NewInternalServerError("failed to create comment", err))
+			return
+		}
+		if !blockExists {
+			c.Error(api_error.NewBadRequestError("block not found in page content", nil))
+			return
+		}
+	}
+
+	thread := CommentThread{PageID: pageID, BlockID: input.BlockID}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO comment_threads (page_id, block_id, created_by) VALUES ($1, $2, $3) RETURNING id, created_at
+	`, pageID, input.BlockID, userIdInt).Scan(&thread.ID, &thread.CreatedAt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create comment", err))
+		return
+	}
+
+	comment, err := insertComment(ctx, tx, thread.ID, userIdInt, body)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create comment", err))
+		return
+	}
+	thread.Comments = []Comment{*comment}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create comment", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": thread})
+}
+
+type ReplyInput struct {
+	Body string `json:"body" binding:"required,max=10000"`
+}
+
+func (h *CommentsHandler) Reply(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to comment")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	threadID, apiErr := uuidFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input ReplyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	body := strings.TrimSpace(input.Body)
+	if body == "" {
+		c.Error(api_error.NewBadRequestError("comment cannot be empty", nil))
+		return
+	}
+
+	if _, apiErr := authorizeThread(ctx, h.db, threadID, userIdInt, access.ActionComment); apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create comment", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	comment, err := insertComment(ctx, tx, threadID, userIdInt, body)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create comment", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create comment", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": comment})
+}
+
+func (h *CommentsHandler) ResolveThread(c *gin.Context) {
+	h.setResolved(c, true)
+}
+
+func (h *CommentsHandler) ReopenThread(c *gin.Context) {
+	h.setResolved(c, false)
+}
+
+func (h *CommentsHandler) setResolved(c *gin.Context, resolved bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to resolve comments")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	threadID, apiErr := uuidFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, apiErr := authorizeThread(ctx, h.db, threadID, userIdInt, access.ActionComment); apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var err error
+	if resolved {
+		_, err = h.db.Exec(ctx, `
+			UPDATE comment_threads SET resolved_at = CURRENT_TIMESTAMP, resolved_by = $2 WHERE id = $1 AND resolved_at IS NULL
+		`, threadID, userIdInt)
+	} else {
+		_, err = h.db.Exec(ctx, `
+			UPDATE comment_threads SET resolved_at = NULL, resolved_by = NULL WHERE id = $1
+		`, threadID)
+	}
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update comment thread", err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+type UpdateCommentInput struct {
+	Body string `json:"body" binding:"required,max=10000"`
+}
+
+// UpdateComment edits a comment, only its author can do that
+func (h *CommentsHandler) UpdateComment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to edit comment")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	commentID, apiErr := uuidFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input UpdateCommentInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	body := strings.TrimSpace(input.Body)
+	if body == "" {
+		c.Error(api_error.NewBadRequestError("comment cannot be empty", nil))
+		return
+	}
+
+	if apiErr := authorizeCommentAuthor(ctx, h.db, commentID, userIdInt); apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	_, err := h.db.Exec(ctx, `
+		UPDATE comments SET body = $1, edited_at = CURRENT_TIMESTAMP WHERE id = $2
+	`, body, commentID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to edit comment", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "comment updated successfully"})
+}
+
+// DeleteComment deletes a comment, only its author can do that. Deleting the last comment of a thread deletes the thread.
+func (h *CommentsHandler) DeleteComment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to delete comment")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	commentID, apiErr := uuidFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if apiErr := authorizeCommentAuthor(ctx, h.db, commentID, userIdInt); apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete comment", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var threadID uuid.UUID
+	err = tx.QueryRow(ctx, `DELETE FROM comments WHERE id = $1 RETURNING thread_id`, commentID).Scan(&threadID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewNotFoundError("comment not found", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete comment", err))
+		return
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM comment_threads WHERE id = $1 AND NOT EXISTS(SELECT 1 FROM comments WHERE thread_id = $1)
+	`, threadID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete comment", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete comment", err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func insertComment(ctx context.Context, tx pgx.Tx, threadID uuid.UUID, authorID int64, body string) (*Comment, error) {
+	comment := Comment{ThreadID: threadID, AuthorID: &authorID, Body: body}
+	err := tx.QueryRow(ctx, `
+		WITH comment AS (
+			INSERT INTO comments (thread_id, author_id, body) VALUES ($1, $2, $3) RETURNING id, created_at
+		)
+		SELECT comment.id, comment.created_at, users.username FROM comment, users WHERE users.id = $2
+	`, threadID, authorID, body).Scan(&comment.ID, &comment.CreatedAt, &comment.AuthorUsername)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert comment: %w", err)
+	}
+	return &comment, nil
+}
+
+// authorizeThread checks the user's access to the page the thread is on and returns the page id
+func authorizeThread(ctx context.Context, q access.Querier, threadID uuid.UUID, userID int64, action access.Action) (uuid.UUID, *api_error.ApiError) {
+	var pageID uuid.UUID
+	err := q.QueryRow(ctx, `SELECT page_id FROM comment_threads WHERE id = $1`, threadID).Scan(&pageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, api_error.NewNotFoundError("comment thread not found", nil)
+	} else if err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to get comment thread", err)
+	}
+	if _, err := access.AuthorizePage(ctx, q, pageID, userID, action); err != nil {
+		return uuid.Nil, accessError(err, "comment thread not found")
+	}
+	return pageID, nil
+}
+
+// authorizeCommentAuthor checks the user wrote the comment and can still comment on its page
+func authorizeCommentAuthor(ctx context.Context, q access.Querier, commentID uuid.UUID, userID int64) *api_error.ApiError {
+	var threadID uuid.UUID
+	var authorID *int64
+	err := q.QueryRow(ctx, `SELECT thread_id, author_id FROM comments WHERE id = $1`, commentID).Scan(&threadID, &authorID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return api_error.NewNotFoundError("comment not found", nil)
+	} else if err != nil {
+		return api_error.NewInternalServerError("failed to get comment", err)
+	}
+	if _, apiErr := authorizeThread(ctx, q, threadID, userID, access.ActionComment); apiErr != nil {
+		return apiErr
+	}
+	if authorID == nil || *authorID != userID {
+		return api_error.NewForbiddenError("only the author can change a comment", nil)
+	}
+	return nil
+}
+
+func (h *CommentsHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/pages/:id/comments", h.GetComments)
+	router.POST("/pages/:id/comments", h.CreateThread)
+	router.POST("/comment-threads/:id/replies", h.Reply)
+	router.POST("/comment-threads/:id/resolve", h.ResolveThread)
+	router.POST("/comment-threads/:id/reopen", h.ReopenThread)
+	router.PUT("/comments/:id", h.UpdateComment)
+	router.DELETE("/comments/:id", h.DeleteComment)
+}
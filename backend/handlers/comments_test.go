@@ -0,0 +1,104 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommentThreads(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("colleague@example.com", "colleague", "password"),
+		db.InsertTestPageFixtureWithParent(childId, parentId, 1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	comments, err := handlers.NewCommentsHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := handlers.NewSharesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletePage, err := handlers.NewDeletePageHandler(pool, mocks.NewBlobStoreMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(comments, shares, deletePage)
+
+	commentsPath := "/api/pages/" + childId.String() + "/comments"
+	sharesPath := "/api/pages/" + parentId.String() + "/shares"
+
+	assert.Equal(t, http.StatusBadRequest, serve(1, "POST", commentsPath, `{"body": "hi", "block_id": "missing"}`).Code)
+
+	w := serve(1, "POST", commentsPath, `{"body": "first"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created struct {
+		Data handlers.CommentThread `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	threadPath := "/api/comment-threads/" + created.Data.ID.String()
+	commentPath := "/api/comments/" + created.Data.Comments[0].ID.String()
+
+	// viewers can read but not reply
+	assert.Equal(t, http.StatusOK, serve(1, "POST", sharesPath, `{"email": "colleague@example.com", "level": "viewer"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(2, "GET", commentsPath, "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(2, "POST", threadPath+"/replies", `{"body": "reply"}`).Code)
+
+	assert.Equal(t, http.StatusOK, serve(1, "POST", sharesPath, `{"email": "colleague@example.com", "level": "commenter"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(2, "POST", threadPath+"/replies", `{"body": "reply"}`).Code)
+	// only the author can edit or delete a comment
+	assert.Equal(t, http.StatusForbidden, serve(2, "PUT", commentPath, `{"body": "edited"}`).Code)
+	assert.Equal(t, http.StatusForbidden, serve(2, "DELETE", commentPath, "").Code)
+	assert.Equal(t, http.StatusOK, serve(1, "PUT", commentPath, `{"body": "edited"}`).Code)
+
+	var threads handlers.CommentThreadsResponse
+	w = serve(1, "GET", commentsPath, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &threads); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, threads.Threads, 1) {
+		assert.Len(t, threads.Threads[0].Comments, 2)
+		assert.Equal(t, "edited", threads.Threads[0].Comments[0].Body)
+		assert.NotNil(t, threads.Threads[0].Comments[0].EditedAt)
+	}
+
+	// resolved threads are hidden unless asked for
+	assert.Equal(t, http.StatusNoContent, serve(2, "POST", threadPath+"/resolve", "").Code)
+	w = serve(1, "GET", commentsPath, "")
+	json.Unmarshal(w.Body.Bytes(), &threads)
+	assert.Len(t, threads.Threads, 0)
+	w = serve(1, "GET", commentsPath+"?include_resolved=true", "")
+	json.Unmarshal(w.Body.Bytes(), &threads)
+	assert.Len(t, threads.Threads, 1)
+	assert.Equal(t, http.StatusNoContent, serve(1, "POST", threadPath+"/reopen", "").Code)
+	w = serve(1, "GET", commentsPath, "")
+	json.Unmarshal(w.Body.Bytes(), &threads)
+	assert.Len(t, threads.Threads, 1)
+
+	// deleting the subtree deletes its comments
+	assert.Equal(t, http.StatusNoContent, serve(1, "DELETE", "/api/pages/"+parentId.String(), "").Code)
+	var count int
+	if err := pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM comment_threads").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, count)
+	assert.Equal(t, http.StatusNotFound, serve(1, "POST", threadPath+"/replies", `{"body": "reply"}`).Code)
+}
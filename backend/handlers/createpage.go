@@ -2,14 +2,19 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
 	"go_notion/backend/page"
+	"go_notion/backend/realtime"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/gofrs/uuid/v5"
@@ -32,6 +37,21 @@ func NewCreatePageHandler(db *pgxpool.Pool, pageConfig *page.PageConfig) (*Creat
 
 type CreatePageInput struct {
 	ParentID *uuid.UUID `json:"parent_id"`
+	// WorkspaceID defaults to the parent's workspace, or the user's personal workspace for top level pages
+	WorkspaceID *int64 `json:"workspace_id"`
+	// ID lets offline clients pick the id of the page, so they can create its children before syncing.
+	// Retrying with the same id and input creates the page once.
+	ID          *uuid.UUID      `json:"id"`
+	TitleText   *string         `json:"title_text"`
+	ContentText *string         `json:"content_text"`
+	RawTitle    json.RawMessage `json:"raw_title"`
+	RawContent  json.RawMessage `json:"raw_content"`
+	Icon        *string         `json:"icon" binding:"omitempty,max=255"`
+	Cover       *string         `json:"cover" binding:"omitempty,max=2048"`
+	// Properties must be a JSON object
+	Properties json.RawMessage `json:"properties"`
+	// TemplateID creates the page as a copy of the template and its sub pages, it can't be combined with the other page fields
+	TemplateID *uuid.UUID `json:"template_id"`
 }
 
 func (np *CreatePageHandler) CreatePage(c *gin.Context) {
@@ -55,11 +75,6 @@ func (np *CreatePageHandler) CreatePage(c *gin.Context) {
 		return
 	}
 
-	var isTopLevel bool = true
-	if input.ParentID != nil {
-		isTopLevel = false
-	}
-
 	tx, err := np.db.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("failed to create page", err))
@@ -68,70 +83,179 @@ func (np *CreatePageHandler) CreatePage(c *gin.Context) {
 
 	defer tx.Rollback(ctx)
 
-	var position float64
+	if input.ID != nil {
+		response, apiErr := claimIdempotencyKey(ctx, tx, userIdInt, idempotencyScopeCreatePage, input.ID.String(), input, 0)
+		if apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+		if response != nil {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", response)
+			return
+		}
+	}
 
-	err = tx.QueryRow(ctx, `
-		SELECT COALESCE(MAX(position), 0) FROM pages WHERE created_by = $1
-	`, userIdInt).Scan(&position)
-	if err != nil {
-		c.Error(api_error.NewInternalServerError("internal server error", err))
+	pageID, apiErr := np.createPageInTx(ctx, tx, userIdInt, input)
+	if apiErr != nil {
+		c.Error(apiErr)
 		return
 	}
 
-	var pageID uuid.UUID
-	position += float64(np.pageConfig.Spacing)
-	err = tx.QueryRow(ctx, `
-		INSERT INTO pages (created_by, position, is_top_level) VALUES ($1, $2, $3) RETURNING id
-	`, userIdInt, position, isTopLevel).Scan(&pageID)
+	response := gin.H{"page_id": pageID}
+	if input.ID != nil {
+		if err := storeIdempotentResponse(ctx, tx, userIdInt, idempotencyScopeCreatePage, input.ID.String(), response); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to create page", err))
+			return
+		}
+	}
 
+	err = tx.Commit(ctx)
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("failed to create page", err))
 		return
 	}
 
+	c.JSON(http.StatusOK, response)
+
+}
+
+// createPageInTx creates the page within the transaction and returns its id
+func (np *CreatePageHandler) createPageInTx(ctx context.Context, tx pgx.Tx, userID int64, input CreatePageInput) (uuid.UUID, *api_error.ApiError) {
+	if input.TemplateID != nil {
+		return np.createPageFromTemplate(ctx, tx, userID, input)
+	}
+
+	var isTopLevel bool = true
 	if input.ParentID != nil {
-		parentIDValue := *input.ParentID // dereference to get the actual UUID
-		var parentPageBelongsToUser bool
+		isTopLevel = false
+	}
+
+	if input.Properties != nil && !isJSONObject(input.Properties) {
+		return uuid.Nil, api_error.NewBadRequestError("properties must be a JSON object", nil)
+	}
+
+	workspaceID, apiErr := resolveNewPageWorkspace(ctx, tx, input, userID)
+	if apiErr != nil {
+		return uuid.Nil, apiErr
+	}
 
-		err = tx.QueryRow(ctx, `
-			SELECT EXISTS(SELECT 1 FROM pages WHERE id = $1 AND created_by = $2)
-		`, parentIDValue, userIdInt).Scan(&parentPageBelongsToUser)
+	input.Properties, apiErr = validateRowProperties(ctx, tx, input.ParentID, input.Properties)
+	if apiErr != nil {
+		return uuid.Nil, apiErr
+	}
 
+	var pageID uuid.UUID
+	var err error
+	for attempt := 1; ; attempt++ {
+		pageID, err = np.insertPage(ctx, tx, userID, workspaceID, isTopLevel, input)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+			if pgErr.ConstraintName == "pages_pkey" {
+				return uuid.Nil, api_error.NewConflictError("a page with this id already exists", err)
+			}
+			// a concurrent create took the same position, the next attempt goes after it
+			if attempt < insertPageAttempts {
+				continue
+			}
+		}
 		if err != nil {
-			c.Error(api_error.NewInternalServerError("failed to check if parent page exists", err))
-			return
+			return uuid.Nil, api_error.NewInternalServerError("failed to create page", err)
+		}
+		break
+	}
+
+	if input.RawContent != nil {
+		if err := syncPageLinks(ctx, tx, pageID, page.ExtractPageLinks(input.RawContent)); err != nil {
+			return uuid.Nil, api_error.NewInternalServerError("failed to create page links", err)
+		}
+		if err := syncPageMentions(ctx, tx, pageID, userID, page.ExtractMentions(input.RawContent)); err != nil {
+			return uuid.Nil, api_error.NewInternalServerError("failed to create page mentions", err)
 		}
+	}
 
-		if !parentPageBelongsToUser {
-			c.Error(api_error.NewNotFoundError("parent page not found", nil))
-			return
+	if input.ParentID != nil {
+		if err := insertParentClosures(ctx, tx, *input.ParentID, pageID); err != nil {
+			return uuid.Nil, api_error.NewInternalServerError("failed to link page to parent", err)
 		}
+	}
 
-		_, err = tx.Exec(ctx, `
-			INSERT INTO pages_closures (ancestor_id, descendant_id, is_parent) 
-			SELECT ancestor_id, $2::uuid as descendant_id,
-			false as is_parent
-			FROM pages_closures
-			WHERE descendant_id = $1
+	// the parent is included so the clients showing it learn about the new sub page
+	changedPageIDs := []uuid.UUID{pageID}
+	if input.ParentID != nil {
+		changedPageIDs = append(changedPageIDs, *input.ParentID)
+	}
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageCreated, WorkspaceID: workspaceID, PageIDs: changedPageIDs, ActorID: userID})
+	if err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page", err)
+	}
 
-			UNION ALL
+	return pageID, nil
+}
 
-			SELECT $1 as ancestor_id, $2 as descendant_id, true as is_parent
-		`, parentIDValue, pageID)
-		if err != nil {
-			c.Error(api_error.NewInternalServerError("failed to link page to parent", err))
-			return
-		}
+// insertPageAttempts is how many times a page is placed before giving up on concurrent creates in its workspace
+const insertPageAttempts = 3
+
+// insertPage inserts the page after the last one of the workspace. It runs in a savepoint, so the transaction can
+// go on when the insert fails on a unique violation
+func (np *CreatePageHandler) insertPage(ctx context.Context, tx pgx.Tx, userID int64, workspaceID int64, isTopLevel bool, input CreatePageInput) (uuid.UUID, error) {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
 	}
+	defer savepoint.Rollback(ctx)
 
-	err = tx.Commit(ctx)
+	var pageID uuid.UUID
+	err = savepoint.QueryRow(ctx, `
+		INSERT INTO pages (id, created_by, last_edited_by, workspace_id, position, is_top_level, text_title, text_content, title, content, icon, cover, properties)
+		VALUES (
+			COALESCE($1, uuid_generate_v4()), $2, $2, $3, (SELECT COALESCE(MAX(position), 0) FROM pages WHERE workspace_id = $3) + $4,
+			$5, $6, $7, $8, $9, $10, $11, COALESCE($12, '{}'::jsonb)
+		) RETURNING id
+	`, input.ID, userID, workspaceID, float64(np.pageConfig.Spacing), isTopLevel, input.TitleText, input.ContentText, input.RawTitle, input.RawContent, input.Icon, input.Cover, input.Properties).Scan(&pageID)
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to create page", err))
-		return
+		return uuid.Nil, err
 	}
+	return pageID, savepoint.Commit(ctx)
+}
+
+// insertParentClosures makes the new page a child of the parent, below all of the parent's ancestors
+func insertParentClosures(ctx context.Context, tx pgx.Tx, parentID uuid.UUID, pageID uuid.UUID) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO pages_closures (ancestor_id, descendant_id, is_parent) 
+		SELECT ancestor_id, $2::uuid as descendant_id,
+		false as is_parent
+		FROM pages_closures
+		WHERE descendant_id = $1
+
+		UNION ALL
+
+		SELECT $1 as ancestor_id, $2 as descendant_id, true as is_parent
+	`, parentID, pageID)
+	return err
+}
 
-	c.JSON(http.StatusOK, gin.H{"page_id": pageID})
+// resolveNewPageWorkspace picks the workspace the new page goes in and checks the user may add pages to it
+func resolveNewPageWorkspace(ctx context.Context, tx pgx.Tx, input CreatePageInput, userID int64) (int64, *api_error.ApiError) {
+	if input.ParentID != nil {
+		// sub pages always live in their parent's workspace
+		workspaceID, err := access.AuthorizePage(ctx, tx, *input.ParentID, userID, access.ActionEdit)
+		if err != nil {
+			return 0, accessError(err, "parent page not found")
+		}
+		if input.WorkspaceID != nil && *input.WorkspaceID != workspaceID {
+			return 0, api_error.NewBadRequestError("parent page is in a different workspace", nil)
+		}
+		return workspaceID, nil
+	}
 
+	workspaceID, apiErr := resolveWorkspaceID(ctx, tx, input.WorkspaceID, userID)
+	if apiErr != nil {
+		return 0, apiErr
+	}
+	if _, err := access.AuthorizeWorkspace(ctx, tx, workspaceID, userID, access.ActionEdit); err != nil {
+		return 0, accessError(err, "workspace not found")
+	}
+	return workspaceID, nil
 }
 
 func (np *CreatePageHandler) RegisterRoutes(router *gin.RouterGroup) {
@@ -1,6 +1,7 @@
 package handlers_test
 
 import (
+	"context"
 	"go_notion/backend/db"
 	"go_notion/backend/handlers"
 	"go_notion/backend/page"
@@ -127,3 +128,58 @@ func TestCreateNestedPage(t *testing.T) {
 		})
 	}
 }
+
+func TestCreatePageWithClientID(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.InsertTestUserWithData("other@example.com", "other", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	np, err := handlers.NewCreatePageHandler(pool, page.NewPageConfig(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(userID int64, body string) *httptest.ResponseRecorder {
+		r := router.NewRouter()
+		r.POST("/api/pages", func(c *gin.Context) {
+			c.Set("user_id", userID)
+			np.CreatePage(c)
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/pages", strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	parent := `{"id": "` + parentId.String() + `", "title_text": "offline", "raw_title": {"text": "offline"}}`
+	child := `{"id": "` + childId.String() + `", "parent_id": "` + parentId.String() + `"}`
+
+	w := create(1, parent)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"page_id": "`+parentId.String()+`"}`, w.Body.String())
+	assert.Equal(t, http.StatusOK, create(1, child).Code)
+
+	// retries of the same request succeed without creating another page
+	w = create(1, parent)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"page_id": "`+parentId.String()+`"}`, w.Body.String())
+	var count int
+	if err := pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM pages").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, count)
+
+	var title string
+	if err := pool.QueryRow(context.Background(), "SELECT text_title FROM pages WHERE id = $1", parentId).Scan(&title); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "offline", title)
+
+	// the same id with a different request, or from someone else, is a conflict
+	assert.Equal(t, http.StatusConflict, create(1, `{"id": "`+parentId.String()+`", "title_text": "changed"}`).Code)
+	assert.Equal(t, http.StatusConflict, create(2, parent).Code)
+}
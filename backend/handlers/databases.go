@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/page"
+	"go_notion/backend/realtime"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DatabasesHandler turns pages into databases, whose sub pages are rows with typed properties
+type DatabasesHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewDatabasesHandler(db *pgxpool.Pool) (*DatabasesHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &DatabasesHandler{db: db}, nil
+}
+
+type Database struct {
+	PageID    uuid.UUID   `json:"page_id"`
+	Schema    page.Schema `json:"schema"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+type UpdateDatabaseInput struct {
+	// Schema replaces the properties, those without an id are new. Row values of removed or changed properties are dropped.
+	Schema page.Schema `json:"schema" binding:"required"`
+}
+
+type DatabaseRow struct {
+	ID           uuid.UUID       `json:"id"`
+	TextTitle    *string         `json:"text_title"`
+	Icon         *string         `json:"icon"`
+	Properties   json.RawMessage `json:"properties"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	LastEditedBy *int64          `json:"last_edited_by"`
+}
+
+type DatabaseRowsResponse struct {
+	Rows []DatabaseRow `json:"rows"`
+}
+
+type GetDatabaseRowsParams struct {
+	// Filter is repeated for each filter written as property:operator:value, rows match all of them
+	Filter []string `form:"filter"`
+	// Sort is repeated for each sort written as property:asc or property:desc, rows are in page order after them
+	Sort   []string `form:"sort"`
+	Size   *int     `form:"size,omitempty" binding:"omitempty,min=1,max=100"`
+	Offset *int     `form:"offset,omitempty" binding:"omitempty,min=0"`
+}
+
+// UpdateDatabase makes the page a database with the schema, or replaces the schema of a database
+func (h *DatabasesHandler) UpdateDatabase(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to update database")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input UpdateDatabaseInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	schema, err := input.Schema.WithIDs()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update database", err))
+		return
+	}
+	if err := schema.Validate(); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update database", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	workspaceID, err := access.AuthorizePage(ctx, tx, pageID, userIdInt, access.ActionEdit)
+	if err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	// relations point to databases of the same workspace the user can see, or to the database itself
+	for _, property := range schema {
+		if property.Type != page.PropertyRelation || *property.DatabaseID == pageID {
+			continue
+		}
+		relatedWorkspaceID, err := access.AuthorizePage(ctx, tx, *property.DatabaseID, userIdInt, access.ActionView)
+		if err != nil {
+			c.Error(accessError(err, fmt.Sprintf("database of property %q not found", property.Name)))
+			return
+		}
+		_, isDatabase, err := databaseSchema(ctx, tx, *property.DatabaseID)
+		if err != nil {
+			c.Error(api_error.NewInternalServerError("failed to update database", err))
+			return
+		}
+		if !isDatabase || relatedWorkspaceID != workspaceID {
+			c.Error(api_error.NewBadRequestError(fmt.Sprintf("property %q must relate to a database of the same workspace", property.Name), nil))
+			return
+		}
+	}
+
+	database := Database{PageID: pageID, Schema: schema}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO page_databases (page_id, schema, created_by) VALUES ($1, $2, $3)
+		ON CONFLICT (page_id) DO UPDATE SET schema = EXCLUDED.schema, updated_at = CURRENT_TIMESTAMP
+		RETURNING updated_at
+	`, pageID, schema, userIdInt).Scan(&database.UpdatedAt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update database", err))
+		return
+	}
+
+	prunedRowIDs, err := pruneRowProperties(ctx, tx, schema, pageID, nil)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update database rows", err))
+		return
+	}
+
+	changedPageIDs := append([]uuid.UUID{pageID}, prunedRowIDs...)
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: workspaceID, PageIDs: changedPageIDs, ActorID: userIdInt})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update database", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update database", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, database)
+}
+
+// GetDatabase returns the schema of the database
+func (h *DatabasesHandler) GetDatabase(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get database")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "database not found"))
+		return
+	}
+
+	database := Database{PageID: pageID}
+	err := h.db.QueryRow(ctx, `
+		SELECT schema, updated_at FROM page_databases WHERE page_id = $1
+	`, pageID).Scan(&database.Schema, &database.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewNotFoundError("database not found", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get database", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, database)
+}
+
+// DeleteDatabase turns the database back into a regular page, its rows stay as sub pages with their properties
+func (h *DatabasesHandler) DeleteDatabase(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to delete database")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete database", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	workspaceID, err := access.AuthorizePage(ctx, tx, pageID, userIdInt, access.ActionManage)
+	if err != nil {
+		c.Error(accessError(err, "database not found"))
+		return
+	}
+
+	cmd, err := tx.Exec(ctx, `DELETE FROM page_databases WHERE page_id = $1`, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete database", err))
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewNotFoundError("database not found", nil))
+		return
+	}
+
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: workspaceID, PageIDs: []uuid.UUID{pageID}, ActorID: userIdInt})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete database", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete database", err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetDatabaseRows lists the rows of the database that match the filters, in the order of the sorts
+func (h *DatabasesHandler) GetDatabaseRows(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get database rows")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var params GetDatabaseRowsParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	filters := make([]page.RowFilter, 0, len(params.Filter))
+	for _, f := range params.Filter {
+		filter, err := page.ParseRowFilter(f)
+		if err != nil {
+			c.Error(api_error.NewBadRequestError(err.Error(), err))
+			return
+		}
+		filters = append(filters, filter)
+	}
+	sorts := make([]page.RowSort, 0, len(params.Sort))
+	for _, s := range params.Sort {
+		sort, err := page.ParseRowSort(s)
+		if err != nil {
+			c.Error(api_error.NewBadRequestError(err.Error(), err))
+			return
+		}
+		sorts = append(sorts, sort)
+	}
+	size, offset := 100, 0
+	if params.Size != nil {
+		size = *params.Size
+	}
+	if params.Offset != nil {
+		offset = *params.Offset
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "database not found"))
+		return
+	}
+	schema, isDatabase, err := databaseSchema(ctx, h.db, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get database rows", err))
+		return
+	}
+	if !isDatabase {
+		c.Error(api_error.NewNotFoundError("database not found", nil))
+		return
+	}
+
+	where, orderBy, args, err := schema.RowQuery(filters, sorts, []any{pageID, size, offset})
+	if err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	rows, err := h.db.Query(ctx, `
+		SELECT pages.id, pages.text_title, pages.icon, pages.properties, pages.created_at, pages.updated_at, pages.last_edited_by
+		FROM pages
+		INNER JOIN pages_closures ON pages_closures.descendant_id = pages.id
+		WHERE pages_closures.ancestor_id = $1 AND pages_closures.is_parent AND `+where+`
+		ORDER BY `+orderBy+`
+		LIMIT $2 OFFSET $3
+	`, args...)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get database rows", err))
+		return
+	}
+	databaseRows, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DatabaseRow, error) {
+		var r DatabaseRow
+		err := row.Scan(&r.ID, &r.TextTitle, &r.Icon, &r.Properties, &r.CreatedAt, &r.UpdatedAt, &r.LastEditedBy)
+		return r, err
+	})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get database rows", err))
+		return
+	}
+	if databaseRows == nil {
+		databaseRows = []DatabaseRow{}
+	}
+
+	c.JSON(http.StatusOK, DatabaseRowsResponse{Rows: databaseRows})
+}
+
+// databaseSchema returns the schema of the page if it is a database
+func databaseSchema(ctx context.Context, q access.Querier, pageID uuid.UUID) (page.Schema, bool, error) {
+	var schema page.Schema
+	err := q.QueryRow(ctx, `SELECT schema FROM page_databases WHERE page_id = $1`, pageID).Scan(&schema)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to get database schema: %w", err)
+	}
+	return schema, true, nil
+}
+
+// validateRowProperties checks the properties of a page against the schema of its parent when the parent
+// is a database, and returns them normalized. Pages outside of databases keep free-form properties.
+func validateRowProperties(ctx context.Context, tx pgx.Tx, parentID *uuid.UUID, properties json.RawMessage) (json.RawMessage, *api_error.ApiError) {
+	if parentID == nil {
+		return properties, nil
+	}
+	schema, isDatabase, err := databaseSchema(ctx, tx, *parentID)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to validate properties", err)
+	}
+	if !isDatabase {
+		return properties, nil
+	}
+	if properties == nil {
+		properties = json.RawMessage("{}")
+	}
+
+	normalized, err := schema.ValidateValues(properties)
+	if err != nil {
+		return nil, api_error.NewBadRequestError(err.Error(), err)
+	}
+
+	// related pages must be rows of the related database
+	for propertyID, pageIDs := range schema.Relations(normalized) {
+		property, _ := schema.Property(propertyID)
+		var count int
+		err := tx.QueryRow(ctx, `
+			SELECT COUNT(*) FROM pages_closures WHERE ancestor_id = $1 AND is_parent AND descendant_id = ANY($2)
+		`, *property.DatabaseID, pageIDs).Scan(&count)
+		if err != nil {
+			return nil, api_error.NewInternalServerError("failed to validate properties", err)
+		}
+		if count != len(pageIDs) {
+			return nil, api_error.NewBadRequestError(fmt.Sprintf("invalid value for property %q: pages must be rows of the related database", property.Name), nil)
+		}
+	}
+	return normalized, nil
+}
+
+// parentPageID returns the parent of the page, or nil for top level pages
+func parentPageID(ctx context.Context, tx pgx.Tx, pageID uuid.UUID) (*uuid.UUID, error) {
+	var parentID uuid.UUID
+	err := tx.QueryRow(ctx, `
+		SELECT ancestor_id FROM pages_closures WHERE descendant_id = $1 AND is_parent
+	`, pageID).Scan(&parentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get parent page: %w", err)
+	}
+	return &parentID, nil
+}
+
+// conformToParentDatabase drops the values of the page's properties that don't fit the schema
+// of its parent, for pages that became rows by being moved or copied into a database
+func conformToParentDatabase(ctx context.Context, tx pgx.Tx, pageID uuid.UUID) error {
+	parentID, err := parentPageID(ctx, tx, pageID)
+	if err != nil || parentID == nil {
+		return err
+	}
+	schema, isDatabase, err := databaseSchema(ctx, tx, *parentID)
+	if err != nil || !isDatabase {
+		return err
+	}
+	// the callers publish the page's change already
+	_, err = pruneRowProperties(ctx, tx, schema, *parentID, []uuid.UUID{pageID})
+	return err
+}
+
+// pruneRowProperties drops the values that don't fit the schema from the rows of the database,
+// or only from the given rows when pageIDs isn't nil. It returns the rows that changed.
+func pruneRowProperties(ctx context.Context, tx pgx.Tx, schema page.Schema, databaseID uuid.UUID, pageIDs []uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT pages.id, pages.properties FROM pages
+		INNER JOIN pages_closures ON pages_closures.descendant_id = pages.id
+		WHERE pages_closures.ancestor_id = $1 AND pages_closures.is_parent AND ($2::uuid[] IS NULL OR pages.id = ANY($2))
+	`, databaseID, pageIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database rows: %w", err)
+	}
+	type rowProperties struct {
+		id         uuid.UUID
+		properties json.RawMessage
+	}
+	databaseRows, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (rowProperties, error) {
+		var r rowProperties
+		err := row.Scan(&r.id, &r.properties)
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database rows: %w", err)
+	}
+
+	var prunedRowIDs []uuid.UUID
+	for _, r := range databaseRows {
+		pruned, changed := schema.Prune(r.properties)
+		if !changed {
+			continue
+		}
+		_, err := tx.Exec(ctx, `UPDATE pages SET properties = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, pruned, r.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update row properties: %w", err)
+		}
+		prunedRowIDs = append(prunedRowIDs, r.id)
+	}
+	return prunedRowIDs, nil
+}
+
+func (h *DatabasesHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.PUT("/databases/:id", h.UpdateDatabase)
+	router.GET("/databases/:id", h.GetDatabase)
+	router.DELETE("/databases/:id", h.DeleteDatabase)
+	router.GET("/databases/:id/rows", h.GetDatabaseRows)
+}
@@ -0,0 +1,177 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/page"
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatabases(t *testing.T) {
+	databaseId := uuid.Must(uuid.NewV4())
+	rowId := uuid.Must(uuid.NewV4())
+	otherId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("stranger@example.com", "stranger", "password"),
+		db.InsertTestPageFixtureWithParent(rowId, databaseId, 1),
+		db.InsertTestPageFixtureWithPosition(otherId, 1, 3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	_, err = pool.Exec(context.Background(), `UPDATE pages SET properties = '{"status": "Todo", "free": "form"}' WHERE id = $1`, rowId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	databases, err := handlers.NewDatabasesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPage, err := handlers.NewCreatePageHandler(pool, page.NewPageConfig(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(databases, createPage, updatePage)
+
+	rows := func(t *testing.T, query string) []handlers.DatabaseRow {
+		w := serve(1, "GET", "/api/databases/"+databaseId.String()+"/rows"+query, "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response handlers.DatabaseRowsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Rows
+	}
+
+	updatedEvents := func(t *testing.T, pageID uuid.UUID) int {
+		var count int
+		err := pool.QueryRow(context.Background(), `
+			SELECT count(*) FROM page_events WHERE type = 'page.updated' AND $1 = ANY(page_ids)
+		`, pageID).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	t.Run("regular pages aren't databases", func(t *testing.T) {
+		w := serve(1, "GET", "/api/databases/"+databaseId.String(), "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = serve(1, "GET", "/api/databases/"+databaseId.String()+"/rows", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("rejects invalid schemas and strangers", func(t *testing.T) {
+		w := serve(1, "PUT", "/api/databases/"+databaseId.String(), `{"schema": [{"name": "Status", "type": "select"}]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = serve(1, "PUT", "/api/databases/"+databaseId.String(), `{"schema": [{"name": "Link", "type": "relation", "database_id": "`+otherId.String()+`"}]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "relations must point to databases")
+
+		w = serve(2, "PUT", "/api/databases/"+databaseId.String(), `{"schema": [{"name": "Notes", "type": "text"}]}`)
+		assert.NotEqual(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("makes the page a database and prunes its rows", func(t *testing.T) {
+		w := serve(1, "PUT", "/api/databases/"+databaseId.String(), `{"schema": [
+			{"id": "status", "name": "Status", "type": "select", "options": ["Todo", "Done"]},
+			{"id": "points", "name": "Points", "type": "number"},
+			{"name": "Due", "type": "date"}
+		]}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var database handlers.Database
+		if err := json.Unmarshal(w.Body.Bytes(), &database); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, database.Schema, 3) {
+			assert.NotEmpty(t, database.Schema[2].ID)
+		}
+
+		var properties []byte
+		var edited bool
+		err := pool.QueryRow(context.Background(), `
+			SELECT properties, updated_at > created_at FROM pages WHERE id = $1
+		`, rowId).Scan(&properties, &edited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.JSONEq(t, `{"status": "Todo"}`, string(properties))
+		assert.True(t, edited, "pruned rows are edited")
+		assert.Equal(t, 1, updatedEvents(t, rowId), "pruned rows are published")
+
+		w = serve(1, "GET", "/api/databases/"+databaseId.String(), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("validates the properties of rows", func(t *testing.T) {
+		w := serve(1, "POST", "/api/pages", `{"parent_id": "`+databaseId.String()+`", "properties": {"status": "Doing"}}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = serve(1, "POST", "/api/pages", `{"parent_id": "`+databaseId.String()+`", "properties": {"status": "Done", "points": 5}}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = serve(1, "PATCH", "/api/pages/"+rowId.String(), `{"properties": {"points": "two"}}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = serve(1, "PATCH", "/api/pages/"+rowId.String(), `{"properties": {"status": "Todo", "points": 2}}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// pages outside of databases keep free-form properties
+		w = serve(1, "PATCH", "/api/pages/"+otherId.String(), `{"properties": {"anything": ["goes"]}}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("filters and sorts rows", func(t *testing.T) {
+		all := rows(t, "?sort=points:desc")
+		if assert.Len(t, all, 2) {
+			assert.NotEqual(t, rowId, all[0].ID)
+			assert.Equal(t, rowId, all[1].ID)
+		}
+
+		todo := rows(t, "?filter=status:eq:Todo")
+		if assert.Len(t, todo, 1) {
+			assert.Equal(t, rowId, todo[0].ID)
+		}
+
+		assert.Len(t, rows(t, "?filter=points:gt:2&filter=status:eq:Todo"), 0)
+		assert.Len(t, rows(t, "?size=1"), 1)
+
+		w := serve(1, "GET", "/api/databases/"+databaseId.String()+"/rows?filter=unknown:eq:x", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("deleting the database keeps the rows", func(t *testing.T) {
+		events := updatedEvents(t, databaseId)
+		w := serve(1, "DELETE", "/api/databases/"+databaseId.String(), "")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, events+1, updatedEvents(t, databaseId))
+
+		w = serve(1, "GET", "/api/databases/"+databaseId.String(), "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		var properties []byte
+		err := pool.QueryRow(context.Background(), `SELECT properties FROM pages WHERE id = $1`, rowId).Scan(&properties)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.JSONEq(t, `{"status": "Todo", "points": 2}`, string(properties))
+	})
+}
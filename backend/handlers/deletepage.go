@@ -3,7 +3,10 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
+	"go_notion/backend/realtime"
+	"go_notion/backend/storage"
 	"net/http"
 	"time"
 
@@ -14,14 +17,18 @@ import (
 )
 
 type DeletePageHandler struct {
-	db *pgxpool.Pool
+	db    *pgxpool.Pool
+	blobs storage.BlobStore
 }
 
-func NewDeletePageHandler(db *pgxpool.Pool) (*DeletePageHandler, error) {
+func NewDeletePageHandler(db *pgxpool.Pool, blobs storage.BlobStore) (*DeletePageHandler, error) {
 	if db == nil {
 		return nil, fmt.Errorf("db cannot be nil")
 	}
-	return &DeletePageHandler{db}, nil
+	if blobs == nil {
+		return nil, fmt.Errorf("blob store cannot be nil")
+	}
+	return &DeletePageHandler{db, blobs}, nil
 }
 
 type DeletePageUri struct {
@@ -57,46 +64,132 @@ func (dp *DeletePageHandler) DeletePage(c *gin.Context) {
 	}
 
 	tx, err := dp.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete page", err))
+		return
+	}
 	defer tx.Rollback(ctx)
+
+	storageKeys, apiErr := dp.deletePageInTx(ctx, tx, userIdInt, pageID)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	err = tx.Commit(ctx)
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("failed to delete page", err))
 		return
 	}
+	removeBlobs(dp.blobs, storageKeys)
+
+	c.Status(http.StatusNoContent)
+}
+
+// deletePageInTx deletes the page and its sub pages within the transaction.
+// It returns the storage keys of their attachments, the caller removes the blobs once the transaction is committed.
+func (dp *DeletePageHandler) deletePageInTx(ctx context.Context, tx pgx.Tx, userID int64, pageID uuid.UUID) ([]string, *api_error.ApiError) {
+	workspaceID, err := access.AuthorizePage(ctx, tx, pageID, userID, access.ActionManage)
+	if err != nil {
+		return nil, accessError(err, "page not found")
+	}
+
+	rows, err := tx.Query(ctx, `
+		DELETE FROM attachments WHERE page_id IN (
+			SELECT descendant_id FROM pages_closures WHERE ancestor_id = $1
+			UNION SELECT $1::uuid
+		) RETURNING storage_key, thumbnail_key
+	`, pageID)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to delete attachments", err)
+	}
+	var storageKeys []string
+	var storageKey string
+	var thumbnailKey *string
+	_, err = pgx.ForEachRow(rows, []any{&storageKey, &thumbnailKey}, func() error {
+		storageKeys = append(storageKeys, storageKey)
+		if thumbnailKey != nil {
+			storageKeys = append(storageKeys, *thumbnailKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to delete attachments", err)
+	}
+
+	// Links pointing into the subtree are kept and marked as broken so the linking pages can show it,
+	// links going out of the subtree are deleted along with their source pages.
+	_, err = tx.Exec(ctx, `
+		UPDATE page_links SET broken_at = CURRENT_TIMESTAMP
+		WHERE broken_at IS NULL AND target_page_id IN (
+			SELECT descendant_id FROM pages_closures WHERE ancestor_id = $1
+			UNION SELECT $1::uuid
+		)
+	`, pageID)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to update page links", err)
+	}
+
+	// Shares inside the subtree are deleted along with the pages, they are logged as unshared so sync
+	// tombstones the pages for the users who only saw them through the shares
+	rows, err = tx.Query(ctx, `
+		SELECT user_id, page_id FROM page_permissions WHERE page_id IN (
+			SELECT descendant_id FROM pages_closures WHERE ancestor_id = $1
+			UNION SELECT $1::uuid
+		)
+		ORDER BY user_id
+	`, pageID)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to delete page shares", err)
+	}
+	type pageShare struct {
+		UserID int64
+		PageID uuid.UUID
+	}
+	shares, err := pgx.CollectRows(rows, pgx.RowToStructByPos[pageShare])
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to delete page shares", err)
+	}
+	for _, share := range shares {
+		if err := recordPageUnshared(ctx, tx, share.UserID, share.PageID); err != nil {
+			return nil, api_error.NewInternalServerError("failed to delete page shares", err)
+		}
+	}
 
 	// Delete nested pages first. If we delete the parent page first, its pages_closures records
 	// will be deleted, losing the information about which pages were nested under it. This would
 	// leave the child pages orphaned in the database.
-	_, err = tx.Exec(ctx, `
+	rows, err = tx.Query(ctx, `
 		DELETE FROM pages WHERE id IN (
 			SELECT descendant_id FROM pages_closures WHERE ancestor_id = $1
-		)
+		) RETURNING id
 	`, pageID)
-
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to delete nested pages", err))
-		return
+		return nil, api_error.NewInternalServerError("failed to delete nested pages", err)
+	}
+	deletedPageIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to delete nested pages", err)
 	}
 
 	cmd, err := tx.Exec(ctx, `
-		DELETE FROM pages WHERE id = $1::uuid AND created_by = $2
-	`, pageID, userIdInt)
+		DELETE FROM pages WHERE id = $1::uuid
+	`, pageID)
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to delete page", err))
-		return
+		return nil, api_error.NewInternalServerError("failed to delete page", err)
 	}
 
 	if cmd.RowsAffected() == 0 {
-		c.Error(api_error.NewNotFoundError("page not found", nil))
-		return
+		return nil, api_error.NewNotFoundError("page not found", nil)
 	}
+	deletedPageIDs = append([]uuid.UUID{pageID}, deletedPageIDs...)
 
-	err = tx.Commit(ctx)
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageDeleted, WorkspaceID: workspaceID, PageIDs: deletedPageIDs, ActorID: userID})
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to delete page", err))
-		return
+		return nil, api_error.NewInternalServerError("failed to delete page", err)
 	}
 
-	c.Status(http.StatusNoContent)
+	return storageKeys, nil
 }
 
 func (dp *DeletePageHandler) RegisterRoutes(router *gin.RouterGroup) {
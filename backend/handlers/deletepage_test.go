@@ -4,6 +4,7 @@ import (
 	"context"
 	"go_notion/backend/db"
 	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
 	"go_notion/backend/router"
 	"net/http"
 	"net/http/httptest"
@@ -23,7 +24,7 @@ func TestDeletePage(t *testing.T) {
 	}
 	defer pool.Close()
 
-	deletePage, err := handlers.NewDeletePageHandler(pool)
+	deletePage, err := handlers.NewDeletePageHandler(pool, mocks.NewBlobStoreMock())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -94,7 +95,7 @@ func TestDeletePageWithNestedPages(t *testing.T) {
 	}
 	defer pool.Close()
 
-	deletePage, err := handlers.NewDeletePageHandler(pool)
+	deletePage, err := handlers.NewDeletePageHandler(pool, mocks.NewBlobStoreMock())
 	if err != nil {
 		t.Fatal(err)
 	}
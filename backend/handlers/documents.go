@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/crdt"
+	"go_notion/backend/page"
+	"go_notion/backend/realtime"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// loadDocument returns the collaborative document of the page, built from its content when it has none yet.
+// The page row is locked so concurrent merges of the same page, possibly on other instances, run one after the other.
+func loadDocument(ctx context.Context, tx pgx.Tx, pageID uuid.UUID) (*crdt.Document, error) {
+	var content json.RawMessage
+	err := tx.QueryRow(ctx, `SELECT content FROM pages WHERE id = $1 FOR UPDATE`, pageID).Scan(&content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock page: %w", err)
+	}
+
+	var state json.RawMessage
+	err = tx.QueryRow(ctx, `SELECT state FROM page_documents WHERE page_id = $1`, pageID).Scan(&state)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return crdt.FromContent(content)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get document: %w", err)
+	}
+
+	doc := crdt.NewDocument()
+	if err := json.Unmarshal(state, doc); err != nil {
+		return nil, fmt.Errorf("failed to decode document: %w", err)
+	}
+	return doc, nil
+}
+
+// getDocument returns the document of the page for a user joining the editing session
+func getDocument(ctx context.Context, db *pgxpool.Pool, pageID uuid.UUID, userID int64) (*crdt.Document, *api_error.ApiError) {
+	if _, err := access.AuthorizePage(ctx, db, pageID, userID, access.ActionView); err != nil {
+		return nil, accessError(err, "page not found")
+	}
+
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to get document", err)
+	}
+	defer tx.Rollback(ctx)
+
+	doc, err := loadDocument(ctx, tx, pageID)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to get document", err)
+	}
+	return doc, nil
+}
+
+// applyDocumentUpdate merges the update into the page's document, renders the result into the page
+// and relays the writes that won to the other editors
+func applyDocumentUpdate(ctx context.Context, db *pgxpool.Pool, pageID uuid.UUID, userID int64, clientID string, update crdt.Update) (crdt.Update, *api_error.ApiError) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+	defer tx.Rollback(ctx)
+
+	workspaceID, err := access.AuthorizePage(ctx, tx, pageID, userID, access.ActionEdit)
+	if err != nil {
+		return crdt.Update{}, accessError(err, "page not found")
+	}
+
+	doc, err := loadDocument(ctx, tx, pageID)
+	if err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+
+	applied, err := doc.Apply(update)
+	if err != nil {
+		return crdt.Update{}, api_error.NewBadRequestError(err.Error(), err)
+	}
+	if len(applied.Blocks) == 0 {
+		return applied, nil
+	}
+
+	if err := compactDocument(ctx, tx, pageID, doc, clientID, update); err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+
+	state, err := json.Marshal(doc)
+	if err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+	// editors send updates as the user types, the page.updated event is published at most once per interval
+	// and the edits made meanwhile are announced later by AnnounceDocumentEdits
+	var announce bool
+	err = tx.QueryRow(ctx, `
+		INSERT INTO page_documents (page_id, state, clock) VALUES ($1, $2, $3)
+		ON CONFLICT (page_id) DO UPDATE SET state = EXCLUDED.state, clock = EXCLUDED.clock, updated_at = CURRENT_TIMESTAMP,
+			announced_at = CASE WHEN page_documents.announced_at <= CURRENT_TIMESTAMP - $4::interval
+				THEN CURRENT_TIMESTAMP ELSE page_documents.announced_at END,
+			announce_pending = page_documents.announced_at > CURRENT_TIMESTAMP - $4::interval
+		RETURNING NOT announce_pending
+	`, pageID, state, doc.Clock(), DocumentAnnounceInterval).Scan(&announce)
+	if err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+
+	content := doc.Content()
+	_, err = tx.Exec(ctx, `
+		UPDATE pages SET content = $1, text_content = $2, updated_at = CURRENT_TIMESTAMP, last_edited_by = $3 WHERE id = $4
+	`, content, doc.Text(), userID, pageID)
+	if err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+
+	if err := syncPageLinks(ctx, tx, pageID, page.ExtractPageLinks(content)); err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update page links", err)
+	}
+	if err := syncPageMentions(ctx, tx, pageID, userID, page.ExtractMentions(content)); err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update page mentions", err)
+	}
+
+	if announce {
+		err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: workspaceID, PageIDs: []uuid.UUID{pageID}, ActorID: userID})
+		if err != nil {
+			return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+		}
+	}
+
+	relayed, err := json.Marshal(applied)
+	if err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+	err = realtime.Relay(ctx, tx, realtime.Event{Type: realtime.EventDocumentUpdate, PageIDs: []uuid.UUID{pageID}, ActorID: userID, ClientID: clientID, Document: relayed})
+	if err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return crdt.Update{}, api_error.NewInternalServerError("failed to update document", err)
+	}
+	return applied, nil
+}
+
+// DocumentEditorRetention is how long an editor session counts for compaction after its last update.
+// Editors away for longer join again to get the document's state before sending updates.
+var DocumentEditorRetention = 24 * time.Hour
+
+// compactDocument records the clock the client based its update on and drops the tombstones every
+// recent editor of the page has seen
+func compactDocument(ctx context.Context, tx pgx.Tx, pageID uuid.UUID, doc *crdt.Document, clientID string, update crdt.Update) error {
+	// clients write above the clock they have seen, so their lowest counter tells how far they had got
+	based := doc.Clock()
+	for _, block := range update.Blocks {
+		for _, at := range writeTimestamps(block) {
+			if at.Counter > 0 {
+				based = min(based, at.Counter-1)
+			}
+		}
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO page_document_editors (page_id, client_id, clock) VALUES ($1, $2, $3)
+		ON CONFLICT (page_id, client_id) DO UPDATE SET clock = EXCLUDED.clock, seen_at = CURRENT_TIMESTAMP
+	`, pageID, clientID, int64(based))
+	if err != nil {
+		return fmt.Errorf("failed to record document editor: %w", err)
+	}
+
+	var horizon int64
+	err = tx.QueryRow(ctx, `
+		SELECT MIN(clock) FROM page_document_editors WHERE page_id = $1 AND seen_at > CURRENT_TIMESTAMP - $2::interval
+	`, pageID, DocumentEditorRetention).Scan(&horizon)
+	if err != nil {
+		return fmt.Errorf("failed to get document horizon: %w", err)
+	}
+	doc.Compact(uint64(horizon))
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM page_document_editors WHERE page_id = $1 AND seen_at <= CURRENT_TIMESTAMP - $2::interval
+	`, pageID, DocumentEditorRetention)
+	if err != nil {
+		return fmt.Errorf("failed to remove document editors: %w", err)
+	}
+	return nil
+}
+
+// writeTimestamps returns the timestamps of the writes of the block
+func writeTimestamps(block crdt.Block) []crdt.Timestamp {
+	var timestamps []crdt.Timestamp
+	if block.Data != nil {
+		timestamps = append(timestamps, block.Data.At)
+	}
+	if block.Position != nil {
+		timestamps = append(timestamps, block.Position.At)
+	}
+	if block.Deleted != nil {
+		timestamps = append(timestamps, block.Deleted.At)
+	}
+	for _, char := range block.Text {
+		if char.Deleted != nil {
+			timestamps = append(timestamps, *char.Deleted)
+		} else {
+			timestamps = append(timestamps, char.At)
+		}
+	}
+	return timestamps
+}
+
+// DocumentAnnounceInterval is the shortest time between two page.updated events for the edits of a document
+var DocumentAnnounceInterval = 3 * time.Second
+
+// AnnounceDocumentEdits publishes the page.updated events held back by applyDocumentUpdate once their
+// interval is over. Several instances can run it at once, each pending page is announced by one of them.
+func AnnounceDocumentEdits(ctx context.Context, db *pgxpool.Pool) error {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to announce document edits: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		UPDATE page_documents SET announce_pending = false, announced_at = CURRENT_TIMESTAMP
+		FROM pages
+		WHERE pages.id = page_documents.page_id
+		AND page_documents.announce_pending
+		AND page_documents.announced_at <= CURRENT_TIMESTAMP - $1::interval
+		RETURNING pages.id, pages.workspace_id, COALESCE(pages.last_edited_by, 0)
+	`, DocumentAnnounceInterval)
+	if err != nil {
+		return fmt.Errorf("failed to announce document edits: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (realtime.Event, error) {
+		event := realtime.Event{Type: realtime.EventPageUpdated, PageIDs: make([]uuid.UUID, 1)}
+		err := row.Scan(&event.PageIDs[0], &event.WorkspaceID, &event.ActorID)
+		return event, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to announce document edits: %w", err)
+	}
+
+	for _, event := range events {
+		if err := realtime.Publish(ctx, tx, event); err != nil {
+			return fmt.Errorf("failed to announce document edits: %w", err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// RunDocumentAnnouncer calls AnnounceDocumentEdits every interval until ctx is done
+func RunDocumentAnnouncer(ctx context.Context, db *pgxpool.Pool) {
+	ticker := time.NewTicker(DocumentAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		announceCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := AnnounceDocumentEdits(announceCtx, db); err != nil {
+			log.Printf("documents: %v", err)
+		}
+		cancel()
+	}
+}
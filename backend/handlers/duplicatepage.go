@@ -3,10 +3,14 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
 	"go_notion/backend/page"
+	"go_notion/backend/realtime"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -20,7 +24,7 @@ import (
 // maintaining this list is important to ensure that the query is updated when the schema changes.
 // this is a copy of the columns in the pages table, excluding created_at, and updated_at because these will be auto generated
 // Note: TestPageColumnsMatchSchema in backend/handlers/duplicatepage_test.go ensures this list stays in sync with the database schema
-var PageColumns = []string{"id", "created_by", "position", "text_title", "text_content", "title", "content", "is_top_level"}
+var PageColumns = []string{"id", "created_by", "workspace_id", "position", "text_title", "text_content", "title", "content", "is_top_level", "icon", "cover", "properties", "last_edited_by"}
 
 type DuplicatePageHandler struct {
 	db         *pgxpool.Pool
@@ -41,6 +45,19 @@ type DuplicatePageUrlInput struct {
 	ID string `uri:"id" binding:"required,uuid"`
 }
 
+// DuplicatePageInput is the optional body of a duplicate request,
+// without it the page and its sub pages are copied next to the original
+type DuplicatePageInput struct {
+	// IncludeChildren copies the sub pages along with the page, defaults to true
+	IncludeChildren *bool `json:"include_children"`
+	// TargetParentID puts the copy under another page, which may be in another workspace
+	TargetParentID *uuid.UUID `json:"target_parent_id"`
+	// TopLevel puts the copy at the top level of the original's workspace
+	TopLevel bool `json:"top_level"`
+	// Title replaces the default "Copy of - <title>"
+	Title *string `json:"title" binding:"omitempty,max=1000"`
+}
+
 func (h *DuplicatePageHandler) DuplicatePage(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
@@ -67,6 +84,14 @@ func (h *DuplicatePageHandler) DuplicatePage(c *gin.Context) {
 		return
 	}
 
+	var input DuplicatePageInput
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+			c.Error(api_error.NewBadRequestError(err.Error(), err))
+			return
+		}
+	}
+
 	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("failed to begin transaction", err))
@@ -74,16 +99,35 @@ func (h *DuplicatePageHandler) DuplicatePage(c *gin.Context) {
 	}
 	defer tx.Rollback(ctx)
 
-	targetPage, apiErr := h.duplicateTargetPage(ctx, tx, pageID, userIdInt)
+	idempotencyKey := c.GetHeader(IdempotencyKeyHeader)
+	if len(idempotencyKey) > 255 {
+		c.Error(api_error.NewBadRequestError("idempotency key is too long", nil))
+		return
+	}
+	if idempotencyKey != "" {
+		response, apiErr := claimIdempotencyKey(ctx, tx, userIdInt, idempotencyScopeDuplicatePage, idempotencyKey, gin.H{"page_id": pageID, "input": input}, duplicateIdempotencyTTL)
+		if apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+		if response != nil {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", response)
+			return
+		}
+	}
+
+	targetPage, apiErr := h.duplicatePageInTx(ctx, tx, userIdInt, pageID, input)
 	if apiErr != nil {
 		c.Error(apiErr)
 		return
 	}
 
-	err = h.duplicateDescendants(ctx, tx, pageID, targetPage.ID, targetPage.Position+float64(h.pageConfig.Spacing))
-	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to duplicate page", err))
-		return
+	response := gin.H{"message": "page duplicated successfully", "id": targetPage.ID, "page": targetPage.Tree}
+	if idempotencyKey != "" {
+		if err := storeIdempotentResponse(ctx, tx, userIdInt, idempotencyScopeDuplicatePage, idempotencyKey, response); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to duplicate page", err))
+			return
+		}
 	}
 
 	if err := tx.Commit(ctx); err != nil {
@@ -91,20 +135,70 @@ func (h *DuplicatePageHandler) DuplicatePage(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "page duplicated successfully", "id": targetPage.ID})
+	c.JSON(http.StatusOK, response)
+
+}
+
+// duplicatePageInTx copies the page, and its sub pages unless left out, within the transaction
+func (h *DuplicatePageHandler) duplicatePageInTx(ctx context.Context, tx pgx.Tx, userID int64, pageID uuid.UUID, input DuplicatePageInput) (*DuplicatedPage, *api_error.ApiError) {
+	if input.TargetParentID != nil && input.TopLevel {
+		return nil, api_error.NewBadRequestError("target_parent_id and top_level cannot be combined", nil)
+	}
+
+	targetPage, apiErr := h.duplicateTargetPage(ctx, tx, pageID, userID, input)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	pageIDs := []uuid.UUID{targetPage.ID}
+	if input.IncludeChildren == nil || *input.IncludeChildren {
+		// the sub pages follow the copy, even into another workspace
+		overrides := map[string]pageOverride{"workspace_id": {Value: targetPage.WorkspaceID, Type: "bigint"}}
+		descendants, err := h.duplicateDescendants(ctx, tx, pageID, targetPage.ID, targetPage.Position+float64(h.pageConfig.Spacing), overrides)
+		if err != nil {
+			return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		}
+		for _, descendantID := range descendants {
+			pageIDs = append(pageIDs, descendantID)
+		}
+	}
+
+	if err := syncCopiedPageReferences(ctx, tx, pageIDs, userID); err != nil {
+		return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+	}
+
+	tree, err := duplicatedPageTree(ctx, tx, targetPage.ID, pageIDs)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+	}
+	targetPage.Tree = tree
 
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageDuplicated, WorkspaceID: targetPage.WorkspaceID, PageIDs: pageIDs, ActorID: userID})
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+	}
+
+	return targetPage, nil
 }
 
 type DuplicatedPage struct {
-	ID       uuid.UUID
-	Position float64
+	ID          uuid.UUID
+	WorkspaceID int64
+	Position    float64
+	// Tree is the copy with its copied sub pages
+	Tree SubPage
 }
 
-func (h *DuplicatePageHandler) duplicateTargetPage(ctx context.Context, tx pgx.Tx, pageID uuid.UUID, userIdInt int64) (*DuplicatedPage, *api_error.ApiError) {
+func (h *DuplicatePageHandler) duplicateTargetPage(ctx context.Context, tx pgx.Tx, pageID uuid.UUID, userIdInt int64, input DuplicatePageInput) (*DuplicatedPage, *api_error.ApiError) {
+	workspaceID, err := access.AuthorizePage(ctx, tx, pageID, userIdInt, access.ActionManage)
+	if err != nil {
+		return nil, accessError(err, "page not found")
+	}
+
 	var pageTitle sql.NullString
-	err := tx.QueryRow(ctx, `
-		SELECT text_title FROM pages WHERE id = $1 AND created_by = $2
-	`, pageID, userIdInt).Scan(&pageTitle)
+	err = tx.QueryRow(ctx, `
+		SELECT text_title FROM pages WHERE id = $1
+	`, pageID).Scan(&pageTitle)
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, api_error.NewNotFoundError("page not found", nil)
@@ -113,16 +207,46 @@ func (h *DuplicatePageHandler) duplicateTargetPage(ctx context.Context, tx pgx.T
 	if err != nil {
 		return nil, api_error.NewInternalServerError("error getting page to duplicate", err)
 	}
+
+	var overrides map[string]pageOverride
+	if input.TargetParentID != nil {
+		workspaceID, err = access.AuthorizePage(ctx, tx, *input.TargetParentID, userIdInt, access.ActionEdit)
+		if err != nil {
+			return nil, accessError(err, "target parent page not found")
+		}
+
+		// the sub pages are read after the copy is placed, a copy inside the original would be copied again
+		var insideOriginal bool
+		err = tx.QueryRow(ctx, `
+			SELECT EXISTS(
+				SELECT 1 FROM pages_closures WHERE ancestor_id = $1 AND descendant_id = $2
+			)
+		`, pageID, *input.TargetParentID).Scan(&insideOriginal)
+		if err != nil {
+			return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		}
+		if insideOriginal || *input.TargetParentID == pageID {
+			return nil, api_error.NewBadRequestError("cannot duplicate page into itself", nil)
+		}
+
+		overrides = map[string]pageOverride{
+			"workspace_id": {Value: workspaceID, Type: "bigint"},
+			"is_top_level": {Value: false, Type: "boolean"},
+		}
+	} else if input.TopLevel {
+		overrides = map[string]pageOverride{"is_top_level": {Value: true, Type: "boolean"}}
+	}
+
 	var position float64
 
 	err = tx.QueryRow(ctx, `
-		SELECT COALESCE(MAX(position), 0) FROM pages WHERE created_by = $1
-	`, userIdInt).Scan(&position)
+		SELECT COALESCE(MAX(position), 0) FROM pages WHERE workspace_id = $1
+	`, workspaceID).Scan(&position)
 	if err != nil {
 		return nil, api_error.NewInternalServerError("failed to duplicate page", err)
 	}
 
-	m, err := h.duplicatePages(ctx, tx, []uuid.UUID{pageID}, position)
+	m, err := h.duplicatePages(ctx, tx, []uuid.UUID{pageID}, position, overrides)
 	if err != nil {
 		return nil, api_error.NewInternalServerError("failed to duplicate page", err)
 	}
@@ -132,7 +256,9 @@ func (h *DuplicatePageHandler) duplicateTargetPage(ctx context.Context, tx pgx.T
 	}
 
 	var newPageTitle string
-	if pageTitle.Valid {
+	if input.Title != nil {
+		newPageTitle = *input.Title
+	} else if pageTitle.Valid {
 		newPageTitle = fmt.Sprintf("Copy of - %s", pageTitle.String)
 	} else {
 		newPageTitle = "Copy"
@@ -145,30 +271,113 @@ func (h *DuplicatePageHandler) duplicateTargetPage(ctx context.Context, tx pgx.T
 		return nil, api_error.NewInternalServerError("failed to change page title", err)
 	}
 
-	ancestors, err := page.GetAncestors(ctx, tx, []uuid.UUID{pageID})
+	if input.TargetParentID != nil {
+		if err := insertParentClosures(ctx, tx, *input.TargetParentID, newPageID); err != nil {
+			return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		}
+		if err := conformToParentDatabase(ctx, tx, newPageID); err != nil {
+			return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		}
+	} else if !input.TopLevel {
+		ancestors, err := page.GetAncestors(ctx, tx, []uuid.UUID{pageID})
+		if err != nil {
+			return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		}
+		pageAncestors := ancestors[pageID]
+
+		// we need to replace pageId with newPageId in the pageAncestors
+		for i := range pageAncestors {
+			pageAncestors[i].DescendantID = newPageID
+		}
+
+		err = page.InsertPageClosures(ctx, tx, pageAncestors)
+		if err != nil {
+			return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		}
+	}
+
+	return &DuplicatedPage{ID: newPageID, WorkspaceID: workspaceID, Position: position}, nil
+}
+
+// syncCopiedPageReferences records the links and mentions in the content of the copied pages. It runs once
+// the copies are in the tree, so the mentioned users are notified if the copies are visible to them.
+func syncCopiedPageReferences(ctx context.Context, tx pgx.Tx, pageIDs []uuid.UUID, actorID int64) error {
+	rows, err := tx.Query(ctx, `SELECT id, content FROM pages WHERE id = ANY($1)`, pageIDs)
 	if err != nil {
-		return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		return fmt.Errorf("failed to get copied pages: %w", err)
+	}
+	type copiedPage struct {
+		ID      uuid.UUID
+		Content json.RawMessage
+	}
+	copies, err := pgx.CollectRows(rows, pgx.RowToStructByPos[copiedPage])
+	if err != nil {
+		return fmt.Errorf("failed to get copied pages: %w", err)
 	}
-	pageAncestors := ancestors[pageID]
 
-	// we need to replace pageId with newPageId in the pageAncestors
-	for i := range pageAncestors {
-		pageAncestors[i].DescendantID = newPageID
+	for _, copied := range copies {
+		if err := syncPageLinks(ctx, tx, copied.ID, page.ExtractPageLinks(copied.Content)); err != nil {
+			return err
+		}
+		if err := syncPageMentions(ctx, tx, copied.ID, actorID, page.ExtractMentions(copied.Content)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	err = page.InsertPageClosures(ctx, tx, pageAncestors)
+// duplicatedPageTree builds the tree of the copied pages under the new page, ordered by position
+func duplicatedPageTree(ctx context.Context, tx pgx.Tx, newPageID uuid.UUID, pageIDs []uuid.UUID) (SubPage, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT `+subPageColumns+`, parents.ancestor_id
+		FROM pages
+		LEFT JOIN pages_closures parents ON parents.descendant_id = pages.id AND parents.is_parent
+		WHERE pages.id = ANY($1)
+		ORDER BY pages.position
+	`, pageIDs)
 	if err != nil {
-		return nil, api_error.NewInternalServerError("failed to duplicate page", err)
+		return SubPage{}, fmt.Errorf("failed to get duplicated pages: %w", err)
+	}
+	defer rows.Close()
+
+	pages := make(map[uuid.UUID]SubPage, len(pageIDs))
+	children := make(map[uuid.UUID][]uuid.UUID, len(pageIDs))
+	for rows.Next() {
+		var subPage SubPage
+		var parentID *uuid.UUID
+		if err := scanSubPage(rows, &subPage, &parentID); err != nil {
+			return SubPage{}, fmt.Errorf("failed to scan duplicated page: %w", err)
+		}
+		pages[subPage.ID] = subPage
+		if parentID != nil && subPage.ID != newPageID {
+			children[*parentID] = append(children[*parentID], subPage.ID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return SubPage{}, fmt.Errorf("failed to get duplicated pages: %w", err)
 	}
 
-	return &DuplicatedPage{ID: newPageID, Position: position}, nil
+	var buildTree func(pageID uuid.UUID) SubPage
+	buildTree = func(pageID uuid.UUID) SubPage {
+		subPages := []SubPage{}
+		for _, childID := range children[pageID] {
+			subPages = append(subPages, buildTree(childID))
+		}
+		subPage := pages[pageID]
+		subPage.SubPages = subPages
+		return subPage
+	}
+	return buildTree(newPageID), nil
 }
 
-func (h *DuplicatePageHandler) duplicateDescendants(ctx context.Context, tx pgx.Tx, pageID uuid.UUID, newPageID uuid.UUID, lastPagePosition float64) error {
+// duplicateDescendants copies the sub pages of pageID under newPageID, which must already have its closures.
+// The copies get the ancestors of newPageID, so the new page may live somewhere else than the original.
+// It returns the ids of the copies keyed by the ids of the originals.
+func (h *DuplicatePageHandler) duplicateDescendants(ctx context.Context, tx pgx.Tx, pageID uuid.UUID, newPageID uuid.UUID, lastPagePosition float64, overrides map[string]pageOverride) (map[uuid.UUID]uuid.UUID, error) {
 
 	mappingOfDescendantsWithAllAncestors, err := page.GetAllDescendantsWithAllAncestors(ctx, tx.Conn(), []uuid.UUID{pageID})
 	if err != nil {
-		return fmt.Errorf("failed to get all descendants: %w", err)
+		return nil, fmt.Errorf("failed to get all descendants: %w", err)
 	}
 	uniqueDescendants := make(map[uuid.UUID]struct{})
 	for descendantID := range mappingOfDescendantsWithAllAncestors {
@@ -180,19 +389,26 @@ func (h *DuplicatePageHandler) duplicateDescendants(ctx context.Context, tx pgx.
 		descendantIds = append(descendantIds, descendantID)
 	}
 
-	mappingOfOldDescendantToNewDescendantId, err := h.duplicatePages(ctx, tx, descendantIds, lastPagePosition)
+	mappingOfOldDescendantToNewDescendantId, err := h.duplicatePages(ctx, tx, descendantIds, lastPagePosition, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate descendant pages: %w", err)
+	}
+
+	newPageAncestors, err := getAncestorIds(ctx, tx, []uuid.UUID{newPageID})
 	if err != nil {
-		return fmt.Errorf("failed to duplicate descendant pages: %w", err)
+		return nil, fmt.Errorf("failed to get ancestors of new page: %w", err)
 	}
 
 	var newPageClosureInserts []page.Closure
+	newDescendantIds := make([]uuid.UUID, 0, len(mappingOfOldDescendantToNewDescendantId))
 
 	for descendantId, ancestors := range mappingOfDescendantsWithAllAncestors {
 		newDescendantID, ok := mappingOfOldDescendantToNewDescendantId[descendantId]
 
 		if !ok {
-			return fmt.Errorf("failed to find new descendant id for descendant %s", descendantId)
+			return nil, fmt.Errorf("failed to find new descendant id for descendant %s", descendantId)
 		}
+		newDescendantIds = append(newDescendantIds, newDescendantID)
 
 		for _, closure := range ancestors {
 			ancestorID := closure.AncestorID
@@ -208,25 +424,33 @@ func (h *DuplicatePageHandler) duplicateDescendants(ctx context.Context, tx pgx.
 				newPageClosureInserts = append(newPageClosureInserts, page.Closure{AncestorID: newAncestorID, DescendantID: newDescendantID, IsParent: closure.IsParent})
 				continue
 			}
-			newPageClosureInserts = append(newPageClosureInserts, page.Closure{AncestorID: ancestorID, DescendantID: newDescendantID, IsParent: closure.IsParent})
 
+			// the ancestors above the original page are replaced by the ancestors of the new page below
 		}
 	}
 
+	newPageClosureInserts = append(newPageClosureInserts, generateAncestorClosuresForDescendants(newPageAncestors[newPageID], newDescendantIds)...)
 	err = page.InsertPageClosures(ctx, tx, newPageClosureInserts)
 	if err != nil {
-		return fmt.Errorf("failed to insert new page closures: %w", err)
+		return nil, fmt.Errorf("failed to insert new page closures: %w", err)
 	}
 
-	return nil
+	return mappingOfOldDescendantToNewDescendantId, nil
 }
 
-func (h *DuplicatePageHandler) duplicatePages(ctx context.Context, tx pgx.Tx, pageIds []uuid.UUID, lastPagePosition float64) (map[uuid.UUID]uuid.UUID, error) {
+// pageOverride replaces a column of the copied pages with a fixed value,
+// Type is the postgres type of the column so the parameter can be inferred
+type pageOverride struct {
+	Value any
+	Type  string
+}
+
+func (h *DuplicatePageHandler) duplicatePages(ctx context.Context, tx pgx.Tx, pageIds []uuid.UUID, lastPagePosition float64, overrides map[string]pageOverride) (map[uuid.UUID]uuid.UUID, error) {
 	if len(pageIds) == 0 {
 		return nil, nil
 	}
 	valueStrings := make([]string, 0, len(pageIds))
-	valueArgs := make([]interface{}, 0, len(pageIds))
+	valueArgs := make([]interface{}, 0, len(pageIds)*3+len(overrides))
 	mappingOfOldPageIdToNewPageId := make(map[uuid.UUID]uuid.UUID, len(pageIds))
 	for i, pageId := range pageIds {
 		newPageId, err := uuid.NewV4()
@@ -246,6 +470,9 @@ func (h *DuplicatePageHandler) duplicatePages(ctx context.Context, tx pgx.Tx, pa
 			columnsToSelect = append(columnsToSelect, "v.new_page_id as id")
 		} else if col == "position" {
 			columnsToSelect = append(columnsToSelect, "v.new_position as position")
+		} else if override, ok := overrides[col]; ok {
+			valueArgs = append(valueArgs, override.Value)
+			columnsToSelect = append(columnsToSelect, fmt.Sprintf("$%d::%s as %s", len(valueArgs), override.Type, col))
 		} else {
 			columnsToSelect = append(columnsToSelect, col)
 		}
@@ -265,6 +492,18 @@ func (h *DuplicatePageHandler) duplicatePages(ctx context.Context, tx pgx.Tx, pa
 		return nil, fmt.Errorf("failed to duplicate pages in bulk: %w", err)
 	}
 
+	// copies of databases are databases with the same schema, their copied rows keep their values
+	_, err = tx.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO page_databases (page_id, schema, created_by)
+		SELECT v.new_page_id, page_databases.schema, page_databases.created_by
+		FROM page_databases
+		CROSS JOIN (VALUES %s) AS v(id, new_page_id, new_position)
+		WHERE page_databases.page_id = v.id
+	`, strings.Join(valueStrings, ",")), valueArgs[:len(pageIds)*3]...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate databases: %w", err)
+	}
+
 	return mappingOfOldPageIdToNewPageId, nil
 
 }
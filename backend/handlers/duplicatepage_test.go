@@ -2,6 +2,7 @@ package handlers_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"go_notion/backend/db"
 	"go_notion/backend/handlers"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -168,3 +170,163 @@ func TestDuplicatePageWithNestedPages(t *testing.T) {
 		})
 	}
 }
+
+func TestDuplicatePageWithIdempotencyKey(t *testing.T) {
+	pageId := uuid.Must(uuid.NewV4())
+	otherPageId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.InsertTestPageFixture(pageId, 1), db.InsertTestPageFixtureWithPosition(otherPageId, 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	duplicatePage, err := handlers.NewDuplicatePageHandler(pool, page.NewPageConfig(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	duplicate := func(id uuid.UUID, key string) *httptest.ResponseRecorder {
+		r := router.NewRouter()
+		r.POST("/api/pages/:id/duplicate", func(c *gin.Context) {
+			c.Set("user_id", int64(1))
+			duplicatePage.DuplicatePage(c)
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/pages/"+id.String()+"/duplicate", nil)
+		if key != "" {
+			req.Header.Set(handlers.IdempotencyKeyHeader, key)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	countPages := func() int {
+		var count int
+		if err := pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM pages").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	first := duplicate(pageId, "retry-me")
+	assert.Equal(t, http.StatusOK, first.Code)
+	retry := duplicate(pageId, "retry-me")
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.JSONEq(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, 3, countPages())
+
+	// the key can't be reused for another page
+	assert.Equal(t, http.StatusConflict, duplicate(otherPageId, "retry-me").Code)
+
+	// without a key every request makes a copy
+	assert.Equal(t, http.StatusOK, duplicate(pageId, "").Code)
+	assert.Equal(t, http.StatusOK, duplicate(pageId, "").Code)
+	assert.Equal(t, 5, countPages())
+}
+
+func TestDuplicatePageWithOptions(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	targetId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.InsertTestPageFixtureWithParent(childId, parentId, 1), db.InsertTestPageFixtureWithPosition(targetId, 1, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	duplicatePage, err := handlers.NewDuplicatePageHandler(pool, page.NewPageConfig(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	duplicate := func(id uuid.UUID, body string) *httptest.ResponseRecorder {
+		r := router.NewRouter()
+		r.POST("/api/pages/:id/duplicate", func(c *gin.Context) {
+			c.Set("user_id", int64(1))
+			duplicatePage.DuplicatePage(c)
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/pages/"+id.String()+"/duplicate", strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+	copied := func(w *httptest.ResponseRecorder) handlers.SubPage {
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response struct {
+			Page handlers.SubPage `json:"page"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Page
+	}
+	ancestorsOf := func(id uuid.UUID) []uuid.UUID {
+		var ancestors []uuid.UUID
+		err := pool.QueryRow(context.Background(), `
+			SELECT COALESCE(array_agg(ancestor_id), '{}') FROM pages_closures WHERE descendant_id = $1
+		`, id).Scan(&ancestors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ancestors
+	}
+
+	t.Run("without children and with a title", func(t *testing.T) {
+		tree := copied(duplicate(parentId, `{"include_children": false, "title": "Shallow"}`))
+		assert.Empty(t, tree.SubPages)
+		if assert.NotNil(t, tree.TextTitle) {
+			assert.Equal(t, "Shallow", *tree.TextTitle)
+		}
+	})
+
+	t.Run("under another parent", func(t *testing.T) {
+		tree := copied(duplicate(parentId, `{"target_parent_id": "`+targetId.String()+`"}`))
+		assert.ElementsMatch(t, []uuid.UUID{targetId}, ancestorsOf(tree.ID))
+		if assert.Len(t, tree.SubPages, 1) {
+			assert.NotEqual(t, childId, tree.SubPages[0].ID)
+			assert.ElementsMatch(t, []uuid.UUID{tree.ID, targetId}, ancestorsOf(tree.SubPages[0].ID))
+		}
+	})
+
+	t.Run("at the top level", func(t *testing.T) {
+		tree := copied(duplicate(childId, `{"top_level": true}`))
+		assert.Empty(t, ancestorsOf(tree.ID))
+
+		var isTopLevel bool
+		if err := pool.QueryRow(context.Background(), `SELECT is_top_level FROM pages WHERE id = $1`, tree.ID).Scan(&isTopLevel); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, isTopLevel)
+	})
+
+	t.Run("copies keep their links and mentions", func(t *testing.T) {
+		content := `{"type": "doc", "content": [
+			{"type": "pageLink", "attrs": {"page_id": "` + targetId.String() + `"}},
+			{"type": "mention", "attrs": {"user_id": 1}}
+		]}`
+		if _, err := pool.Exec(context.Background(), `UPDATE pages SET content = $1 WHERE id = $2`, content, childId); err != nil {
+			t.Fatal(err)
+		}
+
+		tree := copied(duplicate(parentId, `{}`))
+		if !assert.Len(t, tree.SubPages, 1) {
+			return
+		}
+		var linked, mentioned int
+		err := pool.QueryRow(context.Background(), `
+			SELECT
+				(SELECT count(*) FROM page_links WHERE source_page_id = $1 AND target_page_id = $2),
+				(SELECT count(*) FROM page_mentions WHERE page_id = $1 AND user_id = 1)
+		`, tree.SubPages[0].ID, targetId).Scan(&linked, &mentioned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, linked)
+		assert.Equal(t, 1, mentioned)
+	})
+
+	t.Run("rejects invalid targets", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, duplicate(parentId, `{"target_parent_id": "`+childId.String()+`"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, duplicate(parentId, `{"target_parent_id": "`+targetId.String()+`", "top_level": true}`).Code)
+		assert.Equal(t, http.StatusNotFound, duplicate(parentId, `{"target_parent_id": "`+uuid.Must(uuid.NewV4()).String()+`"}`).Code)
+	})
+}
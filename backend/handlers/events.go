@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go_notion/backend/api_error"
+	"go_notion/backend/realtime"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// eventsReplayBatch is how many logged events are read at a time when a client resumes
+const eventsReplayBatch = 500
+
+// eventsHeartbeat keeps idle streams from being closed by proxies
+const eventsHeartbeat = 25 * time.Second
+
+type EventsHandler struct {
+	db  *pgxpool.Pool
+	hub *realtime.Hub
+}
+
+func NewEventsHandler(db *pgxpool.Pool, hub *realtime.Hub) (*EventsHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	if hub == nil {
+		return nil, fmt.Errorf("hub cannot be nil")
+	}
+	return &EventsHandler{db, hub}, nil
+}
+
+type StreamEventsQuery struct {
+	// LastEventID is a fallback for the Last-Event-ID header, for clients that can't set it
+	LastEventID *int64 `form:"last_event_id" binding:"omitempty,min=0"`
+}
+
+// StreamEvents streams the page events of the workspaces the user is a member of, and of the pages shared with
+// them, as server-sent events. Every event is checked against the user's access when it is sent, so joined
+// workspaces and shared pages show up and lost ones stop without reconnecting.
+// Clients resuming with Last-Event-ID first get the logged events they missed.
+func (h *EventsHandler) StreamEvents(c *gin.Context) {
+	userIdInt, apiErr := contextUserID(c, "not authorized to stream events")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var query StreamEventsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	lastEventID := query.LastEventID
+	if header := c.GetHeader("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || id < 0 {
+			c.Error(api_error.NewBadRequestError("invalid Last-Event-ID", err))
+			return
+		}
+		lastEventID = &id
+	}
+
+	// the client is registered before reading the log so nothing published meanwhile is lost,
+	// the live events already replayed are skipped below
+	client := h.hub.Register(userIdInt)
+	defer h.hub.Unregister(client)
+	client.SubscribeAll()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// nginx buffers responses by default, which would hold the events back
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	var replayedUpTo int64
+	if lastEventID != nil {
+		replayedUpTo = *lastEventID
+		for {
+			events, read, err := h.readEvents(c.Request.Context(), userIdInt, replayedUpTo)
+			if err != nil {
+				// headers are sent already, the client reconnects with the last id it got
+				return
+			}
+			for _, event := range events {
+				if err := writeServerSentEvent(c.Writer, event); err != nil {
+					return
+				}
+			}
+			if read == 0 {
+				break
+			}
+			replayedUpTo = read
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-client.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		case event := <-client.Events():
+			if event.ID != 0 && event.ID <= replayedUpTo {
+				continue
+			}
+			visible, err := h.visibleEvents(c.Request.Context(), userIdInt, []realtime.Event{event})
+			if err != nil {
+				log.Printf("events: failed to check access of user %d: %v", userIdInt, err)
+				return
+			}
+			for _, event := range visible {
+				if err := writeServerSentEvent(c.Writer, event); err != nil {
+					return
+				}
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// readEvents returns the logged events after the given id the user can see, and the id of the last event read,
+// 0 once there are no more
+func (h *EventsHandler) readEvents(ctx context.Context, userID int64, afterID int64) ([]realtime.Event, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	workspaceIDs, _, err := eventWorkspaceIDs(ctx, h.db, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	events, err := realtime.ReadEvents(ctx, h.db, afterID, workspaceIDs, eventsReplayBatch)
+	if err != nil || len(events) == 0 {
+		return nil, 0, err
+	}
+	visible, err := h.visibleEvents(ctx, userID, events)
+	if err != nil {
+		return nil, 0, err
+	}
+	return visible, events[len(events)-1].ID, nil
+}
+
+// visibleEvents narrows the events to what the user can see now. Members of the workspace get its events as
+// they are, others only get the events of pages shared with them, with the ids of the other pages left out.
+// Pages deleted in a workspace the user isn't a member of can't be checked anymore, sync tombstones them.
+func (h *EventsHandler) visibleEvents(ctx context.Context, userID int64, events []realtime.Event) ([]realtime.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	_, member, err := eventWorkspaceIDs(ctx, h.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []uuid.UUID
+	for _, event := range events {
+		if event.Type != realtime.EventResync && !member[event.WorkspaceID] {
+			candidates = append(candidates, event.PageIDs...)
+		}
+	}
+	shared := make(map[uuid.UUID]bool)
+	if len(candidates) > 0 {
+		rows, err := h.db.Query(ctx, `SELECT pages.id FROM pages WHERE pages.id = ANY($2) AND `+visiblePagesClause, userID, candidates)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get shared pages: %w", err)
+		}
+		pageIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get shared pages: %w", err)
+		}
+		for _, pageID := range pageIDs {
+			shared[pageID] = true
+		}
+	}
+
+	visible := make([]realtime.Event, 0, len(events))
+	for _, event := range events {
+		if event.Type == realtime.EventResync || member[event.WorkspaceID] {
+			visible = append(visible, event)
+			continue
+		}
+		var pageIDs []uuid.UUID
+		for _, pageID := range event.PageIDs {
+			if shared[pageID] {
+				pageIDs = append(pageIDs, pageID)
+			}
+		}
+		if len(pageIDs) > 0 {
+			event.PageIDs = pageIDs
+			visible = append(visible, event)
+		}
+	}
+	return visible, nil
+}
+
+// writeServerSentEvent writes the event in the text/event-stream format. Events that aren't in the log,
+// like resync, have no id so they don't move the client's resume position.
+func writeServerSentEvent(w io.Writer, event realtime.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+func (h *EventsHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/events", h.StreamEvents)
+}
@@ -0,0 +1,179 @@
+package handlers_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/realtime"
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamEvents(t *testing.T) {
+	pageId := uuid.Must(uuid.NewV4())
+	otherPageId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("other@example.com", "other", "password"),
+		db.InsertTestPageFixture(pageId, 1),
+		db.InsertTestPageFixture(otherPageId, 2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	hub := realtime.NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Listen(ctx, pool)
+
+	events, err := handlers.NewEventsHandler(pool, hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.Use(func(c *gin.Context) {
+		userID := int64(1)
+		if c.GetHeader("X-Test-User") == "2" {
+			userID = 2
+		}
+		c.Set("user_id", userID)
+	})
+	api := r.Group("/api")
+	events.RegisterRoutes(api)
+	updatePage.RegisterRoutes(api)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	update := func(userID string, id uuid.UUID) {
+		body := `{"title_text": "title", "content_text": "content", "raw_title": {}, "raw_content": {}}`
+		req, _ := http.NewRequest("PUT", server.URL+"/api/pages/"+id.String(), strings.NewReader(body))
+		req.Header.Set("X-Test-User", userID)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	type received struct {
+		id    string
+		event realtime.Event
+	}
+	stream := func(userID, lastEventID string) (<-chan received, func()) {
+		streamCtx, stop := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(streamCtx, "GET", server.URL+"/api/events", nil)
+		req.Header.Set("X-Test-User", userID)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+		ch := make(chan received, 16)
+		go func() {
+			defer res.Body.Close()
+			scanner := bufio.NewScanner(res.Body)
+			var current received
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, "id: "):
+					current.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "data: "):
+					json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &current.event)
+				case line == "" && current.event.Type != "":
+					ch <- current
+					current = received{}
+				}
+			}
+		}()
+		return ch, stop
+	}
+	next := func(ch <-chan received, timeout time.Duration) (received, bool) {
+		select {
+		case r := <-ch:
+			return r, true
+		case <-time.After(timeout):
+			return received{}, false
+		}
+	}
+
+	update("1", pageId)
+	update("2", otherPageId)
+	update("1", pageId)
+
+	// resuming from the start replays the user's events only
+	ch, stop := stream("1", "0")
+	first, ok := next(ch, 2*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, realtime.EventPageUpdated, first.event.Type)
+	assert.Equal(t, []uuid.UUID{pageId}, first.event.PageIDs)
+	second, ok := next(ch, 2*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, []uuid.UUID{pageId}, second.event.PageIDs)
+	assert.Greater(t, second.event.ID, first.event.ID)
+	_, ok = next(ch, 200*time.Millisecond)
+	assert.False(t, ok)
+	stop()
+
+	// resuming after the first event only replays the second
+	ch, stop = stream("1", first.id)
+	replayed, ok := next(ch, 2*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, second.id, replayed.id)
+
+	// live events follow, the listener may still be starting so keep editing until one comes through
+	var live received
+	ok = false
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && !ok {
+		update("1", pageId)
+		live, ok = next(ch, 500*time.Millisecond)
+	}
+	assert.True(t, ok)
+	assert.Greater(t, live.event.ID, second.event.ID)
+	stop()
+
+	// access is checked as events are sent, so pages shared after the stream started come through
+	// and pages unshared since stop
+	ch, stop = stream("2", "")
+	defer stop()
+	_, err = pool.Exec(context.Background(), `INSERT INTO page_permissions (page_id, user_id, level) VALUES ($1, 2, 'viewer')`, pageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update("1", pageId)
+	shared, ok := next(ch, 2*time.Second)
+	if assert.True(t, ok) {
+		assert.Equal(t, []uuid.UUID{pageId}, shared.event.PageIDs)
+	}
+
+	_, err = pool.Exec(context.Background(), `DELETE FROM page_permissions WHERE page_id = $1 AND user_id = 2`, pageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update("1", pageId)
+	_, ok = next(ch, 500*time.Millisecond)
+	assert.False(t, ok)
+}
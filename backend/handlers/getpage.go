@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
 	"go_notion/backend/page"
 	"net/http"
@@ -57,7 +58,12 @@ func (gp *GetPageHandler) GetPage(c *gin.Context) {
 		return
 	}
 
-	pages, err := page.GetPages(ctx, gp.db, "id = $1 AND created_by = $2", pageID, userIdInt)
+	if _, err := access.AuthorizePage(ctx, gp.db, pageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	pages, err := page.GetPages(ctx, gp.db, "id = $1", pageID)
 	if err == pgx.ErrNoRows {
 		c.Error(api_error.NewNotFoundError("page not found", nil))
 		return
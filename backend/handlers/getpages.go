@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
 	"go_notion/backend/page"
 	"net/http"
@@ -10,6 +12,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -46,7 +49,17 @@ func (gp *GetPagesHandler) GetPages(c *gin.Context) {
 		return
 	}
 
-	pages, err := gp.getTopLevelPages(ctx, params, userIdInt)
+	workspaceID, apiErr := resolveWorkspaceID(ctx, gp.db, params.WorkspaceID, userIdInt)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+	if _, err := access.AuthorizeWorkspace(ctx, gp.db, workspaceID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "workspace not found"))
+		return
+	}
+
+	pages, err := gp.getTopLevelPages(ctx, params, workspaceID)
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("failed to get pages", err))
 		return
@@ -57,7 +70,7 @@ func (gp *GetPagesHandler) GetPages(c *gin.Context) {
 		pageIds = append(pageIds, page.ID)
 	}
 
-	mapOfPageIdToSubPages, err := gp.generateSubPagesForTopLevelPages(ctx, pageIds)
+	mapOfPageIdToSubPages, err := generateSubPagesForPages(ctx, gp.db, pageIds)
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("failed to get pages", err))
 		return
@@ -74,7 +87,7 @@ func (gp *GetPagesHandler) GetPages(c *gin.Context) {
 	})
 }
 
-func (gp *GetPagesHandler) getTopLevelPages(ctx context.Context, params *GetPagesParams, userId int64) ([]page.Page, error) {
+func (gp *GetPagesHandler) getTopLevelPages(ctx context.Context, params *GetPagesParams, workspaceID int64) ([]page.Page, error) {
 
 	size := 10
 	if params.Size != nil {
@@ -84,12 +97,12 @@ func (gp *GetPagesHandler) getTopLevelPages(ctx context.Context, params *GetPage
 	var pages []page.Page
 	var err error
 	if params.CreatedBefore != nil {
-		pages, err = page.GetPages(ctx, gp.db, "created_by = $1 AND is_top_level = true AND created_at < $2 ORDER BY created_at DESC LIMIT $3", userId, params.CreatedBefore, size)
+		pages, err = page.GetPages(ctx, gp.db, "workspace_id = $1 AND is_top_level = true AND created_at < $2 ORDER BY created_at DESC LIMIT $3", workspaceID, params.CreatedBefore, size)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		pages, err = page.GetPages(ctx, gp.db, "created_by = $1 AND is_top_level = true ORDER BY created_at DESC LIMIT $2", userId, size)
+		pages, err = page.GetPages(ctx, gp.db, "workspace_id = $1 AND is_top_level = true ORDER BY created_at DESC LIMIT $2", workspaceID, size)
 		if err != nil {
 			return nil, err
 		}
@@ -101,6 +114,8 @@ func (gp *GetPagesHandler) getTopLevelPages(ctx context.Context, params *GetPage
 type GetPagesParams struct {
 	Size          *int       `form:"size,omitempty" binding:"omitempty,min=1,max=100"`
 	CreatedBefore *time.Time `form:"created_before,omitempty"`
+	// WorkspaceID defaults to the user's personal workspace
+	WorkspaceID *int64 `form:"workspace_id,omitempty"`
 }
 
 func getPagesParamsFromQuery(c *gin.Context) (*GetPagesParams, error) {
@@ -121,14 +136,27 @@ type PageWithSubPages struct {
 }
 
 type SubPage struct {
-	ID        uuid.UUID `json:"id"`
-	TextTitle *string   `json:"text_title"`
-	SubPages  []SubPage `json:"sub_pages"`
+	ID           uuid.UUID       `json:"id"`
+	TextTitle    *string         `json:"text_title"`
+	Icon         *string         `json:"icon"`
+	Cover        *string         `json:"cover"`
+	Properties   json.RawMessage `json:"properties"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	LastEditedBy *int64          `json:"last_edited_by"`
+	SubPages     []SubPage       `json:"sub_pages"`
+}
+
+// subPageColumns are the columns scanned by scanSubPage
+const subPageColumns = "pages.id, pages.text_title, pages.icon, pages.cover, pages.properties, pages.updated_at, pages.last_edited_by"
+
+func scanSubPage(row pgx.Row, subPage *SubPage, extra ...any) error {
+	return row.Scan(append([]any{&subPage.ID, &subPage.TextTitle, &subPage.Icon, &subPage.Cover, &subPage.Properties, &subPage.UpdatedAt, &subPage.LastEditedBy}, extra...)...)
 }
 
-func (gp *GetPagesHandler) generateSubPagesForTopLevelPages(ctx context.Context, pageIds []uuid.UUID) (map[uuid.UUID][]SubPage, error) {
+// generateSubPagesForPages builds the tree of sub pages under each of the pages
+func generateSubPagesForPages(ctx context.Context, db *pgxpool.Pool, pageIds []uuid.UUID) (map[uuid.UUID][]SubPage, error) {
 
-	mappingOfAncestorIdToDescendants, err := gp.getAncestorToDescendantsMapping(ctx, pageIds)
+	mappingOfAncestorIdToDescendants, err := getAncestorToDescendantsMapping(ctx, db, pageIds)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get ancestor to descendants mapping: %w", err)
 	}
@@ -144,24 +172,23 @@ func (gp *GetPagesHandler) generateSubPagesForTopLevelPages(ctx context.Context,
 		descendantIds = append(descendantIds, descendantId)
 	}
 
-	rows, err := gp.db.Query(ctx, `
-		SELECT id, text_title
+	rows, err := db.Query(ctx, `
+		SELECT `+subPageColumns+`
 		FROM pages
 		WHERE id = ANY($1)
 	`, descendantIds)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to get text title for descendants: %w", err)
+		return nil, fmt.Errorf("failed to get descendants: %w", err)
 	}
 
-	var mappingOfDescendantIdToTextTitle = make(map[uuid.UUID]*string)
+	var mappingOfDescendantIdToSubPage = make(map[uuid.UUID]SubPage)
 	for rows.Next() {
-		var id uuid.UUID
-		var textTitle *string
-		if err := rows.Scan(&id, &textTitle); err != nil {
-			return nil, fmt.Errorf("failed to scan text title for descendant: %w", err)
+		var subPage SubPage
+		if err := scanSubPage(rows, &subPage); err != nil {
+			return nil, fmt.Errorf("failed to scan descendant: %w", err)
 		}
-		mappingOfDescendantIdToTextTitle[id] = textTitle
+		mappingOfDescendantIdToSubPage[subPage.ID] = subPage
 	}
 
 	var mappingOfPageIdToSubPages = make(map[uuid.UUID][]SubPage)
@@ -173,11 +200,9 @@ func (gp *GetPagesHandler) generateSubPagesForTopLevelPages(ctx context.Context,
 
 		for _, closure := range descendants {
 			if closure.IsParent {
-				subPage := SubPage{
-					ID:        closure.DescendantID,
-					TextTitle: mappingOfDescendantIdToTextTitle[closure.DescendantID],
-					SubPages:  buildSubPageTree(closure.DescendantID),
-				}
+				subPage := mappingOfDescendantIdToSubPage[closure.DescendantID]
+				subPage.ID = closure.DescendantID
+				subPage.SubPages = buildSubPageTree(closure.DescendantID)
 				subPages = append(subPages, subPage)
 			}
 		}
@@ -191,8 +216,8 @@ func (gp *GetPagesHandler) generateSubPagesForTopLevelPages(ctx context.Context,
 	return mappingOfPageIdToSubPages, nil
 }
 
-func (gp *GetPagesHandler) getAncestorToDescendantsMapping(ctx context.Context, pageIds []uuid.UUID) (map[uuid.UUID][]page.Closure, error) {
-	conn, err := gp.db.Acquire(ctx)
+func getAncestorToDescendantsMapping(ctx context.Context, db *pgxpool.Pool, pageIds []uuid.UUID) (map[uuid.UUID][]page.Closure, error) {
+	conn, err := db.Acquire(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to acquire db connection: %w", err)
 	}
@@ -0,0 +1,49 @@
+package handlers_test
+
+import (
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeRegisterer is implemented by every handler
+type routeRegisterer interface {
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+// publicRouteRegisterer is implemented by the handlers that also serve signed out visitors
+type publicRouteRegisterer interface {
+	RegisterPublicRoutes(router *gin.RouterGroup)
+}
+
+// serveRequest sends the request to a router with the routes of the handlers under /api.
+// The user is signed in on every route except the public ones.
+func serveRequest(req *http.Request, userID int64, routes ...routeRegisterer) *httptest.ResponseRecorder {
+	r := router.NewRouter()
+	for _, h := range routes {
+		if public, ok := h.(publicRouteRegisterer); ok {
+			public.RegisterPublicRoutes(r.Group("/api"))
+		}
+	}
+	protected := r.Group("/api", func(c *gin.Context) {
+		c.Set("user_id", userID)
+	})
+	for _, h := range routes {
+		h.RegisterRoutes(protected)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// newServe returns a function sending requests as the given user to the routes of the handlers
+func newServe(routes ...routeRegisterer) func(userID int64, method, path, body string) *httptest.ResponseRecorder {
+	return func(userID int64, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		return serveRequest(req, userID, routes...)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_notion/backend/api_error"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// IdempotencyKeyHeader lets clients retry a request without repeating its effect
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// duplicateIdempotencyTTL is how long a retried duplicate returns the first copy instead of making another
+const duplicateIdempotencyTTL = 24 * time.Hour
+
+// uniqueViolationCode is the postgres error code of a unique constraint violation
+const uniqueViolationCode = "23505"
+
+const (
+	idempotencyScopeCreatePage    = "pages.create"
+	idempotencyScopeDuplicatePage = "pages.duplicate"
+)
+
+// claimIdempotencyKey reserves the key for the request in the transaction. When the key was already used
+// for the same request, the response stored back then is returned and the request must not run again.
+// A ttl of 0 keeps the key forever.
+//
+// The reservation holds a row lock, so a concurrent retry waits for the first request to commit and then
+// gets its response, or takes over the key if the first request rolled back.
+func claimIdempotencyKey(ctx context.Context, tx pgx.Tx, userID int64, scope, key string, request any, ttl time.Duration) (json.RawMessage, *api_error.ApiError) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to check idempotency key", err)
+	}
+	requestHash := sha256.Sum256(encoded)
+
+	var expiresAt *time.Time
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl)
+		expiresAt = &expiry
+	}
+
+	// an expired key is taken over as if it was never used
+	var claimed bool
+	err = tx.QueryRow(ctx, `
+		INSERT INTO idempotency_keys (user_id, scope, key, request_hash, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, scope, key) DO UPDATE
+			SET request_hash = EXCLUDED.request_hash, response = NULL, created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at < CURRENT_TIMESTAMP
+		RETURNING true
+	`, userID, scope, key, requestHash[:], expiresAt).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, api_error.NewInternalServerError("failed to check idempotency key", err)
+	}
+
+	var storedHash []byte
+	var response json.RawMessage
+	err = tx.QueryRow(ctx, `
+		SELECT request_hash, response FROM idempotency_keys WHERE user_id = $1 AND scope = $2 AND key = $3
+	`, userID, scope, key).Scan(&storedHash, &response)
+	if err != nil {
+		return nil, api_error.NewInternalServerError("failed to check idempotency key", err)
+	}
+	if string(storedHash) != string(requestHash[:]) {
+		return nil, api_error.NewConflictError("idempotency key was already used for a different request", nil)
+	}
+	if response == nil {
+		return nil, api_error.NewConflictError("request with this idempotency key is still in progress", nil)
+	}
+	return response, nil
+}
+
+// storeIdempotentResponse records the response of a claimed key, it is committed along with the request's changes
+func storeIdempotentResponse(ctx context.Context, tx pgx.Tx, userID int64, scope, key string, response any) error {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE idempotency_keys SET response = $4 WHERE user_id = $1 AND scope = $2 AND key = $3
+	`, userID, scope, key, encoded)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %w", err)
+	}
+	return nil
+}
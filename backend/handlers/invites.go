@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/auth"
+	"go_notion/backend/mailer"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// inviteLifeSpan is how long the link in an invite email stays valid
+const inviteLifeSpan = 7 * 24 * time.Hour
+
+type InvitesHandler struct {
+	db     *pgxpool.Pool
+	mailer mailer.Mailer
+}
+
+func NewInvitesHandler(db *pgxpool.Pool, mailer mailer.Mailer) (*InvitesHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	if mailer == nil {
+		return nil, fmt.Errorf("mailer cannot be nil")
+	}
+	return &InvitesHandler{db, mailer}, nil
+}
+
+type Invite struct {
+	ID        int64       `json:"id"`
+	Email     string      `json:"email"`
+	Role      access.Role `json:"role"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type CreateInviteInput struct {
+	Email string      `json:"email" binding:"required,email"`
+	Role  access.Role `json:"role" binding:"required"`
+}
+
+// CreateInvite emails an invite link to join the workspace. The person doesn't need an account yet,
+// the token in the link is accepted by sign up, sign in and /invites/accept.
+func (h *InvitesHandler) CreateInvite(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to invite to workspace")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri WorkspaceUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	var input CreateInviteInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	if !input.Role.Valid() {
+		c.Error(api_error.NewBadRequestError("invalid role", nil))
+		return
+	}
+	email := strings.ToLower(input.Email)
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create invite", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	role, err := access.AuthorizeWorkspace(ctx, tx, uri.ID, userIdInt, access.ActionManageMembers)
+	if err != nil {
+		c.Error(accessError(err, "workspace not found"))
+		return
+	}
+	if input.Role == access.RoleOwner && role != access.RoleOwner {
+		c.Error(api_error.NewForbiddenError("only owners can invite owners", nil))
+		return
+	}
+
+	var workspaceName, inviterName string
+	var alreadyMember bool
+	err = tx.QueryRow(ctx, `
+		SELECT workspaces.name, users.username, EXISTS(
+			SELECT 1 FROM workspace_members
+			INNER JOIN users AS members ON members.id = workspace_members.user_id
+			WHERE workspace_members.workspace_id = workspaces.id AND lower(members.email) = $3
+		)
+		FROM workspaces, users
+		WHERE workspaces.id = $1 AND users.id = $2
+	`, uri.ID, userIdInt, email).Scan(&workspaceName, &inviterName, &alreadyMember)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create invite", err))
+		return
+	}
+	if alreadyMember {
+		c.Error(api_error.NewBadRequestError("user is already a member of this workspace", nil))
+		return
+	}
+
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create invite", err))
+		return
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM workspace_invites WHERE workspace_id = $1 AND lower(email) = $2 AND accepted_at IS NULL
+	`, uri.ID, email)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create invite", err))
+		return
+	}
+
+	invite := Invite{Email: email, Role: input.Role}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO workspace_invites (workspace_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + $6::interval)
+		RETURNING id, expires_at, created_at
+	`, uri.ID, email, input.Role, tokenHash, userIdInt, inviteLifeSpan).Scan(&invite.ID, &invite.ExpiresAt, &invite.CreatedAt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create invite", err))
+		return
+	}
+
+	// sending inside the transaction means a failed send doesn't leave behind an invite nobody received
+	link := mailer.Link("/invite", url.Values{"token": {token}})
+	err = h.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: fmt.Sprintf("%s invited you to %s", inviterName, workspaceName),
+		Body:    fmt.Sprintf("%s invited you to join the %s workspace as %s.\n\nAccept the invite: %s\n\nThe link expires in %d days.", inviterName, workspaceName, input.Role, link, int(inviteLifeSpan.Hours()/24)),
+	})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to send invite", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create invite", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": invite})
+}
+
+type InvitesResponse struct {
+	Invites []Invite `json:"invites"`
+}
+
+// GetInvites lists the invites that haven't been accepted and haven't expired
+func (h *InvitesHandler) GetInvites(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get invites")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri WorkspaceUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	if _, err := access.AuthorizeWorkspace(ctx, h.db, uri.ID, userIdInt, access.ActionManageMembers); err != nil {
+		c.Error(accessError(err, "workspace not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT id, email, role, expires_at, created_at FROM workspace_invites
+		WHERE workspace_id = $1 AND accepted_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY created_at DESC
+	`, uri.ID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get invites", err))
+		return
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		if err := rows.Scan(&invite.ID, &invite.Email, &invite.Role, &invite.ExpiresAt, &invite.CreatedAt); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get invites", err))
+			return
+		}
+		invites = append(invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get invites", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, InvitesResponse{Invites: invites})
+}
+
+type InviteUri struct {
+	ID       int64 `uri:"id" binding:"required"`
+	InviteID int64 `uri:"invite_id" binding:"required"`
+}
+
+func (h *InvitesHandler) RevokeInvite(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to revoke invite")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri InviteUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	if _, err := access.AuthorizeWorkspace(ctx, h.db, uri.ID, userIdInt, access.ActionManageMembers); err != nil {
+		c.Error(accessError(err, "workspace not found"))
+		return
+	}
+
+	cmd, err := h.db.Exec(ctx, `
+		DELETE FROM workspace_invites WHERE id = $1 AND workspace_id = $2 AND accepted_at IS NULL
+	`, uri.InviteID, uri.ID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to revoke invite", err))
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewNotFoundError("invite not found", nil))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+type AcceptInviteInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// AcceptInvite is for users who are already signed in when they open the invite link
+func (h *InvitesHandler) AcceptInvite(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to accept invite")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input AcceptInviteInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	workspaceID, apiErr := acceptInviteWithPool(ctx, h.db, input.Token, userIdInt)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"workspace_id": workspaceID})
+}
+
+func acceptInviteWithPool(ctx context.Context, db *pgxpool.Pool, token string, userID int64) (int64, *api_error.ApiError) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, api_error.NewInternalServerError("failed to accept invite", err)
+	}
+	defer tx.Rollback(ctx)
+
+	workspaceID, apiErr := acceptInvite(ctx, tx, token, userID)
+	if apiErr != nil {
+		return 0, apiErr
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, api_error.NewInternalServerError("failed to accept invite", err)
+	}
+	return workspaceID, nil
+}
+
+// acceptInvite adds the user to the invite's workspace with the invited role and uses up the invite.
+// The invite only works for the email it was sent to, so a forwarded link can't be used by someone else.
+// A user who is already a member keeps their current role.
+func acceptInvite(ctx context.Context, tx pgx.Tx, token string, userID int64) (int64, *api_error.ApiError) {
+	var inviteID, workspaceID int64
+	var inviteEmail, userEmail string
+	var role access.Role
+	err := tx.QueryRow(ctx, `
+		SELECT workspace_invites.id, workspace_invites.workspace_id, workspace_invites.email, workspace_invites.role, users.email
+		FROM workspace_invites, users
+		WHERE workspace_invites.token_hash = $1
+		AND workspace_invites.accepted_at IS NULL
+		AND workspace_invites.expires_at > CURRENT_TIMESTAMP
+		AND users.id = $2
+		FOR UPDATE OF workspace_invites
+	`, auth.HashOpaqueToken(token), userID).Scan(&inviteID, &workspaceID, &inviteEmail, &role, &userEmail)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, api_error.NewBadRequestError("invalid or expired invite", nil)
+	} else if err != nil {
+		return 0, api_error.NewInternalServerError("failed to accept invite", err)
+	}
+
+	if !strings.EqualFold(inviteEmail, userEmail) {
+		return 0, api_error.NewForbiddenError("this invite was sent to a different email address", nil)
+	}
+
+	cmd, err := tx.Exec(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING
+	`, workspaceID, userID, role)
+	if err != nil {
+		return 0, api_error.NewInternalServerError("failed to accept invite", err)
+	}
+	if cmd.RowsAffected() > 0 {
+		if err := recordAccessChange(ctx, tx, userID, accessChangeWorkspaceJoined, &workspaceID, nil); err != nil {
+			return 0, api_error.NewInternalServerError("failed to accept invite", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE workspace_invites SET accepted_at = CURRENT_TIMESTAMP, accepted_by = $1 WHERE id = $2
+	`, userID, inviteID)
+	if err != nil {
+		return 0, api_error.NewInternalServerError("failed to accept invite", err)
+	}
+
+	// invite tokens are only ever mailed, using one proves the user receives mail at their email
+	_, err = tx.Exec(ctx, `
+		UPDATE users SET email_verified_at = CURRENT_TIMESTAMP WHERE id = $1 AND email_verified_at IS NULL
+	`, userID)
+	if err != nil {
+		return 0, api_error.NewInternalServerError("failed to accept invite", err)
+	}
+
+	if err := notifyPendingMentionsOfUser(ctx, tx, userID); err != nil {
+		return 0, api_error.NewInternalServerError("failed to accept invite", err)
+	}
+	return workspaceID, nil
+}
+
+func (h *InvitesHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/workspaces/:id/invites", h.GetInvites)
+	router.POST("/workspaces/:id/invites", h.CreateInvite)
+	router.DELETE("/workspaces/:id/invites/:invite_id", h.RevokeInvite)
+	router.POST("/invites/accept", h.AcceptInvite)
+}
@@ -0,0 +1,96 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInviteAcceptedOnSignUp(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	mailerMock := &mocks.MailerMock{}
+	invites, err := handlers.NewInvitesHandler(pool, mailerMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signup, err := handlers.NewSignUpHandler(pool, &mocks.TokenGeneratorMock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(invites, signup)
+
+	var workspaceID int64
+	err = pool.QueryRow(context.Background(), "SELECT id FROM workspaces WHERE created_by = 1 AND is_personal").Scan(&workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitesPath := fmt.Sprintf("/api/workspaces/%d/invites", workspaceID)
+
+	inviteToken := func(message int) string {
+		messages := mailerMock.Messages()
+		if !assert.Greater(t, len(messages), message) {
+			t.FailNow()
+		}
+		link := regexp.MustCompile(`https?://\S+`).FindString(messages[message].Body)
+		inviteURL, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inviteURL.Query().Get("token")
+	}
+
+	assert.Equal(t, http.StatusBadRequest, serve(1, "POST", invitesPath, `{"email": "test@test.com", "role": "member"}`).Code, "already a member")
+	assert.Equal(t, http.StatusOK, serve(1, "POST", invitesPath, `{"email": "revoked@example.com", "role": "member"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(1, "POST", invitesPath, `{"email": "new@example.com", "role": "member"}`).Code)
+
+	w := serve(1, "GET", invitesPath, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var pending handlers.InvitesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &pending); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, pending.Invites, 2)
+
+	revokedToken := inviteToken(0)
+	for _, invite := range pending.Invites {
+		if invite.Email == "revoked@example.com" {
+			assert.Equal(t, http.StatusNoContent, serve(1, "DELETE", fmt.Sprintf("%s/%d", invitesPath, invite.ID), "").Code)
+		}
+	}
+	assert.Equal(t, http.StatusBadRequest, serve(1, "POST", "/api/auth/signup", `{"email": "revoked@example.com", "username": "revoked", "password": "password", "invite_token": "`+revokedToken+`"}`).Code)
+
+	token := inviteToken(1)
+	// the invite is tied to the email it was sent to
+	assert.Equal(t, http.StatusForbidden, serve(1, "POST", "/api/auth/signup", `{"email": "other@example.com", "username": "other", "password": "password", "invite_token": "`+token+`"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(1, "POST", "/api/auth/signup", `{"email": "new@example.com", "username": "newuser", "password": "password", "invite_token": "`+token+`"}`).Code)
+
+	var role access.Role
+	err = pool.QueryRow(context.Background(), `
+		SELECT workspace_members.role FROM workspace_members
+		INNER JOIN users ON users.id = workspace_members.user_id
+		WHERE workspace_members.workspace_id = $1 AND users.email = 'new@example.com'
+	`, workspaceID).Scan(&role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, access.RoleMember, role)
+
+	// invites are single use
+	assert.Equal(t, http.StatusBadRequest, serve(1, "POST", "/api/invites/accept", `{"token": "`+token+`"}`).Code)
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+	"go_notion/backend/auth"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JWKSHandler struct {
+	keySet auth.KeySetProvider
+}
+
+func NewJWKSHandler(keySet auth.KeySetProvider) (*JWKSHandler, error) {
+	if keySet == nil {
+		return nil, fmt.Errorf("keySet cannot be nil")
+	}
+	return &JWKSHandler{keySet}, nil
+}
+
+// GetJWKS publishes the public keys our tokens are signed with so other services can verify them without the token secret
+func (h *JWKSHandler) GetJWKS(c *gin.Context) {
+	// verifiers refetch the key set when they see an unknown kid, so a short cache is enough to absorb rotations
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keySet.JWKS())
+}
+
+func (h *JWKSHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/.well-known/jwks.json", h.GetJWKS)
+}
@@ -0,0 +1,38 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/auth"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJWKS(t *testing.T) {
+	jwks, err := handlers.NewJWKSHandler(&mocks.KeySetProviderMock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	jwks.RegisterRoutes(r.Group(""))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var set auth.JWKSet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, set.Keys, 1) {
+		assert.Equal(t, "key-1", set.Keys[0].Kid)
+	}
+}
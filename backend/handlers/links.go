@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type LinksHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewLinksHandler(db *pgxpool.Pool) (*LinksHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &LinksHandler{db}, nil
+}
+
+type Backlink struct {
+	PageID    uuid.UUID `json:"page_id"`
+	TextTitle *string   `json:"text_title"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BacklinksResponse struct {
+	Backlinks []Backlink `json:"backlinks"`
+}
+
+type PageLink struct {
+	PageID uuid.UUID `json:"page_id"`
+	// TextTitle is only set when the user can view the target page
+	TextTitle *string    `json:"text_title"`
+	BrokenAt  *time.Time `json:"broken_at"`
+}
+
+type PageLinksResponse struct {
+	Links []PageLink `json:"links"`
+}
+
+// GetBacklinks lists the pages linking to the page, leaving out the ones the user can't view
+func (h *LinksHandler) GetBacklinks(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get backlinks")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT pages.id, pages.text_title, page_links.created_at
+		FROM page_links
+		INNER JOIN pages ON pages.id = page_links.source_page_id
+		WHERE page_links.target_page_id = $1
+		ORDER BY page_links.created_at DESC
+	`, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get backlinks", err))
+		return
+	}
+	candidates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Backlink, error) {
+		var link Backlink
+		err := row.Scan(&link.PageID, &link.TextTitle, &link.CreatedAt)
+		return link, err
+	})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get backlinks", err))
+		return
+	}
+
+	backlinks := []Backlink{}
+	for _, link := range candidates {
+		_, level, err := access.PageLevel(ctx, h.db, link.PageID, userIdInt)
+		if err != nil {
+			c.Error(accessError(err, "page not found"))
+			return
+		}
+		if level.Allows(access.ActionView) {
+			backlinks = append(backlinks, link)
+		}
+	}
+
+	c.JSON(http.StatusOK, BacklinksResponse{Backlinks: backlinks})
+}
+
+// GetLinks lists the pages the page links to, including the broken links
+func (h *LinksHandler) GetLinks(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get links")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT page_links.target_page_id, pages.text_title, page_links.broken_at
+		FROM page_links
+		LEFT JOIN pages ON pages.id = page_links.target_page_id
+		WHERE page_links.source_page_id = $1
+		ORDER BY page_links.created_at
+	`, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get links", err))
+		return
+	}
+	links, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PageLink, error) {
+		var link PageLink
+		err := row.Scan(&link.PageID, &link.TextTitle, &link.BrokenAt)
+		return link, err
+	})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get links", err))
+		return
+	}
+
+	for i := range links {
+		if links[i].BrokenAt != nil {
+			continue
+		}
+		_, level, err := access.PageLevel(ctx, h.db, links[i].PageID, userIdInt)
+		if err != nil && !errors.Is(err, access.ErrNotFound) {
+			c.Error(api_error.NewInternalServerError("failed to get links", err))
+			return
+		}
+		if !level.Allows(access.ActionView) {
+			links[i].TextTitle = nil
+		}
+	}
+
+	c.JSON(http.StatusOK, PageLinksResponse{Links: links})
+}
+
+// syncPageLinks replaces the outgoing links of the page with the given targets.
+// Links to pages that don't exist are stored as broken right away.
+func syncPageLinks(ctx context.Context, tx pgx.Tx, pageID uuid.UUID, targets []uuid.UUID) error {
+	// a page linking to itself is not a backlink
+	filtered := make([]uuid.UUID, 0, len(targets))
+	for _, target := range targets {
+		if target != pageID {
+			filtered = append(filtered, target)
+		}
+	}
+
+	_, err := tx.Exec(ctx, `
+		DELETE FROM page_links WHERE source_page_id = $1 AND NOT (target_page_id = ANY($2::uuid[]))
+	`, pageID, filtered)
+	if err != nil {
+		return fmt.Errorf("failed to delete page links: %w", err)
+	}
+
+	if len(filtered) == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO page_links (source_page_id, target_page_id, broken_at)
+		SELECT $1::uuid, target.id, CASE WHEN pages.id IS NULL THEN CURRENT_TIMESTAMP END
+		FROM unnest($2::uuid[]) AS target(id)
+		LEFT JOIN pages ON pages.id = target.id
+		ON CONFLICT (source_page_id, target_page_id) DO NOTHING
+	`, pageID, filtered)
+	if err != nil {
+		return fmt.Errorf("failed to insert page links: %w", err)
+	}
+	return nil
+}
+
+func (h *LinksHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/pages/:id/backlinks", h.GetBacklinks)
+	router.GET("/pages/:id/links", h.GetLinks)
+}
@@ -0,0 +1,88 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBacklinks(t *testing.T) {
+	sourceId := uuid.Must(uuid.NewV4())
+	targetId := uuid.Must(uuid.NewV4())
+	missingId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("colleague@example.com", "colleague", "password"),
+		db.InsertTestPageFixture(sourceId, 1),
+		db.InsertTestPageFixtureWithPosition(targetId, 1, 2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	links, err := handlers.NewLinksHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletePage, err := handlers.NewDeletePageHandler(pool, mocks.NewBlobStoreMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(links, updatePage, deletePage)
+
+	content := `{"type": "doc", "content": [
+		{"type": "pageLink", "attrs": {"page_id": "` + targetId.String() + `"}},
+		{"type": "pageLink", "attrs": {"page_id": "` + missingId.String() + `"}},
+		{"type": "pageLink", "attrs": {"page_id": "` + sourceId.String() + `"}}
+	]}`
+	update := `{"title_text": "source", "content_text": "links", "raw_title": {}, "raw_content": ` + content + `}`
+	assert.Equal(t, http.StatusOK, serve(1, "PUT", "/api/pages/"+sourceId.String(), update).Code)
+	// updating again doesn't duplicate links
+	assert.Equal(t, http.StatusOK, serve(1, "PUT", "/api/pages/"+sourceId.String(), update).Code)
+
+	w := serve(1, "GET", "/api/pages/"+targetId.String()+"/backlinks", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var backlinks handlers.BacklinksResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &backlinks); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, backlinks.Backlinks, 1) {
+		assert.Equal(t, sourceId, backlinks.Backlinks[0].PageID)
+	}
+	assert.Equal(t, http.StatusNotFound, serve(2, "GET", "/api/pages/"+targetId.String()+"/backlinks", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(1, "DELETE", "/api/pages/"+targetId.String(), "").Code)
+
+	w = serve(1, "GET", "/api/pages/"+sourceId.String()+"/links", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var outgoing handlers.PageLinksResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &outgoing); err != nil {
+		t.Fatal(err)
+	}
+	// the self link is ignored and both remaining links are broken
+	if assert.Len(t, outgoing.Links, 2) {
+		for _, link := range outgoing.Links {
+			assert.NotNil(t, link.BrokenAt)
+			assert.Nil(t, link.TextTitle)
+		}
+	}
+
+	// removing the links from the content removes them from the table
+	update = `{"title_text": "source", "content_text": "no links", "raw_title": {}, "raw_content": {"type": "doc"}}`
+	assert.Equal(t, http.StatusOK, serve(1, "PUT", "/api/pages/"+sourceId.String(), update).Code)
+	w = serve(1, "GET", "/api/pages/"+sourceId.String()+"/links", "")
+	json.Unmarshal(w.Body.Bytes(), &outgoing)
+	assert.Len(t, outgoing.Links, 0)
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const NotificationKindMention = "mention"
+
+type NotificationsHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewNotificationsHandler(db *pgxpool.Pool) (*NotificationsHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &NotificationsHandler{db}, nil
+}
+
+type Notification struct {
+	ID            uuid.UUID  `json:"id"`
+	Kind          string     `json:"kind"`
+	PageID        *uuid.UUID `json:"page_id"`
+	PageTextTitle *string    `json:"page_text_title"`
+	ActorID       *int64     `json:"actor_id"`
+	ActorUsername *string    `json:"actor_username"`
+	ReadAt        *time.Time `json:"read_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type NotificationsResponse struct {
+	Notifications []Notification `json:"notifications"`
+	UnreadCount   int            `json:"unread_count"`
+}
+
+type GetNotificationsParams struct {
+	Size          *int       `form:"size,omitempty" binding:"omitempty,min=1,max=100"`
+	CreatedBefore *time.Time `form:"created_before,omitempty"`
+	Unread        bool       `form:"unread"`
+}
+
+func (h *NotificationsHandler) GetNotifications(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get notifications")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var params GetNotificationsParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	size := 20
+	if params.Size != nil {
+		size = *params.Size
+	}
+	createdBefore := time.Now()
+	if params.CreatedBefore != nil {
+		createdBefore = *params.CreatedBefore
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT notifications.id, notifications.kind, notifications.page_id, pages.text_title,
+			notifications.actor_id, users.username, notifications.read_at, notifications.created_at
+		FROM notifications
+		LEFT JOIN pages ON pages.id = notifications.page_id
+		LEFT JOIN users ON users.id = notifications.actor_id
+		WHERE notifications.user_id = $1 AND notifications.created_at < $2 AND (NOT $3 OR notifications.read_at IS NULL)
+		ORDER BY notifications.created_at DESC
+		LIMIT $4
+	`, userIdInt, createdBefore, params.Unread, size)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get notifications", err))
+		return
+	}
+	notifications, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Notification, error) {
+		var n Notification
+		err := row.Scan(&n.ID, &n.Kind, &n.PageID, &n.PageTextTitle, &n.ActorID, &n.ActorUsername, &n.ReadAt, &n.CreatedAt)
+		return n, err
+	})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get notifications", err))
+		return
+	}
+
+	var unreadCount int
+	err = h.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL
+	`, userIdInt).Scan(&unreadCount)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get notifications", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, NotificationsResponse{Notifications: notifications, UnreadCount: unreadCount})
+}
+
+type MarkNotificationsReadInput struct {
+	// IDs of the notifications to mark as read, all of the user's notifications when empty
+	IDs []uuid.UUID `json:"ids" binding:"omitempty,max=100"`
+}
+
+func (h *NotificationsHandler) MarkRead(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to update notifications")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input MarkNotificationsReadInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	_, err := h.db.Exec(ctx, `
+		UPDATE notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND read_at IS NULL AND (COALESCE(cardinality($2::uuid[]), 0) = 0 OR id = ANY($2::uuid[]))
+	`, userIdInt, input.IDs)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update notifications", err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// syncPageMentions replaces the mentions of the page and notifies the users mentioned for the first time.
+// Users who can't view the page yet are notified once they get access, see notifyPendingMentionsOfUser.
+// The author mentioning themselves is never notified.
+func syncPageMentions(ctx context.Context, tx pgx.Tx, pageID uuid.UUID, actorID int64, mentions []int64) error {
+	if mentions == nil {
+		mentions = []int64{}
+	}
+	_, err := tx.Exec(ctx, `
+		WITH removed AS (
+			DELETE FROM page_mentions WHERE page_id = $1 AND NOT (user_id = ANY($2::integer[]))
+		)
+		INSERT INTO page_mentions (page_id, user_id, actor_id, notified_at)
+		SELECT $1::uuid, users.id, $3::integer, CASE WHEN users.id = $3 THEN CURRENT_TIMESTAMP END
+		FROM users WHERE users.id = ANY($2::integer[])
+		ON CONFLICT (page_id, user_id) DO NOTHING
+	`, pageID, mentions, actorID)
+	if err != nil {
+		return fmt.Errorf("failed to update page mentions: %w", err)
+	}
+
+	// mentions from earlier saves are retried too, the users may have been given access since
+	rows, err := tx.Query(ctx, `
+		SELECT page_id, user_id, actor_id FROM page_mentions WHERE page_id = $1 AND notified_at IS NULL
+	`, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to get pending mentions: %w", err)
+	}
+	return notifyPendingMentions(ctx, tx, rows)
+}
+
+// notifyPendingMentionsOfUser notifies the user of the mentions they couldn't view before,
+// it is called whenever the user is given access to pages
+func notifyPendingMentionsOfUser(ctx context.Context, tx pgx.Tx, userID int64) error {
+	rows, err := tx.Query(ctx, `
+		SELECT page_id, user_id, actor_id FROM page_mentions WHERE user_id = $1 AND notified_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get pending mentions: %w", err)
+	}
+	return notifyPendingMentions(ctx, tx, rows)
+}
+
+type pendingMention struct {
+	PageID  uuid.UUID
+	UserID  int64
+	ActorID *int64
+}
+
+// notifyPendingMentions notifies the users of the mentions in rows they can view and marks those as notified,
+// the others stay pending
+func notifyPendingMentions(ctx context.Context, tx pgx.Tx, rows pgx.Rows) error {
+	mentions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[pendingMention])
+	if err != nil {
+		return fmt.Errorf("failed to get pending mentions: %w", err)
+	}
+
+	for _, mention := range mentions {
+		_, level, err := access.PageLevel(ctx, tx, mention.PageID, mention.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get page access: %w", err)
+		}
+		if !level.Allows(access.ActionView) {
+			continue
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO notifications (user_id, kind, page_id, actor_id) VALUES ($1, $2, $3, $4)
+		`, mention.UserID, NotificationKindMention, mention.PageID, mention.ActorID)
+		if err != nil {
+			return fmt.Errorf("failed to insert notification: %w", err)
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE page_mentions SET notified_at = CURRENT_TIMESTAMP WHERE page_id = $1 AND user_id = $2
+		`, mention.PageID, mention.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to update page mentions: %w", err)
+		}
+	}
+	return nil
+}
+
+func (h *NotificationsHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/notifications", h.GetNotifications)
+	router.POST("/notifications/read", h.MarkRead)
+}
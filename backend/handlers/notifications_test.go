@@ -0,0 +1,98 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMentionNotifications(t *testing.T) {
+	pageId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("colleague@example.com", "colleague", "password"),
+		db.InsertTestUserWithData("stranger@example.com", "stranger", "password"),
+		db.InsertTestPageFixture(pageId, 1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	notifications, err := handlers.NewNotificationsHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := handlers.NewSharesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(notifications, updatePage, shares)
+	getNotifications := func(userID int64) handlers.NotificationsResponse {
+		w := serve(userID, "GET", "/api/notifications", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response handlers.NotificationsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	update := func(content string) {
+		body := `{"title_text": "title", "content_text": "content", "raw_title": {}, "raw_content": ` + content + `}`
+		assert.Equal(t, http.StatusOK, serve(1, "PUT", "/api/pages/"+pageId.String(), body).Code)
+	}
+
+	assert.Equal(t, http.StatusOK, serve(1, "POST", "/api/pages/"+pageId.String()+"/shares", `{"email": "colleague@example.com", "level": "viewer"}`).Code)
+
+	mentions := `{"type": "doc", "content": [
+		{"type": "mention", "attrs": {"user_id": 1}},
+		{"type": "mention", "attrs": {"user_id": 2}},
+		{"type": "mention", "attrs": {"user_id": 3}}
+	]}`
+	update(mentions)
+	// the same mentions don't notify twice
+	update(mentions)
+
+	response := getNotifications(2)
+	assert.Equal(t, 1, response.UnreadCount)
+	if assert.Len(t, response.Notifications, 1) {
+		assert.Equal(t, handlers.NotificationKindMention, response.Notifications[0].Kind)
+		assert.Equal(t, pageId, *response.Notifications[0].PageID)
+		assert.Equal(t, int64(1), *response.Notifications[0].ActorID)
+	}
+	// the author and users without access are not notified
+	assert.Len(t, getNotifications(1).Notifications, 0)
+	assert.Len(t, getNotifications(3).Notifications, 0)
+
+	// removing the mention and adding it back notifies again
+	update(`{"type": "doc"}`)
+	update(mentions)
+	assert.Equal(t, 2, getNotifications(2).UnreadCount)
+
+	assert.Equal(t, http.StatusNoContent, serve(2, "POST", "/api/notifications/read", `{"ids": ["`+response.Notifications[0].ID.String()+`"]}`).Code)
+	assert.Equal(t, 1, getNotifications(2).UnreadCount)
+	assert.Equal(t, http.StatusNoContent, serve(2, "POST", "/api/notifications/read", `{}`).Code)
+	response = getNotifications(2)
+	assert.Equal(t, 0, response.UnreadCount)
+	assert.Len(t, response.Notifications, 2)
+
+	// users mentioned before they could view the page are notified once it is shared with them
+	assert.Equal(t, http.StatusOK, serve(1, "POST", "/api/pages/"+pageId.String()+"/shares", `{"email": "stranger@example.com", "level": "viewer"}`).Code)
+	response = getNotifications(3)
+	if assert.Len(t, response.Notifications, 1) {
+		assert.Equal(t, pageId, *response.Notifications[0].PageID)
+		assert.Equal(t, int64(1), *response.Notifications[0].ActorID)
+	}
+	update(mentions)
+	assert.Len(t, getNotifications(3).Notifications, 1)
+}
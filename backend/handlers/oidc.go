@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/auth"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// oidcLoginLifeSpan is how long the user has to complete the login at the provider
+const oidcLoginLifeSpan = 10 * time.Minute
+
+// oidcStateCookie holds the state in the browser that started the login. The callback only completes
+// a login for that browser, so an intercepted code and state are useless elsewhere and a victim can't
+// be sent through a callback link that signs them into someone else's account.
+const oidcStateCookie = "oidc_state"
+
+type OIDCHandler struct {
+	db              *pgxpool.Pool
+	tokenGenerator  auth.TokenGenerator
+	challengeIssuer auth.ChallengeIssuer
+	providers       map[string]*auth.OIDCProvider
+}
+
+func NewOIDCHandler(db *pgxpool.Pool, tokenGenerator auth.TokenGenerator, challengeIssuer auth.ChallengeIssuer, providers []*auth.OIDCProvider) (*OIDCHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	if tokenGenerator == nil {
+		return nil, fmt.Errorf("tokenGenerator cannot be nil")
+	}
+	if challengeIssuer == nil {
+		return nil, fmt.Errorf("challengeIssuer cannot be nil")
+	}
+	providersByName := make(map[string]*auth.OIDCProvider, len(providers))
+	for _, provider := range providers {
+		providersByName[provider.Name()] = provider
+	}
+	return &OIDCHandler{db, tokenGenerator, challengeIssuer, providersByName}, nil
+}
+
+type OIDCProviderUri struct {
+	Provider string `uri:"provider" binding:"required"`
+}
+
+// StartLogin redirects the user to the provider. The state, nonce and PKCE verifier are kept in the database
+// so the callback can be handled by any instance of the app, and the state is also set in a cookie.
+func (h *OIDCHandler) StartLogin(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	provider, apiErr := h.getProvider(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	state, stateHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to start login", err))
+		return
+	}
+	nonce, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to start login", err))
+		return
+	}
+	codeVerifier, err := auth.NewPKCEVerifier()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to start login", err))
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, auth.PKCEChallenge(codeVerifier))
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("identity provider is unavailable", err))
+		return
+	}
+
+	// abandoned logins are cleaned up here rather than in a background job since this is the only place they're created
+	_, err = h.db.Exec(ctx, `DELETE FROM oidc_login_states WHERE expires_at < CURRENT_TIMESTAMP`)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to start login", err))
+		return
+	}
+
+	_, err = h.db.Exec(ctx, `
+		INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + $5::interval)
+	`, stateHash, provider.Name(), nonce, codeVerifier, oidcLoginLifeSpan)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to start login", err))
+		return
+	}
+
+	setStateCookie(c, provider, state, int(oidcLoginLifeSpan.Seconds()))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+type OIDCCallbackQuery struct {
+	Code  string `form:"code"`
+	State string `form:"state" binding:"required"`
+	// Error is set by the provider when the user cancelled or the login failed
+	Error string `form:"error"`
+}
+
+// Callback completes the login. The external identity is linked to an existing user with the same verified email,
+// taking the account over when the user never proved that they own the email, or a new user is created, and the same response as a password sign in is returned: the token, or a challenge
+// when the user has 2FA enabled.
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	provider, apiErr := h.getProvider(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var query OIDCCallbackQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	if query.Error != "" {
+		c.Error(api_error.NewUnauthorizedError("login was not completed", fmt.Errorf("provider returned error: %s", query.Error)))
+		return
+	}
+	if query.Code == "" {
+		c.Error(api_error.NewBadRequestError("code is required", nil))
+		return
+	}
+
+	browserState, err := c.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(browserState), []byte(query.State)) != 1 {
+		c.Error(api_error.NewUnauthorizedError("invalid or expired login", fmt.Errorf("state does not match the browser that started the login")))
+		return
+	}
+	setStateCookie(c, provider, "", -1)
+
+	// deleting the state makes it single use, a replayed callback finds nothing
+	var stateProvider, nonce, codeVerifier string
+	var expiresAt time.Time
+	err = h.db.QueryRow(ctx, `
+		DELETE FROM oidc_login_states WHERE state_hash = $1
+		RETURNING provider, nonce, code_verifier, expires_at
+	`, auth.HashOpaqueToken(query.State)).Scan(&stateProvider, &nonce, &codeVerifier, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewUnauthorizedError("invalid or expired login", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to complete login", err))
+		return
+	}
+
+	if stateProvider != provider.Name() || expiresAt.Before(time.Now()) {
+		c.Error(api_error.NewUnauthorizedError("invalid or expired login", nil))
+		return
+	}
+
+	claims, err := provider.Exchange(ctx, query.Code, codeVerifier)
+	if err != nil {
+		c.Error(api_error.NewUnauthorizedError("login failed", err))
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		c.Error(api_error.NewUnauthorizedError("login failed", fmt.Errorf("id token nonce mismatch")))
+		return
+	}
+
+	userID, apiErr := h.findOrCreateUser(ctx, provider.Name(), claims)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	// the provider stands in for the password, not for the second factor
+	var totpEnabled bool
+	if err := h.db.QueryRow(ctx, `SELECT totp_enabled FROM users WHERE id = $1`, userID).Scan(&totpEnabled); err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+	if totpEnabled {
+		respondWithTwoFactorChallenge(c, h.challengeIssuer, userID)
+		return
+	}
+
+	token, err := issueToken(ctx, c, h.db, h.tokenGenerator, userID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+func (h *OIDCHandler) findOrCreateUser(ctx context.Context, providerName string, claims *auth.OIDCClaims) (int64, *api_error.ApiError) {
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, api_error.NewInternalServerError("failed to complete login", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int64
+	err = tx.QueryRow(ctx, `
+		SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2
+	`, providerName, claims.Subject).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, api_error.NewInternalServerError("failed to complete login", err)
+	}
+
+	// linking by email is only safe when the provider vouches for the address,
+	// otherwise anyone could claim an existing account by setting its email at the provider
+	if claims.Email == "" || !claims.EmailVerified {
+		return 0, api_error.NewUnauthorizedError("your identity provider did not verify your email address", nil)
+	}
+
+	var emailVerified bool
+	err = tx.QueryRow(ctx, `
+		SELECT id, email_verified_at IS NOT NULL FROM users WHERE lower(email) = $1 FOR UPDATE
+	`, claims.Email).Scan(&userID, &emailVerified)
+	if errors.Is(err, pgx.ErrNoRows) {
+		username, err := availableUsername(ctx, tx, claims.Email)
+		if err != nil {
+			return 0, api_error.NewInternalServerError("failed to complete login", err)
+		}
+		err = tx.QueryRow(ctx, `
+			INSERT INTO users (email, username, password, email_verified_at) VALUES ($1, $2, NULL, CURRENT_TIMESTAMP) RETURNING id
+		`, claims.Email, username).Scan(&userID)
+		if err != nil {
+			return 0, api_error.NewInternalServerError("failed to create user", err)
+		}
+		if _, err := access.CreatePersonalWorkspace(ctx, tx, userID, username); err != nil {
+			return 0, api_error.NewInternalServerError("failed to create user", err)
+		}
+	} else if err != nil {
+		return 0, api_error.NewInternalServerError("failed to complete login", err)
+	} else if !emailVerified {
+		if err := claimUnverifiedUser(ctx, tx, userID); err != nil {
+			return 0, api_error.NewInternalServerError("failed to link identity", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)
+	`, userID, providerName, claims.Subject, claims.Email)
+	if err != nil {
+		return 0, api_error.NewInternalServerError("failed to link identity", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, api_error.NewInternalServerError("failed to complete login", err)
+	}
+	return userID, nil
+}
+
+// claimUnverifiedUser hands an account that never proved its email over to the identity that just did.
+// Sign up doesn't check emails, so whoever set the password may not own the address: anyone could have
+// registered it ahead of its owner. The password, the second factor and every session are dropped so only
+// the provider's identity gets in from now on.
+func claimUnverifiedUser(ctx context.Context, tx pgx.Tx, userID int64) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE users SET password = NULL, totp_secret = NULL, totp_enabled = false, email_verified_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to reset credentials: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+// setStateCookie sets the state cookie for the path of the callback only. SameSite lax still sends it on the
+// redirect back from the provider, which is a top level navigation.
+func setStateCookie(c *gin.Context, provider *auth.OIDCProvider, state string, maxAge int) {
+	path, secure := "/", true
+	if redirectURL, err := url.Parse(provider.RedirectURL()); err == nil {
+		path, secure = redirectURL.Path, redirectURL.Scheme == "https"
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, path, "", secure, true)
+}
+
+var usernameDisallowedChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// availableUsername derives a username from the local part of the email, adding a random suffix when it's taken
+func availableUsername(ctx context.Context, tx pgx.Tx, email string) (string, error) {
+	base, _, _ := strings.Cut(strings.ToLower(email), "@")
+	base = usernameDisallowedChars.ReplaceAllString(base, "")
+	// leave room for the suffix while staying within the 30 characters sign up allows
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	candidate := base
+	for attempt := 0; attempt < 5; attempt++ {
+		var taken bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)`, candidate).Scan(&taken)
+		if err != nil {
+			return "", fmt.Errorf("failed to check username: %w", err)
+		}
+		if !taken {
+			return candidate, nil
+		}
+		suffix, err := rand.Int(rand.Reader, big.NewInt(100000))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate username suffix: %w", err)
+		}
+		candidate = fmt.Sprintf("%s-%05d", base, suffix.Int64())
+	}
+	return "", fmt.Errorf("could not find an available username for %s", base)
+}
+
+func (h *OIDCHandler) getProvider(c *gin.Context) (*auth.OIDCProvider, *api_error.ApiError) {
+	var uri OIDCProviderUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		return nil, api_error.NewBadRequestError(err.Error(), err)
+	}
+	provider, ok := h.providers[strings.ToLower(uri.Provider)]
+	if !ok {
+		return nil, api_error.NewNotFoundError("identity provider not found", nil)
+	}
+	return provider, nil
+}
+
+func (h *OIDCHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/auth/oidc/:provider/start", h.StartLogin)
+	router.GET("/auth/oidc/:provider/callback", h.Callback)
+}
@@ -0,0 +1,258 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/auth"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+)
+
+// oidcLoginTest signs in through a mock identity provider, login runs the whole flow for the identity
+// and returns the response of the callback
+type oidcLoginTest struct {
+	issuer *mocks.OIDCIssuer
+	router *gin.Engine
+}
+
+func newOIDCLoginTest(t *testing.T, pool *pgxpool.Pool) *oidcLoginTest {
+	issuer, err := mocks.NewOIDCIssuer("client-id", "client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+
+	provider := auth.NewOIDCProvider(auth.OIDCProviderConfig{
+		Name:         "mock",
+		Issuer:       issuer.URL(),
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  "http://localhost:8080/api/auth/oidc/mock/callback",
+	}, nil)
+
+	oidc, err := handlers.NewOIDCHandler(pool, &mocks.TokenGeneratorMock{}, &mocks.ChallengeIssuerMock{}, []*auth.OIDCProvider{provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	oidc.RegisterRoutes(r.Group("/api"))
+	return &oidcLoginTest{issuer: issuer, router: r}
+}
+
+func (l *oidcLoginTest) login(t *testing.T, identity mocks.OIDCIdentity) *httptest.ResponseRecorder {
+	code, state, cookies := l.authorize(t, identity)
+	return l.callback(code, state, cookies)
+}
+
+// authorize starts a login and signs in at the provider, it returns the callback parameters and the cookies set by the start
+func (l *oidcLoginTest) authorize(t *testing.T, identity mocks.OIDCIdentity) (string, string, []*http.Cookie) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/auth/oidc/mock/start", nil)
+	l.router.ServeHTTP(w, req)
+	if !assert.Equal(t, http.StatusFound, w.Code) {
+		t.FailNow()
+	}
+
+	code, state, err := l.issuer.Authorize(w.Header().Get("Location"), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, state, w.Result().Cookies()
+}
+
+func (l *oidcLoginTest) callback(code, state string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/auth/oidc/mock/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	l.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.VerifyTestUserEmail(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	oidcLogin := newOIDCLoginTest(t, pool)
+
+	tests := []struct {
+		name           string
+		identity       mocks.OIDCIdentity
+		expectedStatus int
+		expectedUserID int64
+	}{
+		{
+			name:           "links to the existing user with the same verified email",
+			identity:       mocks.OIDCIdentity{Subject: "existing", Email: "test@test.com", EmailVerified: true},
+			expectedStatus: http.StatusOK,
+			expectedUserID: 1,
+		},
+		{
+			name:           "unverified emails are not linked",
+			identity:       mocks.OIDCIdentity{Subject: "unverified", Email: "test@test.com", EmailVerified: false},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "creates a user for a new verified email",
+			identity:       mocks.OIDCIdentity{Subject: "new", Email: "new@test.com", EmailVerified: true},
+			expectedStatus: http.StatusOK,
+			expectedUserID: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := oidcLogin.login(t, test.identity)
+			assert.Equal(t, test.expectedStatus, w.Code)
+
+			if test.expectedUserID == 0 {
+				return
+			}
+			var userID int64
+			err := pool.QueryRow(context.Background(), `
+				SELECT user_id FROM user_identities WHERE provider = 'mock' AND subject = $1
+			`, test.identity.Subject).Scan(&userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, test.expectedUserID, userID)
+		})
+	}
+}
+
+func TestOIDCLoginClaimsUnverifiedUser(t *testing.T) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := uuid.Must(uuid.NewV4())
+	// whoever signed up with the email never proved they own it
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.EnableTestUserTwoFactor(1, secret, "abcde-12345"), db.InsertTestSessionFixture(sessionID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	w := newOIDCLoginTest(t, pool).login(t, mocks.OIDCIdentity{Subject: "owner", Email: "test@test.com", EmailVerified: true})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var passwordCleared, totpEnabled, sessionRevoked, emailVerified bool
+	var recoveryCodes int
+	err = pool.QueryRow(context.Background(), `
+		SELECT password IS NULL, totp_enabled, email_verified_at IS NOT NULL,
+			(SELECT revoked_at IS NOT NULL FROM sessions WHERE id = $2),
+			(SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = users.id)
+		FROM users WHERE id = $1
+	`, 1, sessionID).Scan(&passwordCleared, &totpEnabled, &emailVerified, &sessionRevoked, &recoveryCodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, passwordCleared, "the password set by whoever signed up must stop working")
+	assert.False(t, totpEnabled)
+	assert.Zero(t, recoveryCodes)
+	assert.True(t, sessionRevoked)
+	assert.True(t, emailVerified)
+}
+
+func TestOIDCCallbackRequiresTheBrowserThatStartedTheLogin(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.VerifyTestUserEmail(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	oidcLogin := newOIDCLoginTest(t, pool)
+	code, state, cookies := oidcLogin.authorize(t, mocks.OIDCIdentity{Subject: "existing", Email: "test@test.com", EmailVerified: true})
+	if assert.Len(t, cookies, 1) {
+		assert.True(t, cookies[0].HttpOnly)
+		assert.Equal(t, "/api/auth/oidc/mock/callback", cookies[0].Path)
+	}
+
+	// someone else holding the code and state, or a victim sent to the callback link
+	assert.Equal(t, http.StatusUnauthorized, oidcLogin.callback(code, state, nil).Code)
+	otherCookie := &http.Cookie{Name: "oidc_state", Value: "other"}
+	assert.Equal(t, http.StatusUnauthorized, oidcLogin.callback(code, state, []*http.Cookie{otherCookie}).Code)
+
+	assert.Equal(t, http.StatusOK, oidcLogin.callback(code, state, cookies).Code)
+}
+
+func TestOIDCLoginWithTwoFactor(t *testing.T) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.VerifyTestUserEmail(1), db.EnableTestUserTwoFactor(1, secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	w := newOIDCLoginTest(t, pool).login(t, mocks.OIDCIdentity{Subject: "existing", Email: "test@test.com", EmailVerified: true})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+		Token             string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, response.TwoFactorRequired)
+	assert.NotEmpty(t, response.ChallengeToken)
+	assert.Empty(t, response.Token, "a session token must not be issued before the second factor")
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	pool, err := db.OpenTestDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	provider := auth.NewOIDCProvider(auth.OIDCProviderConfig{Name: "mock", Issuer: "http://localhost", ClientID: "client-id", RedirectURL: "http://localhost"}, nil)
+	oidc, err := handlers.NewOIDCHandler(pool, &mocks.TokenGeneratorMock{}, &mocks.ChallengeIssuerMock{}, []*auth.OIDCProvider{provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.GET("/api/auth/oidc/:provider/callback", func(c *gin.Context) {
+		oidc.Callback(c)
+	})
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{name: "unknown state", path: "/api/auth/oidc/mock/callback?code=code&state=unknown", expectedStatus: http.StatusUnauthorized},
+		{name: "unknown provider", path: "/api/auth/oidc/other/callback?code=code&state=unknown", expectedStatus: http.StatusNotFound},
+		{name: "missing state", path: "/api/auth/oidc/mock/callback?code=code", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", test.path, nil)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, test.expectedStatus, w.Code)
+		})
+	}
+}
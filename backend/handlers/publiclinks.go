@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/auth"
+	"go_notion/backend/mailer"
+	"go_notion/backend/page"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PublicLinkPasswordHeader carries the password of a password protected link.
+// A header is used rather than a query parameter so the password doesn't end up in access logs.
+const PublicLinkPasswordHeader = "X-Share-Password"
+
+// PublicLinkLockoutPolicy locks a password protected link after repeated wrong passwords. The generic per-ip
+// rate limit alone would let many addresses guess in parallel, each guess costing a password hash.
+var PublicLinkLockoutPolicy = auth.LockoutPolicy{FreeAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Hour}
+
+type PublicLinksHandler struct {
+	db            *pgxpool.Pool
+	lockoutPolicy auth.LockoutPolicy
+}
+
+func NewPublicLinksHandler(db *pgxpool.Pool) (*PublicLinksHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &PublicLinksHandler{db, PublicLinkLockoutPolicy}, nil
+}
+
+type PublicLink struct {
+	ID              int64      `json:"id"`
+	HasPassword     bool       `json:"has_password"`
+	IncludeSubPages bool       `json:"include_sub_pages"`
+	ExpiresAt       *time.Time `json:"expires_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	Token           string     `json:"token,omitempty"`
+	URL             string     `json:"url,omitempty"`
+}
+
+type CreatePublicLinkInput struct {
+	Password  *string    `json:"password"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// IncludeSubPages defaults to true, when false only the page itself is visible through the link
+	IncludeSubPages *bool `json:"include_sub_pages"`
+}
+
+// CreatePublicLink returns the token for the link. Only its hash is stored so this is the only time it's shown.
+func (h *PublicLinksHandler) CreatePublicLink(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to create public link")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input CreatePublicLinkInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	if input.ExpiresAt != nil && input.ExpiresAt.Before(time.Now()) {
+		c.Error(api_error.NewBadRequestError("expires_at must be in the future", nil))
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	var passwordHash *string
+	if input.Password != nil {
+		hash, hashErr := auth.HashLinkPassword(*input.Password)
+		if hashErr != nil {
+			if hashErr.IsPasswordValidationError() {
+				c.Error(api_error.NewBadRequestError(hashErr.Error(), hashErr))
+				return
+			}
+			c.Error(api_error.NewInternalServerError("failed to create public link", hashErr))
+			return
+		}
+		passwordHash = &hash
+	}
+
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create public link", err))
+		return
+	}
+
+	link := PublicLink{
+		HasPassword:     passwordHash != nil,
+		IncludeSubPages: input.IncludeSubPages == nil || *input.IncludeSubPages,
+		ExpiresAt:       input.ExpiresAt,
+		Token:           token,
+		URL:             mailer.Link("/public/"+token, nil),
+	}
+	err = h.db.QueryRow(ctx, `
+		INSERT INTO public_links (page_id, token_hash, password_hash, include_sub_pages, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, pageID, tokenHash, passwordHash, link.IncludeSubPages, link.ExpiresAt, userIdInt).Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create public link", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": link})
+}
+
+type PublicLinksResponse struct {
+	Links []PublicLink `json:"links"`
+}
+
+func (h *PublicLinksHandler) GetPublicLinks(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get public links")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT id, password_hash IS NOT NULL, include_sub_pages, expires_at, created_at
+		FROM public_links WHERE page_id = $1
+		ORDER BY created_at
+	`, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get public links", err))
+		return
+	}
+	defer rows.Close()
+
+	links := []PublicLink{}
+	for rows.Next() {
+		var link PublicLink
+		if err := rows.Scan(&link.ID, &link.HasPassword, &link.IncludeSubPages, &link.ExpiresAt, &link.CreatedAt); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get public links", err))
+			return
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get public links", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, PublicLinksResponse{Links: links})
+}
+
+type DeletePublicLinkUri struct {
+	ID     string `uri:"id" binding:"required,uuid"`
+	LinkID int64  `uri:"link_id" binding:"required"`
+}
+
+func (h *PublicLinksHandler) DeletePublicLink(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to delete public link")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri DeletePublicLinkUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	pageID, err := uuid.FromString(uri.ID)
+	if err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	cmd, err := h.db.Exec(ctx, `DELETE FROM public_links WHERE id = $1 AND page_id = $2`, uri.LinkID, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to delete public link", err))
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewNotFoundError("public link not found", nil))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+type PublicPageUri struct {
+	Token string `uri:"token" binding:"required"`
+}
+
+type PublicPageQuery struct {
+	// PageID selects a sub page of the shared page, defaults to the shared page itself
+	PageID string `form:"page_id" binding:"omitempty,uuid"`
+}
+
+type PublicPageResponse struct {
+	Data     page.Page `json:"data"`
+	SubPages []SubPage `json:"sub_pages"`
+}
+
+// GetPublicPage serves a page through a public link, no account is needed.
+// Unknown, deleted and expired links are all reported as not found.
+func (h *PublicLinksHandler) GetPublicPage(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	// the link can be revoked at any time so the response must not be kept around by caches
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Robots-Tag", "noindex")
+
+	var uri PublicPageUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	var query PublicPageQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	var linkID int64
+	var rootPageID uuid.UUID
+	var passwordHash *string
+	var includeSubPages bool
+	var expiresAt, lockedUntil *time.Time
+	var failedAttempts int
+	err := h.db.QueryRow(ctx, `
+		SELECT id, page_id, password_hash, include_sub_pages, expires_at, failed_password_attempts, locked_until
+		FROM public_links WHERE token_hash = $1
+	`, auth.HashOpaqueToken(uri.Token)).Scan(&linkID, &rootPageID, &passwordHash, &includeSubPages, &expiresAt, &failedAttempts, &lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewNotFoundError("page not found", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get page", err))
+		return
+	}
+	if expiresAt != nil && expiresAt.Before(time.Now()) {
+		c.Error(api_error.NewNotFoundError("page not found", nil))
+		return
+	}
+
+	if passwordHash != nil {
+		password := c.GetHeader(PublicLinkPasswordHeader)
+		if password == "" {
+			c.Error(api_error.NewUnauthorizedError("a valid password is required to view this page", nil))
+			return
+		}
+		// a locked link refuses passwords without hashing them, even the right one
+		if lockedUntil != nil && lockedUntil.After(time.Now()) {
+			c.Error(api_error.NewTooManyRequestsError("too many wrong passwords for this link, try again later", nil))
+			return
+		}
+		if !auth.CompareLinkPassword(password, *passwordHash) {
+			if err := h.recordFailedPassword(ctx, linkID); err != nil {
+				c.Error(api_error.NewInternalServerError("failed to get page", err))
+				return
+			}
+			c.Error(api_error.NewUnauthorizedError("a valid password is required to view this page", nil))
+			return
+		}
+		if failedAttempts > 0 {
+			_, err := h.db.Exec(ctx, `
+				UPDATE public_links SET failed_password_attempts = 0, locked_until = NULL WHERE id = $1
+			`, linkID)
+			if err != nil {
+				c.Error(api_error.NewInternalServerError("failed to get page", err))
+				return
+			}
+		}
+	}
+
+	pageID := rootPageID
+	if query.PageID != "" {
+		pageID, err = uuid.FromString(query.PageID)
+		if err != nil {
+			c.Error(api_error.NewBadRequestError(err.Error(), err))
+			return
+		}
+	}
+	if pageID != rootPageID {
+		if !includeSubPages {
+			c.Error(api_error.NewNotFoundError("page not found", nil))
+			return
+		}
+		var isDescendant bool
+		err = h.db.QueryRow(ctx, `
+			SELECT EXISTS(SELECT 1 FROM pages_closures WHERE ancestor_id = $1 AND descendant_id = $2)
+		`, rootPageID, pageID).Scan(&isDescendant)
+		if err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get page", err))
+			return
+		}
+		if !isDescendant {
+			c.Error(api_error.NewNotFoundError("page not found", nil))
+			return
+		}
+	}
+
+	pages, err := page.GetPages(ctx, h.db, "id = $1", pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get page", err))
+		return
+	}
+	if len(pages) == 0 {
+		c.Error(api_error.NewNotFoundError("page not found", nil))
+		return
+	}
+
+	subPages := []SubPage{}
+	if includeSubPages {
+		mapOfPageIdToSubPages, err := generateSubPagesForPages(ctx, h.db, []uuid.UUID{pageID})
+		if err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get page", err))
+			return
+		}
+		subPages = mapOfPageIdToSubPages[pageID]
+	}
+
+	c.JSON(http.StatusOK, PublicPageResponse{Data: pages[0], SubPages: subPages})
+}
+
+// recordFailedPassword bumps the link's failed password counter and locks the link once the lockout policy says so
+func (h *PublicLinksHandler) recordFailedPassword(ctx context.Context, linkID int64) error {
+	var failedAttempts int
+	err := h.db.QueryRow(ctx, `
+		UPDATE public_links SET failed_password_attempts = failed_password_attempts + 1 WHERE id = $1
+		RETURNING failed_password_attempts
+	`, linkID).Scan(&failedAttempts)
+	if err != nil {
+		return fmt.Errorf("failed to record failed password attempt: %w", err)
+	}
+
+	lockDuration := h.lockoutPolicy.LockDuration(failedAttempts)
+	if lockDuration == 0 {
+		return nil
+	}
+	_, err = h.db.Exec(ctx, `
+		UPDATE public_links SET locked_until = CURRENT_TIMESTAMP + $2::interval WHERE id = $1
+	`, linkID, lockDuration)
+	if err != nil {
+		return fmt.Errorf("failed to lock link: %w", err)
+	}
+	return nil
+}
+
+// RegisterRoutes registers the routes for managing links, they require authentication
+func (h *PublicLinksHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/pages/:id/public-links", h.GetPublicLinks)
+	router.POST("/pages/:id/public-links", h.CreatePublicLink)
+	router.DELETE("/pages/:id/public-links/:link_id", h.DeletePublicLink)
+}
+
+// RegisterPublicRoutes registers the route that serves pages through a link, it must be outside the authenticated group
+func (h *PublicLinksHandler) RegisterPublicRoutes(router *gin.RouterGroup) {
+	router.GET("/public/:token", h.GetPublicPage)
+}
@@ -0,0 +1,96 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicLinks(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.InsertTestPageFixtureWithParent(childId, parentId, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	publicLinks, err := handlers.NewPublicLinksHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return serveRequest(req, 1, publicLinks)
+	}
+
+	createLink := func(body string) handlers.PublicLink {
+		w := serve("POST", "/api/pages/"+parentId.String()+"/public-links", body, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Data handlers.PublicLink `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Data
+	}
+
+	link := createLink(`{}`)
+	assert.NotEmpty(t, link.Token)
+
+	w := serve("GET", "/api/public/"+link.Token, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var page handlers.PublicPageResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, parentId, page.Data.ID)
+	assert.Len(t, page.SubPages, 1)
+	assert.Equal(t, childId, page.SubPages[0].ID)
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/api/public/"+link.Token+"?page_id="+childId.String(), "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/public/"+link.Token+"?page_id="+uuid.Must(uuid.NewV4()).String(), "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/public/not-a-token", "", nil).Code)
+
+	protectedLink := createLink(`{"password": "hunter2", "include_sub_pages": false}`)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/api/public/"+protectedLink.Token, "", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/api/public/"+protectedLink.Token, "", map[string]string{handlers.PublicLinkPasswordHeader: "wrong"}).Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/api/public/"+protectedLink.Token, "", map[string]string{handlers.PublicLinkPasswordHeader: "hunter2"}).Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/public/"+protectedLink.Token+"?page_id="+childId.String(), "", map[string]string{handlers.PublicLinkPasswordHeader: "hunter2"}).Code)
+
+	// repeated wrong passwords lock the link, after which even the right one is refused
+	guessedLink := createLink(`{"password": "correct horse"}`)
+	for i := 0; i < handlers.PublicLinkLockoutPolicy.FreeAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, serve("GET", "/api/public/"+guessedLink.Token, "", map[string]string{handlers.PublicLinkPasswordHeader: fmt.Sprintf("guess %d", i)}).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve("GET", "/api/public/"+guessedLink.Token, "", map[string]string{handlers.PublicLinkPasswordHeader: "correct horse"}).Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/api/public/"+protectedLink.Token, "", map[string]string{handlers.PublicLinkPasswordHeader: "hunter2"}).Code, "other links are not locked")
+
+	expiresAt := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/api/pages/"+parentId.String()+"/public-links", `{"expires_at": "`+expiresAt+`"}`, nil).Code)
+
+	_, err = pool.Exec(context.Background(), `UPDATE public_links SET expires_at = CURRENT_TIMESTAMP - interval '1 minute' WHERE id = $1`, link.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/public/"+link.Token, "", nil).Code)
+
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/api/pages/"+parentId.String()+fmt.Sprintf("/public-links/%d", protectedLink.ID), "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/public/"+protectedLink.Token, "", map[string]string{handlers.PublicLinkPasswordHeader: "hunter2"}).Code)
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/auth"
+	"go_notion/backend/crdt"
+	"go_notion/backend/realtime"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/net/websocket"
+)
+
+type RealtimeHandler struct {
+	db       *pgxpool.Pool
+	hub      *realtime.Hub
+	sessions *auth.SessionStore
+}
+
+func NewRealtimeHandler(db *pgxpool.Pool, hub *realtime.Hub) (*RealtimeHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	if hub == nil {
+		return nil, fmt.Errorf("hub cannot be nil")
+	}
+	sessions, err := auth.NewSessionStore(db)
+	if err != nil {
+		return nil, err
+	}
+	return &RealtimeHandler{db, hub, sessions}, nil
+}
+
+const (
+	RealtimeActionSubscribe   = "subscribe"
+	RealtimeActionUnsubscribe = "unsubscribe"
+	// RealtimeActionJoin subscribes to a page and returns the state of its collaborative document
+	RealtimeActionJoin = "join"
+	// RealtimeActionUpdate merges the client's edits into the page's collaborative document
+	RealtimeActionUpdate = "update"
+)
+
+// RealtimeMessage is sent by clients to follow a page, or the sidebar tree of a workspace, and to edit pages
+type RealtimeMessage struct {
+	Action      string     `json:"action"`
+	PageID      *uuid.UUID `json:"page_id"`
+	WorkspaceID *int64     `json:"workspace_id"`
+	// ClientID identifies the editor session sending updates, it comes back on the relayed updates
+	ClientID string       `json:"client_id"`
+	Update   *crdt.Update `json:"update"`
+}
+
+// RealtimeReply acknowledges a message, events are sent as realtime.Event
+type RealtimeReply struct {
+	Type        string     `json:"type"`
+	PageID      *uuid.UUID `json:"page_id,omitempty"`
+	WorkspaceID *int64     `json:"workspace_id,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	// Document is the whole state on join and the writes that won on update
+	Document *crdt.Update `json:"document,omitempty"`
+	// Clock is the highest counter of the document, the client's next writes must be above it
+	Clock uint64 `json:"clock,omitempty"`
+}
+
+func (h *RealtimeHandler) Connect(c *gin.Context) {
+	userIdInt, apiErr := contextUserID(c, "not authorized to connect")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	// tokens issued before sessions existed don't have one
+	value, _ := c.Get("session_id")
+	sessionID, _ := value.(uuid.UUID)
+
+	server := websocket.Server{
+		// the connection is authenticated with a token and not with cookies, so other origins can't
+		// piggyback on the user's credentials and there is no need to check the origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			h.serve(c.Request.Context(), conn, userIdInt, sessionID)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+func (h *RealtimeHandler) serve(ctx context.Context, conn *websocket.Conn, userID int64, sessionID uuid.UUID) {
+	defer conn.Close()
+
+	client := h.hub.Register(userID)
+	defer h.hub.Unregister(client)
+
+	// every write goes through this goroutine, replies to the reader are queued here
+	replies := make(chan RealtimeReply, 8)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			var message RealtimeMessage
+			if err := websocket.JSON.Receive(conn, &message); err != nil {
+				return
+			}
+			reply := h.handleMessage(ctx, client, message)
+			select {
+			case replies <- reply:
+			case <-client.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var err error
+		select {
+		case event := <-client.Events():
+			deliver, dropped, authErr := h.authorizeEvent(ctx, client, sessionID, event)
+			if authErr != nil {
+				log.Printf("realtime: closing connection of user %d: %v", userID, authErr)
+				return
+			}
+			for _, reply := range dropped {
+				if err = websocket.JSON.Send(conn, reply); err != nil {
+					break
+				}
+			}
+			if err == nil && deliver {
+				err = websocket.JSON.Send(conn, event)
+			}
+		case reply := <-replies:
+			err = websocket.JSON.Send(conn, reply)
+		case <-client.Done():
+			return
+		case <-readerDone:
+			return
+		}
+		if err != nil {
+			log.Printf("realtime: failed to send to user %d: %v", userID, err)
+			return
+		}
+	}
+}
+
+func (h *RealtimeHandler) handleMessage(ctx context.Context, client *realtime.Client, message RealtimeMessage) RealtimeReply {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	reply := RealtimeReply{PageID: message.PageID, WorkspaceID: message.WorkspaceID}
+	if message.Action == RealtimeActionJoin || message.Action == RealtimeActionUpdate {
+		return h.handleDocumentMessage(ctx, client, message, reply)
+	}
+	if (message.PageID == nil) == (message.WorkspaceID == nil) {
+		reply.Type = "error"
+		reply.Message = "either page_id or workspace_id is required"
+		return reply
+	}
+
+	switch message.Action {
+	case RealtimeActionSubscribe:
+		var err error
+		if message.PageID != nil {
+			_, err = access.AuthorizePage(ctx, h.db, *message.PageID, client.UserID, access.ActionView)
+		} else {
+			_, err = access.AuthorizeWorkspace(ctx, h.db, *message.WorkspaceID, client.UserID, access.ActionView)
+		}
+		if err != nil {
+			reply.Type = "error"
+			reply.Message = subscribeErrorMessage(err)
+			return reply
+		}
+		if message.PageID != nil {
+			client.SubscribePage(*message.PageID)
+		} else {
+			client.SubscribeWorkspace(*message.WorkspaceID)
+		}
+		reply.Type = "subscribed"
+	case RealtimeActionUnsubscribe:
+		if message.PageID != nil {
+			client.UnsubscribePage(*message.PageID)
+		} else {
+			client.UnsubscribeWorkspace(*message.WorkspaceID)
+		}
+		reply.Type = "unsubscribed"
+	default:
+		reply.Type = "error"
+		reply.Message = "unknown action"
+	}
+	return reply
+}
+
+// authorizeEvent checks the user can still see what the event is about before it is delivered, since the session,
+// shares and memberships may have been revoked after the client subscribed. Subscriptions the user lost access
+// to are dropped and returned as unsubscribed replies. An error means the connection must be closed.
+func (h *RealtimeHandler) authorizeEvent(ctx context.Context, client *realtime.Client, sessionID uuid.UUID, event realtime.Event) (bool, []RealtimeReply, error) {
+	if event.Type == realtime.EventResync {
+		return true, nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	if sessionID != uuid.Nil {
+		if err := h.sessions.ValidateSession(ctx, sessionID, client.UserID); err != nil {
+			return false, nil, err
+		}
+	}
+
+	deliver := false
+	var dropped []RealtimeReply
+	if client.SubscribedWorkspace(event) {
+		_, err := access.AuthorizeWorkspace(ctx, h.db, event.WorkspaceID, client.UserID, access.ActionView)
+		if isAccessDenied(err) {
+			client.UnsubscribeWorkspace(event.WorkspaceID)
+			dropped = append(dropped, RealtimeReply{Type: "unsubscribed", WorkspaceID: &event.WorkspaceID})
+		} else if err != nil {
+			return false, nil, err
+		} else {
+			deliver = true
+		}
+	}
+	for _, pageID := range client.SubscribedPages(event) {
+		if event.Type == realtime.EventPageDeleted {
+			// the page is gone, there is nothing left to see and nothing more to follow
+			client.UnsubscribePage(pageID)
+			deliver = true
+			continue
+		}
+		_, err := access.AuthorizePage(ctx, h.db, pageID, client.UserID, access.ActionView)
+		if isAccessDenied(err) {
+			client.UnsubscribePage(pageID)
+			dropped = append(dropped, RealtimeReply{Type: "unsubscribed", PageID: &pageID})
+		} else if err != nil {
+			return false, nil, err
+		} else {
+			deliver = true
+		}
+	}
+	return deliver, dropped, nil
+}
+
+func isAccessDenied(err error) bool {
+	return errors.Is(err, access.ErrNotFound) || errors.Is(err, access.ErrForbidden)
+}
+
+func (h *RealtimeHandler) handleDocumentMessage(ctx context.Context, client *realtime.Client, message RealtimeMessage, reply RealtimeReply) RealtimeReply {
+	if message.PageID == nil {
+		reply.Type = "error"
+		reply.Message = "page_id is required"
+		return reply
+	}
+
+	if message.Action == RealtimeActionJoin {
+		doc, apiErr := getDocument(ctx, h.db, *message.PageID, client.UserID)
+		if apiErr != nil {
+			reply.Type = "error"
+			reply.Message = documentErrorMessage(apiErr)
+			return reply
+		}
+		client.SubscribePage(*message.PageID)
+		state := doc.State()
+		reply.Type = "joined"
+		reply.Document = &state
+		reply.Clock = doc.Clock()
+		return reply
+	}
+
+	if message.ClientID == "" || message.Update == nil {
+		reply.Type = "error"
+		reply.Message = "client_id and update are required"
+		return reply
+	}
+	applied, apiErr := applyDocumentUpdate(ctx, h.db, *message.PageID, client.UserID, message.ClientID, *message.Update)
+	if apiErr != nil {
+		reply.Type = "error"
+		reply.Message = documentErrorMessage(apiErr)
+		return reply
+	}
+	reply.Type = "updated"
+	reply.Document = &applied
+	return reply
+}
+
+// documentErrorMessage hides whether a page the user can't access exists, like the http handlers do
+func documentErrorMessage(apiErr *api_error.ApiError) string {
+	if apiErr.Code >= http.StatusInternalServerError {
+		log.Printf("realtime: %s: %v", apiErr.Message, apiErr.Err)
+	}
+	return apiErr.Message
+}
+
+func subscribeErrorMessage(err error) string {
+	if isAccessDenied(err) {
+		return "not found"
+	}
+	log.Printf("realtime: failed to authorize subscription: %v", err)
+	return "failed to subscribe"
+}
+
+func (h *RealtimeHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/ws", h.Connect)
+}
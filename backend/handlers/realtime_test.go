@@ -0,0 +1,339 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/crdt"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/realtime"
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestRealtimePageEvents(t *testing.T) {
+	pageId := uuid.Must(uuid.NewV4())
+	otherPageId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("other@example.com", "other", "password"),
+		db.InsertTestPageFixture(pageId, 1),
+		db.InsertTestPageFixture(otherPageId, 2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	hub := realtime.NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Listen(ctx, pool)
+
+	realtimeHandler, err := handlers.NewRealtimeHandler(pool, hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", int64(1))
+	})
+	api := r.Group("/api")
+	realtimeHandler.RegisterRoutes(api)
+	updatePage.RegisterRoutes(api)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	subscribe := func(message handlers.RealtimeMessage) handlers.RealtimeReply {
+		message.Action = handlers.RealtimeActionSubscribe
+		if err := websocket.JSON.Send(conn, message); err != nil {
+			t.Fatal(err)
+		}
+		var reply handlers.RealtimeReply
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := websocket.JSON.Receive(conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	assert.Equal(t, "error", subscribe(handlers.RealtimeMessage{PageID: &otherPageId}).Type)
+	assert.Equal(t, "subscribed", subscribe(handlers.RealtimeMessage{PageID: &pageId}).Type)
+
+	// the listener may still be starting, so keep editing until the event comes through
+	var event realtime.Event
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		body := `{"title_text": "title", "content_text": "content", "raw_title": {}, "raw_content": {}}`
+		req, _ := http.NewRequest("PUT", server.URL+"/api/pages/"+pageId.String(), strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if err := websocket.JSON.Receive(conn, &event); err == nil {
+			break
+		}
+	}
+
+	assert.Equal(t, realtime.EventPageUpdated, event.Type)
+	assert.Equal(t, []uuid.UUID{pageId}, event.PageIDs)
+	assert.Equal(t, int64(1), event.ActorID)
+}
+
+func TestCollaborativeEditing(t *testing.T) {
+	interval := handlers.DocumentAnnounceInterval
+	handlers.DocumentAnnounceInterval = time.Hour
+	defer func() { handlers.DocumentAnnounceInterval = interval }()
+
+	pageId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestPageFixture(pageId, 1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	hub := realtime.NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Listen(ctx, pool)
+
+	realtimeHandler, err := handlers.NewRealtimeHandler(pool, hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getPage, err := handlers.NewGetPageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", int64(1))
+	})
+	api := r.Group("/api")
+	realtimeHandler.RegisterRoutes(api)
+	getPage.RegisterRoutes(api)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	dial := func() *websocket.Conn {
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// waitFor skips the messages of other types, like the page events of the edits
+	waitFor := func(conn *websocket.Conn, messageType string, timeout time.Duration) (map[string]json.RawMessage, bool) {
+		deadline := time.Now().Add(timeout)
+		for {
+			conn.SetReadDeadline(deadline)
+			var message map[string]json.RawMessage
+			if err := websocket.JSON.Receive(conn, &message); err != nil {
+				return nil, false
+			}
+			if string(message["type"]) == `"`+messageType+`"` {
+				return message, true
+			}
+		}
+	}
+	send := func(conn *websocket.Conn, message handlers.RealtimeMessage) {
+		message.PageID = &pageId
+		if err := websocket.JSON.Send(conn, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice := dial()
+	defer alice.Close()
+	bob := dial()
+	defer bob.Close()
+
+	send(alice, handlers.RealtimeMessage{Action: handlers.RealtimeActionJoin})
+	_, ok := waitFor(alice, "joined", 2*time.Second)
+	assert.True(t, ok)
+	send(bob, handlers.RealtimeMessage{Action: handlers.RealtimeActionJoin})
+	_, ok = waitFor(bob, "joined", 2*time.Second)
+	assert.True(t, ok)
+
+	block := func(counter uint64, client, id, text string) *crdt.Update {
+		at := crdt.Timestamp{Counter: counter, ClientID: client}
+		node := json.RawMessage(`{"type":"paragraph","content":[{"type":"text","text":"` + text + `"}]}`)
+		return &crdt.Update{Blocks: map[string]crdt.Block{
+			id: {Data: &crdt.Register[json.RawMessage]{Value: node, At: at}, Position: &crdt.Register[string]{Value: id, At: at}},
+		}}
+	}
+
+	// the listener may still be starting, so keep editing until bob gets alice's edits
+	var relayed map[string]json.RawMessage
+	for counter := uint64(1); counter <= 10 && relayed == nil; counter++ {
+		send(alice, handlers.RealtimeMessage{Action: handlers.RealtimeActionUpdate, ClientID: "alice", Update: block(counter, "alice", "a", "from alice")})
+		_, ok = waitFor(alice, "updated", 2*time.Second)
+		assert.True(t, ok)
+		relayed, _ = waitFor(bob, string(realtime.EventDocumentUpdate), 500*time.Millisecond)
+	}
+	if assert.NotNil(t, relayed) {
+		assert.Equal(t, `"alice"`, string(relayed["client_id"]))
+	}
+
+	send(bob, handlers.RealtimeMessage{Action: handlers.RealtimeActionUpdate, ClientID: "bob", Update: block(20, "bob", "b", "from bob")})
+	_, ok = waitFor(bob, "updated", 2*time.Second)
+	assert.True(t, ok)
+
+	// the merged document is rendered into the page
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/pages/"+pageId.String(), nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "from alice\\nfrom bob")
+
+	// the edits are announced once per interval, the ones held back by the announcer
+	countEvents := func() int {
+		var count int
+		err := pool.QueryRow(ctx, `SELECT count(*) FROM page_events WHERE $1 = ANY(page_ids)`, pageId).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	assert.Equal(t, 1, countEvents())
+	assert.NoError(t, handlers.AnnounceDocumentEdits(ctx, pool))
+	assert.Equal(t, 1, countEvents(), "the interval isn't over yet")
+
+	_, err = pool.Exec(ctx, `UPDATE page_documents SET announced_at = announced_at - interval '2 hours' WHERE page_id = $1`, pageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, handlers.AnnounceDocumentEdits(ctx, pool))
+	assert.Equal(t, 2, countEvents())
+	assert.NoError(t, handlers.AnnounceDocumentEdits(ctx, pool))
+	assert.Equal(t, 2, countEvents())
+}
+
+func TestRealtimeRechecksAccessBeforeDelivering(t *testing.T) {
+	pageId := uuid.Must(uuid.NewV4())
+	sessionId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("other@example.com", "other", "password"),
+		db.InsertTestPageFixture(pageId, 1),
+		db.InsertTestSessionFixture(sessionId, 2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	_, err = pool.Exec(context.Background(), `INSERT INTO page_permissions (page_id, user_id, level) VALUES ($1, 2, 'viewer')`, pageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := realtime.NewHub()
+	realtimeHandler, err := handlers.NewRealtimeHandler(pool, hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", int64(2))
+		c.Set("session_id", sessionId)
+	})
+	realtimeHandler.RegisterRoutes(r.Group("/api"))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	connect := func() *websocket.Conn {
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := websocket.JSON.Send(conn, handlers.RealtimeMessage{Action: handlers.RealtimeActionSubscribe, PageID: &pageId}); err != nil {
+			t.Fatal(err)
+		}
+		var reply handlers.RealtimeReply
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := websocket.JSON.Receive(conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "subscribed", reply.Type)
+		return conn
+	}
+	update := realtime.Event{Type: realtime.EventDocumentUpdate, WorkspaceID: 1, PageIDs: []uuid.UUID{pageId}, Document: json.RawMessage(`{"blocks": {}}`)}
+
+	t.Run("unshared pages stop relaying", func(t *testing.T) {
+		conn := connect()
+		defer conn.Close()
+
+		hub.Broadcast(update)
+		var event realtime.Event
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if assert.NoError(t, websocket.JSON.Receive(conn, &event)) {
+			assert.Equal(t, realtime.EventDocumentUpdate, event.Type)
+		}
+
+		_, err := pool.Exec(context.Background(), `DELETE FROM page_permissions WHERE page_id = $1 AND user_id = 2`, pageId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub.Broadcast(update)
+		var reply handlers.RealtimeReply
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if assert.NoError(t, websocket.JSON.Receive(conn, &reply)) {
+			assert.Equal(t, "unsubscribed", reply.Type)
+			assert.Equal(t, pageId, *reply.PageID)
+		}
+
+		hub.Broadcast(update)
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		assert.Error(t, websocket.JSON.Receive(conn, &event), "the subscription is dropped")
+	})
+
+	t.Run("revoked sessions are disconnected", func(t *testing.T) {
+		_, err := pool.Exec(context.Background(), `INSERT INTO page_permissions (page_id, user_id, level) VALUES ($1, 2, 'viewer')`, pageId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := connect()
+		defer conn.Close()
+
+		_, err = pool.Exec(context.Background(), `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1`, sessionId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub.Broadcast(update)
+		var event realtime.Event
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		err = websocket.JSON.Receive(conn, &event)
+		assert.Error(t, err)
+		assert.NotContains(t, err.Error(), "timeout", "the connection is closed")
+	})
+}
@@ -3,8 +3,10 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
 	"go_notion/backend/page"
+	"go_notion/backend/realtime"
 	"net/http"
 	"time"
 
@@ -67,23 +69,38 @@ func (rp *ReorderPageHandler) ReorderPage(c *gin.Context) {
 		return
 	}
 
-	apiErr := rp.validateInput(ctx, input, pageID, userIdInt)
-	if apiErr != nil {
+	tx, err := rp.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to begin transaction: %w", err)))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if apiErr := rp.reorderPageInTx(ctx, tx, userIdInt, pageID, input); apiErr != nil {
 		c.Error(apiErr)
 		return
 	}
 
-	tx, err := rp.db.BeginTx(ctx, pgx.TxOptions{})
+	err = tx.Commit(ctx)
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to begin transaction: %w", err)))
+		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to commit transaction: %w", err)))
 		return
 	}
-	defer tx.Rollback(ctx)
+
+	c.Status(http.StatusOK)
+
+}
+
+// reorderPageInTx moves the page under the new parent within the transaction
+func (rp *ReorderPageHandler) reorderPageInTx(ctx context.Context, tx pgx.Tx, userID int64, pageID uuid.UUID, input ReorderPageInput) *api_error.ApiError {
+	workspaceID, apiErr := rp.validateInput(ctx, tx, input, pageID, userID)
+	if apiErr != nil {
+		return apiErr
+	}
 
 	ancestors, err := getAncestorIds(ctx, tx, []uuid.UUID{pageID, input.NewParentId})
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to get ancestors: %w", err)))
-		return
+		return api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to get ancestors: %w", err))
 	}
 
 	_, err = tx.Exec(ctx, `
@@ -91,14 +108,12 @@ func (rp *ReorderPageHandler) ReorderPage(c *gin.Context) {
 	`, pageID)
 
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to delete old ancestors of page: %w", err)))
-		return
+		return api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to delete old ancestors of page: %w", err))
 	}
 
 	descendantIds, err := getDescendants(ctx, tx, pageID)
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to get descendants: %w", err)))
-		return
+		return api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to get descendants: %w", err))
 	}
 
 	// we need to delete all the closures that are between the descendants and the current page ancestors
@@ -114,8 +129,7 @@ func (rp *ReorderPageHandler) ReorderPage(c *gin.Context) {
 		`, descendantIds, existingPageAncestorIds)
 
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to delete old ancestors of page: %w", err)))
-		return
+		return api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to delete old ancestors of page: %w", err))
 	}
 
 	// the plus one is for the new parent closure
@@ -143,55 +157,56 @@ func (rp *ReorderPageHandler) ReorderPage(c *gin.Context) {
 	closures := append(newAncestorsForCurrentPage, descendantClosures...)
 	err = page.InsertPageClosures(ctx, tx, closures)
 	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to insert new ancestors of page: %w", err)))
-		return
+		return api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to insert new ancestors of page: %w", err))
 	}
 
-	err = tx.Commit(ctx)
-	if err != nil {
-		c.Error(api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to commit transaction: %w", err)))
-		return
+	if err := conformToParentDatabase(ctx, tx, pageID); err != nil {
+		return api_error.NewInternalServerError("failed to reorder page", err)
 	}
 
-	c.Status(http.StatusOK)
+	// the sub pages move along, they may have left a shared page and sync reevaluates the pages named in events
+	movedPageIDs := append([]uuid.UUID{pageID, input.NewParentId}, descendantIds...)
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageMoved, WorkspaceID: workspaceID, PageIDs: movedPageIDs, ActorID: userID})
+	if err != nil {
+		return api_error.NewInternalServerError("failed to reorder page", err)
+	}
 
+	return nil
 }
 
-func (rp *ReorderPageHandler) validateInput(ctx context.Context, input ReorderPageInput, pageID uuid.UUID, userID int64) *api_error.ApiError {
+// validateInput checks the move is allowed and returns the workspace the page is moved within
+func (rp *ReorderPageHandler) validateInput(ctx context.Context, tx pgx.Tx, input ReorderPageInput, pageID uuid.UUID, userID int64) (int64, *api_error.ApiError) {
 	// ensure new parent is not a descendant of the current page
 	var willGenerateCyclicClosure bool
-	err := rp.db.QueryRow(ctx, `
+	err := tx.QueryRow(ctx, `
 		SELECT EXISTS(
 			SELECT 1 FROM pages_closures WHERE ancestor_id = $1 AND descendant_id = $2
 		)
 	`, pageID, input.NewParentId).Scan(&willGenerateCyclicClosure)
 	if err != nil {
-		return api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to check if new parent is a descendant: %w", err))
+		return 0, api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to check if new parent is a descendant: %w", err))
 	}
 
 	if willGenerateCyclicClosure {
-		return api_error.NewBadRequestError("cannot add page to nested page", nil)
+		return 0, api_error.NewBadRequestError("cannot add page to nested page", nil)
 	}
 
-	var pagesBelongsToUser bool
-	err = rp.db.QueryRow(ctx,
-		`SELECT EXISTS(
-			SELECT 1 FROM pages 
-			WHERE id IN ($1, $2) 
-			GROUP BY created_by 
-			HAVING created_by = $3 
-			AND COUNT(*) = 2
-		)`, pageID, input.NewParentId, userID).Scan(&pagesBelongsToUser)
+	pageWorkspaceID, err := access.AuthorizePage(ctx, tx, pageID, userID, access.ActionManage)
+	if err != nil {
+		return 0, accessError(err, "page not found")
+	}
 
+	parentWorkspaceID, err := access.AuthorizePage(ctx, tx, input.NewParentId, userID, access.ActionEdit)
 	if err != nil {
-		return api_error.NewInternalServerError("failed to reorder page", fmt.Errorf("failed to check if page belongs to user: %w", err))
+		return 0, accessError(err, "new parent page not found")
 	}
 
-	if !pagesBelongsToUser {
-		return api_error.NewUnauthorizedError("not authorized to reorder page", nil)
+	// the closures don't cross workspaces, moving between them would need the whole subtree to move too
+	if pageWorkspaceID != parentWorkspaceID {
+		return 0, api_error.NewBadRequestError("cannot move page to a different workspace", nil)
 	}
 
-	return nil
+	return pageWorkspaceID, nil
 }
 
 func getDescendants(ctx context.Context, tx pgx.Tx, pageID uuid.UUID) ([]uuid.UUID, error) {
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"go_notion/backend/api_error"
+	"go_notion/backend/auth"
+	"go_notion/backend/router"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// issueToken records a session for the device making the request and returns a token bound to it
+func issueToken(ctx context.Context, c *gin.Context, db *pgxpool.Pool, tokenGenerator auth.TokenGenerator, userID int64) (string, error) {
+	sessionID, err := auth.CreateSession(ctx, db, userID, c.Request.UserAgent(), router.GetRealIP(c))
+	if err != nil {
+		return "", err
+	}
+	return tokenGenerator.Generate(userID, sessionID)
+}
+
+type SessionsHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewSessionsHandler(db *pgxpool.Pool) (*SessionsHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &SessionsHandler{db}, nil
+}
+
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  *string   `json:"user_agent"`
+	IPAddress  *string   `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Current is true for the session the request was made with
+	Current bool `json:"current"`
+}
+
+type SessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+func (h *SessionsHandler) GetSessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to get sessions", nil))
+		return
+	}
+	userIdInt, ok := userID.(int64)
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to get sessions", fmt.Errorf("user id is not an integer")))
+		return
+	}
+	// tokens issued before sessions existed don't have one
+	currentSessionID, _ := c.Get("session_id")
+
+	rows, err := h.db.Query(ctx, `
+		SELECT id, user_agent, ip_address, created_at, last_seen_at FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY last_seen_at DESC
+	`, userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get sessions", err))
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get sessions", err))
+			return
+		}
+		s.Current = currentSessionID == s.ID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get sessions", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, SessionsResponse{Sessions: sessions})
+}
+
+type RevokeSessionUri struct {
+	ID string `uri:"id" binding:"required,uuid"`
+}
+
+// RevokeSession signs a device out. Revoking the current session is how a client signs out.
+func (h *SessionsHandler) RevokeSession(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to revoke session", nil))
+		return
+	}
+	userIdInt, ok := userID.(int64)
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to revoke session", fmt.Errorf("user id is not an integer")))
+		return
+	}
+
+	var uri RevokeSessionUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	sessionID, err := uuid.FromString(uri.ID)
+	if err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	cmd, err := h.db.Exec(ctx, `
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to revoke session", err))
+		return
+	}
+
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewNotFoundError("session not found", nil))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *SessionsHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/me/sessions", h.GetSessions)
+	router.DELETE("/me/sessions/:id", h.RevokeSession)
+}
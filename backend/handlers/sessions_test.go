@@ -0,0 +1,85 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListAndRevokeSessions(t *testing.T) {
+	currentSession := uuid.Must(uuid.NewV4())
+	otherSession := uuid.Must(uuid.NewV4())
+	otherUsersSession := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("other@example.com", "other", "password"),
+		db.InsertTestSessionFixture(currentSession, 1),
+		db.InsertTestSessionFixture(otherSession, 1),
+		db.InsertTestSessionFixture(otherUsersSession, 2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	sessions, err := handlers.NewSessionsHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.Use(func(c *gin.Context) {
+		c.Set("session_id", currentSession)
+		c.Set("user_id", int64(1))
+	})
+	sessions.RegisterRoutes(r.Group("/api"))
+
+	listSessions := func() handlers.SessionsResponse {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/me/sessions", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response handlers.SessionsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := listSessions()
+	assert.Len(t, response.Sessions, 2)
+	for _, session := range response.Sessions {
+		assert.Equal(t, session.ID == currentSession, session.Current)
+	}
+
+	// another user's session can't be revoked
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/api/me/sessions/"+otherUsersSession.String(), nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/me/sessions/"+otherSession.String(), nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	response = listSessions()
+	assert.Len(t, response.Sessions, 1)
+	assert.Equal(t, currentSession, response.Sessions[0].ID)
+
+	var revoked bool
+	err = pool.QueryRow(context.Background(), "SELECT revoked_at IS NOT NULL FROM sessions WHERE id = $1", otherSession).Scan(&revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, revoked)
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type SharesHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewSharesHandler(db *pgxpool.Pool) (*SharesHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &SharesHandler{db}, nil
+}
+
+type PageShare struct {
+	UserID    int64     `json:"user_id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Level     string    `json:"level"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PageSharesResponse struct {
+	Shares []PageShare `json:"shares"`
+}
+
+// GetShares lists the grants made on the page itself, grants inherited from ancestors are listed on the ancestor
+func (h *SharesHandler) GetShares(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get page shares")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT users.id, users.username, users.email, page_permissions.level, page_permissions.created_at
+		FROM page_permissions
+		INNER JOIN users ON users.id = page_permissions.user_id
+		WHERE page_permissions.page_id = $1
+		ORDER BY page_permissions.created_at
+	`, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get page shares", err))
+		return
+	}
+	defer rows.Close()
+
+	shares := []PageShare{}
+	for rows.Next() {
+		var share PageShare
+		if err := rows.Scan(&share.UserID, &share.Username, &share.Email, &share.Level, &share.CreatedAt); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get page shares", err))
+			return
+		}
+		shares = append(shares, share)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get page shares", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, PageSharesResponse{Shares: shares})
+}
+
+type SharePageInput struct {
+	Email string `json:"email" binding:"required,email"`
+	Level string `json:"level" binding:"required"`
+}
+
+// SharePage grants the user access to the page and its subtree. Sharing again with the same user changes their level.
+func (h *SharesHandler) SharePage(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to share page")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input SharePageInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	level, err := access.ParseLevel(input.Level)
+	if err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to share page", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var granteeID int64
+	err = tx.QueryRow(ctx, `SELECT id FROM users WHERE lower(email) = lower($1)`, input.Email).Scan(&granteeID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewNotFoundError("user not found", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to share page", err))
+		return
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO page_permissions (page_id, user_id, level, granted_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (page_id, user_id) DO UPDATE SET level = EXCLUDED.level, granted_by = EXCLUDED.granted_by
+	`, pageID, granteeID, level.String(), userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to share page", err))
+		return
+	}
+
+	// sharing again only changes the level, logging it anyway just sends the pages again
+	if err := recordAccessChange(ctx, tx, granteeID, accessChangePageShared, nil, []uuid.UUID{pageID}); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to share page", err))
+		return
+	}
+	if err := notifyPendingMentionsOfUser(ctx, tx, granteeID); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to share page", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to share page", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "page shared successfully"})
+}
+
+type UnsharePageUri struct {
+	ID     string `uri:"id" binding:"required,uuid"`
+	UserID int64  `uri:"user_id" binding:"required"`
+}
+
+func (h *SharesHandler) UnsharePage(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to unshare page")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri UnsharePageUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	pageID, err := uuid.FromString(uri.ID)
+	if err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unshare page", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(ctx, `
+		DELETE FROM page_permissions WHERE page_id = $1 AND user_id = $2
+	`, pageID, uri.UserID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unshare page", err))
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewNotFoundError("share not found", nil))
+		return
+	}
+	if err := recordPageUnshared(ctx, tx, uri.UserID, pageID); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unshare page", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unshare page", err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+type SharedPage struct {
+	ID        uuid.UUID `json:"id"`
+	TextTitle *string   `json:"text_title"`
+	Level     string    `json:"level"`
+}
+
+type SharedPagesResponse struct {
+	Pages []SharedPage `json:"pages"`
+}
+
+// GetSharedPages lists the pages shared directly with the user, their sub pages are reachable from there
+func (h *SharesHandler) GetSharedPages(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get shared pages")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT pages.id, pages.text_title, page_permissions.level
+		FROM page_permissions
+		INNER JOIN pages ON pages.id = page_permissions.page_id
+		WHERE page_permissions.user_id = $1
+		ORDER BY page_permissions.created_at DESC
+	`, userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get shared pages", err))
+		return
+	}
+	defer rows.Close()
+
+	pages := []SharedPage{}
+	for rows.Next() {
+		var p SharedPage
+		if err := rows.Scan(&p.ID, &p.TextTitle, &p.Level); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get shared pages", err))
+			return
+		}
+		pages = append(pages, p)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get shared pages", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, SharedPagesResponse{Pages: pages})
+}
+
+func (h *SharesHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/pages/:id/shares", h.GetShares)
+	router.POST("/pages/:id/shares", h.SharePage)
+	router.DELETE("/pages/:id/shares/:user_id", h.UnsharePage)
+	router.GET("/me/shared-pages", h.GetSharedPages)
+}
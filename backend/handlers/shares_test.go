@@ -0,0 +1,78 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedPermissionsAreInherited(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("colleague@example.com", "colleague", "password"),
+		db.InsertTestPageFixtureWithParent(childId, parentId, 1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	shares, err := handlers.NewSharesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getPage, err := handlers.NewGetPageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletePage, err := handlers.NewDeletePageHandler(pool, mocks.NewBlobStoreMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(shares, getPage, updatePage, deletePage)
+
+	sharesPath := "/api/pages/" + parentId.String() + "/shares"
+	childPath := "/api/pages/" + childId.String()
+	update := `{"title_text": "shared", "content_text": "shared", "raw_title": {}, "raw_content": {}}`
+
+	assert.Equal(t, http.StatusNotFound, serve(2, "GET", childPath, "").Code)
+	// only users with full access can share
+	assert.Equal(t, http.StatusNotFound, serve(2, "POST", sharesPath, `{"email": "colleague@example.com", "level": "editor"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(1, "POST", sharesPath, `{"email": "colleague@example.com", "level": "owner"}`).Code)
+
+	assert.Equal(t, http.StatusOK, serve(1, "POST", sharesPath, `{"email": "colleague@example.com", "level": "viewer"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(2, "GET", childPath, "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(2, "PUT", childPath, update).Code)
+
+	assert.Equal(t, http.StatusOK, serve(1, "POST", sharesPath, `{"email": "colleague@example.com", "level": "editor"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(2, "PUT", childPath, update).Code)
+	// editors can't delete or reshare
+	assert.Equal(t, http.StatusForbidden, serve(2, "DELETE", childPath, "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(2, "POST", sharesPath, `{"email": "test@test.com", "level": "viewer"}`).Code)
+
+	w := serve(2, "GET", "/api/me/shared-pages", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var sharedPages handlers.SharedPagesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sharedPages); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, sharedPages.Pages, 1)
+	assert.Equal(t, parentId, sharedPages.Pages[0].ID)
+	assert.Equal(t, "editor", sharedPages.Pages[0].Level)
+
+	assert.Equal(t, http.StatusNoContent, serve(1, "DELETE", sharesPath+"/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(2, "GET", childPath, "").Code)
+}
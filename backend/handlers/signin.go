@@ -2,34 +2,54 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go_notion/backend/api_error"
 	"go_notion/backend/auth"
+	"go_notion/backend/mailer"
+	"log"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// unlockTokenLifeSpan is how long the link in an account unlock email stays valid
+const unlockTokenLifeSpan = 24 * time.Hour
+
 type SignInHandler struct {
-	db             *pgxpool.Pool
-	tokenGenerator auth.TokenGenerator
+	db              *pgxpool.Pool
+	tokenGenerator  auth.TokenGenerator
+	challengeIssuer auth.ChallengeIssuer
+	mailer          mailer.Mailer
+	lockoutPolicy   auth.LockoutPolicy
 }
 
-func NewSignInHandler(db *pgxpool.Pool, tokenGenerator auth.TokenGenerator) (*SignInHandler, error) {
+func NewSignInHandler(db *pgxpool.Pool, tokenGenerator auth.TokenGenerator, challengeIssuer auth.ChallengeIssuer, mailer mailer.Mailer) (*SignInHandler, error) {
 	if db == nil {
 		return nil, fmt.Errorf("db cannot be nil")
 	}
 	if tokenGenerator == nil {
 		return nil, fmt.Errorf("tokenGenerator cannot be nil")
 	}
-	return &SignInHandler{db, tokenGenerator}, nil
+	if challengeIssuer == nil {
+		return nil, fmt.Errorf("challengeIssuer cannot be nil")
+	}
+	if mailer == nil {
+		return nil, fmt.Errorf("mailer cannot be nil")
+	}
+	return &SignInHandler{db, tokenGenerator, challengeIssuer, mailer, auth.DefaultLockoutPolicy}, nil
 }
 
 type SignInInput struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=5"`
+	// InviteToken optionally joins the workspace the user was invited to. When 2FA is enabled
+	// it has to be passed again to /auth/signin/2fa since that's where the token is issued.
+	InviteToken string `json:"invite_token"`
 }
 
 func (s *SignInHandler) SignIn(c *gin.Context) {
@@ -43,23 +63,77 @@ func (s *SignInHandler) SignIn(c *gin.Context) {
 	}
 
 	var userID int64
-	var hashedPassword string
+	// the password is null for users who only ever signed in through single sign on
+	var hashedPassword *string
+	var totpEnabled bool
+	var lockedUntil *time.Time
 
-	err := s.db.QueryRow(ctx, "select id, password from users where email=$1", input.Email).Scan(&userID, &hashedPassword)
+	err := s.db.QueryRow(ctx, "select id, password, totp_enabled, locked_until from users where email=$1", input.Email).Scan(&userID, &hashedPassword, &totpEnabled, &lockedUntil)
 
-	if err != nil {
+	if errors.Is(err, pgx.ErrNoRows) {
+		// comparing against a dummy hash makes unknown emails take as long as wrong passwords,
+		// otherwise the response time alone would tell an attacker which emails have an account
+		auth.DummyComparePassword(input.Password)
 		c.Error(api_error.NewBadRequestError("wrong email or password", err))
 		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+
+	// a locked account answers like an unknown email, with the same error after the same work,
+	// so neither the message nor the timing tells an attacker that the email has an account
+	if lockedUntil != nil && lockedUntil.After(time.Now()) {
+		auth.DummyComparePassword(input.Password)
+		c.Error(api_error.NewBadRequestError("wrong email or password", nil))
+		return
 	}
 
-	if !auth.ComparePassword(input.Password, hashedPassword) {
+	if hashedPassword == nil {
+		auth.DummyComparePassword(input.Password)
+		c.Error(api_error.NewBadRequestError("wrong email or password", nil))
+		return
+	}
+
+	if !auth.ComparePassword(input.Password, *hashedPassword) {
+		if err := s.recordFailedAttempt(ctx, userID); err != nil {
+			c.Error(api_error.NewInternalServerError("authentication failed", err))
+			return
+		}
 		// as a security practice, we should not be too direct about what exactly went wrong because
 		// "hackers" could try and brute force the password once we let them know its the password that's wrong
-		c.Error(api_error.NewBadRequestError("wrong email or password", err))
+		c.Error(api_error.NewBadRequestError("wrong email or password", nil))
+		return
+	}
+
+	// sign in is the only time we see the plain password, so it's when old hashes get upgraded
+	if auth.PasswordNeedsRehash(*hashedPassword) {
+		if err := s.rehashPassword(ctx, userID, input.Password, *hashedPassword); err != nil {
+			// the user proved who they are, failing to upgrade the hash shouldn't stop them from signing in
+			log.Printf("failed to rehash password for user %d: %v", userID, err)
+		}
+	}
+
+	if totpEnabled {
+		// the password was right but the user still has to prove they hold the second factor. The failed attempts
+		// are only reset once they do, or every lockout would come with fresh guesses at the code.
+		respondWithTwoFactorChallenge(c, s.challengeIssuer, userID)
 		return
 	}
 
-	token, err := s.tokenGenerator.Generate(userID)
+	if err := s.resetFailedAttempts(ctx, userID); err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+
+	if input.InviteToken != "" {
+		if _, apiErr := acceptInviteWithPool(ctx, s.db, input.InviteToken, userID); apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+	}
+
+	token, err := issueToken(ctx, c, s.db, s.tokenGenerator, userID)
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("authentication failed", err))
 		return
@@ -68,6 +142,259 @@ func (s *SignInHandler) SignIn(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"token": token})
 }
 
+// respondWithTwoFactorChallenge answers a sign in that still needs the second factor.
+// The challenge token can only be exchanged for a real token at /auth/signin/2fa.
+func respondWithTwoFactorChallenge(c *gin.Context, challengeIssuer auth.ChallengeIssuer, userID int64) {
+	challengeToken, err := challengeIssuer.GenerateChallenge(userID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"two_factor_required": true, "challenge_token": challengeToken})
+}
+
+type SignInTwoFactorInput struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	// Code is either the current TOTP code or one of the user's unused recovery codes
+	Code        string `json:"code" binding:"required"`
+	InviteToken string `json:"invite_token"`
+}
+
+func (s *SignInHandler) SignInTwoFactor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var input SignInTwoFactorInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	userID, err := s.challengeIssuer.VerifyChallenge(input.ChallengeToken)
+	if err != nil {
+		c.Error(api_error.NewUnauthorizedError("invalid or expired challenge", err))
+		return
+	}
+
+	var totpSecret *string
+	var totpEnabled bool
+	var totpLastStep int64
+	var lockedUntil *time.Time
+	err = s.db.QueryRow(ctx, "select totp_secret, totp_enabled, totp_last_step, locked_until from users where id=$1", userID).Scan(&totpSecret, &totpEnabled, &totpLastStep, &lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewUnauthorizedError("invalid or expired challenge", err))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+
+	if !totpEnabled || totpSecret == nil {
+		c.Error(api_error.NewBadRequestError("two factor authentication is not enabled", nil))
+		return
+	}
+
+	// the challenge token lives for a few minutes, without this check it could be used to grind through codes
+	if lockedUntil != nil && lockedUntil.After(time.Now()) {
+		c.Error(api_error.NewTooManyRequestsError("too many failed sign in attempts, try again later or use the unlock link sent to your email", nil))
+		return
+	}
+
+	acceptedCode, err := acceptTOTPCode(ctx, s.db, userID, *totpSecret, input.Code, totpLastStep)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+	if !acceptedCode {
+		usedRecoveryCode, err := s.useRecoveryCode(ctx, userID, input.Code)
+		if err != nil {
+			c.Error(api_error.NewInternalServerError("authentication failed", err))
+			return
+		}
+		if !usedRecoveryCode {
+			if err := s.recordFailedAttempt(ctx, userID); err != nil {
+				c.Error(api_error.NewInternalServerError("authentication failed", err))
+				return
+			}
+			c.Error(api_error.NewBadRequestError("invalid code", nil))
+			return
+		}
+	}
+
+	if err := s.resetFailedAttempts(ctx, userID); err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+
+	if input.InviteToken != "" {
+		if _, apiErr := acceptInviteWithPool(ctx, s.db, input.InviteToken, userID); apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+	}
+
+	token, err := issueToken(ctx, c, s.db, s.tokenGenerator, userID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("authentication failed", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+// useRecoveryCode marks the recovery code as used and reports whether it was a valid, unused code
+func (s *SignInHandler) useRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	cmd, err := s.db.Exec(ctx, `
+		UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM user_recovery_codes WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL LIMIT 1
+		)
+	`, userID, auth.HashRecoveryCode(code))
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	return cmd.RowsAffected() == 1, nil
+}
+
+func (s *SignInHandler) rehashPassword(ctx context.Context, userID int64, password, oldHash string) error {
+	newHash, hashErr := auth.HashPassword(password)
+	if hashErr != nil {
+		return hashErr
+	}
+	// matching on the old hash means a password change that happened in the meantime is never overwritten
+	_, err := s.db.Exec(ctx, `
+		UPDATE users SET password = $1 WHERE id = $2 AND password = $3
+	`, newHash, userID, oldHash)
+	if err != nil {
+		return fmt.Errorf("failed to store rehashed password: %w", err)
+	}
+	return nil
+}
+
+// recordFailedAttempt bumps the user's failed attempt counter and locks the account once the lockout policy says so.
+// The first time the account gets locked, the user is emailed a link to unlock it straight away.
+func (s *SignInHandler) recordFailedAttempt(ctx context.Context, userID int64) error {
+	var failedAttempts int
+	var email string
+	err := s.db.QueryRow(ctx, `
+		UPDATE users SET failed_sign_in_attempts = failed_sign_in_attempts + 1 WHERE id = $1
+		RETURNING failed_sign_in_attempts, email
+	`, userID).Scan(&failedAttempts, &email)
+	if err != nil {
+		return fmt.Errorf("failed to record failed sign in attempt: %w", err)
+	}
+
+	lockDuration := s.lockoutPolicy.LockDuration(failedAttempts)
+	if lockDuration == 0 {
+		return nil
+	}
+
+	_, err = s.db.Exec(ctx, `
+		UPDATE users SET locked_until = CURRENT_TIMESTAMP + $2::interval WHERE id = $1
+	`, userID, lockDuration)
+	if err != nil {
+		return fmt.Errorf("failed to lock account: %w", err)
+	}
+
+	// later failures only extend the lock, we don't want to flood the user's inbox
+	if failedAttempts == s.lockoutPolicy.FreeAttempts {
+		return s.sendUnlockEmail(ctx, userID, email)
+	}
+	return nil
+}
+
+func (s *SignInHandler) resetFailedAttempts(ctx context.Context, userID int64) error {
+	_, err := s.db.Exec(ctx, `
+		UPDATE users SET failed_sign_in_attempts = 0, locked_until = NULL
+		WHERE id = $1 AND (failed_sign_in_attempts > 0 OR locked_until IS NOT NULL)
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to reset failed sign in attempts: %w", err)
+	}
+	return nil
+}
+
+func (s *SignInHandler) sendUnlockEmail(ctx context.Context, userID int64, email string) error {
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(ctx, `
+		INSERT INTO account_unlock_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, CURRENT_TIMESTAMP + $3::interval)
+	`, userID, tokenHash, unlockTokenLifeSpan)
+	if err != nil {
+		return fmt.Errorf("failed to store unlock token: %w", err)
+	}
+
+	link := mailer.Link("/unlock", url.Values{"token": {token}})
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Your account has been locked",
+		Body:    fmt.Sprintf("We noticed several failed attempts to sign in to your account so we locked it for a while.\n\nIf this was you, you can unlock your account right away: %s\n\nIf it wasn't, consider changing your password.", link),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send unlock email: %w", err)
+	}
+	return nil
+}
+
+type UnlockAccountInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// UnlockAccount clears the lock on an account using the token from the unlock email
+func (s *SignInHandler) UnlockAccount(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var input UnlockAccountInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unlock account", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int64
+	err = tx.QueryRow(ctx, `
+		UPDATE account_unlock_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id
+	`, auth.HashOpaqueToken(input.Token)).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewBadRequestError("invalid or expired unlock token", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unlock account", err))
+		return
+	}
+
+	// the token was mailed to the user, using it proves they receive mail at their email
+	_, err = tx.Exec(ctx, `
+		UPDATE users SET failed_sign_in_attempts = 0, locked_until = NULL, email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unlock account", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unlock account", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "account unlocked"})
+}
+
 func (s *SignInHandler) RegisterRoutes(router *gin.RouterGroup) {
 	router.POST("/auth/signin", s.SignIn)
+	router.POST("/auth/signin/2fa", s.SignInTwoFactor)
+	router.POST("/auth/unlock", s.UnlockAccount)
 }
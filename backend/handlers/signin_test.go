@@ -1,14 +1,20 @@
 package handlers_test
 
 import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/auth"
 	"go_notion/backend/db"
 	"go_notion/backend/handlers"
 	"go_notion/backend/mocks"
 	"go_notion/backend/router"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -37,7 +43,7 @@ func TestSignIn(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 
 			tokenGenerator := &mocks.TokenGeneratorMock{}
-			signIn, err := handlers.NewSignInHandler(pool, tokenGenerator)
+			signIn, err := handlers.NewSignInHandler(pool, tokenGenerator, &mocks.ChallengeIssuerMock{}, &mocks.MailerMock{})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -56,3 +62,203 @@ func TestSignIn(t *testing.T) {
 	}
 
 }
+
+func TestSignInWithTwoFactor(t *testing.T) {
+	email, username, password := "test@test.com", "test", "password"
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryCode := "abcde-12345"
+
+	pool, err := db.OpenTestDb(db.InsertTestUserWithData(email, username, password), db.EnableTestUserTwoFactor(1, secret, recoveryCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	signIn, err := handlers.NewSignInHandler(pool, &mocks.TokenGeneratorMock{}, &mocks.ChallengeIssuerMock{}, &mocks.MailerMock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	signIn.RegisterRoutes(r.Group("/api"))
+
+	w := httptest.NewRecorder()
+	body := `{"email": "` + email + `", "password": "` + password + `"}`
+	req, _ := http.NewRequest("POST", "/api/auth/signin", strings.NewReader(body))
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var challengeResponse struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+		Token             string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &challengeResponse); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, challengeResponse.TwoFactorRequired)
+	assert.Empty(t, challengeResponse.Token, "a session token must not be issued before the second factor")
+
+	code, err := auth.GenerateTOTP(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		challengeToken string
+		code           string
+		expectedStatus int
+	}{
+		{name: "valid totp code", challengeToken: challengeResponse.ChallengeToken, code: code, expectedStatus: http.StatusOK},
+		{name: "totp codes are single use", challengeToken: challengeResponse.ChallengeToken, code: code, expectedStatus: http.StatusBadRequest},
+		{name: "invalid challenge token", challengeToken: "invalid", code: code, expectedStatus: http.StatusUnauthorized},
+		{name: "wrong code", challengeToken: challengeResponse.ChallengeToken, code: "000000", expectedStatus: http.StatusBadRequest},
+		{name: "recovery code", challengeToken: challengeResponse.ChallengeToken, code: recoveryCode, expectedStatus: http.StatusOK},
+		{name: "recovery codes are single use", challengeToken: challengeResponse.ChallengeToken, code: recoveryCode, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			body := `{"challenge_token": "` + test.challengeToken + `", "code": "` + test.code + `"}`
+			req, _ := http.NewRequest("POST", "/api/auth/signin/2fa", strings.NewReader(body))
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+		})
+	}
+
+	// the password alone doesn't clear the failed code, it would give fresh guesses at the code after each lockout
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/auth/signin", strings.NewReader(body))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var failedAttempts int
+	if err := pool.QueryRow(context.Background(), "select failed_sign_in_attempts from users where id = 1").Scan(&failedAttempts); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, failedAttempts)
+}
+
+func TestSignInLocksAccountAfterRepeatedFailures(t *testing.T) {
+	email, username, password := "test@test.com", "test", "password"
+
+	pool, err := db.OpenTestDb(db.InsertTestUserWithData(email, username, password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	mailerMock := &mocks.MailerMock{}
+	signIn, err := handlers.NewSignInHandler(pool, &mocks.TokenGeneratorMock{}, &mocks.ChallengeIssuerMock{}, mailerMock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	signIn.RegisterRoutes(r.Group("/api"))
+
+	signInWith := func(password string) int {
+		w := httptest.NewRecorder()
+		body := `{"email": "` + email + `", "password": "` + password + `"}`
+		req, _ := http.NewRequest("POST", "/api/auth/signin", strings.NewReader(body))
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < auth.DefaultLockoutPolicy.FreeAttempts; i++ {
+		assert.Equal(t, http.StatusBadRequest, signInWith("wrongpassword"))
+	}
+
+	// the right password is refused while the account is locked, with the same error as a wrong one
+	assert.Equal(t, http.StatusBadRequest, signInWith(password))
+
+	messages := mailerMock.Messages()
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, email, messages[0].To)
+	}
+
+	link := regexp.MustCompile(`https?://\S+`).FindString(messages[0].Body)
+	unlockURL, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := unlockURL.Query().Get("token")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/auth/unlock", strings.NewReader(`{"token": "`+token+`"}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// unlock tokens are single use
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/auth/unlock", strings.NewReader(`{"token": "`+token+`"}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Equal(t, http.StatusOK, signInWith(password))
+}
+
+func TestSignInWithUnknownEmail(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	signIn, err := handlers.NewSignInHandler(pool, &mocks.TokenGeneratorMock{}, &mocks.ChallengeIssuerMock{}, &mocks.MailerMock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	signIn.RegisterRoutes(r.Group("/api"))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/auth/signin", strings.NewReader(`{"email": "unknown@test.com", "password": "password"}`))
+	r.ServeHTTP(w, req)
+
+	// unknown emails get the exact same response as a wrong password
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"errors": [{"error": "wrong email or password"}]}`, w.Body.String())
+}
+
+func TestSignInRehashesBcryptPasswords(t *testing.T) {
+	email, username, password := "test@test.com", "test", "password"
+	bcryptHash, err := auth.NewBcryptHasher(auth.BcryptDevCost).Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := db.OpenTestDb(db.InsertTestUserWithPasswordHash(email, username, bcryptHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	signIn, err := handlers.NewSignInHandler(pool, &mocks.TokenGeneratorMock{}, &mocks.ChallengeIssuerMock{}, &mocks.MailerMock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	signIn.RegisterRoutes(r.Group("/api"))
+
+	w := httptest.NewRecorder()
+	body := `{"email": "` + email + `", "password": "` + password + `"}`
+	req, _ := http.NewRequest("POST", "/api/auth/signin", strings.NewReader(body))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var storedHash string
+	err = pool.QueryRow(context.Background(), "SELECT password FROM users WHERE email = $1", email).Scan(&storedHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(storedHash, "$argon2id$"), "bcrypt hash should have been upgraded, got %s", storedHash)
+	assert.True(t, auth.ComparePassword(password, storedHash))
+}
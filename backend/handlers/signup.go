@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
 	"go_notion/backend/auth"
 	"log"
@@ -30,6 +31,8 @@ type SignUpInput struct {
 	Email    string `json:"email" binding:"required,email"`
 	Username string `json:"username" binding:"required,min=3,max=30"`
 	Password string `json:"password" binding:"required,min=5"`
+	// InviteToken optionally joins the workspace the user was invited to, the invite must be for the same email
+	InviteToken string `json:"invite_token"`
 }
 
 func (s *SignUpHandler) SignUp(c *gin.Context) {
@@ -104,12 +107,24 @@ func (s *SignUpHandler) SignUp(c *gin.Context) {
 		return
 	}
 
+	if _, err := access.CreatePersonalWorkspace(ctx, tx, userID, input.Username); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create user.", err))
+		return
+	}
+
+	if input.InviteToken != "" {
+		if _, apiErr := acceptInvite(ctx, tx, input.InviteToken, userID); apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		c.Error(api_error.NewInternalServerError("internal server error", err))
 		return
 	}
 
-	token, err := s.tokenGenerator.Generate(userID)
+	token, err := issueToken(ctx, c, s.db, s.tokenGenerator, userID)
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("authentication failed", err))
 		return
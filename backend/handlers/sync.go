@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go_notion/backend/api_error"
+	"go_notion/backend/realtime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// syncBatch is how many logged events one sync call goes through, clients call again while has_more is set
+const syncBatch = 1000
+
+type SyncHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewSyncHandler(db *pgxpool.Pool) (*SyncHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &SyncHandler{db}, nil
+}
+
+type SyncQuery struct {
+	// Since is the cursor of the previous sync, leave it out or send 0 for the first one
+	Since string `form:"since"`
+}
+
+// SyncPage is the current state of a page along with where it sits in the tree
+type SyncPage struct {
+	ID           uuid.UUID        `json:"id"`
+	WorkspaceID  int64            `json:"workspace_id"`
+	ParentID     *uuid.UUID       `json:"parent_id"`
+	Position     float64          `json:"position"`
+	Title        *json.RawMessage `json:"title"`
+	Content      *json.RawMessage `json:"content"`
+	TextTitle    *string          `json:"text_title"`
+	TextContent  *string          `json:"text_content"`
+	Icon         *string          `json:"icon"`
+	Cover        *string          `json:"cover"`
+	Properties   json.RawMessage  `json:"properties"`
+	CreatedAt    time.Time        `json:"created_at"`
+	UpdatedAt    time.Time        `json:"updated_at"`
+	LastEditedBy *int64           `json:"last_edited_by"`
+}
+
+type SyncResponse struct {
+	// Pages were created, updated or moved since the cursor
+	Pages []SyncPage `json:"pages"`
+	// Deleted are the tombstones of the pages deleted since the cursor
+	Deleted []uuid.UUID `json:"deleted"`
+	Cursor  string      `json:"cursor"`
+	// HasMore means there are more changes after the returned cursor
+	HasMore bool `json:"has_more"`
+}
+
+// Sync returns the changes to the pages the user can see since the cursor. The cursor is the position in the
+// page event log, which is numbered in commit order, and in the user's own log of access changes, so changes
+// are never skipped between two syncs. Pages the user gained access to are sent whole and the ones they lost
+// access to are tombstoned. Without a cursor the whole tree is returned along with the cursor to continue from.
+func (h *SyncHandler) Sync(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to sync")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var query SyncQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	var since syncCursor
+	if query.Since != "" {
+		var err error
+		since, err = parseSyncCursor(query.Since)
+		if err != nil {
+			c.Error(api_error.NewBadRequestError("invalid cursor", err))
+			return
+		}
+	}
+
+	// the logs and the pages are read from the same snapshot so they agree with each other
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to sync", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var response *SyncResponse
+	if since == (syncCursor{}) {
+		response, err = syncSnapshot(ctx, tx, userIdInt)
+	} else {
+		response, err = syncChanges(ctx, tx, userIdInt, since)
+	}
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to sync", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// syncCursor is the last page event and the last access change of the user a client has synced
+type syncCursor struct {
+	EventID   int64
+	AccessSeq int64
+}
+
+// parseSyncCursor reads cursors of the form "<event id>.<access seq>", a lone event id is a cursor from
+// before access changes were logged
+func parseSyncCursor(value string) (syncCursor, error) {
+	eventID, accessSeq, hasSeq := strings.Cut(value, ".")
+	var cursor syncCursor
+	var err error
+	if cursor.EventID, err = strconv.ParseInt(eventID, 10, 64); err != nil || cursor.EventID < 0 {
+		return syncCursor{}, fmt.Errorf("invalid event id in cursor %q", value)
+	}
+	if hasSeq {
+		if cursor.AccessSeq, err = strconv.ParseInt(accessSeq, 10, 64); err != nil || cursor.AccessSeq < 0 {
+			return syncCursor{}, fmt.Errorf("invalid access sequence in cursor %q", value)
+		}
+	}
+	return cursor, nil
+}
+
+func (c syncCursor) String() string {
+	return strconv.FormatInt(c.EventID, 10) + "." + strconv.FormatInt(c.AccessSeq, 10)
+}
+
+// visiblePagesClause selects the pages of the workspaces user $1 is a member of and the pages shared with them
+const visiblePagesClause = `(
+	pages.workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = $1)
+	OR EXISTS (
+		SELECT 1 FROM page_permissions WHERE page_permissions.user_id = $1 AND (
+			page_permissions.page_id = pages.id
+			OR page_permissions.page_id IN (SELECT ancestor_id FROM pages_closures WHERE descendant_id = pages.id)
+		)
+	)
+)`
+
+func syncSnapshot(ctx context.Context, tx pgx.Tx, userID int64) (*SyncResponse, error) {
+	var cursor syncCursor
+	err := tx.QueryRow(ctx, `
+		SELECT (SELECT COALESCE(MAX(id), 0) FROM page_events), (SELECT COALESCE(MAX(seq), 0) FROM access_changes WHERE user_id = $1)
+	`, userID).Scan(&cursor.EventID, &cursor.AccessSeq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cursor: %w", err)
+	}
+
+	pages, err := getSyncPages(ctx, tx, visiblePagesClause, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &SyncResponse{Pages: pages, Deleted: []uuid.UUID{}, Cursor: cursor.String()}, nil
+}
+
+func syncChanges(ctx context.Context, tx pgx.Tx, userID int64, since syncCursor) (*SyncResponse, error) {
+	cursor := since
+	// the client may hold a stale copy of the affected pages, the ones the user can still see are sent
+	// and the others are tombstoned
+	affected := make(map[uuid.UUID]bool)
+	// the changed pages of workspaces the user isn't a member of are only sent if they are shared with the user
+	// and left out otherwise, their ids are none of the user's business
+	changed := make(map[uuid.UUID]bool)
+
+	changes, err := readAccessChanges(ctx, tx, userID, since.AccessSeq, syncBatch)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		pageIDs, err := accessChangePageIDs(ctx, tx, change)
+		if err != nil {
+			return nil, err
+		}
+		for _, pageID := range pageIDs {
+			affected[pageID] = true
+		}
+		cursor.AccessSeq = change.Seq
+	}
+
+	workspaceIDs, member, err := eventWorkspaceIDs(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := realtime.ReadEvents(ctx, tx, since.EventID, workspaceIDs, syncBatch)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		// pages deleted or moved out of a shared page are tombstoned as well
+		tombstone := member[event.WorkspaceID] || event.Type == realtime.EventPageDeleted || event.Type == realtime.EventPageMoved
+		for _, pageID := range event.PageIDs {
+			if tombstone {
+				affected[pageID] = true
+			} else {
+				changed[pageID] = true
+			}
+		}
+		cursor.EventID = event.ID
+	}
+
+	candidates := make([]uuid.UUID, 0, len(affected)+len(changed))
+	for pageID := range affected {
+		candidates = append(candidates, pageID)
+	}
+	for pageID := range changed {
+		if !affected[pageID] {
+			candidates = append(candidates, pageID)
+		}
+	}
+	pages, err := getSyncPages(ctx, tx, "pages.id = ANY($2) AND "+visiblePagesClause, userID, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pages {
+		delete(affected, p.ID)
+	}
+	deleted := make([]uuid.UUID, 0, len(affected))
+	for pageID := range affected {
+		deleted = append(deleted, pageID)
+	}
+
+	return &SyncResponse{
+		Pages:   pages,
+		Deleted: deleted,
+		Cursor:  cursor.String(),
+		HasMore: len(events) == syncBatch || len(changes) == syncBatch,
+	}, nil
+}
+
+// eventWorkspaceIDs returns the workspaces whose events concern the user, the ones they are a member of and
+// the ones with pages shared with them. The ones they are a member of are set in member.
+func eventWorkspaceIDs(ctx context.Context, q realtime.Reader, userID int64) ([]int64, map[int64]bool, error) {
+	memberOf, err := syncWorkspaceIDs(ctx, q, `
+		SELECT workspace_id FROM workspace_members WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedIn, err := syncWorkspaceIDs(ctx, q, `
+		SELECT DISTINCT pages.workspace_id FROM page_permissions
+		INNER JOIN pages ON pages.id = page_permissions.page_id
+		WHERE page_permissions.user_id = $1
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	member := make(map[int64]bool, len(memberOf))
+	for _, workspaceID := range memberOf {
+		member[workspaceID] = true
+	}
+	workspaceIDs := memberOf
+	for _, workspaceID := range sharedIn {
+		if !member[workspaceID] {
+			workspaceIDs = append(workspaceIDs, workspaceID)
+		}
+	}
+	return workspaceIDs, member, nil
+}
+
+func syncWorkspaceIDs(ctx context.Context, q realtime.Reader, sql string, userID int64) ([]int64, error) {
+	rows, err := q.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces: %w", err)
+	}
+	workspaceIDs, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces: %w", err)
+	}
+	return workspaceIDs, nil
+}
+
+func getSyncPages(ctx context.Context, tx pgx.Tx, whereClause string, args ...any) ([]SyncPage, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT pages.id, pages.workspace_id, parent.ancestor_id, pages.position, pages.title, pages.content,
+			pages.text_title, pages.text_content, pages.icon, pages.cover, pages.properties,
+			pages.created_at, pages.updated_at, pages.last_edited_by
+		FROM pages
+		LEFT JOIN pages_closures parent ON parent.descendant_id = pages.id AND parent.is_parent
+		WHERE `+whereClause+`
+		ORDER BY pages.position
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pages: %w", err)
+	}
+	pages, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SyncPage, error) {
+		var p SyncPage
+		err := row.Scan(&p.ID, &p.WorkspaceID, &p.ParentID, &p.Position, &p.Title, &p.Content, &p.TextTitle, &p.TextContent, &p.Icon, &p.Cover, &p.Properties, &p.CreatedAt, &p.UpdatedAt, &p.LastEditedBy)
+		return p, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pages: %w", err)
+	}
+	return pages, nil
+}
+
+const (
+	accessChangeWorkspaceJoined = "workspace.joined"
+	accessChangeWorkspaceLeft   = "workspace.left"
+	accessChangePageShared      = "page.shared"
+	accessChangePageUnshared    = "page.unshared"
+)
+
+type accessChange struct {
+	Seq         int64
+	Type        string
+	WorkspaceID *int64
+	PageIDs     []uuid.UUID
+}
+
+// recordAccessChange logs a change of the pages the user can see, in the same transaction as the change.
+// The pages that were already there are not in the page event log after the user's cursor, sync sends
+// or tombstones them from this log. Changes are numbered per user in commit order.
+func recordAccessChange(ctx context.Context, tx pgx.Tx, userID int64, changeType string, workspaceID *int64, pageIDs []uuid.UUID) error {
+	if pageIDs == nil {
+		pageIDs = []uuid.UUID{}
+	}
+	_, err := tx.Exec(ctx, `
+		WITH next AS (
+			INSERT INTO sync_sequences (user_id, seq) VALUES ($1, 1)
+			ON CONFLICT (user_id) DO UPDATE SET seq = sync_sequences.seq + 1
+			RETURNING seq
+		)
+		INSERT INTO access_changes (user_id, seq, type, workspace_id, page_ids)
+		SELECT $1, seq, $2, $3, $4 FROM next
+	`, userID, changeType, workspaceID, pageIDs)
+	if err != nil {
+		return fmt.Errorf("failed to record access change: %w", err)
+	}
+	return nil
+}
+
+// recordPageUnshared logs the subtree of the page as it is now, the pages may be moved or deleted before the user syncs
+func recordPageUnshared(ctx context.Context, tx pgx.Tx, userID int64, pageID uuid.UUID) error {
+	rows, err := tx.Query(ctx, `
+		SELECT $1::uuid UNION SELECT descendant_id FROM pages_closures WHERE ancestor_id = $1
+	`, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to get unshared pages: %w", err)
+	}
+	pageIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return fmt.Errorf("failed to get unshared pages: %w", err)
+	}
+	return recordAccessChange(ctx, tx, userID, accessChangePageUnshared, nil, pageIDs)
+}
+
+func readAccessChanges(ctx context.Context, tx pgx.Tx, userID int64, afterSeq int64, limit int) ([]accessChange, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT seq, type, workspace_id, page_ids FROM access_changes
+		WHERE user_id = $1 AND seq > $2
+		ORDER BY seq
+		LIMIT $3
+	`, userID, afterSeq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access changes: %w", err)
+	}
+	changes, err := pgx.CollectRows(rows, pgx.RowToStructByPos[accessChange])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access changes: %w", err)
+	}
+	return changes, nil
+}
+
+// accessChangePageIDs returns the pages whose visibility the change may have changed
+func accessChangePageIDs(ctx context.Context, tx pgx.Tx, change accessChange) ([]uuid.UUID, error) {
+	var rows pgx.Rows
+	var err error
+	switch change.Type {
+	case accessChangeWorkspaceJoined, accessChangeWorkspaceLeft:
+		rows, err = tx.Query(ctx, `SELECT id FROM pages WHERE workspace_id = $1`, change.WorkspaceID)
+	case accessChangePageShared:
+		rows, err = tx.Query(ctx, `
+			SELECT id FROM pages
+			WHERE id = ANY($1) OR id IN (SELECT descendant_id FROM pages_closures WHERE ancestor_id = ANY($1))
+		`, change.PageIDs)
+	default:
+		return change.PageIDs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pages of access change: %w", err)
+	}
+	pageIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pages of access change: %w", err)
+	}
+	return pageIDs, nil
+}
+
+func (h *SyncHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/sync", h.Sync)
+}
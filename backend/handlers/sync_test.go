@@ -0,0 +1,185 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/access"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/mocks"
+	"go_notion/backend/page"
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	otherId := uuid.Must(uuid.NewV4())
+	strangerPageId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("stranger@example.com", "stranger", "password"),
+		db.InsertTestPageFixtureWithParent(childId, parentId, 1),
+		db.InsertTestPageFixtureWithPosition(otherId, 1, 3),
+		db.InsertTestPageFixture(strangerPageId, 2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	syncHandler, err := handlers.NewSyncHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletePage, err := handlers.NewDeletePageHandler(pool, mocks.NewBlobStoreMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := handlers.NewSharesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces, err := handlers.NewWorkspacesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(syncHandler, updatePage, deletePage, shares, workspaces)
+	sync := func(userID int64, since string) handlers.SyncResponse {
+		w := serve(userID, "GET", "/api/sync?since="+since, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response handlers.SyncResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	pageIDs := func(pages []handlers.SyncPage) []uuid.UUID {
+		ids := []uuid.UUID{}
+		for _, p := range pages {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, http.StatusBadRequest, serve(1, "GET", "/api/sync?since=abc", "").Code)
+
+	// the first sync is the whole tree
+	snapshot := sync(1, "")
+	assert.ElementsMatch(t, []uuid.UUID{parentId, childId, otherId}, pageIDs(snapshot.Pages))
+	for _, p := range snapshot.Pages {
+		if p.ID == childId {
+			assert.Equal(t, parentId, *p.ParentID)
+		}
+	}
+
+	// nothing changed yet
+	unchanged := sync(1, snapshot.Cursor)
+	assert.Empty(t, unchanged.Pages)
+	assert.Empty(t, unchanged.Deleted)
+	assert.Equal(t, snapshot.Cursor, unchanged.Cursor)
+
+	update := `{"title_text": "changed", "content_text": "changed", "raw_title": {}, "raw_content": {}}`
+	assert.Equal(t, http.StatusOK, serve(1, "PUT", "/api/pages/"+otherId.String(), update).Code)
+	assert.Equal(t, http.StatusOK, serve(1, "PUT", "/api/pages/"+childId.String(), update).Code)
+	assert.Equal(t, http.StatusNoContent, serve(1, "DELETE", "/api/pages/"+parentId.String(), "").Code)
+	assert.Equal(t, http.StatusOK, serve(2, "PUT", "/api/pages/"+strangerPageId.String(), update).Code)
+
+	delta := sync(1, snapshot.Cursor)
+	assert.Equal(t, []uuid.UUID{otherId}, pageIDs(delta.Pages))
+	assert.Equal(t, "changed", *delta.Pages[0].TextTitle)
+	// the updated then deleted child is only a tombstone
+	assert.ElementsMatch(t, []uuid.UUID{parentId, childId}, delta.Deleted)
+	assert.False(t, delta.HasMore)
+
+	caughtUp := sync(1, delta.Cursor)
+	assert.Empty(t, caughtUp.Pages)
+	assert.Empty(t, caughtUp.Deleted)
+
+	assert.Equal(t, http.StatusBadRequest, serve(1, "GET", "/api/sync?since=1.abc", "").Code)
+
+	// pages that become visible are sent whole, the ones that become hidden are tombstoned
+	var workspaceID string
+	if err := pool.QueryRow(context.Background(), `SELECT workspace_id::text FROM pages WHERE id = $1`, otherId).Scan(&workspaceID); err != nil {
+		t.Fatal(err)
+	}
+	stranger := sync(2, "")
+	assert.Equal(t, []uuid.UUID{strangerPageId}, pageIDs(stranger.Pages))
+
+	assert.Equal(t, http.StatusOK, serve(1, "POST", "/api/pages/"+otherId.String()+"/shares", `{"email": "stranger@example.com", "level": "viewer"}`).Code)
+	shared := sync(2, stranger.Cursor)
+	assert.Equal(t, []uuid.UUID{otherId}, pageIDs(shared.Pages))
+	assert.Empty(t, shared.Deleted)
+
+	assert.Equal(t, http.StatusNoContent, serve(1, "DELETE", "/api/pages/"+otherId.String()+"/shares/2", "").Code)
+	unshared := sync(2, shared.Cursor)
+	assert.Empty(t, unshared.Pages)
+	assert.Equal(t, []uuid.UUID{otherId}, unshared.Deleted)
+
+	assert.Equal(t, http.StatusOK, serve(1, "POST", "/api/workspaces/"+workspaceID+"/members", `{"email": "stranger@example.com", "role": "member"}`).Code)
+	joined := sync(2, unshared.Cursor)
+	assert.Equal(t, []uuid.UUID{otherId}, pageIDs(joined.Pages))
+	assert.Empty(t, joined.Deleted)
+
+	assert.Equal(t, http.StatusNoContent, serve(1, "DELETE", "/api/workspaces/"+workspaceID+"/members/2", "").Code)
+	left := sync(2, joined.Cursor)
+	assert.Empty(t, left.Pages)
+	assert.Equal(t, []uuid.UUID{otherId}, left.Deleted)
+
+	assert.Empty(t, sync(2, left.Cursor).Deleted)
+}
+
+func TestSyncSeesEveryCopiedSubPage(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("member@example.com", "member", "password"),
+		db.InsertTestWorkspaceMemberFixture(1, 2, access.RoleMember),
+		db.InsertTestPageFixtureWithParent(childId, parentId, 1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	syncHandler, err := handlers.NewSyncHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicatePage, err := handlers.NewDuplicatePageHandler(pool, page.NewPageConfig(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(syncHandler, duplicatePage)
+	sync := func(userID int64, since string) handlers.SyncResponse {
+		w := serve(userID, "GET", "/api/sync?since="+since, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response handlers.SyncResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	snapshot := sync(2, "")
+	assert.Len(t, snapshot.Pages, 2)
+
+	// the copy of the child is announced along with the copy of its parent
+	assert.Equal(t, http.StatusOK, serve(1, "POST", "/api/pages/"+parentId.String()+"/duplicate", `{"include_children": true}`).Code)
+	delta := sync(2, snapshot.Cursor)
+	assert.Len(t, delta.Pages, 2)
+	for _, p := range delta.Pages {
+		assert.NotContains(t, []uuid.UUID{parentId, childId}, p.ID)
+	}
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/page"
+	"go_notion/backend/realtime"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type TemplatesHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewTemplatesHandler(db *pgxpool.Pool) (*TemplatesHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &TemplatesHandler{db: db}, nil
+}
+
+type Template struct {
+	PageID    uuid.UUID `json:"page_id"`
+	TextTitle *string   `json:"text_title"`
+	CreatedBy *int64    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TemplatesResponse struct {
+	Templates []Template `json:"templates"`
+}
+
+type GetTemplatesParams struct {
+	// WorkspaceID defaults to the user's personal workspace
+	WorkspaceID *int64 `form:"workspace_id,omitempty"`
+}
+
+// GetTemplates lists the templates of a workspace
+func (h *TemplatesHandler) GetTemplates(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get templates")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var params GetTemplatesParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	workspaceID, apiErr := resolveWorkspaceID(ctx, h.db, params.WorkspaceID, userIdInt)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+	if _, err := access.AuthorizeWorkspace(ctx, h.db, workspaceID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "workspace not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT pages.id, pages.text_title, page_templates.created_by, page_templates.created_at
+		FROM page_templates
+		INNER JOIN pages ON pages.id = page_templates.page_id
+		WHERE pages.workspace_id = $1
+		ORDER BY pages.text_title, page_templates.created_at
+	`, workspaceID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get templates", err))
+		return
+	}
+	templates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Template, error) {
+		var template Template
+		err := row.Scan(&template.PageID, &template.TextTitle, &template.CreatedBy, &template.CreatedAt)
+		return template, err
+	})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get templates", err))
+		return
+	}
+	if templates == nil {
+		templates = []Template{}
+	}
+
+	c.JSON(http.StatusOK, TemplatesResponse{Templates: templates})
+}
+
+// MarkTemplate makes the page and its sub pages a template
+func (h *TemplatesHandler) MarkTemplate(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to mark template")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	_, err := h.db.Exec(ctx, `
+		INSERT INTO page_templates (page_id, created_by) VALUES ($1, $2)
+		ON CONFLICT (page_id) DO NOTHING
+	`, pageID, userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to mark template", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"page_id": pageID})
+}
+
+// UnmarkTemplate turns the template back into a regular page
+func (h *TemplatesHandler) UnmarkTemplate(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to unmark template")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if _, err := access.AuthorizePage(ctx, h.db, pageID, userIdInt, access.ActionManage); err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	cmd, err := h.db.Exec(ctx, `DELETE FROM page_templates WHERE page_id = $1`, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to unmark template", err))
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewNotFoundError("template not found", nil))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// createPageFromTemplate copies the template and its sub pages to the new page's place,
+// replacing the placeholders in their titles and text
+func (np *CreatePageHandler) createPageFromTemplate(ctx context.Context, tx pgx.Tx, userID int64, input CreatePageInput) (uuid.UUID, *api_error.ApiError) {
+	if input.ID != nil || input.TitleText != nil || input.ContentText != nil || input.RawTitle != nil || input.RawContent != nil ||
+		input.Icon != nil || input.Cover != nil || input.Properties != nil {
+		return uuid.Nil, api_error.NewBadRequestError("template_id cannot be combined with id, title, content or metadata", nil)
+	}
+	templateID := *input.TemplateID
+
+	if _, err := access.AuthorizePage(ctx, tx, templateID, userID, access.ActionView); err != nil {
+		return uuid.Nil, accessError(err, "template not found")
+	}
+	var isTemplate bool
+	err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM page_templates WHERE page_id = $1)`, templateID).Scan(&isTemplate)
+	if err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page from template", err)
+	}
+	if !isTemplate {
+		return uuid.Nil, api_error.NewNotFoundError("template not found", nil)
+	}
+
+	workspaceID, apiErr := resolveNewPageWorkspace(ctx, tx, input, userID)
+	if apiErr != nil {
+		return uuid.Nil, apiErr
+	}
+
+	var position float64
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(MAX(position), 0) FROM pages WHERE workspace_id = $1
+	`, workspaceID).Scan(&position)
+	if err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page from template", err)
+	}
+
+	// the template may be in another workspace and made by someone else, the copies belong to the user's workspace
+	overrides := map[string]pageOverride{
+		"workspace_id":   {Value: workspaceID, Type: "bigint"},
+		"created_by":     {Value: userID, Type: "bigint"},
+		"last_edited_by": {Value: userID, Type: "bigint"},
+	}
+	rootOverrides := map[string]pageOverride{
+		"is_top_level": {Value: input.ParentID == nil, Type: "boolean"},
+	}
+	for column, override := range overrides {
+		rootOverrides[column] = override
+	}
+
+	duplicator := &DuplicatePageHandler{np.db, np.pageConfig}
+	m, err := duplicator.duplicatePages(ctx, tx, []uuid.UUID{templateID}, position, rootOverrides)
+	if err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page from template", err)
+	}
+	pageID := m[templateID]
+
+	if input.ParentID != nil {
+		if err := insertParentClosures(ctx, tx, *input.ParentID, pageID); err != nil {
+			return uuid.Nil, api_error.NewInternalServerError("failed to link page to parent", err)
+		}
+		if err := conformToParentDatabase(ctx, tx, pageID); err != nil {
+			return uuid.Nil, api_error.NewInternalServerError("failed to link page to parent", err)
+		}
+	}
+
+	descendants, err := duplicator.duplicateDescendants(ctx, tx, templateID, pageID, position+float64(np.pageConfig.Spacing), overrides)
+	if err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page from template", err)
+	}
+
+	pageIDs := []uuid.UUID{pageID}
+	for _, descendantID := range descendants {
+		pageIDs = append(pageIDs, descendantID)
+	}
+	if err := replaceTemplatePlaceholders(ctx, tx, pageIDs, userID); err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page from template", err)
+	}
+	if err := syncCopiedPageReferences(ctx, tx, pageIDs, userID); err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page from template", err)
+	}
+
+	// every copy is announced, sync only looks at the pages named in events
+	changedPageIDs := pageIDs
+	if input.ParentID != nil {
+		changedPageIDs = append(changedPageIDs, *input.ParentID)
+	}
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageCreated, WorkspaceID: workspaceID, PageIDs: changedPageIDs, ActorID: userID})
+	if err != nil {
+		return uuid.Nil, api_error.NewInternalServerError("failed to create page from template", err)
+	}
+
+	return pageID, nil
+}
+
+// replaceTemplatePlaceholders fills in {{date}}, {{time}} and {{user}} in the pages copied from a template.
+// The date and time are in UTC.
+func replaceTemplatePlaceholders(ctx context.Context, tx pgx.Tx, pageIDs []uuid.UUID, userID int64) error {
+	var username string
+	if err := tx.QueryRow(ctx, `SELECT username FROM users WHERE id = $1`, userID).Scan(&username); err != nil {
+		return fmt.Errorf("failed to get username: %w", err)
+	}
+	now := time.Now().UTC()
+	values := map[string]string{
+		"date": now.Format(time.DateOnly),
+		"time": now.Format("15:04"),
+		"user": username,
+	}
+
+	type templatePage struct {
+		id          uuid.UUID
+		textTitle   *string
+		textContent *string
+		title       []byte
+		content     []byte
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT id, text_title, text_content, title, content FROM pages WHERE id = ANY($1)
+	`, pageIDs)
+	if err != nil {
+		return fmt.Errorf("failed to get template pages: %w", err)
+	}
+	pages, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (templatePage, error) {
+		var p templatePage
+		err := row.Scan(&p.id, &p.textTitle, &p.textContent, &p.title, &p.content)
+		return p, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get template pages: %w", err)
+	}
+
+	replace := func(text *string) *string {
+		if text == nil {
+			return nil
+		}
+		replaced := page.ReplacePlaceholders(*text, values)
+		return &replaced
+	}
+	for _, p := range pages {
+		_, err := tx.Exec(ctx, `
+			UPDATE pages SET text_title = $1, text_content = $2, title = $3, content = $4 WHERE id = $5
+		`, replace(p.textTitle), replace(p.textContent), page.ReplaceContentPlaceholders(p.title, values), page.ReplaceContentPlaceholders(p.content, values), p.id)
+		if err != nil {
+			return fmt.Errorf("failed to replace placeholders: %w", err)
+		}
+	}
+	return nil
+}
+
+func (h *TemplatesHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/templates", h.GetTemplates)
+	router.PUT("/pages/:id/template", h.MarkTemplate)
+	router.DELETE("/pages/:id/template", h.UnmarkTemplate)
+}
@@ -0,0 +1,136 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/page"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplates(t *testing.T) {
+	templateId := uuid.Must(uuid.NewV4())
+	templateChildId := uuid.Must(uuid.NewV4())
+	targetId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("stranger@example.com", "stranger", "password"),
+		db.InsertTestPageFixtureWithParent(templateChildId, templateId, 1),
+		db.InsertTestPageFixtureWithPosition(targetId, 1, 3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	_, err = pool.Exec(context.Background(), `
+		UPDATE pages SET text_title = 'Notes {{date}}', content = '{"type": "doc", "content": [{"type": "text", "text": "by {{user}}"}]}'
+		WHERE id = $1
+	`, templateId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := handlers.NewTemplatesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPage, err := handlers.NewCreatePageHandler(pool, page.NewPageConfig(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(templates, createPage)
+
+	t.Run("only managers can mark templates", func(t *testing.T) {
+		w := serve(2, "PUT", "/api/pages/"+templateId.String()+"/template", "")
+		assert.NotEqual(t, http.StatusOK, w.Code)
+
+		w = serve(1, "PUT", "/api/pages/"+templateId.String()+"/template", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("lists templates", func(t *testing.T) {
+		w := serve(1, "GET", "/api/templates", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response handlers.TemplatesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, response.Templates, 1) {
+			assert.Equal(t, templateId, response.Templates[0].PageID)
+		}
+	})
+
+	t.Run("creates a page from the template", func(t *testing.T) {
+		w := serve(1, "POST", "/api/pages", `{"template_id": "`+templateId.String()+`", "parent_id": "`+targetId.String()+`"}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response struct {
+			PageID uuid.UUID `json:"page_id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		var title string
+		var content []byte
+		err := pool.QueryRow(context.Background(), `SELECT text_title, content FROM pages WHERE id = $1`, response.PageID).Scan(&title, &content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Notes "+time.Now().UTC().Format(time.DateOnly), title)
+		assert.Contains(t, string(content), "by test")
+
+		var parentId uuid.UUID
+		err = pool.QueryRow(context.Background(), `SELECT ancestor_id FROM pages_closures WHERE descendant_id = $1 AND is_parent`, response.PageID).Scan(&parentId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, targetId, parentId)
+
+		// the copied sub page sits below the new page and the target
+		var ancestors []uuid.UUID
+		err = pool.QueryRow(context.Background(), `
+			SELECT array_agg(ancestor_id) FROM pages_closures
+			WHERE descendant_id = (SELECT descendant_id FROM pages_closures WHERE ancestor_id = $1 AND is_parent)
+		`, response.PageID).Scan(&ancestors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.ElementsMatch(t, []uuid.UUID{response.PageID, targetId}, ancestors)
+
+		var isTemplate bool
+		err = pool.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM page_templates WHERE page_id = $1)`, response.PageID).Scan(&isTemplate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, isTemplate)
+	})
+
+	t.Run("rejects pages that aren't templates", func(t *testing.T) {
+		w := serve(1, "POST", "/api/pages", `{"template_id": "`+targetId.String()+`"}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = serve(2, "POST", "/api/pages", `{"template_id": "`+templateId.String()+`"}`)
+		assert.NotEqual(t, http.StatusOK, w.Code)
+
+		w = serve(1, "POST", "/api/pages", `{"template_id": "`+templateId.String()+`", "title_text": "title"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("unmarks templates", func(t *testing.T) {
+		w := serve(1, "DELETE", "/api/pages/"+templateId.String()+"/template", "")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		w = serve(1, "DELETE", "/api/pages/"+templateId.String()+"/template", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
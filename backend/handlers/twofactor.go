@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"go_notion/backend/auth"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type TwoFactorHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewTwoFactorHandler(db *pgxpool.Pool) (*TwoFactorHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &TwoFactorHandler{db}, nil
+}
+
+// SetupTwoFactor generates a new TOTP secret for the user. 2FA is only enabled once the user
+// proves their authenticator app is set up correctly by calling ConfirmTwoFactor with a valid code.
+func (h *TwoFactorHandler) SetupTwoFactor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to set up two factor authentication", nil))
+		return
+	}
+	userIdInt, ok := userID.(int64)
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to set up two factor authentication", fmt.Errorf("user id is not an integer")))
+		return
+	}
+
+	var email string
+	var totpEnabled bool
+	err := h.db.QueryRow(ctx, "SELECT email, totp_enabled FROM users WHERE id = $1", userIdInt).Scan(&email, &totpEnabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewNotFoundError("user not found", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to set up two factor authentication", err))
+		return
+	}
+
+	if totpEnabled {
+		c.Error(api_error.NewBadRequestError("two factor authentication is already enabled", nil))
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to set up two factor authentication", err))
+		return
+	}
+
+	_, err = h.db.Exec(ctx, "UPDATE users SET totp_secret = $1 WHERE id = $2", secret, userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to set up two factor authentication", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"otpauth_uri": auth.TOTPURI(email, secret), "secret": secret})
+}
+
+type ConfirmTwoFactorInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ConfirmTwoFactor enables 2FA once the user submits a valid code for the secret from SetupTwoFactor.
+// The recovery codes are only ever returned here, we keep hashes of them.
+func (h *TwoFactorHandler) ConfirmTwoFactor(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to confirm two factor authentication", nil))
+		return
+	}
+	userIdInt, ok := userID.(int64)
+	if !ok {
+		c.Error(api_error.NewUnauthorizedError("not authorized to confirm two factor authentication", fmt.Errorf("user id is not an integer")))
+		return
+	}
+
+	var input ConfirmTwoFactorInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var totpSecret *string
+	var totpEnabled bool
+	var totpLastStep int64
+	err = tx.QueryRow(ctx, "SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1 FOR UPDATE", userIdInt).Scan(&totpSecret, &totpEnabled, &totpLastStep)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewNotFoundError("user not found", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+
+	if totpEnabled {
+		c.Error(api_error.NewBadRequestError("two factor authentication is already enabled", nil))
+		return
+	}
+
+	if totpSecret == nil {
+		c.Error(api_error.NewBadRequestError("two factor authentication has not been set up", nil))
+		return
+	}
+
+	acceptedCode, err := acceptTOTPCode(ctx, tx, userIdInt, *totpSecret, input.Code, totpLastStep)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+	if !acceptedCode {
+		c.Error(api_error.NewBadRequestError("invalid code", nil))
+		return
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+
+	codeHashes := make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		codeHashes = append(codeHashes, auth.HashRecoveryCode(code))
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_recovery_codes (user_id, code_hash) SELECT $1, unnest($2::varchar[])
+	`, userIdInt, codeHashes)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE users SET totp_enabled = true WHERE id = $1", userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to confirm two factor authentication", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+}
+
+// acceptTOTPCode checks the code and records the time step it matched. The update only applies to a step
+// after the last accepted one, so a code sent by two concurrent requests is still only accepted once.
+func acceptTOTPCode(ctx context.Context, q access.Querier, userID int64, secret, code string, lastStep int64) (bool, error) {
+	step, valid := auth.MatchTOTP(secret, code, time.Now(), lastStep)
+	if !valid {
+		return false, nil
+	}
+	var id int64
+	err := q.QueryRow(ctx, `
+		UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1 RETURNING id
+	`, step, userID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to record totp code: %w", err)
+	}
+	return true, nil
+}
+
+func (h *TwoFactorHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/me/2fa/setup", h.SetupTwoFactor)
+	router.POST("/me/2fa/confirm", h.ConfirmTwoFactor)
+}
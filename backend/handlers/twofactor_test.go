@@ -0,0 +1,87 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"go_notion/backend/auth"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupAndConfirmTwoFactor(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	twoFactor, err := handlers.NewTwoFactorHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", int64(1))
+	})
+	twoFactor.RegisterRoutes(r.Group("/api"))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/me/2fa/setup", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var setupResponse struct {
+		OtpauthURI string `json:"otpauth_uri"`
+		Secret     string `json:"secret"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &setupResponse); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(setupResponse.OtpauthURI, "otpauth://totp/"))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/me/2fa/confirm", strings.NewReader(`{"code": "000000"}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	code, err := auth.GenerateTOTP(setupResponse.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/me/2fa/confirm", strings.NewReader(`{"code": "`+code+`"}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var confirmResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmResponse); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, confirmResponse.RecoveryCodes, auth.RecoveryCodeCount)
+
+	var totpEnabled bool
+	err = pool.QueryRow(context.Background(), "SELECT totp_enabled FROM users WHERE id = 1").Scan(&totpEnabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, totpEnabled)
+
+	// setting up again once enabled must not silently replace the secret
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/me/2fa/setup", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
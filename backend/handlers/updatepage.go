@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go_notion/backend/access"
 	"go_notion/backend/api_error"
+	"go_notion/backend/page"
+	"go_notion/backend/realtime"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -69,22 +73,174 @@ func (up *UpdatePageHandler) UpdatePage(c *gin.Context) {
 		return
 	}
 
-	cmd, err := up.db.Exec(ctx, `
-		UPDATE pages SET text_title = $1, text_content = $2, title = $3, content = $4 WHERE id = $5 AND created_by = $6
-	`, input.TitleText, input.ContentText, input.RawTitle, input.RawContent, pageID, userIdInt)
+	tx, err := up.db.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
 		c.Error(api_error.NewInternalServerError("failed to update page", err))
 		return
 	}
+	defer tx.Rollback(ctx)
+
+	if apiErr := up.updatePageInTx(ctx, tx, userIdInt, pageID, input); apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update page", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "page updated successfully"})
+}
+
+// updatePageInTx replaces the page's title and content within the transaction
+func (up *UpdatePageHandler) updatePageInTx(ctx context.Context, tx pgx.Tx, userID int64, pageID uuid.UUID, input UpdatePageInput) *api_error.ApiError {
+	workspaceID, err := access.AuthorizePage(ctx, tx, pageID, userID, access.ActionEdit)
+	if err != nil {
+		return accessError(err, "page not found")
+	}
+
+	cmd, err := tx.Exec(ctx, `
+		UPDATE pages SET text_title = $1, text_content = $2, title = $3, content = $4, updated_at = CURRENT_TIMESTAMP, last_edited_by = $5
+		WHERE id = $6
+	`, input.TitleText, input.ContentText, input.RawTitle, input.RawContent, userID, pageID)
+	if err != nil {
+		return api_error.NewInternalServerError("failed to update page", err)
+	}
 
 	if cmd.RowsAffected() == 0 {
-		c.Error(api_error.NewNotFoundError("page not found", nil))
+		return api_error.NewNotFoundError("page not found", nil)
+	}
+
+	if err := syncPageLinks(ctx, tx, pageID, page.ExtractPageLinks(input.RawContent)); err != nil {
+		return api_error.NewInternalServerError("failed to update page links", err)
+	}
+
+	if err := syncPageMentions(ctx, tx, pageID, userID, page.ExtractMentions(input.RawContent)); err != nil {
+		return api_error.NewInternalServerError("failed to update page mentions", err)
+	}
+
+	// replacing the content as a whole ends the collaborative session, the document is rebuilt from the new content
+	cmd, err = tx.Exec(ctx, `DELETE FROM page_documents WHERE page_id = $1`, pageID)
+	if err != nil {
+		return api_error.NewInternalServerError("failed to update page", err)
+	}
+	if cmd.RowsAffected() > 0 {
+		err = realtime.Relay(ctx, tx, realtime.Event{Type: realtime.EventDocumentReset, PageIDs: []uuid.UUID{pageID}, ActorID: userID})
+		if err != nil {
+			return api_error.NewInternalServerError("failed to update page", err)
+		}
+	}
+
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: workspaceID, PageIDs: []uuid.UUID{pageID}, ActorID: userID})
+	if err != nil {
+		return api_error.NewInternalServerError("failed to update page", err)
+	}
+
+	return nil
+}
+
+// UpdatePageMetadataInput changes the metadata of a page, fields left out are kept and an empty icon or cover removes it
+type UpdatePageMetadataInput struct {
+	Icon  *string `json:"icon" binding:"omitempty,max=255"`
+	Cover *string `json:"cover" binding:"omitempty,max=2048"`
+	// Properties replaces all of the properties, it must be a JSON object
+	Properties json.RawMessage `json:"properties"`
+}
+
+// UpdatePageMetadata changes the icon, cover or properties of a page without touching its content
+func (up *UpdatePageHandler) UpdatePageMetadata(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to update page")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	pageID, apiErr := pageIDFromUri(c)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input UpdatePageMetadataInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	if input.Icon == nil && input.Cover == nil && input.Properties == nil {
+		c.Error(api_error.NewBadRequestError("nothing to update", nil))
+		return
+	}
+	if input.Properties != nil && !isJSONObject(input.Properties) {
+		c.Error(api_error.NewBadRequestError("properties must be a JSON object", nil))
+		return
+	}
+
+	tx, err := up.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update page", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	workspaceID, err := access.AuthorizePage(ctx, tx, pageID, userIdInt, access.ActionEdit)
+	if err != nil {
+		c.Error(accessError(err, "page not found"))
+		return
+	}
+
+	if input.Properties != nil {
+		parentID, err := parentPageID(ctx, tx, pageID)
+		if err != nil {
+			c.Error(api_error.NewInternalServerError("failed to update page", err))
+			return
+		}
+		input.Properties, apiErr = validateRowProperties(ctx, tx, parentID, input.Properties)
+		if apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+	}
+
+	// a nil field keeps the current value, an empty string clears it
+	_, err = tx.Exec(ctx, `
+		UPDATE pages SET
+			icon = CASE WHEN $1::text IS NULL THEN icon ELSE NULLIF($1::text, '') END,
+			cover = CASE WHEN $2::text IS NULL THEN cover ELSE NULLIF($2::text, '') END,
+			properties = COALESCE($3::jsonb, properties),
+			updated_at = CURRENT_TIMESTAMP,
+			last_edited_by = $4
+		WHERE id = $5
+	`, input.Icon, input.Cover, input.Properties, userIdInt, pageID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update page", err))
+		return
+	}
+
+	err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: workspaceID, PageIDs: []uuid.UUID{pageID}, ActorID: userIdInt})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update page", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update page", err))
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "page updated successfully"})
 }
 
+// isJSONObject reports whether the raw JSON is an object, as opposed to an array, string, number or null
+func isJSONObject(raw json.RawMessage) bool {
+	var object map[string]json.RawMessage
+	return json.Unmarshal(raw, &object) == nil && object != nil
+}
+
 func (up *UpdatePageHandler) RegisterRoutes(router *gin.RouterGroup) {
 	router.PUT("/pages/:id", up.UpdatePage)
+	router.PATCH("/pages/:id", up.UpdatePageMetadata)
 }
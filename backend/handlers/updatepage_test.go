@@ -1,13 +1,17 @@
 package handlers_test
 
 import (
+	"context"
+	"encoding/json"
 	"go_notion/backend/db"
 	"go_notion/backend/handlers"
+	"go_notion/backend/page"
 	"go_notion/backend/router"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gofrs/uuid/v5"
@@ -85,3 +89,92 @@ func TestUpdatePage(t *testing.T) {
 		})
 	}
 }
+
+func TestPageMetadata(t *testing.T) {
+	parentId := uuid.Must(uuid.NewV4())
+	childId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture, db.InsertTestPageFixtureWithParent(childId, parentId, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getPage, err := handlers.NewGetPageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getPages, err := handlers.NewGetPagesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(updatePage, getPage, getPages)
+	get := func(id uuid.UUID) page.Page {
+		w := serve(1, "GET", "/api/pages/"+id.String(), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response handlers.PageResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Data
+	}
+
+	t.Run("updating bumps updated_at", func(t *testing.T) {
+		_, err := pool.Exec(context.Background(), `UPDATE pages SET updated_at = '2000-01-01', last_edited_by = NULL WHERE id = $1`, childId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := serve(1, "PUT", "/api/pages/"+childId.String(), `{"title_text": "title", "content_text": "content", "raw_title": {}, "raw_content": {}}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		updated := get(childId)
+		assert.True(t, updated.UpdatedAt.After(time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)))
+		if assert.NotNil(t, updated.LastEditedBy) {
+			assert.Equal(t, int64(1), *updated.LastEditedBy)
+		}
+	})
+
+	t.Run("sets and clears metadata", func(t *testing.T) {
+		w := serve(1, "PATCH", "/api/pages/"+childId.String(), `{"icon": "🚀", "cover": "https://example.com/cover.png", "properties": {"status": "draft"}}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		updated := get(childId)
+		if assert.NotNil(t, updated.Icon) && assert.NotNil(t, updated.Cover) {
+			assert.Equal(t, "🚀", *updated.Icon)
+			assert.Equal(t, "https://example.com/cover.png", *updated.Cover)
+		}
+		assert.JSONEq(t, `{"status": "draft"}`, string(updated.Properties))
+
+		// the sidebar tree shows the metadata of sub pages too
+		w = serve(1, "GET", "/api/pages", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var pages handlers.PagesResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &pages); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, pages.Pages, 1) && assert.Len(t, pages.Pages[0].SubPages, 1) {
+			subPage := pages.Pages[0].SubPages[0]
+			if assert.NotNil(t, subPage.Icon) {
+				assert.Equal(t, "🚀", *subPage.Icon)
+			}
+			assert.JSONEq(t, `{"status": "draft"}`, string(subPage.Properties))
+		}
+
+		w = serve(1, "PATCH", "/api/pages/"+childId.String(), `{"icon": ""}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		updated = get(childId)
+		assert.Nil(t, updated.Icon)
+		assert.NotNil(t, updated.Cover)
+	})
+
+	t.Run("rejects invalid metadata", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, serve(1, "PATCH", "/api/pages/"+childId.String(), `{}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(1, "PATCH", "/api/pages/"+childId.String(), `{"properties": ["status"]}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(1, "PATCH", "/api/pages/"+childId.String(), `{"icon": "`+strings.Repeat("x", 256)+`"}`).Code)
+	})
+}
@@ -0,0 +1,523 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/api_error"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// accessError maps the errors from the access layer to api errors.
+// Not being a member is reported as not found so the existence of other workspaces' pages isn't leaked.
+func accessError(err error, notFoundMessage string) *api_error.ApiError {
+	switch {
+	case errors.Is(err, access.ErrNotFound):
+		return api_error.NewNotFoundError(notFoundMessage, nil)
+	case errors.Is(err, access.ErrForbidden):
+		return api_error.NewForbiddenError("your role in this workspace does not allow this", nil)
+	default:
+		return api_error.NewInternalServerError("failed to check access", err)
+	}
+}
+
+// resolveWorkspaceID returns the requested workspace, falling back to the user's personal workspace
+func resolveWorkspaceID(ctx context.Context, q access.Querier, requested *int64, userID int64) (int64, *api_error.ApiError) {
+	if requested != nil {
+		return *requested, nil
+	}
+	workspaceID, err := access.PersonalWorkspaceID(ctx, q, userID)
+	if err != nil {
+		return 0, accessError(err, "workspace not found")
+	}
+	return workspaceID, nil
+}
+
+type WorkspacesHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewWorkspacesHandler(db *pgxpool.Pool) (*WorkspacesHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("db cannot be nil")
+	}
+	return &WorkspacesHandler{db}, nil
+}
+
+type Workspace struct {
+	ID         int64       `json:"id"`
+	Name       string      `json:"name"`
+	IsPersonal bool        `json:"is_personal"`
+	Role       access.Role `json:"role"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+type WorkspacesResponse struct {
+	Workspaces []Workspace `json:"workspaces"`
+}
+
+func (h *WorkspacesHandler) GetWorkspaces(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get workspaces")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT workspaces.id, workspaces.name, workspaces.is_personal, workspace_members.role, workspaces.created_at
+		FROM workspaces
+		INNER JOIN workspace_members ON workspace_members.workspace_id = workspaces.id
+		WHERE workspace_members.user_id = $1
+		ORDER BY workspaces.is_personal DESC, workspaces.created_at
+	`, userIdInt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get workspaces", err))
+		return
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		var w Workspace
+		if err := rows.Scan(&w.ID, &w.Name, &w.IsPersonal, &w.Role, &w.CreatedAt); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get workspaces", err))
+			return
+		}
+		workspaces = append(workspaces, w)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get workspaces", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, WorkspacesResponse{Workspaces: workspaces})
+}
+
+type CreateWorkspaceInput struct {
+	Name string `json:"name" binding:"required,max=255"`
+}
+
+// CreateWorkspace creates a shared workspace, the creator becomes its owner
+func (h *WorkspacesHandler) CreateWorkspace(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to create workspace")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var input CreateWorkspaceInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		c.Error(api_error.NewBadRequestError("name cannot be empty", nil))
+		return
+	}
+
+	workspace := Workspace{Name: name, Role: access.RoleOwner}
+	err := h.db.QueryRow(ctx, `
+		WITH workspace AS (
+			INSERT INTO workspaces (name, created_by) VALUES ($1, $2::integer) RETURNING id, created_at
+		), owner AS (
+			INSERT INTO workspace_members (workspace_id, user_id, role) SELECT id, $2::integer, $3::varchar FROM workspace
+		)
+		SELECT id, created_at FROM workspace
+	`, name, userIdInt, access.RoleOwner).Scan(&workspace.ID, &workspace.CreatedAt)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to create workspace", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": workspace})
+}
+
+type WorkspaceUri struct {
+	ID int64 `uri:"id" binding:"required"`
+}
+
+type WorkspaceMember struct {
+	UserID   int64       `json:"user_id"`
+	Username string      `json:"username"`
+	Email    string      `json:"email"`
+	Role     access.Role `json:"role"`
+}
+
+type WorkspaceMembersResponse struct {
+	Members []WorkspaceMember `json:"members"`
+}
+
+func (h *WorkspacesHandler) GetMembers(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to get workspace members")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri WorkspaceUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	if _, err := access.AuthorizeWorkspace(ctx, h.db, uri.ID, userIdInt, access.ActionView); err != nil {
+		c.Error(accessError(err, "workspace not found"))
+		return
+	}
+
+	rows, err := h.db.Query(ctx, `
+		SELECT users.id, users.username, users.email, workspace_members.role
+		FROM workspace_members
+		INNER JOIN users ON users.id = workspace_members.user_id
+		WHERE workspace_members.workspace_id = $1
+		ORDER BY workspace_members.created_at
+	`, uri.ID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get workspace members", err))
+		return
+	}
+	defer rows.Close()
+
+	members := []WorkspaceMember{}
+	for rows.Next() {
+		var m WorkspaceMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Email, &m.Role); err != nil {
+			c.Error(api_error.NewInternalServerError("failed to get workspace members", err))
+			return
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to get workspace members", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, WorkspaceMembersResponse{Members: members})
+}
+
+type AddMemberInput struct {
+	Email string      `json:"email" binding:"required,email"`
+	Role  access.Role `json:"role" binding:"required"`
+}
+
+// AddMember adds an existing user to the workspace
+func (h *WorkspacesHandler) AddMember(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to add workspace member")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri WorkspaceUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	var input AddMemberInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	if !input.Role.Valid() {
+		c.Error(api_error.NewBadRequestError("invalid role", nil))
+		return
+	}
+
+	role, err := access.AuthorizeWorkspace(ctx, h.db, uri.ID, userIdInt, access.ActionManageMembers)
+	if err != nil {
+		c.Error(accessError(err, "workspace not found"))
+		return
+	}
+	if input.Role == access.RoleOwner && role != access.RoleOwner {
+		c.Error(api_error.NewForbiddenError("only owners can add owners", nil))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to add workspace member", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var memberID int64
+	err = tx.QueryRow(ctx, `SELECT id FROM users WHERE lower(email) = lower($1)`, input.Email).Scan(&memberID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.Error(api_error.NewNotFoundError("user not found", nil))
+		return
+	} else if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to add workspace member", err))
+		return
+	}
+
+	cmd, err := tx.Exec(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING
+	`, uri.ID, memberID, input.Role)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to add workspace member", err))
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		c.Error(api_error.NewBadRequestError("user is already a member of this workspace", nil))
+		return
+	}
+
+	if err := recordAccessChange(ctx, tx, memberID, accessChangeWorkspaceJoined, &uri.ID, nil); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to add workspace member", err))
+		return
+	}
+	if err := notifyPendingMentionsOfUser(ctx, tx, memberID); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to add workspace member", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to add workspace member", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "member added successfully"})
+}
+
+type WorkspaceMemberUri struct {
+	ID     int64 `uri:"id" binding:"required"`
+	UserID int64 `uri:"user_id" binding:"required"`
+}
+
+type UpdateMemberInput struct {
+	Role access.Role `json:"role" binding:"required"`
+}
+
+func (h *WorkspacesHandler) UpdateMember(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to update workspace member")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri WorkspaceMemberUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	var input UpdateMemberInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+	if !input.Role.Valid() {
+		c.Error(api_error.NewBadRequestError("invalid role", nil))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update workspace member", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	actorRole, currentRole, apiErr := h.authorizeMemberChange(ctx, tx, uri, userIdInt, access.ActionManageMembers)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+	if input.Role == access.RoleOwner && actorRole != access.RoleOwner {
+		c.Error(api_error.NewForbiddenError("only owners can add owners", nil))
+		return
+	}
+
+	if currentRole == access.RoleOwner && input.Role != access.RoleOwner {
+		if apiErr := ensureAnotherOwner(ctx, tx, uri.ID); apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE workspace_members SET role = $1 WHERE workspace_id = $2 AND user_id = $3
+	`, input.Role, uri.ID, uri.UserID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update workspace member", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to update workspace member", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "member updated successfully"})
+}
+
+// RemoveMember removes a member from the workspace. Any member can remove themselves to leave it.
+func (h *WorkspacesHandler) RemoveMember(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	userIdInt, apiErr := contextUserID(c, "not authorized to remove workspace member")
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	var uri WorkspaceMemberUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.Error(api_error.NewBadRequestError(err.Error(), err))
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to remove workspace member", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	action := access.ActionManageMembers
+	if uri.UserID == userIdInt {
+		action = access.ActionView
+	}
+	_, currentRole, apiErr := h.authorizeMemberChange(ctx, tx, uri, userIdInt, action)
+	if apiErr != nil {
+		c.Error(apiErr)
+		return
+	}
+
+	if currentRole == access.RoleOwner {
+		if apiErr := ensureAnotherOwner(ctx, tx, uri.ID); apiErr != nil {
+			c.Error(apiErr)
+			return
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2
+	`, uri.ID, uri.UserID)
+	if err != nil {
+		c.Error(api_error.NewInternalServerError("failed to remove workspace member", err))
+		return
+	}
+	if err := recordAccessChange(ctx, tx, uri.UserID, accessChangeWorkspaceLeft, &uri.ID, nil); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to remove workspace member", err))
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(api_error.NewInternalServerError("failed to remove workspace member", err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// authorizeMemberChange checks the acting user may change the target member and returns both of their roles.
+// Only owners can change other owners.
+func (h *WorkspacesHandler) authorizeMemberChange(ctx context.Context, tx pgx.Tx, uri WorkspaceMemberUri, userID int64, action access.Action) (access.Role, access.Role, *api_error.ApiError) {
+	// locking the workspace serializes membership changes so two owners can't demote each other at the same time
+	_, err := tx.Exec(ctx, `SELECT id FROM workspaces WHERE id = $1 FOR UPDATE`, uri.ID)
+	if err != nil {
+		return "", "", api_error.NewInternalServerError("failed to change workspace member", err)
+	}
+
+	actorRole, err := access.AuthorizeWorkspace(ctx, tx, uri.ID, userID, action)
+	if err != nil {
+		return "", "", accessError(err, "workspace not found")
+	}
+
+	targetRole, err := access.WorkspaceRole(ctx, tx, uri.ID, uri.UserID)
+	if err != nil {
+		return "", "", accessError(err, "member not found")
+	}
+
+	if targetRole == access.RoleOwner && actorRole != access.RoleOwner {
+		return "", "", api_error.NewForbiddenError("only owners can change owners", nil)
+	}
+	return actorRole, targetRole, nil
+}
+
+// ensureAnotherOwner prevents a workspace from being left without an owner
+func ensureAnotherOwner(ctx context.Context, tx pgx.Tx, workspaceID int64) *api_error.ApiError {
+	var owners int
+	err := tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM workspace_members WHERE workspace_id = $1 AND role = $2
+	`, workspaceID, access.RoleOwner).Scan(&owners)
+	if err != nil {
+		return api_error.NewInternalServerError("failed to change workspace member", err)
+	}
+	if owners < 2 {
+		return api_error.NewBadRequestError("a workspace must have at least one owner", nil)
+	}
+	return nil
+}
+
+func contextUserID(c *gin.Context, message string) (int64, *api_error.ApiError) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		return 0, api_error.NewUnauthorizedError(message, nil)
+	}
+	userIdInt, ok := userID.(int64)
+	if !ok {
+		return 0, api_error.NewUnauthorizedError(message, fmt.Errorf("user id is not an integer"))
+	}
+	return userIdInt, nil
+}
+
+// UUIDUri binds the :id path parameter of routes for resources with uuid ids, such as pages and comments
+type UUIDUri struct {
+	ID string `uri:"id" binding:"required,uuid"`
+}
+
+// uuidFromUri parses the :id path parameter
+func uuidFromUri(c *gin.Context) (uuid.UUID, *api_error.ApiError) {
+	var uri UUIDUri
+	if err := c.ShouldBindUri(&uri); err != nil {
+		return uuid.Nil, api_error.NewBadRequestError(err.Error(), err)
+	}
+	id, err := uuid.FromString(uri.ID)
+	if err != nil {
+		return uuid.Nil, api_error.NewBadRequestError(err.Error(), err)
+	}
+	return id, nil
+}
+
+// pageIDFromUri parses the :id path parameter of routes under /pages/:id
+func pageIDFromUri(c *gin.Context) (uuid.UUID, *api_error.ApiError) {
+	return uuidFromUri(c)
+}
+
+func (h *WorkspacesHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/workspaces", h.GetWorkspaces)
+	router.POST("/workspaces", h.CreateWorkspace)
+	router.GET("/workspaces/:id/members", h.GetMembers)
+	router.POST("/workspaces/:id/members", h.AddMember)
+	router.PUT("/workspaces/:id/members/:user_id", h.UpdateMember)
+	router.DELETE("/workspaces/:id/members/:user_id", h.RemoveMember)
+}
@@ -0,0 +1,135 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_notion/backend/access"
+	"go_notion/backend/db"
+	"go_notion/backend/handlers"
+	"go_notion/backend/page"
+	"go_notion/backend/router"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkspaceMembersCanAccessSharedPages(t *testing.T) {
+	pageId := uuid.Must(uuid.NewV4())
+	pool, err := db.OpenTestDb(
+		db.InsertTestUserFixture,
+		db.InsertTestUserWithData("member@example.com", "member", "password"),
+		db.InsertTestUserWithData("guest@example.com", "guest", "password"),
+		db.InsertTestPageFixture(pageId, 1),
+		db.InsertTestWorkspaceMemberFixture(1, 3, access.RoleGuest),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	workspaces, err := handlers.NewWorkspacesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getPage, err := handlers.NewGetPageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePage, err := handlers.NewUpdatePageHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := newServe(workspaces, getPage, updatePage)
+
+	var response handlers.WorkspacesResponse
+	w := serve(1, "GET", "/api/workspaces", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, response.Workspaces, 1)
+	workspace := response.Workspaces[0]
+	assert.True(t, workspace.IsPersonal)
+	assert.Equal(t, access.RoleOwner, workspace.Role)
+
+	pagePath := "/api/pages/" + pageId.String()
+	update := `{"title_text": "shared", "content_text": "shared", "raw_title": {}, "raw_content": {}}`
+
+	// not a member yet
+	assert.Equal(t, http.StatusNotFound, serve(2, "GET", pagePath, "").Code)
+
+	membersPath := fmt.Sprintf("/api/workspaces/%d/members", workspace.ID)
+	// guests can't manage members
+	assert.Equal(t, http.StatusForbidden, serve(3, "POST", membersPath, `{"email": "member@example.com", "role": "member"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(1, "POST", membersPath, `{"email": "member@example.com", "role": "member"}`).Code)
+
+	assert.Equal(t, http.StatusOK, serve(2, "GET", pagePath, "").Code)
+	assert.Equal(t, http.StatusOK, serve(2, "PUT", pagePath, update).Code)
+
+	// guests can view but not edit
+	assert.Equal(t, http.StatusOK, serve(3, "GET", pagePath, "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(3, "PUT", pagePath, update).Code)
+
+	// the only owner can't leave
+	assert.Equal(t, http.StatusBadRequest, serve(1, "DELETE", membersPath+"/1", "").Code)
+	// members can't change owners
+	assert.Equal(t, http.StatusForbidden, serve(2, "PUT", membersPath+"/1", `{"role": "guest"}`).Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(2, "DELETE", membersPath+"/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(2, "GET", pagePath, "").Code)
+}
+
+func TestCreateWorkspace(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	workspaces, err := handlers.NewWorkspacesHandler(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np, err := handlers.NewCreatePageHandler(pool, page.NewPageConfig(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", int64(1))
+	})
+	workspaces.RegisterRoutes(r.Group("/api"))
+	np.RegisterRoutes(r.Group("/api"))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/workspaces", strings.NewReader(`{"name": "Team"}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Data handlers.Workspace `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Team", response.Data.Name)
+	assert.Equal(t, access.RoleOwner, response.Data.Role)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/pages", strings.NewReader(fmt.Sprintf(`{"workspace_id": %d}`, response.Data.ID)))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// workspaces the user isn't a member of are hidden
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/pages", strings.NewReader(`{"workspace_id": 999}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	AppURLEnvVar  = "APP_URL"
+	DefaultAppURL = "http://localhost:3000"
+
+	// MailerEnvVar selects the mailer, "log" (the default in development) or "smtp"
+	MailerEnvVar       = "MAILER"
+	SMTPHostEnvVar     = "SMTP_HOST"
+	SMTPPortEnvVar     = "SMTP_PORT"
+	SMTPUsernameEnvVar = "SMTP_USERNAME"
+	SMTPPasswordEnvVar = "SMTP_PASSWORD"
+	MailFromEnvVar     = "MAIL_FROM"
+	DefaultSMTPPort    = "587"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends transactional emails such as account unlock links.
+// Implementations must be safe for concurrent use since handlers share a single instance.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// NewMailerFromEnv creates the mailer configured in the environment. The log mailer writes unlock
+// and invite links to the log, so it is refused outside of development and tests.
+func NewMailerFromEnv() (Mailer, error) {
+	switch kind := os.Getenv(MailerEnvVar); kind {
+	case "", "log":
+		if env := os.Getenv("GO_ENV"); env != "" && env != "development" && env != "test" {
+			return nil, fmt.Errorf("mailer configuration error: the log mailer is only for development, set %s to smtp", MailerEnvVar)
+		}
+		return NewLogMailer(), nil
+	case "smtp":
+		config := SMTPConfig{
+			Host:     os.Getenv(SMTPHostEnvVar),
+			Port:     os.Getenv(SMTPPortEnvVar),
+			Username: os.Getenv(SMTPUsernameEnvVar),
+			Password: os.Getenv(SMTPPasswordEnvVar),
+			From:     os.Getenv(MailFromEnvVar),
+		}
+		if config.Port == "" {
+			config.Port = DefaultSMTPPort
+		}
+		return NewSMTPMailer(config)
+	default:
+		return nil, fmt.Errorf("mailer configuration error: unknown %s %q", MailerEnvVar, kind)
+	}
+}
+
+// LogMailer writes emails to the application log instead of delivering them.
+// It is meant for development, where there is no mail server to talk to.
+type LogMailer struct{}
+
+func NewLogMailer() *LogMailer {
+	return &LogMailer{}
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	log.Printf("email to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// Link builds a link to the frontend for use in email bodies.
+// The frontend is served from APP_URL, which defaults to the local development server.
+func Link(path string, params url.Values) string {
+	base, ok := os.LookupEnv(AppURLEnvVar)
+	if !ok || base == "" {
+		base = DefaultAppURL
+	}
+	link := strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+	if len(params) > 0 {
+		link += "?" + params.Encode()
+	}
+	return link
+}
@@ -0,0 +1,111 @@
+package mailer_test
+
+import (
+	"bufio"
+	"context"
+	"go_notion/backend/mailer"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMailerFromEnv(t *testing.T) {
+	t.Setenv("GO_ENV", "development")
+	t.Setenv(mailer.MailerEnvVar, "")
+	m, err := mailer.NewMailerFromEnv()
+	if assert.NoError(t, err) {
+		assert.IsType(t, &mailer.LogMailer{}, m)
+	}
+
+	t.Setenv("GO_ENV", "production")
+	_, err = mailer.NewMailerFromEnv()
+	assert.Error(t, err, "the log mailer must be refused in production")
+
+	t.Setenv(mailer.MailerEnvVar, "smtp")
+	t.Setenv(mailer.SMTPHostEnvVar, "smtp.example.com")
+	t.Setenv(mailer.MailFromEnvVar, "")
+	_, err = mailer.NewMailerFromEnv()
+	assert.Error(t, err, "a sender address is required")
+
+	t.Setenv(mailer.MailFromEnvVar, "go_notion <no-reply@example.com>")
+	m, err = mailer.NewMailerFromEnv()
+	if assert.NoError(t, err) {
+		assert.IsType(t, &mailer.SMTPMailer{}, m)
+	}
+}
+
+// serveSMTP answers a single SMTP session without TLS or auth and returns the received DATA
+func serveSMTP(listener net.Listener) <-chan string {
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		write := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		write("220 localhost ready")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.Fields(line)[0]); command {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				write("250 OK")
+			case "DATA":
+				write("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				write("250 OK")
+			case "QUIT":
+				write("221 bye")
+				return
+			default:
+				write("502 not implemented")
+			}
+		}
+	}()
+	return received
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := serveSMTP(listener)
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	m, err := mailer.NewSMTPMailer(mailer.SMTPConfig{Host: host, Port: port, From: "no-reply@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = m.Send(ctx, mailer.Message{To: "test@test.com", Subject: "Unlock your account", Body: "Open this link\nhttp://localhost:3000/unlock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := <-received
+	assert.Contains(t, data, "To: <test@test.com>\r\n")
+	assert.Contains(t, data, "Subject: Unlock your account\r\n")
+	assert.Contains(t, data, "\r\n\r\nOpen this link\r\nhttp://localhost:3000/unlock\r\n")
+
+	err = m.Send(ctx, mailer.Message{To: "test@test.com", Subject: "Hi\r\nBcc: someone@example.com"})
+	assert.Error(t, err, "line breaks in the subject must be refused")
+}
@@ -0,0 +1,399 @@
+// Package media inspects uploaded files: it tells their type from their content,
+// strips the metadata that can reveal where a photo was taken and makes image thumbnails.
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+)
+
+const (
+	// ThumbnailSize is the largest width and height of thumbnails, in pixels
+	ThumbnailSize = 256
+	// MaxPixels bounds the images that are decoded for a thumbnail, since a small file can declare huge dimensions
+	MaxPixels = 40_000_000
+)
+
+var ErrInvalidImage = errors.New("invalid image")
+
+// textTypes can't be told apart from plain text by their content, the declared type is trusted for them
+var textTypes = map[string]bool{
+	"text/csv":         true,
+	"text/markdown":    true,
+	"application/json": true,
+}
+
+// SniffContentType returns the media type of the content, ignoring what the client declared
+// unless the content is plain text and the declared type is a text format.
+func SniffContentType(content []byte, declared string) string {
+	sniffed, _, err := mime.ParseMediaType(http.DetectContentType(content))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	if sniffed == "text/plain" {
+		if declaredType, _, err := mime.ParseMediaType(declared); err == nil && textTypes[declaredType] {
+			return declaredType
+		}
+	}
+	return sniffed
+}
+
+// Image describes an uploaded image
+type Image struct {
+	Width  int
+	Height int
+	// Thumbnail fits in ThumbnailSize, it is nil when the image has more than MaxPixels
+	Thumbnail []byte
+}
+
+// IsDecodable reports whether images of the type get dimensions and a thumbnail
+func IsDecodable(contentType string) bool {
+	return contentType == "image/png" || contentType == "image/jpeg" || contentType == "image/gif"
+}
+
+// ThumbnailContentType is the type of the thumbnails of images of the type.
+// Photos stay jpeg, other images become png to keep their transparency.
+func ThumbnailContentType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// ProcessImage reads the dimensions of the image and makes its thumbnail,
+// it returns nil for types that aren't decodable. Only the first frame of animated gifs is used.
+// The dimensions and the thumbnail of jpegs follow their exif orientation, as browsers show them.
+func ProcessImage(contentType string, content []byte) (*Image, error) {
+	if !IsDecodable(contentType) {
+		return nil, nil
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(content)
+	}
+	img := &Image{Width: config.Width, Height: config.Height}
+	if orientation >= 5 {
+		img.Width, img.Height = config.Height, config.Width
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return img, nil
+	}
+
+	var src image.Image
+	switch contentType {
+	case "image/png":
+		src, err = png.Decode(bytes.NewReader(content))
+	case "image/jpeg":
+		src, err = jpeg.Decode(bytes.NewReader(content))
+	case "image/gif":
+		src, err = gif.Decode(bytes.NewReader(content))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+
+	var thumbnail bytes.Buffer
+	resized := orient(resize(src, ThumbnailSize), orientation)
+	if ThumbnailContentType(contentType) == "image/jpeg" {
+		err = jpeg.Encode(&thumbnail, resized, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&thumbnail, resized)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	img.Thumbnail = thumbnail.Bytes()
+	return img, nil
+}
+
+// resize scales the image down to fit in maxSize, averaging the pixels each thumbnail pixel covers
+func resize(src image.Image, maxSize int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	targetWidth, targetHeight := width, height
+	if width > maxSize || height > maxSize {
+		if width >= height {
+			targetWidth, targetHeight = maxSize, max(1, height*maxSize/width)
+		} else {
+			targetWidth, targetHeight = max(1, width*maxSize/height), maxSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	for y := 0; y < targetHeight; y++ {
+		y0, y1 := bounds.Min.Y+y*height/targetHeight, bounds.Min.Y+(y+1)*height/targetHeight
+		for x := 0; x < targetWidth; x++ {
+			x0, x1 := bounds.Min.X+x*width/targetWidth, bounds.Min.X+(x+1)*width/targetWidth
+			// the colors are premultiplied by alpha, so transparent pixels don't darken their neighbours
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
+
+// orient turns the image upright according to its exif orientation
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation == 1 {
+		return src
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	targetWidth, targetHeight := width, height
+	if orientation >= 5 {
+		// the orientations from 5 to 8 are turned a quarter
+		targetWidth, targetHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	for y := 0; y < targetHeight; y++ {
+		for x := 0; x < targetWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = width-1-x, y
+			case 3:
+				sx, sy = width-1-x, height-1-y
+			case 4:
+				sx, sy = x, height-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, height-1-x
+			case 7:
+				sx, sy = width-1-y, height-1-x
+			case 8:
+				sx, sy = width-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// StripMetadata removes the exif and xmp metadata of jpeg, png and webp images, where cameras and phones
+// record the location of photos. The pixels are left untouched, and so is the orientation of jpegs. Other types are returned as they are.
+func StripMetadata(contentType string, content []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(content)
+	case "image/png":
+		return stripPNG(content)
+	case "image/webp":
+		return stripWebP(content)
+	default:
+		return content, nil
+	}
+}
+
+// stripJPEG drops the APP1 segments, which hold the exif and xmp metadata.
+// The exif orientation is put back in a segment of its own, without it photos taken upright would show sideways.
+func stripJPEG(content []byte) ([]byte, error) {
+	return rewriteJPEG(content, func(marker byte, segment []byte) []byte {
+		if marker != 0xE1 {
+			return segment
+		}
+		if orientation := exifOrientation(segment[4:]); orientation != 1 {
+			return orientationSegment(orientation)
+		}
+		return nil
+	})
+}
+
+// jpegOrientation returns the exif orientation of the jpeg, 1 when it has none
+func jpegOrientation(content []byte) int {
+	orientation := 1
+	rewriteJPEG(content, func(marker byte, segment []byte) []byte {
+		if marker == 0xE1 && orientation == 1 {
+			orientation = exifOrientation(segment[4:])
+		}
+		return nil
+	})
+	return orientation
+}
+
+// rewriteJPEG replaces each segment before the scans, markers included, with what rewrite returns for it
+func rewriteJPEG(content []byte, rewrite func(marker byte, segment []byte) []byte) ([]byte, error) {
+	if len(content) < 2 || content[0] != 0xFF || content[1] != 0xD8 {
+		return nil, ErrInvalidImage
+	}
+	rewritten := make([]byte, 0, len(content))
+	rewritten = append(rewritten, content[:2]...)
+	i := 2
+	for i < len(content) {
+		if i+1 >= len(content) || content[i] != 0xFF {
+			return nil, ErrInvalidImage
+		}
+		marker := content[i+1]
+		switch {
+		case marker == 0xFF:
+			// fill byte before a marker
+			i++
+			continue
+		case marker == 0xD9:
+			// end of image
+			return append(rewritten, content[i:]...), nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			rewritten = append(rewritten, content[i:i+2]...)
+			i += 2
+			continue
+		case marker == 0xDA:
+			// the scans follow, metadata segments come before them
+			return append(rewritten, content[i:]...), nil
+		}
+		if i+4 > len(content) {
+			return nil, ErrInvalidImage
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(content[i+2:i+4]))
+		if end < i+4 || end > len(content) {
+			return nil, ErrInvalidImage
+		}
+		rewritten = append(rewritten, rewrite(marker, content[i:end])...)
+		i = end
+	}
+	return rewritten, nil
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+const orientationTag = 0x0112
+
+// exifOrientation reads the orientation tag of an APP1 segment's payload, from 1 to 8.
+// It returns 1, upright, when the payload isn't exif or has no valid orientation.
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return 1
+	}
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for entry := ifd + 2; entry+12 <= len(tiff) && count > 0; entry, count = entry+12, count-1 {
+		// tag, type, count and value, a short value is in the first two bytes of the value
+		const typeShort = 3
+		if order.Uint16(tiff[entry:entry+2]) != orientationTag || order.Uint16(tiff[entry+2:entry+4]) != typeShort {
+			continue
+		}
+		if orientation := int(order.Uint16(tiff[entry+8 : entry+10])); orientation >= 1 && orientation <= 8 {
+			return orientation
+		}
+		return 1
+	}
+	return 1
+}
+
+// orientationSegment is an APP1 segment with an exif holding nothing but the orientation
+func orientationSegment(orientation int) []byte {
+	tiff := []byte("MM\x00*")
+	tiff = binary.BigEndian.AppendUint32(tiff, 8)
+	// one entry, then no next ifd
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = binary.BigEndian.AppendUint16(tiff, 0)
+	tiff = binary.BigEndian.AppendUint32(tiff, 0)
+
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(2+len(exifHeader)+len(tiff)))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff...)
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNG drops the eXIf chunk and the text chunks, which hold the xmp metadata
+func stripPNG(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, pngSignature) {
+		return nil, ErrInvalidImage
+	}
+	stripped := make([]byte, 0, len(content))
+	stripped = append(stripped, pngSignature...)
+	i := len(pngSignature)
+	for i < len(content) {
+		if i+8 > len(content) {
+			return nil, ErrInvalidImage
+		}
+		// length, type, data and crc
+		end := i + 12 + int(binary.BigEndian.Uint32(content[i:i+4]))
+		if end < i+12 || end > len(content) {
+			return nil, ErrInvalidImage
+		}
+		switch string(content[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+		default:
+			stripped = append(stripped, content[i:end]...)
+		}
+		i = end
+	}
+	return stripped, nil
+}
+
+// stripWebP drops the EXIF and XMP chunks and clears their flags in the VP8X header
+func stripWebP(content []byte) ([]byte, error) {
+	if len(content) < 12 || string(content[:4]) != "RIFF" || string(content[8:12]) != "WEBP" {
+		return nil, ErrInvalidImage
+	}
+	stripped := make([]byte, 0, len(content))
+	stripped = append(stripped, content[:12]...)
+	i := 12
+	for i < len(content) {
+		if i+8 > len(content) {
+			return nil, ErrInvalidImage
+		}
+		size := int(binary.LittleEndian.Uint32(content[i+4 : i+8]))
+		// chunks are padded to an even size
+		end := i + 8 + size + size%2
+		if end < i+8 || end > len(content) {
+			return nil, ErrInvalidImage
+		}
+		switch fourCC := string(content[i : i+4]); fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := len(stripped)
+			stripped = append(stripped, content[i:end]...)
+			if size > 0 {
+				const exifFlag, xmpFlag = 0x08, 0x04
+				stripped[start+8] &^= exifFlag | xmpFlag
+			}
+		default:
+			stripped = append(stripped, content[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
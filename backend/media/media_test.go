@@ -0,0 +1,272 @@
+package media_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go_notion/backend/media"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// exifSegment is an APP1 segment with a little endian exif holding the orientation and a gps ifd
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("II*\x00")
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)
+	// the gps ifd pointer, then the orientation
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x8825)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 4)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 38)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0)
+	tiff = append(tiff, "GPS!!!"...)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(2+len(payload)))
+	return append(segment, payload...)
+}
+
+// withSegment inserts a segment after the start of image marker of the jpeg
+func withSegment(content, segment []byte) []byte {
+	return append(append(append([]byte{}, content[:2]...), segment...), content[2:]...)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  []byte
+		declared string
+		expected string
+	}{
+		{"png named as text", encodePNG(t, 1, 1), "text/plain", "image/png"},
+		{"text named as image", []byte("hello"), "image/png", "text/plain"},
+		{"csv", []byte("a,b\n1,2"), "text/csv", "text/csv"},
+		{"html named as csv", []byte("<html><script></script></html>"), "text/csv", "text/html"},
+		{"pdf", []byte("%PDF-1.7"), "", "application/pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, media.SniffContentType(tt.content, tt.declared))
+		})
+	}
+}
+
+func TestProcessImage(t *testing.T) {
+	t.Run("fits thumbnails in the thumbnail size", func(t *testing.T) {
+		img, err := media.ProcessImage("image/png", encodePNG(t, 600, 300))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 600, img.Width)
+		assert.Equal(t, 300, img.Height)
+
+		thumbnail, err := png.DecodeConfig(bytes.NewReader(img.Thumbnail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, media.ThumbnailSize, thumbnail.Width)
+		assert.Equal(t, media.ThumbnailSize/2, thumbnail.Height)
+	})
+
+	t.Run("keeps small images at their size", func(t *testing.T) {
+		img, err := media.ProcessImage("image/jpeg", encodeJPEG(t, 10, 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumbnail, err := jpeg.DecodeConfig(bytes.NewReader(img.Thumbnail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 10, thumbnail.Width)
+		assert.Equal(t, 20, thumbnail.Height)
+	})
+
+	t.Run("skips the thumbnail of huge images", func(t *testing.T) {
+		content := encodePNG(t, 1, 1)
+		// the IHDR chunk follows the signature, its width and height are the first 8 bytes of its data
+		ihdr := make([]byte, 13)
+		copy(ihdr, content[16:29])
+		binary.BigEndian.PutUint32(ihdr[0:4], 100_000)
+		binary.BigEndian.PutUint32(ihdr[4:8], 100_000)
+		huge := append(append(append([]byte{}, content[:8]...), pngChunk("IHDR", ihdr)...), content[33:]...)
+
+		img, err := media.ProcessImage("image/png", huge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 100_000, img.Width)
+		assert.Nil(t, img.Thumbnail)
+	})
+
+	t.Run("turns photos upright", func(t *testing.T) {
+		// the left half is red, the right half blue
+		src := image.NewRGBA(image.Rect(0, 0, 64, 32))
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 64; x++ {
+				c := color.RGBA{R: 255, A: 255}
+				if x >= 32 {
+					c = color.RGBA{B: 255, A: 255}
+				}
+				src.Set(x, y, c)
+			}
+		}
+		var content bytes.Buffer
+		if err := jpeg.Encode(&content, src, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// 6 is turned a quarter clockwise, the left half ends up on top
+		img, err := media.ProcessImage("image/jpeg", withSegment(content.Bytes(), exifSegment(6)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 32, img.Width)
+		assert.Equal(t, 64, img.Height)
+
+		thumbnail, err := jpeg.Decode(bytes.NewReader(img.Thumbnail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, image.Rect(0, 0, 32, 64), thumbnail.Bounds())
+		top, _, _, _ := thumbnail.At(16, 8).RGBA()
+		_, _, bottom, _ := thumbnail.At(16, 56).RGBA()
+		assert.Greater(t, top, uint32(0xC000))
+		assert.Greater(t, bottom, uint32(0xC000))
+	})
+
+	t.Run("ignores other types and rejects invalid images", func(t *testing.T) {
+		img, err := media.ProcessImage("application/pdf", []byte("%PDF-1.7"))
+		assert.NoError(t, err)
+		assert.Nil(t, img)
+
+		_, err = media.ProcessImage("image/png", []byte("not a png"))
+		assert.ErrorIs(t, err, media.ErrInvalidImage)
+	})
+}
+
+func TestStripMetadata(t *testing.T) {
+	t.Run("jpeg", func(t *testing.T) {
+		content := encodeJPEG(t, 4, 4)
+		exif := []byte("\xFF\xE1\x00\x0EExif\x00\x00GPS!!!")
+		withExif := append(append(append([]byte{}, content[:2]...), exif...), content[2:]...)
+
+		stripped, err := media.StripMetadata("image/jpeg", withExif)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, content, stripped)
+		_, err = jpeg.Decode(bytes.NewReader(stripped))
+		assert.NoError(t, err)
+	})
+
+	t.Run("jpeg keeps the orientation", func(t *testing.T) {
+		content := encodeJPEG(t, 4, 4)
+
+		stripped, err := media.StripMetadata("image/jpeg", withSegment(content, exifSegment(6)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotContains(t, string(stripped), "GPS")
+		// only the orientation is left, in a big endian exif
+		orientation := []byte("\xFF\xE1\x00\x22Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+		assert.Equal(t, withSegment(content, orientation), stripped)
+
+		// upright photos don't need it
+		stripped, err = media.StripMetadata("image/jpeg", withSegment(content, exifSegment(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, content, stripped)
+	})
+
+	t.Run("png", func(t *testing.T) {
+		content := encodePNG(t, 4, 4)
+		// metadata chunks go after IHDR, which ends at byte 33
+		withExif := append([]byte{}, content[:33]...)
+		withExif = append(withExif, pngChunk("eXIf", []byte("GPS"))...)
+		withExif = append(withExif, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x/>"))...)
+		withExif = append(withExif, content[33:]...)
+
+		stripped, err := media.StripMetadata("image/png", withExif)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, content, stripped)
+	})
+
+	t.Run("webp", func(t *testing.T) {
+		chunk := func(fourCC string, data []byte) []byte {
+			c := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+			c = append(c, data...)
+			if len(data)%2 == 1 {
+				c = append(c, 0)
+			}
+			return c
+		}
+		riff := func(chunks ...[]byte) []byte {
+			body := []byte("WEBP")
+			for _, c := range chunks {
+				body = append(body, c...)
+			}
+			return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+		}
+		vp8x := []byte{0x08 | 0x04 | 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		clearedVP8X := []byte{0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		image := chunk("VP8L", []byte{1, 2, 3})
+
+		stripped, err := media.StripMetadata("image/webp", riff(chunk("VP8X", vp8x), image, chunk("EXIF", []byte("GPS")), chunk("XMP ", []byte("<x/>"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, riff(chunk("VP8X", clearedVP8X), image), stripped)
+	})
+
+	t.Run("other types and invalid images", func(t *testing.T) {
+		stripped, err := media.StripMetadata("text/plain", []byte("hello"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(stripped))
+
+		_, err = media.StripMetadata("image/jpeg", []byte("\xFF\xD8\xFF\xE1\xFF\xFF"))
+		assert.ErrorIs(t, err, media.ErrInvalidImage)
+	})
+}
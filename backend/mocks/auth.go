@@ -1,8 +1,53 @@
 package mocks
 
+import (
+	"context"
+	"fmt"
+	"go_notion/backend/auth"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid/v5"
+)
+
 // TokenGeneratorMock implements TokenGenerator interface for testing purposes
 type TokenGeneratorMock struct{}
 
-func (t *TokenGeneratorMock) Generate(userID int64) (string, error) {
+func (t *TokenGeneratorMock) Generate(userID int64, sessionID uuid.UUID) (string, error) {
 	return "token", nil
 }
+
+// ChallengeIssuerMock implements ChallengeIssuer interface for testing purposes.
+// Challenge tokens are of the form "challenge-<user id>" so tests can craft them directly.
+type ChallengeIssuerMock struct{}
+
+func (t *ChallengeIssuerMock) GenerateChallenge(userID int64) (string, error) {
+	return fmt.Sprintf("challenge-%d", userID), nil
+}
+
+func (t *ChallengeIssuerMock) VerifyChallenge(token string) (int64, error) {
+	id, ok := strings.CutPrefix(token, "challenge-")
+	if !ok {
+		return 0, fmt.Errorf("invalid challenge token")
+	}
+	return strconv.ParseInt(id, 10, 64)
+}
+
+// KeySetProviderMock implements KeySetProvider interface for testing purposes with a single fixed key
+type KeySetProviderMock struct{}
+
+func (k *KeySetProviderMock) JWKS() auth.JWKSet {
+	return auth.JWKSet{Keys: []auth.JWK{{Kty: "OKP", Kid: "key-1", Use: "sig", Alg: "EdDSA", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}}}
+}
+
+// SessionValidatorMock implements SessionValidator interface for testing purposes. Sessions in Revoked are rejected.
+type SessionValidatorMock struct {
+	Revoked map[uuid.UUID]bool
+}
+
+func (s *SessionValidatorMock) ValidateSession(ctx context.Context, sessionID uuid.UUID, userID int64) error {
+	if s.Revoked[sessionID] {
+		return auth.ErrSessionRevoked
+	}
+	return nil
+}
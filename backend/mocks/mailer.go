@@ -0,0 +1,26 @@
+package mocks
+
+import (
+	"context"
+	"go_notion/backend/mailer"
+	"sync"
+)
+
+// MailerMock implements Mailer interface for testing purposes. It keeps every message it was asked to send.
+type MailerMock struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (m *MailerMock) Send(ctx context.Context, message mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func (m *MailerMock) Messages() []mailer.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mailer.Message(nil), m.messages...)
+}
@@ -0,0 +1,165 @@
+package mocks
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCIdentity is the user the mock issuer signs in when a code is redeemed
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type pendingCode struct {
+	identity      OIDCIdentity
+	nonce         string
+	codeChallenge string
+}
+
+// OIDCIssuer is a minimal OpenID Connect provider running on a local httptest server.
+// It serves discovery, a JWKS and a token endpoint. Instead of a login page, tests call Authorize
+// to get the code the provider would have redirected back with.
+type OIDCIssuer struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]pendingCode
+}
+
+func NewOIDCIssuer(clientID, clientSecret string) (*OIDCIssuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate issuer key: %w", err)
+	}
+	issuer := &OIDCIssuer{ClientID: clientID, ClientSecret: clientSecret, key: key, codes: make(map[string]pendingCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	return issuer, nil
+}
+
+func (i *OIDCIssuer) URL() string {
+	return i.Server.URL
+}
+
+func (i *OIDCIssuer) Close() {
+	i.Server.Close()
+}
+
+// Authorize simulates the user signing in at the provider, given the query parameters of the authorization url
+func (i *OIDCIssuer) Authorize(authURL string, identity OIDCIdentity) (code string, state string, err error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	query := u.Query()
+	if query.Get("client_id") != i.ClientID {
+		return "", "", fmt.Errorf("unknown client id %q", query.Get("client_id"))
+	}
+
+	code = fmt.Sprintf("code-%d", time.Now().UnixNano())
+	i.mu.Lock()
+	i.codes[code] = pendingCode{identity: identity, nonce: query.Get("nonce"), codeChallenge: query.Get("code_challenge")}
+	i.mu.Unlock()
+	return code, query.Get("state"), nil
+}
+
+func (i *OIDCIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"issuer":                 i.Server.URL,
+		"authorization_endpoint": i.Server.URL + "/authorize",
+		"token_endpoint":         i.Server.URL + "/token",
+		"jwks_uri":               i.Server.URL + "/jwks",
+	})
+}
+
+func (i *OIDCIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *OIDCIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if clientID != i.ClientID || clientSecret != i.ClientSecret {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, `{"error": "invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+	code := r.PostForm.Get("code")
+	i.mu.Lock()
+	pending, ok := i.codes[code]
+	delete(i.codes, code)
+	i.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != pending.codeChallenge {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            i.Server.URL,
+		"sub":            pending.identity.Subject,
+		"aud":            i.ClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          pending.nonce,
+		"email":          pending.identity.Email,
+		"email_verified": pending.identity.EmailVerified,
+	})
+	token.Header["kid"] = "mock-key"
+	idToken, err := token.SignedString(i.key)
+	if err != nil {
+		http.Error(w, `{"error": "server_error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]string{"access_token": "mock-access-token", "token_type": "Bearer", "id_token": idToken})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
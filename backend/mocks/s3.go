@@ -0,0 +1,79 @@
+package mocks
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// S3ServerMock is an in-memory stand-in for an S3 compatible service such as MinIO.
+// It serves path style object requests and refuses requests not signed with its access key,
+// the signature itself isn't checked.
+type S3ServerMock struct {
+	AccessKeyID string
+
+	mu      sync.Mutex
+	objects map[string]S3ObjectMock
+}
+
+type S3ObjectMock struct {
+	Body        []byte
+	ContentType string
+}
+
+func NewS3ServerMock(accessKeyID string) *S3ServerMock {
+	return &S3ServerMock{AccessKeyID: accessKeyID, objects: make(map[string]S3ObjectMock)}
+}
+
+func (m *S3ServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+m.AccessKeyID+"/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	// the path is /<bucket>/<key>
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.Contains(path, "/") {
+		http.Error(w, "<Error><Code>InvalidRequest</Code></Error>", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			http.Error(w, "<Error><Code>MissingContentLength</Code></Error>", http.StatusLengthRequired)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.objects[path] = S3ObjectMock{Body: body, ContentType: r.Header.Get("Content-Type")}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		object, ok := m.objects[path]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.ContentType)
+		w.Write(object.Body)
+	case http.MethodDelete:
+		delete(m.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>MethodNotAllowed</Code></Error>", http.StatusMethodNotAllowed)
+	}
+}
+
+// Object returns the object stored at the path, which includes the bucket
+func (m *S3ServerMock) Object(path string) (S3ObjectMock, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[path]
+	return object, ok
+}
@@ -0,0 +1,59 @@
+package mocks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go_notion/backend/storage"
+	"io"
+	"sync"
+)
+
+// BlobStoreMock implements BlobStore interface for testing purposes, keeping the blobs in memory
+type BlobStoreMock struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func NewBlobStoreMock() *BlobStoreMock {
+	return &BlobStoreMock{blobs: make(map[string][]byte)}
+}
+
+func (b *BlobStoreMock) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) != size {
+		return fmt.Errorf("blob is %d bytes, expected %d", len(content), size)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blobs[key] = content
+	return nil
+}
+
+func (b *BlobStoreMock) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.blobs[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (b *BlobStoreMock) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.blobs, key)
+	return nil
+}
+
+// Has reports whether a blob is stored under the key
+func (b *BlobStoreMock) Has(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.blobs[key]
+	return ok
+}
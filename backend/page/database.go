@@ -0,0 +1,502 @@
+package page
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+type PropertyType string
+
+const (
+	PropertyText        PropertyType = "text"
+	PropertyNumber      PropertyType = "number"
+	PropertySelect      PropertyType = "select"
+	PropertyMultiSelect PropertyType = "multi_select"
+	PropertyDate        PropertyType = "date"
+	PropertyCheckbox    PropertyType = "checkbox"
+	PropertyRelation    PropertyType = "relation"
+)
+
+const (
+	MaxProperties = 100
+	MaxOptions    = 100
+	maxNameLength = 100
+)
+
+var propertyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Property is a column of a database, the values of its rows are stored in their properties under the property's id
+type Property struct {
+	ID   string       `json:"id"`
+	Name string       `json:"name"`
+	Type PropertyType `json:"type"`
+	// Options are the choices of select and multi_select properties
+	Options []string `json:"options,omitempty"`
+	// DatabaseID is the database whose rows relation properties point to
+	DatabaseID *uuid.UUID `json:"database_id,omitempty"`
+}
+
+// Schema is the ordered list of the properties of a database
+type Schema []Property
+
+// WithIDs gives the properties without an id a random one, so clients only need ids to keep a property when renaming it
+func (s Schema) WithIDs() (Schema, error) {
+	withIDs := make(Schema, len(s))
+	for i, property := range s {
+		if property.ID == "" {
+			id := make([]byte, 4)
+			if _, err := rand.Read(id); err != nil {
+				return nil, fmt.Errorf("failed to generate property id: %w", err)
+			}
+			property.ID = hex.EncodeToString(id)
+		}
+		withIDs[i] = property
+	}
+	return withIDs, nil
+}
+
+// Validate checks the properties have unique ids and names and the settings their type needs
+func (s Schema) Validate() error {
+	if len(s) > MaxProperties {
+		return fmt.Errorf("a database can have at most %d properties", MaxProperties)
+	}
+	ids := make(map[string]bool, len(s))
+	names := make(map[string]bool, len(s))
+	for _, property := range s {
+		if !propertyIDPattern.MatchString(property.ID) {
+			return fmt.Errorf("property id %q must be 1 to 64 letters, digits, dashes or underscores", property.ID)
+		}
+		if ids[property.ID] {
+			return fmt.Errorf("property id %q is used twice", property.ID)
+		}
+		ids[property.ID] = true
+
+		name := strings.TrimSpace(property.Name)
+		if name == "" || len(name) > maxNameLength {
+			return fmt.Errorf("property %q must have a name of at most %d characters", property.ID, maxNameLength)
+		}
+		if names[strings.ToLower(name)] {
+			return fmt.Errorf("property name %q is used twice", name)
+		}
+		names[strings.ToLower(name)] = true
+
+		switch property.Type {
+		case PropertySelect, PropertyMultiSelect:
+			if err := validateOptions(property); err != nil {
+				return err
+			}
+		case PropertyText, PropertyNumber, PropertyDate, PropertyCheckbox, PropertyRelation:
+			if len(property.Options) > 0 {
+				return fmt.Errorf("%s property %q cannot have options", property.Type, property.Name)
+			}
+		default:
+			return fmt.Errorf("property %q has unknown type %q", property.Name, property.Type)
+		}
+
+		if (property.Type == PropertyRelation) != (property.DatabaseID != nil) {
+			return fmt.Errorf("property %q: database_id is required for relation properties and only allowed for them", property.Name)
+		}
+	}
+	return nil
+}
+
+func validateOptions(property Property) error {
+	if len(property.Options) == 0 || len(property.Options) > MaxOptions {
+		return fmt.Errorf("%s property %q must have 1 to %d options", property.Type, property.Name, MaxOptions)
+	}
+	options := make(map[string]bool, len(property.Options))
+	for _, option := range property.Options {
+		if option == "" || len(option) > maxNameLength {
+			return fmt.Errorf("options of property %q must be 1 to %d characters", property.Name, maxNameLength)
+		}
+		if options[option] {
+			return fmt.Errorf("option %q of property %q is used twice", option, property.Name)
+		}
+		options[option] = true
+	}
+	return nil
+}
+
+// Property returns the property with the id
+func (s Schema) Property(id string) (Property, bool) {
+	for _, property := range s {
+		if property.ID == id {
+			return property, true
+		}
+	}
+	return Property{}, false
+}
+
+// ValidateValues checks the properties of a row against the schema and returns them normalized:
+// null values are dropped, dates are in UTC and lists have no duplicates.
+func (s Schema) ValidateValues(properties json.RawMessage) (json.RawMessage, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(properties, &values); err != nil || values == nil {
+		return nil, fmt.Errorf("properties must be a JSON object")
+	}
+
+	normalized := make(map[string]json.RawMessage, len(values))
+	for id, raw := range values {
+		property, ok := s.Property(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown property %q", id)
+		}
+		value, err := normalizeValue(property, raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for property %q: %w", property.Name, err)
+		}
+		if value != nil {
+			normalized[id] = value
+		}
+	}
+	return json.Marshal(normalized)
+}
+
+// Prune drops the values that don't fit the schema, after a property was removed or changed
+// or a page was moved into the database. It reports whether any value was dropped.
+func (s Schema) Prune(properties json.RawMessage) (json.RawMessage, bool) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(properties, &values); err != nil || values == nil {
+		return json.RawMessage("{}"), true
+	}
+	pruned := make(map[string]json.RawMessage, len(values))
+	for id, raw := range values {
+		property, ok := s.Property(id)
+		if !ok {
+			continue
+		}
+		if value, err := normalizeValue(property, raw); err == nil && value != nil {
+			pruned[id] = value
+		}
+	}
+	if len(pruned) == len(values) {
+		return properties, false
+	}
+	prunedProperties, err := json.Marshal(pruned)
+	if err != nil {
+		return json.RawMessage("{}"), true
+	}
+	return prunedProperties, true
+}
+
+// Relations returns the pages the relation values point to, by relation property id.
+// The properties must have been validated.
+func (s Schema) Relations(properties json.RawMessage) map[string][]uuid.UUID {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(properties, &values); err != nil {
+		return nil
+	}
+	relations := make(map[string][]uuid.UUID)
+	for _, property := range s {
+		raw, ok := values[property.ID]
+		if property.Type != PropertyRelation || !ok {
+			continue
+		}
+		var pageIDs []uuid.UUID
+		if err := json.Unmarshal(raw, &pageIDs); err == nil && len(pageIDs) > 0 {
+			relations[property.ID] = pageIDs
+		}
+	}
+	return relations
+}
+
+// normalizeValue returns the value in its stored form, or nil for null
+func normalizeValue(property Property, raw json.RawMessage) (json.RawMessage, error) {
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return nil, nil
+	}
+
+	switch property.Type {
+	case PropertyText:
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, fmt.Errorf("must be a string")
+		}
+		return json.Marshal(text)
+	case PropertyNumber:
+		var number float64
+		if err := json.Unmarshal(raw, &number); err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return json.Marshal(number)
+	case PropertyCheckbox:
+		var checked bool
+		if err := json.Unmarshal(raw, &checked); err != nil {
+			return nil, fmt.Errorf("must be a boolean")
+		}
+		return json.Marshal(checked)
+	case PropertyDate:
+		var date string
+		if err := json.Unmarshal(raw, &date); err != nil {
+			return nil, fmt.Errorf("must be a date string")
+		}
+		normalized, err := NormalizeDate(date)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(normalized)
+	case PropertySelect:
+		var option string
+		if err := json.Unmarshal(raw, &option); err != nil {
+			return nil, fmt.Errorf("must be a string")
+		}
+		if !hasOption(property, option) {
+			return nil, fmt.Errorf("%q is not an option", option)
+		}
+		return json.Marshal(option)
+	case PropertyMultiSelect:
+		var options []string
+		if err := json.Unmarshal(raw, &options); err != nil {
+			return nil, fmt.Errorf("must be a list of strings")
+		}
+		for _, option := range options {
+			if !hasOption(property, option) {
+				return nil, fmt.Errorf("%q is not an option", option)
+			}
+		}
+		return json.Marshal(unique(options))
+	case PropertyRelation:
+		var pageIDs []uuid.UUID
+		if err := json.Unmarshal(raw, &pageIDs); err != nil {
+			return nil, fmt.Errorf("must be a list of page ids")
+		}
+		return json.Marshal(unique(pageIDs))
+	default:
+		return nil, fmt.Errorf("unknown type %q", property.Type)
+	}
+}
+
+// NormalizeDate accepts a date like 2006-01-02 or a time in RFC 3339, which is converted to UTC
+// so dates and times sort and compare as strings
+func NormalizeDate(date string) (string, error) {
+	if _, err := time.Parse(time.DateOnly, date); err == nil {
+		return date, nil
+	}
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a date like 2006-01-02 or 2006-01-02T15:04:05Z", date)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+func hasOption(property Property, option string) bool {
+	for _, o := range property.Options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+func unique[T comparable](values []T) []T {
+	seen := make(map[T]bool, len(values))
+	uniqueValues := make([]T, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			uniqueValues = append(uniqueValues, value)
+		}
+	}
+	return uniqueValues
+}
+
+const (
+	FilterEq       = "eq"
+	FilterNeq      = "neq"
+	FilterContains = "contains"
+	FilterGt       = "gt"
+	FilterGte      = "gte"
+	FilterLt       = "lt"
+	FilterLte      = "lte"
+	FilterEmpty    = "empty"
+	FilterNotEmpty = "not_empty"
+)
+
+// filterOperators are the operators each type of property can be filtered with
+var filterOperators = map[PropertyType][]string{
+	PropertyText:        {FilterEq, FilterNeq, FilterContains, FilterEmpty, FilterNotEmpty},
+	PropertyNumber:      {FilterEq, FilterNeq, FilterGt, FilterGte, FilterLt, FilterLte, FilterEmpty, FilterNotEmpty},
+	PropertySelect:      {FilterEq, FilterNeq, FilterEmpty, FilterNotEmpty},
+	PropertyMultiSelect: {FilterContains, FilterEmpty, FilterNotEmpty},
+	PropertyDate:        {FilterEq, FilterNeq, FilterGt, FilterGte, FilterLt, FilterLte, FilterEmpty, FilterNotEmpty},
+	PropertyCheckbox:    {FilterEq, FilterNeq},
+	PropertyRelation:    {FilterContains, FilterEmpty, FilterNotEmpty},
+}
+
+var comparisons = map[string]string{FilterEq: "=", FilterGt: ">", FilterGte: ">=", FilterLt: "<", FilterLte: "<="}
+
+// RowFilter keeps the rows whose value of the property matches
+type RowFilter struct {
+	PropertyID string
+	Operator   string
+	Value      string
+}
+
+// ParseRowFilter parses filters written as property:operator:value, the value is left out for empty and not_empty
+func ParseRowFilter(filter string) (RowFilter, error) {
+	parts := strings.SplitN(filter, ":", 3)
+	if len(parts) < 2 {
+		return RowFilter{}, fmt.Errorf("filter %q must be property:operator:value", filter)
+	}
+	rowFilter := RowFilter{PropertyID: parts[0], Operator: parts[1]}
+	if len(parts) == 3 {
+		rowFilter.Value = parts[2]
+	}
+	return rowFilter, nil
+}
+
+type RowSort struct {
+	PropertyID string
+	Descending bool
+}
+
+// ParseRowSort parses sorts written as property, property:asc or property:desc
+func ParseRowSort(sort string) (RowSort, error) {
+	id, direction, _ := strings.Cut(sort, ":")
+	switch direction {
+	case "", "asc":
+		return RowSort{PropertyID: id}, nil
+	case "desc":
+		return RowSort{PropertyID: id, Descending: true}, nil
+	default:
+		return RowSort{}, fmt.Errorf("sort %q must be property:asc or property:desc", sort)
+	}
+}
+
+// RowQuery turns the filters and sorts into a condition and an order on the pages table.
+// The values are passed as parameters numbered after args, which are returned with them appended.
+// Rows without a value come last whatever the direction, ties keep the order of the pages.
+func (s Schema) RowQuery(filters []RowFilter, sorts []RowSort, args []any) (string, string, []any, error) {
+	param := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conditions := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		property, ok := s.Property(filter.PropertyID)
+		if !ok {
+			return "", "", nil, fmt.Errorf("unknown property %q", filter.PropertyID)
+		}
+		if !hasOperator(property.Type, filter.Operator) {
+			return "", "", nil, fmt.Errorf("%s properties can't be filtered with %q", property.Type, filter.Operator)
+		}
+
+		key := param(property.ID)
+		value := "pages.properties->" + key
+		text := "pages.properties->>" + key
+		if filter.Operator == FilterEmpty || filter.Operator == FilterNotEmpty {
+			empty := "COALESCE(" + value + ` IN ('null'::jsonb, '""'::jsonb, '[]'::jsonb), true)`
+			if filter.Operator == FilterNotEmpty {
+				empty = "NOT " + empty
+			}
+			conditions = append(conditions, empty)
+			continue
+		}
+
+		var condition string
+		switch property.Type {
+		case PropertyText, PropertySelect:
+			switch filter.Operator {
+			case FilterContains:
+				condition = "strpos(lower(" + text + "), lower(" + param(filter.Value) + ")) > 0"
+			case FilterNeq:
+				condition = text + " IS DISTINCT FROM " + param(filter.Value)
+			default:
+				condition = text + " = " + param(filter.Value)
+			}
+		case PropertyNumber:
+			number, err := strconv.ParseFloat(filter.Value, 64)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("filter on %q needs a number", property.Name)
+			}
+			condition = numberExpression(value, text) + comparison(filter.Operator) + param(number) + "::numeric"
+		case PropertyDate:
+			date, err := NormalizeDate(filter.Value)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("filter on %q: %w", property.Name, err)
+			}
+			condition = text + comparison(filter.Operator) + param(date)
+		case PropertyCheckbox:
+			checked, err := strconv.ParseBool(filter.Value)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("filter on %q needs true or false", property.Name)
+			}
+			// rows without a value are unchecked
+			condition = checkboxExpression(value) + comparison(filter.Operator) + param(checked)
+		case PropertyMultiSelect, PropertyRelation:
+			condition = "COALESCE(" + value + " @> jsonb_build_array(" + param(filter.Value) + "::text), false)"
+		}
+		conditions = append(conditions, condition)
+	}
+
+	orders := make([]string, 0, len(sorts)+2)
+	for _, sort := range sorts {
+		property, ok := s.Property(sort.PropertyID)
+		if !ok {
+			return "", "", nil, fmt.Errorf("unknown property %q", sort.PropertyID)
+		}
+		key := param(property.ID)
+		value := "pages.properties->" + key
+		text := "pages.properties->>" + key
+
+		var expression string
+		switch property.Type {
+		case PropertyText, PropertySelect, PropertyDate:
+			expression = text
+		case PropertyNumber:
+			expression = numberExpression(value, text)
+		case PropertyCheckbox:
+			expression = checkboxExpression(value)
+		default:
+			return "", "", nil, fmt.Errorf("%s properties can't be sorted", property.Type)
+		}
+		direction := "ASC"
+		if sort.Descending {
+			direction = "DESC"
+		}
+		orders = append(orders, expression+" "+direction+" NULLS LAST")
+	}
+	orders = append(orders, "pages.position", "pages.id")
+
+	where := "true"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+	return where, strings.Join(orders, ", "), args, nil
+}
+
+func hasOperator(propertyType PropertyType, operator string) bool {
+	for _, o := range filterOperators[propertyType] {
+		if o == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// comparison is the SQL operator of the filter, neq treats a missing value as different
+func comparison(operator string) string {
+	if operator == FilterNeq {
+		return " IS DISTINCT FROM "
+	}
+	return " " + comparisons[operator] + " "
+}
+
+// numberExpression is the value as a number, values of another type are treated as missing
+func numberExpression(value, text string) string {
+	return "(CASE WHEN jsonb_typeof(" + value + ") = 'number' THEN (" + text + ")::numeric END)"
+}
+
+func checkboxExpression(value string) string {
+	return "COALESCE(" + value + " = 'true'::jsonb, false)"
+}
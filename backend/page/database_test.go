@@ -0,0 +1,168 @@
+package page_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/page"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSchema() page.Schema {
+	databaseID := uuid.Must(uuid.NewV4())
+	return page.Schema{
+		{ID: "notes", Name: "Notes", Type: page.PropertyText},
+		{ID: "points", Name: "Points", Type: page.PropertyNumber},
+		{ID: "status", Name: "Status", Type: page.PropertySelect, Options: []string{"Todo", "Done"}},
+		{ID: "tags", Name: "Tags", Type: page.PropertyMultiSelect, Options: []string{"bug", "feature"}},
+		{ID: "due", Name: "Due", Type: page.PropertyDate},
+		{ID: "done", Name: "Done", Type: page.PropertyCheckbox},
+		{ID: "blocked_by", Name: "Blocked by", Type: page.PropertyRelation, DatabaseID: &databaseID},
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	assert.NoError(t, testSchema().Validate())
+
+	databaseID := uuid.Must(uuid.NewV4())
+	tests := []struct {
+		name   string
+		schema page.Schema
+	}{
+		{"invalid id", page.Schema{{ID: "a b", Name: "A", Type: page.PropertyText}}},
+		{"duplicate id", page.Schema{{ID: "a", Name: "A", Type: page.PropertyText}, {ID: "a", Name: "B", Type: page.PropertyText}}},
+		{"duplicate name", page.Schema{{ID: "a", Name: "Name", Type: page.PropertyText}, {ID: "b", Name: "name", Type: page.PropertyNumber}}},
+		{"missing name", page.Schema{{ID: "a", Name: " ", Type: page.PropertyText}}},
+		{"unknown type", page.Schema{{ID: "a", Name: "A", Type: "formula"}}},
+		{"select without options", page.Schema{{ID: "a", Name: "A", Type: page.PropertySelect}}},
+		{"duplicate options", page.Schema{{ID: "a", Name: "A", Type: page.PropertySelect, Options: []string{"x", "x"}}}},
+		{"options on text", page.Schema{{ID: "a", Name: "A", Type: page.PropertyText, Options: []string{"x"}}}},
+		{"relation without database", page.Schema{{ID: "a", Name: "A", Type: page.PropertyRelation}}},
+		{"database on text", page.Schema{{ID: "a", Name: "A", Type: page.PropertyText, DatabaseID: &databaseID}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, tt.schema.Validate())
+		})
+	}
+}
+
+func TestSchemaWithIDs(t *testing.T) {
+	schema, err := page.Schema{{ID: "kept", Name: "A"}, {Name: "B"}}.WithIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "kept", schema[0].ID)
+	assert.Len(t, schema[1].ID, 8)
+}
+
+func TestSchemaValidateValues(t *testing.T) {
+	schema := testSchema()
+	relatedID := uuid.Must(uuid.NewV4())
+
+	normalized, err := schema.ValidateValues(json.RawMessage(`{
+		"notes": "hello", "points": 3, "status": "Done", "tags": ["bug", "bug"], "due": "2024-05-01T12:00:00+02:00",
+		"done": true, "blocked_by": ["` + relatedID.String() + `"], "notes": null
+	}`))
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{
+			"points": 3, "status": "Done", "tags": ["bug"], "due": "2024-05-01T10:00:00Z", "done": true, "blocked_by": ["`+relatedID.String()+`"]
+		}`, string(normalized))
+	}
+	assert.Equal(t, map[string][]uuid.UUID{"blocked_by": {relatedID}}, schema.Relations(normalized))
+
+	invalid := []string{
+		`[]`,
+		`{"unknown": "x"}`,
+		`{"notes": 1}`,
+		`{"points": "3"}`,
+		`{"status": "Doing"}`,
+		`{"tags": ["bug", "chore"]}`,
+		`{"due": "01/05/2024"}`,
+		`{"done": "yes"}`,
+		`{"blocked_by": ["not a uuid"]}`,
+	}
+	for _, properties := range invalid {
+		t.Run(properties, func(t *testing.T) {
+			_, err := schema.ValidateValues(json.RawMessage(properties))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSchemaPrune(t *testing.T) {
+	schema := testSchema()
+
+	kept := json.RawMessage(`{"status": "Done"}`)
+	pruned, changed := schema.Prune(kept)
+	assert.False(t, changed)
+	assert.Equal(t, kept, pruned)
+
+	pruned, changed = schema.Prune(json.RawMessage(`{"status": "Doing", "points": 2, "removed": true}`))
+	assert.True(t, changed)
+	assert.JSONEq(t, `{"points": 2}`, string(pruned))
+}
+
+func TestParseRowFilterAndSort(t *testing.T) {
+	filter, err := page.ParseRowFilter("due:gte:2024-05-01T10:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, page.RowFilter{PropertyID: "due", Operator: page.FilterGte, Value: "2024-05-01T10:00:00Z"}, filter)
+
+	filter, err = page.ParseRowFilter("notes:empty")
+	assert.NoError(t, err)
+	assert.Equal(t, page.RowFilter{PropertyID: "notes", Operator: page.FilterEmpty}, filter)
+
+	_, err = page.ParseRowFilter("notes")
+	assert.Error(t, err)
+
+	sort, err := page.ParseRowSort("points:desc")
+	assert.NoError(t, err)
+	assert.Equal(t, page.RowSort{PropertyID: "points", Descending: true}, sort)
+
+	_, err = page.ParseRowSort("points:up")
+	assert.Error(t, err)
+}
+
+func TestSchemaRowQuery(t *testing.T) {
+	schema := testSchema()
+
+	where, orderBy, args, err := schema.RowQuery(
+		[]page.RowFilter{{PropertyID: "points", Operator: page.FilterGt, Value: "2"}, {PropertyID: "tags", Operator: page.FilterContains, Value: "bug"}},
+		[]page.RowSort{{PropertyID: "due", Descending: true}},
+		[]any{"database id"},
+	)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "(CASE WHEN jsonb_typeof(pages.properties->$2) = 'number' THEN (pages.properties->>$2)::numeric END) > $3::numeric"+
+			" AND COALESCE(pages.properties->$4 @> jsonb_build_array($5::text), false)", where)
+		assert.Equal(t, "pages.properties->>$6 DESC NULLS LAST, pages.position, pages.id", orderBy)
+		assert.Equal(t, []any{"database id", "points", 2.0, "tags", "bug", "due"}, args)
+	}
+
+	where, orderBy, args, err = schema.RowQuery(nil, nil, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "true", where)
+		assert.Equal(t, "pages.position, pages.id", orderBy)
+		assert.Empty(t, args)
+	}
+
+	invalid := []struct {
+		name    string
+		filters []page.RowFilter
+		sorts   []page.RowSort
+	}{
+		{"unknown property", []page.RowFilter{{PropertyID: "unknown", Operator: page.FilterEq}}, nil},
+		{"operator not allowed for type", []page.RowFilter{{PropertyID: "status", Operator: page.FilterGt, Value: "Todo"}}, nil},
+		{"not a number", []page.RowFilter{{PropertyID: "points", Operator: page.FilterEq, Value: "many"}}, nil},
+		{"not a date", []page.RowFilter{{PropertyID: "due", Operator: page.FilterLt, Value: "soon"}}, nil},
+		{"not a boolean", []page.RowFilter{{PropertyID: "done", Operator: page.FilterEq, Value: "maybe"}}, nil},
+		{"sort by unknown property", nil, []page.RowSort{{PropertyID: "unknown"}}},
+		{"sort by list", nil, []page.RowSort{{PropertyID: "tags"}}},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := schema.RowQuery(tt.filters, tt.sorts, nil)
+			assert.Error(t, err)
+		})
+	}
+}
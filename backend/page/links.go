@@ -0,0 +1,66 @@
+package page
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+var pageHrefRegexp = regexp.MustCompile(`(?:^|/)pages/([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})`)
+
+// ExtractPageLinks returns the ids of the pages referenced in the editor content, without duplicates.
+// A page is referenced either by a "pageLink" node carrying its id in attrs.page_id (or attrs.pageId),
+// or by a link whose href points at /pages/<id>.
+func ExtractPageLinks(content json.RawMessage) []uuid.UUID {
+	var doc any
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	links := []uuid.UUID{}
+	add := func(value any) {
+		s, ok := value.(string)
+		if !ok {
+			return
+		}
+		id, err := uuid.FromString(s)
+		if err != nil || seen[id] {
+			return
+		}
+		seen[id] = true
+		links = append(links, id)
+	}
+
+	var walk func(node any)
+	walk = func(node any) {
+		switch n := node.(type) {
+		case []any:
+			for _, child := range n {
+				walk(child)
+			}
+		case map[string]any:
+			if n["type"] == "pageLink" {
+				if attrs, ok := n["attrs"].(map[string]any); ok {
+					if id, ok := attrs["page_id"]; ok {
+						add(id)
+					} else {
+						add(attrs["pageId"])
+					}
+				}
+			}
+			if href, ok := n["href"].(string); ok {
+				if match := pageHrefRegexp.FindStringSubmatch(href); match != nil {
+					add(match[1])
+				}
+			}
+			for _, child := range n {
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+
+	return links
+}
@@ -0,0 +1,61 @@
+package page_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/page"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractPageLinks(t *testing.T) {
+	first := uuid.Must(uuid.NewV4())
+	second := uuid.Must(uuid.NewV4())
+
+	tests := []struct {
+		name     string
+		content  string
+		expected []uuid.UUID
+	}{
+		{
+			name:     "no links",
+			content:  `{"type": "doc", "content": [{"type": "paragraph", "content": [{"type": "text", "text": "hello"}]}]}`,
+			expected: []uuid.UUID{},
+		},
+		{
+			name: "page link nodes",
+			content: `{"type": "doc", "content": [
+				{"type": "pageLink", "attrs": {"page_id": "` + first.String() + `"}},
+				{"type": "paragraph", "content": [{"type": "pageLink", "attrs": {"pageId": "` + second.String() + `"}}]}
+			]}`,
+			expected: []uuid.UUID{first, second},
+		},
+		{
+			name: "hrefs to pages",
+			content: `{"type": "doc", "content": [{"type": "text", "text": "see", "marks": [
+				{"type": "link", "attrs": {"href": "https://example.com/pages/` + first.String() + `?x=1"}},
+				{"type": "link", "attrs": {"href": "/pages/` + first.String() + `"}},
+				{"type": "link", "attrs": {"href": "https://example.com/other/` + second.String() + `"}}
+			]}]}`,
+			expected: []uuid.UUID{first},
+		},
+		{
+			name:     "invalid ids are ignored",
+			content:  `{"type": "pageLink", "attrs": {"page_id": "not-a-uuid"}}`,
+			expected: []uuid.UUID{},
+		},
+		{
+			name:     "invalid json",
+			content:  `{`,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links := page.ExtractPageLinks(json.RawMessage(tt.content))
+			assert.ElementsMatch(t, tt.expected, links)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package page
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// ExtractMentions returns the ids of the users mentioned in the editor content, without duplicates.
+// A mention is a "mention" node carrying the user id in attrs.user_id (or attrs.id).
+func ExtractMentions(content json.RawMessage) []int64 {
+	var doc any
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil
+	}
+
+	seen := make(map[int64]bool)
+	mentions := []int64{}
+	add := func(value any) {
+		var id int64
+		switch v := value.(type) {
+		case float64:
+			if v != float64(int64(v)) {
+				return
+			}
+			id = int64(v)
+		case string:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return
+			}
+			id = parsed
+		default:
+			return
+		}
+		if id <= 0 || seen[id] {
+			return
+		}
+		seen[id] = true
+		mentions = append(mentions, id)
+	}
+
+	var walk func(node any)
+	walk = func(node any) {
+		switch n := node.(type) {
+		case []any:
+			for _, child := range n {
+				walk(child)
+			}
+		case map[string]any:
+			if n["type"] == "mention" {
+				if attrs, ok := n["attrs"].(map[string]any); ok {
+					if id, ok := attrs["user_id"]; ok {
+						add(id)
+					} else {
+						add(attrs["id"])
+					}
+				}
+			}
+			for _, child := range n {
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+
+	return mentions
+}
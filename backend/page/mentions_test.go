@@ -0,0 +1,43 @@
+package page_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/page"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractMentions(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []int64
+	}{
+		{
+			name:     "no mentions",
+			content:  `{"type": "doc", "content": [{"type": "text", "text": "@someone"}]}`,
+			expected: []int64{},
+		},
+		{
+			name: "nested mentions",
+			content: `{"type": "doc", "content": [
+				{"type": "paragraph", "content": [{"type": "mention", "attrs": {"user_id": 2}}]},
+				{"type": "mention", "attrs": {"id": "3"}},
+				{"type": "mention", "attrs": {"user_id": 2}}
+			]}`,
+			expected: []int64{2, 3},
+		},
+		{
+			name:     "invalid ids are ignored",
+			content:  `{"type": "doc", "content": [{"type": "mention", "attrs": {"user_id": 1.5}}, {"type": "mention", "attrs": {"id": "abc"}}, {"type": "mention", "attrs": {"id": -1}}]}`,
+			expected: []int64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ElementsMatch(t, tt.expected, page.ExtractMentions(json.RawMessage(tt.content)))
+		})
+	}
+}
@@ -16,8 +16,13 @@ type Page struct {
 	Content     *json.RawMessage `json:"content"`
 	TextTitle   *string          `json:"text_title"`
 	TextContent *string          `json:"text_content"`
+	Icon        *string          `json:"icon"`
+	Cover       *string          `json:"cover"`
+	Properties  json.RawMessage  `json:"properties"`
 	CreatedAt   time.Time        `json:"created_at"`
 	UpdatedAt   time.Time        `json:"updated_at"`
+	// LastEditedBy is nil when the user was deleted
+	LastEditedBy *int64 `json:"last_edited_by"`
 }
 
 func GetPages(ctx context.Context, db *pgxpool.Pool, whereClause string, args ...any) ([]Page, error) {
@@ -33,7 +38,7 @@ func GetPages(ctx context.Context, db *pgxpool.Pool, whereClause string, args ..
 	}
 	defer tx.Rollback(ctx)
 
-	var query = "SELECT id, title, content, text_title, text_content, created_at, updated_at FROM pages WHERE " + whereClause
+	var query = "SELECT id, title, content, text_title, text_content, icon, cover, properties, created_at, updated_at, last_edited_by FROM pages WHERE " + whereClause
 
 	rows, err := tx.Query(ctx, query, args...)
 	if err != nil {
@@ -44,7 +49,7 @@ func GetPages(ctx context.Context, db *pgxpool.Pool, whereClause string, args ..
 	var pages []Page
 	for rows.Next() {
 		var p Page
-		if err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.TextTitle, &p.TextContent, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.TextTitle, &p.TextContent, &p.Icon, &p.Cover, &p.Properties, &p.CreatedAt, &p.UpdatedAt, &p.LastEditedBy); err != nil {
 			return nil, err
 		}
 		pages = append(pages, p)
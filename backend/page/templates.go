@@ -0,0 +1,59 @@
+package page
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([a-zA-Z_]+)\s*\}\}`)
+
+// ReplacePlaceholders replaces the {{name}} placeholders of a template with their values.
+// Placeholders without a value are left as they are.
+func ReplacePlaceholders(text string, values map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := placeholderPattern.FindStringSubmatch(placeholder)[1]
+		if value, ok := values[name]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// ReplaceContentPlaceholders replaces the placeholders in the strings of the editor content,
+// keys are left alone. Content that isn't valid JSON is returned unchanged.
+func ReplaceContentPlaceholders(content json.RawMessage, values map[string]string) json.RawMessage {
+	if len(content) == 0 || !placeholderPattern.Match(content) {
+		return content
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return content
+	}
+
+	var replace func(node any) any
+	replace = func(node any) any {
+		switch n := node.(type) {
+		case string:
+			return ReplacePlaceholders(n, values)
+		case map[string]any:
+			for key, value := range n {
+				n[key] = replace(value)
+			}
+		case []any:
+			for i, value := range n {
+				n[i] = replace(value)
+			}
+		}
+		return node
+	}
+
+	replaced, err := json.Marshal(replace(doc))
+	if err != nil {
+		return content
+	}
+	return replaced
+}
@@ -0,0 +1,48 @@
+package page_test
+
+import (
+	"encoding/json"
+	"go_notion/backend/page"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplacePlaceholders(t *testing.T) {
+	values := map[string]string{"date": "2024-05-01", "user": "alice"}
+
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"no placeholders", "Meeting notes", "Meeting notes"},
+		{"several placeholders", "{{date}} notes by {{ user }}", "2024-05-01 notes by alice"},
+		{"unknown placeholder", "{{date}} {{project}}", "2024-05-01 {{project}}"},
+		{"unclosed placeholder", "{{date", "{{date"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, page.ReplacePlaceholders(tt.text, values))
+		})
+	}
+}
+
+func TestReplaceContentPlaceholders(t *testing.T) {
+	values := map[string]string{"user": `bob "the builder"`}
+
+	content := json.RawMessage(`{"type": "doc", "content": [
+		{"type": "heading", "attrs": {"level": 1}, "content": [{"type": "text", "text": "Owner: {{user}}"}]},
+		{"{{user}}": "keys are kept"}
+	]}`)
+	replaced := page.ReplaceContentPlaceholders(content, values)
+
+	assert.JSONEq(t, `{"type": "doc", "content": [
+		{"type": "heading", "attrs": {"level": 1}, "content": [{"type": "text", "text": "Owner: bob \"the builder\""}]},
+		{"{{user}}": "keys are kept"}
+	]}`, string(replaced))
+
+	invalid := json.RawMessage(`{"text": "{{user}}"`)
+	assert.Equal(t, invalid, page.ReplaceContentPlaceholders(invalid, values))
+	assert.Nil(t, page.ReplaceContentPlaceholders(nil, values))
+}
@@ -0,0 +1,120 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Channel is the postgres channel page events are sent on
+const Channel = "page_events"
+
+type EventType string
+
+const (
+	EventPageCreated    EventType = "page.created"
+	EventPageUpdated    EventType = "page.updated"
+	EventPageDeleted    EventType = "page.deleted"
+	EventPageMoved      EventType = "page.moved"
+	EventPageDuplicated EventType = "page.duplicated"
+	// EventDocumentUpdate relays merged collaborative edits to the other editors of the page
+	EventDocumentUpdate EventType = "document.update"
+	// EventDocumentReset tells editors the page content was replaced as a whole and they should join again
+	EventDocumentReset EventType = "document.reset"
+	// EventResync tells clients events may have been missed and they should refetch what they show
+	EventResync EventType = "resync"
+)
+
+// Event is kept to ids only, clients refetch what they need. Notify payloads are limited to 8000 bytes.
+type Event struct {
+	// ID is the position of the event in the page_events log
+	ID          int64       `json:"id,omitempty"`
+	Type        EventType   `json:"type"`
+	WorkspaceID int64       `json:"workspace_id,omitempty"`
+	PageIDs     []uuid.UUID `json:"page_ids,omitempty"`
+	ActorID     int64       `json:"actor_id,omitempty"`
+	// ClientID is the editor session a document update comes from, so it can ignore its own updates
+	ClientID string `json:"client_id,omitempty"`
+	// Document holds the merged writes of a document update, it is left out when too large to relay
+	// and editors then join again to get the whole state
+	Document json.RawMessage `json:"document,omitempty"`
+}
+
+// maxRelayPayload keeps relayed documents under the 8000 bytes postgres allows in a notification
+const maxRelayPayload = 7500
+
+type Querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type Reader interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Publish records the event in the page_events log, it is sent to every server instance when the transaction
+// commits so publishing along with the change it describes never announces a change that was rolled back.
+// Events get their id at commit, in commit order, so a client resuming after an id can't miss an event that
+// committed later. Numbering and sending is done by the page_events_publish trigger.
+func Publish(ctx context.Context, q Querier, event Event) error {
+	pageIDs := event.PageIDs
+	if pageIDs == nil {
+		pageIDs = []uuid.UUID{}
+	}
+	var actorID *int64
+	if event.ActorID != 0 {
+		actorID = &event.ActorID
+	}
+	_, err := q.Exec(ctx, `
+		INSERT INTO page_events (type, workspace_id, page_ids, actor_id) VALUES ($1, $2, $3, $4)
+	`, event.Type, event.WorkspaceID, pageIDs, actorID)
+	if err != nil {
+		return fmt.Errorf("failed to record event: %w", err)
+	}
+	return nil
+}
+
+// Relay sends the event to every server instance without recording it in the log,
+// for events that only matter to the clients connected right now
+func Relay(ctx context.Context, q Querier, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	if len(payload) > maxRelayPayload {
+		event.Document = nil
+		if payload, err = json.Marshal(event); err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+	}
+	if _, err := q.Exec(ctx, `SELECT pg_notify($1, $2)`, Channel, string(payload)); err != nil {
+		return fmt.Errorf("failed to relay event: %w", err)
+	}
+	return nil
+}
+
+// ReadEvents returns the events of the workspaces logged after the given id, oldest first
+func ReadEvents(ctx context.Context, q Reader, afterID int64, workspaceIDs []int64, limit int) ([]Event, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, type, workspace_id, page_ids, COALESCE(actor_id, 0) FROM page_events
+		WHERE id > $1 AND workspace_id = ANY($2)
+		ORDER BY id
+		LIMIT $3
+	`, afterID, workspaceIDs, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Event, error) {
+		var event Event
+		err := row.Scan(&event.ID, &event.Type, &event.WorkspaceID, &event.PageIDs, &event.ActorID)
+		return event, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,115 @@
+package realtime_test
+
+import (
+	"context"
+	"go_notion/backend/db"
+	"go_notion/backend/realtime"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	pool, err := db.OpenTestDb(db.InsertTestUserFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var workspaceID int64
+	if err := pool.QueryRow(ctx, `SELECT workspace_id FROM workspace_members WHERE user_id = 1`).Scan(&workspaceID); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := realtime.NewHub()
+	go hub.Listen(ctx, pool)
+	client := hub.Register(1)
+	defer hub.Unregister(client)
+	client.SubscribeWorkspace(workspaceID)
+	// the listener needs a moment to LISTEN before anything is published
+	time.Sleep(100 * time.Millisecond)
+
+	next := func() (realtime.Event, bool) {
+		select {
+		case event := <-client.Events():
+			return event, true
+		case <-time.After(2 * time.Second):
+			return realtime.Event{}, false
+		}
+	}
+
+	t.Run("splits large events and sends them on commit", func(t *testing.T) {
+		pageIDs := make([]uuid.UUID, 250)
+		for i := range pageIDs {
+			pageIDs[i] = uuid.Must(uuid.NewV4())
+		}
+
+		tx, err := pool.BeginTx(ctx, pgx.TxOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+		err = realtime.Publish(ctx, tx, realtime.Event{Type: realtime.EventPageDeleted, WorkspaceID: workspaceID, PageIDs: pageIDs, ActorID: 1})
+		assert.NoError(t, err)
+		_, ok := receive(client)
+		assert.False(t, ok, "nothing is sent before commit")
+		assert.NoError(t, tx.Commit(ctx))
+
+		var received []uuid.UUID
+		var ids []int64
+		for range 3 {
+			event, ok := next()
+			if !assert.True(t, ok) {
+				return
+			}
+			assert.Equal(t, realtime.EventPageDeleted, event.Type)
+			assert.Equal(t, workspaceID, event.WorkspaceID)
+			assert.Equal(t, int64(1), event.ActorID)
+			received = append(received, event.PageIDs...)
+			ids = append(ids, event.ID)
+		}
+		assert.Equal(t, pageIDs, received)
+		assert.Positive(t, ids[0])
+		assert.Equal(t, []int64{ids[0], ids[0], ids[0]}, ids)
+	})
+
+	t.Run("numbers events in commit order", func(t *testing.T) {
+		first, err := pool.BeginTx(ctx, pgx.TxOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer first.Rollback(ctx)
+		second, err := pool.BeginTx(ctx, pgx.TxOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer second.Rollback(ctx)
+
+		firstPage, secondPage := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+		assert.NoError(t, realtime.Publish(ctx, first, realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: workspaceID, PageIDs: []uuid.UUID{firstPage}}))
+		assert.NoError(t, realtime.Publish(ctx, second, realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: workspaceID, PageIDs: []uuid.UUID{secondPage}}))
+		assert.NoError(t, second.Commit(ctx))
+		assert.NoError(t, first.Commit(ctx))
+
+		committedFirst, ok := next()
+		assert.True(t, ok)
+		committedSecond, ok := next()
+		assert.True(t, ok)
+		assert.Equal(t, []uuid.UUID{secondPage}, committedFirst.PageIDs)
+		assert.Equal(t, []uuid.UUID{firstPage}, committedSecond.PageIDs)
+		assert.Greater(t, committedSecond.ID, committedFirst.ID)
+
+		events, err := realtime.ReadEvents(ctx, pool, committedFirst.ID-1, []int64{workspaceID}, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, committedFirst.ID, events[0].ID)
+			assert.Equal(t, committedSecond.ID, events[1].ID)
+		}
+	})
+}
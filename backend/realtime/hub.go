@@ -0,0 +1,232 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// clientBuffer is how many events a client can fall behind before it is disconnected
+const clientBuffer = 64
+
+// Client is a single connection. It receives the events of the pages and workspaces it subscribed to.
+type Client struct {
+	UserID int64
+
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+
+	mu         sync.RWMutex
+	all        bool
+	pages      map[uuid.UUID]bool
+	workspaces map[int64]bool
+}
+
+// Events delivers the client's events, stop reading once Done is closed
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Done is closed when the hub drops the client, for example because it fell too far behind
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) SubscribePage(pageID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages[pageID] = true
+}
+
+func (c *Client) UnsubscribePage(pageID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pages, pageID)
+}
+
+// SubscribeWorkspace subscribes to the sidebar tree of the workspace, any page created, moved or deleted in it
+func (c *Client) SubscribeWorkspace(workspaceID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workspaces[workspaceID] = true
+}
+
+func (c *Client) UnsubscribeWorkspace(workspaceID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.workspaces, workspaceID)
+}
+
+// SubscribeAll subscribes to every event, for clients that filter them against the user's access themselves
+func (c *Client) SubscribeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.all = true
+}
+
+// SubscribedPages returns the pages of the event the client subscribed to
+func (c *Client) SubscribedPages(event Event) []uuid.UUID {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var pageIDs []uuid.UUID
+	for _, pageID := range event.PageIDs {
+		if c.pages[pageID] {
+			pageIDs = append(pageIDs, pageID)
+		}
+	}
+	return pageIDs
+}
+
+// SubscribedWorkspace reports whether the client subscribed to the workspace of the event
+func (c *Client) SubscribedWorkspace(event Event) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return event.WorkspaceID != 0 && c.workspaces[event.WorkspaceID]
+}
+
+func (c *Client) wants(event Event) bool {
+	if event.Type == EventResync {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.all {
+		return true
+	}
+	if event.WorkspaceID != 0 && c.workspaces[event.WorkspaceID] {
+		return true
+	}
+	for _, pageID := range event.PageIDs {
+		if c.pages[pageID] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*Client]struct{})}
+}
+
+func (h *Hub) Register(userID int64) *Client {
+	client := &Client{
+		UserID:     userID,
+		events:     make(chan Event, clientBuffer),
+		done:       make(chan struct{}),
+		pages:      make(map[uuid.UUID]bool),
+		workspaces: make(map[int64]bool),
+	}
+	h.mu.Lock()
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+	return client
+}
+
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	delete(h.clients, client)
+	h.mu.Unlock()
+	client.close()
+}
+
+// Close drops every client, hijacked websocket connections are not closed by the http server's shutdown
+func (h *Hub) Close() {
+	h.mu.Lock()
+	clients := h.clients
+	h.clients = make(map[*Client]struct{})
+	h.mu.Unlock()
+
+	for client := range clients {
+		client.close()
+	}
+}
+
+// Broadcast delivers the event to the clients of this instance subscribed to it.
+// A client that can't keep up is dropped rather than blocking everyone else.
+func (h *Hub) Broadcast(event Event) {
+	h.mu.RLock()
+	var slow []*Client
+	for client := range h.clients {
+		if !client.wants(event) {
+			continue
+		}
+		select {
+		case client.events <- event:
+		default:
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range slow {
+		h.Unregister(client)
+	}
+}
+
+// Listen broadcasts the events published on the postgres channel until the context is done.
+// The connection is reestablished when lost, and clients are told to resync since events may have been missed meanwhile.
+func (h *Hub) Listen(ctx context.Context, pool *pgxpool.Pool) error {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := h.listen(ctx, pool)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("realtime listener error, retrying in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+		h.Broadcast(Event{Type: EventResync})
+	}
+}
+
+func (h *Hub) listen(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// the connection is in LISTEN mode, it can't go back to the pool for others to use
+	defer conn.Hijack().Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			log.Printf("realtime: invalid event payload: %v", err)
+			continue
+		}
+		h.Broadcast(event)
+	}
+}
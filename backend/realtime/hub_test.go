@@ -0,0 +1,71 @@
+package realtime_test
+
+import (
+	"go_notion/backend/realtime"
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(client *realtime.Client) (realtime.Event, bool) {
+	select {
+	case event := <-client.Events():
+		return event, true
+	default:
+		return realtime.Event{}, false
+	}
+}
+
+func TestBroadcastOnlyReachesSubscribers(t *testing.T) {
+	hub := realtime.NewHub()
+	pageID := uuid.Must(uuid.NewV4())
+
+	pageClient := hub.Register(1)
+	pageClient.SubscribePage(pageID)
+	treeClient := hub.Register(2)
+	treeClient.SubscribeWorkspace(10)
+	otherClient := hub.Register(3)
+	otherClient.SubscribeWorkspace(20)
+
+	hub.Broadcast(realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: 10, PageIDs: []uuid.UUID{pageID}})
+
+	event, ok := receive(pageClient)
+	assert.True(t, ok)
+	assert.Equal(t, realtime.EventPageUpdated, event.Type)
+	_, ok = receive(treeClient)
+	assert.True(t, ok)
+	_, ok = receive(otherClient)
+	assert.False(t, ok)
+
+	pageClient.UnsubscribePage(pageID)
+	hub.Broadcast(realtime.Event{Type: realtime.EventPageUpdated, WorkspaceID: 10, PageIDs: []uuid.UUID{pageID}})
+	_, ok = receive(pageClient)
+	assert.False(t, ok)
+	_, ok = receive(treeClient)
+	assert.True(t, ok)
+
+	// everyone needs to know about a resync
+	hub.Broadcast(realtime.Event{Type: realtime.EventResync})
+	for _, client := range []*realtime.Client{pageClient, treeClient, otherClient} {
+		event, ok := receive(client)
+		assert.True(t, ok)
+		assert.Equal(t, realtime.EventResync, event.Type)
+	}
+}
+
+func TestSlowClientIsDropped(t *testing.T) {
+	hub := realtime.NewHub()
+	client := hub.Register(1)
+	client.SubscribeWorkspace(10)
+
+	for range 100 {
+		hub.Broadcast(realtime.Event{Type: realtime.EventPageCreated, WorkspaceID: 10})
+	}
+
+	select {
+	case <-client.Done():
+	default:
+		t.Fatal("expected the client to be dropped")
+	}
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"fmt"
+	"go_notion/backend/auth"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// secretQueryParams carry credentials in the url, their values are kept out of the access log
+var secretQueryParams = []string{auth.QueryTokenParam, "code", "state", "signature"}
+
+// secretPathSegments precede path segments that are credentials, like the token of public links
+var secretPathSegments = []string{"/public/"}
+
+const redacted = "REDACTED"
+
+// redactPath replaces the secret segments and the values of secret query parameters in a logged path
+func redactPath(path string) string {
+	rawPath, rawQuery, found := strings.Cut(path, "?")
+	rawPath = redactPathSegments(rawPath)
+	if !found {
+		return rawPath
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// a query that doesn't parse can't be redacted reliably, it is left out as a whole
+		return rawPath + "?" + redacted
+	}
+	changed := false
+	for _, param := range secretQueryParams {
+		if query.Has(param) {
+			query.Set(param, redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return rawPath + "?" + rawQuery
+	}
+	return rawPath + "?" + query.Encode()
+}
+
+// redactPathSegments replaces the segment that follows each of secretPathSegments
+func redactPathSegments(path string) string {
+	for _, prefix := range secretPathSegments {
+		before, after, found := strings.Cut(path, prefix)
+		if !found || after == "" {
+			continue
+		}
+		segment, _, _ := strings.Cut(after, "/")
+		path = before + prefix + redacted + after[len(segment):]
+	}
+	return path
+}
+
+// logFormatter is gin's default log format with secret query parameters redacted
+func logFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		redactPath(param.Path),
+		param.ErrorMessage,
+	)
+}
@@ -0,0 +1,40 @@
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactPath(t *testing.T) {
+	assert.Equal(t, "/api/pages", redactPath("/api/pages"))
+	assert.Equal(t, "/api/pages?size=10", redactPath("/api/pages?size=10"))
+	assert.Equal(t, "/api/events?access_token=REDACTED&since=3", redactPath("/api/events?since=3&access_token=eyJhbGciOi"))
+	assert.Equal(t, "/api/auth/oidc/google/callback?code=REDACTED&state=REDACTED", redactPath("/api/auth/oidc/google/callback?state=abc&code=def"))
+	assert.Equal(t, "/api/events?REDACTED", redactPath("/api/events?access_token=%zz"))
+	assert.Equal(t, "/api/v1/public/REDACTED", redactPath("/api/v1/public/s3cr3t"))
+	assert.Equal(t, "/api/v1/public/REDACTED?include_sub_pages=true", redactPath("/api/v1/public/s3cr3t?include_sub_pages=true"))
+	assert.Equal(t, "/api/v1/public/", redactPath("/api/v1/public/"))
+}
+
+func TestLoggerRedactsTokens(t *testing.T) {
+	var out bytes.Buffer
+	r := gin.New()
+	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: logFormatter, Output: &out}))
+	r.GET("/api/events", func(c *gin.Context) {
+		assert.Equal(t, "secret", c.Query("access_token"), "handlers still see the token")
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/events?access_token=secret", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, out.String(), "/api/events?access_token=REDACTED")
+	assert.NotContains(t, out.String(), "secret")
+}
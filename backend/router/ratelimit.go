@@ -28,7 +28,7 @@ type RateLimitConfig struct {
 // IPRateLimiter middleware generator
 func IPRateLimiter(config RateLimitConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ip := getRealIP(c)
+		ip := GetRealIP(c)
 
 		// using method + path because we can have the same path for different methods
 		// Use normalized path to prevent memory exhaustion from URL parameter variations
@@ -57,9 +57,9 @@ func IPRateLimiter(config RateLimitConfig) gin.HandlerFunc {
 	}
 }
 
-// getRealIP attempts to get the real IP address considering proxy headers
+// GetRealIP attempts to get the real IP address considering proxy headers
 // using c.ClientIP() is not enough because the IP address can be spoofed using proxy headers
-func getRealIP(c *gin.Context) string {
+func GetRealIP(c *gin.Context) string {
 	// Check X-Forwarded-For header
 	if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
 		ips := strings.Split(xff, ",")
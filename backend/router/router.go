@@ -8,7 +8,9 @@ import (
 )
 
 func NewRouter() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	// the default logger writes whole urls, which carry tokens on websocket and event stream requests
+	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: logFormatter}), gin.Recovery())
 	// In release mode, Gin typically disables some debug features and optimizes for performance,
 	// which is suitable for production environments
 	if env := os.Getenv("GIN_MODE"); env == "release" {
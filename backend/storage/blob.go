@@ -0,0 +1,77 @@
+// Package storage keeps the files uploaded to pages outside of the database.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// BlobStoreEnvVar selects the blob store, "local" (the default) or "s3"
+	BlobStoreEnvVar     = "BLOB_STORE"
+	BlobStoreDirEnvVar  = "BLOB_STORE_DIR"
+	DefaultBlobStoreDir = "data/blobs"
+
+	S3EndpointEnvVar        = "S3_ENDPOINT"
+	S3BucketEnvVar          = "S3_BUCKET"
+	S3RegionEnvVar          = "S3_REGION"
+	S3AccessKeyIDEnvVar     = "S3_ACCESS_KEY_ID"
+	S3SecretAccessKeyEnvVar = "S3_SECRET_ACCESS_KEY"
+	DefaultS3Region         = "us-east-1"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps blobs under keys chosen by the caller, such as "attachments/<id>/original".
+// Implementations must be safe for concurrent use since handlers share a single instance.
+type BlobStore interface {
+	// Put stores the size bytes read from r under the key, replacing the blob already there
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns the blob or ErrNotFound, the caller closes the reader
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob, deleting a blob that doesn't exist is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStoreFromEnv creates the blob store configured in the environment
+func NewBlobStoreFromEnv() (BlobStore, error) {
+	switch kind := os.Getenv(BlobStoreEnvVar); kind {
+	case "", "local":
+		dir := os.Getenv(BlobStoreDirEnvVar)
+		if dir == "" {
+			dir = DefaultBlobStoreDir
+		}
+		return NewLocalBlobStore(dir)
+	case "s3":
+		config := S3Config{
+			Endpoint:        os.Getenv(S3EndpointEnvVar),
+			Bucket:          os.Getenv(S3BucketEnvVar),
+			Region:          os.Getenv(S3RegionEnvVar),
+			AccessKeyID:     os.Getenv(S3AccessKeyIDEnvVar),
+			SecretAccessKey: os.Getenv(S3SecretAccessKeyEnvVar),
+		}
+		if config.Region == "" {
+			config.Region = DefaultS3Region
+		}
+		return NewS3BlobStore(config, nil)
+	default:
+		return nil, fmt.Errorf("blob store configuration error: unknown %s %q", BlobStoreEnvVar, kind)
+	}
+}
+
+// validateKey only allows relative keys made of non empty segments, so a key can't escape the store
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	MaxFileSizeEnvVar  = "ATTACHMENT_MAX_FILE_SIZE"
+	UserQuotaEnvVar    = "STORAGE_USER_QUOTA"
+	DefaultMaxFileSize = 10 << 20
+	DefaultUserQuota   = 1 << 30
+
+	URLSecretEnvVar    = "ATTACHMENT_URL_SECRET"
+	DefaultURLLifetime = time.Hour
+)
+
+// Limits bound the uploads, the sizes are in bytes
+type Limits struct {
+	MaxFileSize int64
+	// UserQuota is the total size of the files a user may upload
+	UserQuota int64
+}
+
+func LimitsFromEnv() (Limits, error) {
+	limits := Limits{MaxFileSize: DefaultMaxFileSize, UserQuota: DefaultUserQuota}
+	for envVar, limit := range map[string]*int64{MaxFileSizeEnvVar: &limits.MaxFileSize, UserQuotaEnvVar: &limits.UserQuota} {
+		value, ok := os.LookupEnv(envVar)
+		if !ok || value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			return Limits{}, fmt.Errorf("storage configuration error: invalid %s %q", envVar, value)
+		}
+		*limit = parsed
+	}
+	return limits, nil
+}
+
+// URLSigner signs urls that grant access to a resource until they expire,
+// for clients such as image tags that can't send an authorization header
+type URLSigner struct {
+	secret   []byte
+	lifetime time.Duration
+}
+
+func NewURLSigner(secret []byte, lifetime time.Duration) (*URLSigner, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("url signing secret must be at least 32 bytes")
+	}
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("url lifetime must be positive")
+	}
+	return &URLSigner{secret: secret, lifetime: lifetime}, nil
+}
+
+// URLSignerFromEnv uses the secret in the environment. Without one a random secret is used,
+// so the urls stop working on restart and only work on the instance that signed them.
+func URLSignerFromEnv() (*URLSigner, error) {
+	secret := []byte(os.Getenv(URLSecretEnvVar))
+	if len(secret) == 0 {
+		log.Printf("storage configuration: %s environment variable is not set, download urls only work until restart", URLSecretEnvVar)
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate url signing secret: %w", err)
+		}
+	}
+	return NewURLSigner(secret, DefaultURLLifetime)
+}
+
+// Sign returns when the url for the resource expires and its signature
+func (s *URLSigner) Sign(resource string, now time.Time) (int64, string) {
+	expires := now.Add(s.lifetime).Unix()
+	return expires, s.signature(resource, expires)
+}
+
+// Verify checks the signature was made for the resource and hasn't expired
+func (s *URLSigner) Verify(resource string, expires int64, signature string, now time.Time) bool {
+	if now.Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.signature(resource, expires)))
+}
+
+func (s *URLSigner) signature(resource string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%d", resource, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}